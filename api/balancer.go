@@ -0,0 +1,136 @@
+package api
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	BALANCE_ROUND_ROBIN     = "round-robin"
+	BALANCE_LEAST_LOAD      = "least-load"
+	BALANCE_POWER_OF_TWO    = "power-of-two"
+	BALANCE_WEIGHTED_RANDOM = "weighted-random"
+)
+
+// Candidate is a storage server which can be selected by Balancer.
+type Candidate struct {
+	Server *common.StorageServer
+	Load   *common.LoadInfo // live load reported by tracker servers, nil for static storage servers.
+}
+
+// Balancer selects a storage server from candidates.
+type Balancer interface {
+	// Select selects a server from candidates, candidates is never empty.
+	Select(candidates []*Candidate) *Candidate
+}
+
+// NewBalancer creates a Balancer by strategy name,
+// it returns nil if the strategy is unknown.
+func NewBalancer(strategy string) Balancer {
+	switch strategy {
+	case BALANCE_ROUND_ROBIN, "":
+		return &roundRobinBalancer{
+			lock:    new(sync.Mutex),
+			weights: make(map[string]int64),
+		}
+	case BALANCE_LEAST_LOAD:
+		return &leastLoadBalancer{}
+	case BALANCE_POWER_OF_TWO:
+		return &powerOfTwoBalancer{
+			lock: new(sync.Mutex),
+			rnd:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		}
+	case BALANCE_WEIGHTED_RANDOM:
+		return &weightedRandomBalancer{
+			lock: new(sync.Mutex),
+			rnd:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		}
+	}
+	return nil
+}
+
+// roundRobinBalancer selects the server which is least selected by this client.
+type roundRobinBalancer struct {
+	lock    *sync.Mutex
+	weights map[string]int64 // server use weights
+}
+
+func (b *roundRobinBalancer) Select(candidates []*Candidate) *Candidate {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	selected := candidates[0]
+	for _, c := range candidates[1:] {
+		if b.weights[c.Server.InstanceId] < b.weights[selected.Server.InstanceId] {
+			selected = c
+		}
+	}
+	b.weights[selected.Server.InstanceId] = b.weights[selected.Server.InstanceId] + 1
+	return selected
+}
+
+// leastLoadBalancer selects the server with the lowest load.
+type leastLoadBalancer struct {
+}
+
+func (b *leastLoadBalancer) Select(candidates []*Candidate) *Candidate {
+	selected := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.Load.Score() < selected.Load.Score() {
+			selected = c
+		}
+	}
+	return selected
+}
+
+// powerOfTwoBalancer selects two servers randomly and uses the one with lower load,
+// it avoids all clients piling onto the same least loaded server.
+type powerOfTwoBalancer struct {
+	lock *sync.Mutex
+	rnd  *rand.Rand
+}
+
+func (b *powerOfTwoBalancer) Select(candidates []*Candidate) *Candidate {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	b.lock.Lock()
+	i := b.rnd.Intn(len(candidates))
+	j := b.rnd.Intn(len(candidates) - 1)
+	b.lock.Unlock()
+	if j >= i {
+		j++
+	}
+	if candidates[j].Load.Score() < candidates[i].Load.Score() {
+		return candidates[j]
+	}
+	return candidates[i]
+}
+
+// weightedRandomBalancer selects a server randomly,
+// the probability is in inverse proportion to the load.
+type weightedRandomBalancer struct {
+	lock *sync.Mutex
+	rnd  *rand.Rand
+}
+
+func (b *weightedRandomBalancer) Select(candidates []*Candidate) *Candidate {
+	weights := make([]float64, len(candidates))
+	total := float64(0)
+	for i, c := range candidates {
+		weights[i] = 1 / (1 + c.Load.Score())
+		total += weights[i]
+	}
+	b.lock.Lock()
+	r := b.rnd.Float64() * total
+	b.lock.Unlock()
+	for i, w := range weights {
+		if r < w {
+			return candidates[i]
+		}
+		r -= w
+	}
+	return candidates[len(candidates)-1]
+}
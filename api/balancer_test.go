@@ -0,0 +1,64 @@
+package api_test
+
+import (
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/common"
+	"testing"
+)
+
+func createCandidates() []*api.Candidate {
+	return []*api.Candidate{
+		{
+			Server: &common.StorageServer{Server: common.Server{InstanceId: "busy"}},
+			Load:   &common.LoadInfo{Connections: 50, Uploads: 10},
+		},
+		{
+			Server: &common.StorageServer{Server: common.Server{InstanceId: "idle"}},
+			Load:   &common.LoadInfo{Connections: 1},
+		},
+		{
+			Server: &common.StorageServer{Server: common.Server{InstanceId: "full"}},
+			Load:   &common.LoadInfo{FreeDisk: 1, TotalDisk: 100},
+		},
+	}
+}
+
+func TestLeastLoadBalancer(t *testing.T) {
+	b := api.NewBalancer(api.BALANCE_LEAST_LOAD)
+	if s := b.Select(createCandidates()); s.Server.InstanceId != "idle" {
+		t.Fatal("expect idle, got ", s.Server.InstanceId)
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	b := api.NewBalancer(api.BALANCE_ROUND_ROBIN)
+	candidates := createCandidates()
+	selected := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		selected[b.Select(candidates).Server.InstanceId]++
+	}
+	for _, c := range candidates {
+		if selected[c.Server.InstanceId] != 2 {
+			t.Fatal("expect 2 selections of ", c.Server.InstanceId, ", got ", selected[c.Server.InstanceId])
+		}
+	}
+}
+
+func TestRandomBalancers(t *testing.T) {
+	for _, strategy := range []string{api.BALANCE_POWER_OF_TWO, api.BALANCE_WEIGHTED_RANDOM} {
+		b := api.NewBalancer(strategy)
+		selected := make(map[string]int)
+		for i := 0; i < 1000; i++ {
+			selected[b.Select(createCandidates()).Server.InstanceId]++
+		}
+		if selected["idle"] <= selected["busy"] || selected["idle"] <= selected["full"] {
+			t.Fatal(strategy, ": expect idle to be selected most, got ", selected)
+		}
+	}
+}
+
+func TestUnknownBalancer(t *testing.T) {
+	if api.NewBalancer("unknown") != nil {
+		t.Fatal("expect nil balancer")
+	}
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"container/list"
 	"errors"
+	"github.com/hetianyi/godfs/binlog"
 	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/godfs/util"
 	"github.com/hetianyi/gox"
@@ -12,7 +13,9 @@ import (
 	"github.com/hetianyi/gox/logger"
 	json "github.com/json-iterator/go"
 	"io"
+	"io/ioutil"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -23,6 +26,7 @@ const (
 )
 
 var NoStorageServerErr = errors.New("no storage available")
+var NoTrackerServerErr = errors.New("no tracker available")
 
 // Config is the APIClient config
 type Config struct {
@@ -31,6 +35,15 @@ type Config struct {
 	SynchronizeOnce         bool                    // synchronize with each tracker server only once
 	SynchronizeOnceCallback chan int                // attached with `SynchronizeOnce`, for noticing client cli that whether all server is synced.
 	StaticStorageServers    []*common.StorageServer // storage servers
+	UseStaleInstances       bool                    // use instances restored by tracker server which are not verified yet
+	BalanceStrategy         string                  // storage server balancing strategy: round-robin, least-load, power-of-two or weighted-random
+}
+
+// UploadOptions are optional attributes of an upload.
+type UploadOptions struct {
+	FileName    string // original file name, saved in the file metadata
+	ContentType string // saved in the file metadata, it is guessed from FileName if empty
+	Md5         string // optional md5 hint of the content, storage servers already holding it are preferred
 }
 
 // ClientAPI is godfs APIClient interface.
@@ -43,6 +56,10 @@ type ClientAPI interface {
 	// If no group provided, it will upload file to a random server.
 	Upload(src io.Reader, length int64, group string, isPrivate bool) (*common.UploadResult, error)
 
+	// UploadWithOptions uploads file like Upload with optional attributes,
+	// the file name and content type are saved in the file metadata and replicated with the file.
+	UploadWithOptions(src io.Reader, length int64, group string, isPrivate bool, options *UploadOptions) (*common.UploadResult, error)
+
 	// Download downloads a file from server.
 	//
 	// Return error can be common.NoStorageServerErr if there is no server available
@@ -54,6 +71,10 @@ type ClientAPI interface {
 	DownloadFrom(fileId string, offset int64, length int64, server *common.Server,
 		handler func(body io.Reader, bodyLength int64) error) error
 
+	// FileMeta queries the metadata of a file saved on the storage server,
+	// it returns nil if the file has no metadata.
+	FileMeta(server *common.Server, fileId string) (map[string]string, error)
+
 	// Query queries file's information by fileId.
 	//
 	// Parameter `fileId` must be the pattern of common.FILE_ID_PATTERN
@@ -65,23 +86,83 @@ type ClientAPI interface {
 	// PushBinlog pushes binlog to tracker server.
 	PushBinlog(server *common.Server, binlogs []common.BingLogDTO) error
 
-	// SyncBinlog synchronizes binlogs from other storage servers.
-	SyncBinlog(server *common.Server, clientState *common.BinlogQueryDTO) (*common.BinlogQueryResultDTO, error)
+	// SyncBinlog synchronizes at most fetch binlogs from other storage servers,
+	// the server may return fewer binlogs than requested.
+	SyncBinlog(server *common.Server, clientState *common.BinlogQueryDTO, fetch int) (*common.BinlogQueryResultDTO, error)
+
+	// PushReplicas reports the files synchronized by this storage server to tracker server.
+	PushReplicas(server *common.Server, replicas []common.ReplicaDTO) error
+
+	// Locate queries instanceIds of the storage servers which hold the file from tracker servers.
+	Locate(fileId string) ([]string, error)
+
+	// Ping checks if the server is alive, it returns the status attributes of the server.
+	Ping(server *common.Server) (map[string]string, error)
+
+	// SetMode switches a storage server between active, readonly and draining mode.
+	SetMode(server *common.Server, mode common.StorageMode) error
+
+	// SyncRate queries byte-rate limits of file synchronization of a storage server.
+	//
+	// The limits are replaced by rate if it is not nil,
+	// or reset to the limits of the server configuration if reset is true.
+	SyncRate(server *common.Server, rate *common.SyncRateDTO, reset bool) (*common.SyncRateDTO, error)
+
+	// BinlogLag queries how far a binlog position is behind the latest binlog of a storage server.
+	BinlogLag(server *common.Server, pos *common.BinlogQueryDTO) (*common.BinlogLagDTO, error)
+
+	// SyncStatus queries the synchronization state of a storage server with its group members.
+	SyncStatus(server *common.Server) (*common.SyncStatusDTO, error)
+
+	// AntiEntropySummary queries the bucket summaries of files held by a storage server.
+	AntiEntropySummary(server *common.Server) ([]common.AntiEntropyBucketDTO, error)
+
+	// AntiEntropyFiles queries binlogs of files held by a storage server in the buckets.
+	AntiEntropyFiles(server *common.Server, buckets []int) ([]common.BingLogDTO, error)
+
+	// Reconcile runs an anti-entropy round of a storage server with the group member peer,
+	// or with every group member if peer is empty. Differences are only reported if dryRun is true.
+	Reconcile(server *common.Server, peer string, dryRun bool) ([]*common.AntiEntropyReportDTO, error)
+
+	// Import imports a file of another cluster into a storage server keeping its fileId,
+	// secret is the secret of the other cluster which the fileId is created with.
+	//
+	// The content is only sent if the server does not hold the file yet,
+	// it returns true if the content is sent. meta is the file metadata saved with the file.
+	Import(server *common.Server, fileId string, secret string, meta map[string]string, src io.Reader, length int64) (bool, error)
+
+	// ClusterSyncStatus queries the synchronization state of groups aggregated by tracker servers,
+	// an empty group means all groups.
+	//
+	// If server is nil, the state is queried from tracker servers of the client configuration.
+	ClusterSyncStatus(server *common.Server, group string) (*common.ClusterSyncStatusDTO, error)
+
+	// Allocate queries ranked storage servers for uploading a file from tracker servers.
+	//
+	// md5 is optional, servers which already hold the content are preferred.
+	Allocate(group string, size int64, md5 string) ([]*common.StorageServer, error)
+
+	// List lists a page of files matching the query.
+	//
+	// If server is nil, the files are listed from tracker servers,
+	// otherwise from the given tracker or storage server.
+	// Cursors of storage servers are only valid on the storage server which returned it.
+	List(server *common.Server, query *common.ListQueryDTO) (*common.ListResultDTO, error)
 }
 
 // NewClient creates a new APIClient.
 func NewClient() *clientAPIImpl {
 	return &clientAPIImpl{
-		lock:    new(sync.Mutex),
-		weights: make(map[string]int64),
+		lock:     new(sync.Mutex),
+		balancer: NewBalancer(BALANCE_ROUND_ROBIN),
 	}
 }
 
 // clientAPIImpl is the implementation of APIClient.
 type clientAPIImpl struct {
-	config  *Config
-	lock    *sync.Mutex
-	weights map[string]int64 // server use weights
+	config   *Config
+	lock     *sync.Mutex
+	balancer Balancer // storage server balancing strategy
 }
 
 func (c *clientAPIImpl) SetConfig(config *Config) {
@@ -95,14 +176,22 @@ func (c *clientAPIImpl) SetConfig(config *Config) {
 	if c.config.MaxConnectionsPerServer <= 0 {
 		c.config.MaxConnectionsPerServer = DefaultMaxConnectionsPerServer
 	}
-	if (c.config.TrackerServers == nil || len(c.config.TrackerServers) == 0) &&
+	if b := NewBalancer(c.config.BalanceStrategy); b != nil {
+		c.lock.Lock()
+		c.balancer = b
+		c.lock.Unlock()
+	} else {
+		logger.Warn("unknown balance strategy \"", c.config.BalanceStrategy, "\", use ", BALANCE_ROUND_ROBIN)
+	}
+	if common.BootAs == common.BOOT_CLIENT &&
+		(c.config.TrackerServers == nil || len(c.config.TrackerServers) == 0) &&
 		(c.config.StaticStorageServers == nil || len(c.config.StaticStorageServers) == 0) {
 		logger.Warn("client initialized but no server provided")
 	}
 	if c.config.TrackerServers != nil {
 		for _, s := range c.config.TrackerServers {
 			conn.InitServerSettings(s, c.config.MaxConnectionsPerServer, time.Minute*2)
-			tracks(c, s, config.SynchronizeOnce, config.SynchronizeOnceCallback)
+			tracks(c, s, config.SynchronizeOnce, config.UseStaleInstances, config.SynchronizeOnceCallback)
 		}
 	}
 	if c.config.StaticStorageServers != nil {
@@ -113,16 +202,48 @@ func (c *clientAPIImpl) SetConfig(config *Config) {
 }
 
 func (c *clientAPIImpl) Upload(src io.Reader, length int64, group string, isPrivate bool) (*common.UploadResult, error) {
+	return c.UploadWithOptions(src, length, group, isPrivate, nil)
+}
+
+func (c *clientAPIImpl) UploadWithOptions(src io.Reader, length int64, group string, isPrivate bool,
+	options *UploadOptions) (*common.UploadResult, error) {
 	logger.Debug("begin to upload file")
+	attrs := map[string]string{
+		"isPrivate": gox.TValue(isPrivate, "1", "0").(string),
+	}
+	md5 := ""
+	if options != nil {
+		attrs["name"] = options.FileName
+		attrs["contentType"] = options.ContentType
+		md5 = options.Md5
+	}
 	var exclude = list.New()                  // excluded storage list
 	var selectedStorage *common.StorageServer // target server for file uploading.
 	var lastErr error
 	var lastConn *net.Conn
 	var ret *common.UploadResult
+	// storage servers allocated by tracker servers are preferred.
+	var allocated []*common.StorageServer
+	if len(c.config.TrackerServers) > 0 {
+		targets, err := c.Allocate(group, length, md5)
+		if err != nil {
+			logger.Debug("error allocate storage servers, fallback to local selection: ", err)
+		}
+		allocated = targets
+	}
 	gox.Try(func() {
 		for {
 			// select storage server.
-			selectedStorage = c.selectStorageServer(group, true, exclude)
+			selectedStorage = nil
+			for len(allocated) > 0 && selectedStorage == nil {
+				if !isExcluded(allocated[0].Server, exclude) {
+					selectedStorage = allocated[0]
+				}
+				allocated = allocated[1:]
+			}
+			if selectedStorage == nil {
+				selectedStorage = c.selectStorageServer(group, true, exclude)
+			}
 			if selectedStorage == nil {
 				if lastErr == nil {
 					lastErr = NoStorageServerErr
@@ -155,10 +276,8 @@ func (c *clientAPIImpl) Upload(src io.Reader, length int64, group string, isPriv
 			authenticated = true
 			// send file body
 			err = pip.Send(&common.Header{
-				Operation: common.OPERATION_UPLOAD,
-				Attributes: map[string]string{
-					"isPrivate": gox.TValue(isPrivate, "1", "0").(string),
-				},
+				Operation:  common.OPERATION_UPLOAD,
+				Attributes: attrs,
 			}, src, length)
 			if err != nil {
 				lastErr = err
@@ -225,6 +344,11 @@ func (c *clientAPIImpl) DownloadFrom(fileId string, offset int64, length int64,
 	if err != nil {
 		return err
 	}
+	// storage servers which really hold the file.
+	var located []string
+	if server == nil && len(c.config.TrackerServers) > 0 {
+		located, _ = c.Locate(fileId)
+	}
 	gox.Try(func() {
 		for {
 			if server != nil && lastErr != nil {
@@ -235,7 +359,10 @@ func (c *clientAPIImpl) DownloadFrom(fileId string, offset int64, length int64,
 					Server: *server,
 				}
 			} else {
-				selectedStorage = c.selectStorageServer(fileInfo.Group, false, exclude)
+				selectedStorage = selectLocatedServer(located, exclude)
+				if selectedStorage == nil {
+					selectedStorage = c.selectStorageServer(fileInfo.Group, false, exclude)
+				}
 			}
 			if selectedStorage == nil {
 				if lastErr == nil {
@@ -470,36 +597,82 @@ func (c *clientAPIImpl) SyncInstances(server *common.Server) (map[string]*common
 func (c *clientAPIImpl) PushBinlog(server *common.Server, binlogs []common.BingLogDTO) error {
 	logger.Debug("pushing binlog: ", len(binlogs))
 
-	connection, authenticated, err := conn.GetConnection(server)
+	body := binlog.NewStreamEncoder()
+	fileIds := make([]string, len(binlogs))
+	for i := range binlogs {
+		if err := body.WriteBinlog(&binlogs[i]); err != nil {
+			return err
+		}
+		fileIds[i] = binlogs[i].FileId
+	}
+	if err := writeDigests(body, fileIds); err != nil {
+		return err
+	}
+	streamed, err := c.pushStream(server, body)
+	if err != nil || streamed || len(binlogs) == 0 {
+		return err
+	}
+	// trackers of old versions only accept binlogs in the header attributes,
+	// push them again or they are lost while the push position advances.
+	logger.Debug("tracker server ", server.ConnectionString(), " ignores streamed binlogs, push in header")
+	jsonAttr, err := json.MarshalToString(binlogs)
 	if err != nil {
 		return err
 	}
+	_, err = c.push(server, &common.Header{
+		Operation: common.OPERATION_PUSH_BINLOGS,
+		Attributes: map[string]string{
+			"binlogs": jsonAttr,
+		},
+	}, nil, 0)
+	return err
+}
+
+// pushStream pushes records in the body to the tracker server,
+// it returns false if the tracker server is of an old version which ignores the body.
+func (c *clientAPIImpl) pushStream(server *common.Server, body *binlog.StreamEncoder) (bool, error) {
+	header, err := c.push(server, &common.Header{
+		Operation: common.OPERATION_PUSH_BINLOGS,
+	}, body.Reader(), body.Len())
+	if err != nil {
+		return false, err
+	}
+	return header.Attributes["stream"] == "true", nil
+}
+
+// push sends a push request to the tracker server and returns the header of the successful response.
+//
+// The connection is closed if the tracker server does not accept streamed records,
+// because the unread body breaks the connection on the tracker server.
+func (c *clientAPIImpl) push(server *common.Server, request *common.Header, body io.Reader,
+	bodyLength int64) (*common.Header, error) {
+	connection, authenticated, err := conn.GetConnection(server)
+	if err != nil {
+		return nil, err
+	}
 	pip := &gpip.Pip{
 		Conn: *connection,
 	}
 	if authenticated == nil || !authenticated.(bool) {
 		if err = authenticate(pip, server); err != nil {
-			return err
+			conn.ReturnConnection(server, connection, nil, true)
+			return nil, err
 		}
 		logger.Debug("authentication success with server ", server.ConnectionString())
 	}
 	authenticated = true
-	jsonAttr, _ := json.Marshal(binlogs)
 	// send file body
-	err = pip.Send(&common.Header{
-		Operation: common.OPERATION_PUSH_BINLOGS,
-		Attributes: map[string]string{
-			"binlogs": string(jsonAttr),
-		},
-	}, nil, 0)
-	if err != nil {
-		return err
+	if err = pip.Send(request, body, bodyLength); err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return nil, err
 	}
+	var ret *common.Header
 	// receive response
 	err = pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
 		header := _header.(*common.Header)
 		if header != nil {
 			if header.Result == common.SUCCESS {
+				ret = header
 				return nil
 			}
 			return errors.New("push failed: " + header.Msg)
@@ -507,13 +680,15 @@ func (c *clientAPIImpl) PushBinlog(server *common.Server, binlogs []common.BingL
 		return errors.New("push failed: got empty response from server")
 	})
 	if err != nil {
-		return err
+		conn.ReturnConnection(server, connection, nil, true)
+		return nil, err
 	}
-	conn.ReturnConnection(server, connection, authenticated, false)
-	return nil
+	broken := bodyLength > 0 && ret.Attributes["stream"] != "true"
+	conn.ReturnConnection(server, connection, authenticated, broken)
+	return ret, nil
 }
 
-func (c *clientAPIImpl) SyncBinlog(server *common.Server, clientState *common.BinlogQueryDTO) (*common.BinlogQueryResultDTO, error) {
+func (c *clientAPIImpl) SyncBinlog(server *common.Server, clientState *common.BinlogQueryDTO, fetch int) (*common.BinlogQueryResultDTO, error) {
 	logger.Debug("synchronize binlog")
 
 	connection, authenticated, err := conn.GetConnection(server)
@@ -540,6 +715,7 @@ func (c *clientAPIImpl) SyncBinlog(server *common.Server, clientState *common.Bi
 		Operation: common.OPERATION_SYNC_BINLOGS,
 		Attributes: map[string]string{
 			"clientState": data,
+			"fetch":       convert.IntToStr(fetch),
 		},
 	}, nil, 0)
 	if err != nil {
@@ -557,143 +733,889 @@ func (c *clientAPIImpl) SyncBinlog(server *common.Server, clientState *common.Bi
 				if err := json.UnmarshalFromString(ret, blr); err != nil {
 					return err
 				}
-				return nil
+				// servers of old versions return binlogs in the header.
+				if bodyLength == 0 {
+					return nil
+				}
+				return binlog.DecodeStream(bodyReader, func(bl *common.BingLogDTO, _ *common.ReplicaDTO, _ *[2]string) error {
+					if bl != nil {
+						blr.Logs = append(blr.Logs, *bl)
+					}
+					return nil
+				})
 			}
 			return errors.New("push failed: " + header.Msg)
 		}
 		return errors.New("push failed: got empty response from server")
 	})
-	defer conn.ReturnConnection(server, connection, authenticated, false)
-	return blr, err
+	if err != nil {
+		// the body may be partially read, the connection can not be reused.
+		conn.ReturnConnection(server, connection, authenticated, true)
+		return nil, err
+	}
+	conn.ReturnConnection(server, connection, authenticated, false)
+	return blr, nil
 }
 
-// authenticate authenticates with server.
-func authenticate(p *gpip.Pip, server conn.Server) error {
-	logger.Debug("trying to authenticate with server ", server.ConnectionString())
-	secret := ""
-	if _, t := server.(*common.Server); t {
-		secret = server.(*common.Server).Secret
-	} else if _, t := server.(*common.StorageServer); t {
-		secret = server.(*common.StorageServer).Secret
-	}
+func (c *clientAPIImpl) PushReplicas(server *common.Server, replicas []common.ReplicaDTO) error {
+	logger.Debug("pushing replicas: ", len(replicas))
 
-	// validate with instance info
-	var instance *common.Instance
-	if common.BootAs == common.BOOT_TRACKER {
-		conf := common.InitializedTrackerConfiguration
-		advPort, _ := convert.StrToUint16(convert.IntToStr(conf.AdvertisePort))
-		instance = &common.Instance{
-			Server: common.Server{
-				Host:       conf.AdvertiseAddress,
-				Port:       advPort,
-				Secret:     conf.Secret,
-				InstanceId: conf.InstanceId,
-			},
-			Role: common.ROLE_TRACKER,
-		}
-	} else if common.BootAs == common.BOOT_STORAGE {
-		conf := common.InitializedStorageConfiguration
-		advPort, _ := convert.StrToUint16(convert.IntToStr(conf.AdvertisePort))
-		instance = &common.Instance{
-			Server: common.Server{
-				Host:           conf.AdvertiseAddress,
-				Port:           advPort,
-				Secret:         conf.Secret,
-				InstanceId:     conf.InstanceId,
-				HistorySecrets: common.InitializedStorageConfiguration.HistorySecrets,
-			},
-			Role: common.ROLE_STORAGE,
-			Attributes: map[string]string{
-				"group":    conf.Group,
-				"readonly": convert.BoolToStr(conf.Readonly),
-			},
+	body := binlog.NewStreamEncoder()
+	fileIds := make([]string, len(replicas))
+	for i := range replicas {
+		if err := body.WriteReplica(&replicas[i]); err != nil {
+			return err
 		}
-	} /* else if common.BootAs == common.BOOT_PROXY {} */
-	info, err := json.Marshal(instance)
-	if err != nil {
+		fileIds[i] = replicas[i].FileId
+	}
+	if err := writeDigests(body, fileIds); err != nil {
 		return err
 	}
+	// trackers of old versions don't track replicas, they are dropped.
+	_, err := c.pushStream(server, body)
+	return err
+}
+
+func (c *clientAPIImpl) Locate(fileId string) ([]string, error) {
+	var lastErr = NoStorageServerErr
+	for _, server := range c.config.TrackerServers {
+		ret, err := c.locateFrom(server, fileId)
+		if err != nil {
+			logger.Debug("error locate file from tracker server ", server.ConnectionString(), ": ", err)
+			lastErr = err
+			continue
+		}
+		return ret, nil
+	}
+	return nil, lastErr
+}
 
-	err = p.Send(&common.Header{
-		Operation: common.OPERATION_CONNECT,
+// locateFrom queries instances which hold the file from a tracker server.
+func (c *clientAPIImpl) locateFrom(server *common.Server, fileId string) ([]string, error) {
+	connection, authenticated, err := conn.GetConnection(server)
+	if err != nil {
+		return nil, err
+	}
+	pip := &gpip.Pip{
+		Conn: *connection,
+	}
+	if authenticated == nil || !authenticated.(bool) {
+		if err = authenticate(pip, server); err != nil {
+			conn.ReturnConnection(server, connection, nil, true)
+			return nil, err
+		}
+		logger.Debug("authentication success with server ", server.ConnectionString())
+	}
+	authenticated = true
+	err = pip.Send(&common.Header{
+		Operation: common.OPERATION_LOCATE,
 		Attributes: map[string]string{
-			"secret":   secret,
-			"instance": string(info),
+			"fileId": fileId,
 		},
 	}, nil, 0)
 	if err != nil {
-		return err
+		conn.ReturnConnection(server, connection, nil, true)
+		return nil, err
 	}
-	return p.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
+	var ret []string
+	// receive response
+	err = pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
 		header := _header.(*common.Header)
-		if header.Result != common.SUCCESS {
-			return errors.New("authentication failed with server: " + server.ConnectionString())
+		if header != nil {
+			if header.Result == common.SUCCESS {
+				return json.UnmarshalFromString(header.Attributes["instances"], &ret)
+			}
+			return errors.New("locate failed: " + header.Msg)
 		}
-		return nil
+		return errors.New("locate failed: got empty response from server")
 	})
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return nil, err
+	}
+	conn.ReturnConnection(server, connection, authenticated, false)
+	return ret, nil
 }
 
-// selectStorageServer selects proper storage server.
-func (c *clientAPIImpl) selectStorageServer(group string, uploadable bool, exclude *list.List) *common.StorageServer {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	logger.Debug("select storage server")
-
-	var candidates = list.New()
-	var syncStorages *list.List
-	// if registered storage server is not empty, use it first.
-	if uploadable {
-		syncStorages = FilterUploadableInstances()
-	} else {
-		syncStorages = FilterInstances(common.ROLE_STORAGE)
+func (c *clientAPIImpl) FileMeta(server *common.Server, fileId string) (map[string]string, error) {
+	connection, authenticated, err := conn.GetConnection(server)
+	if err != nil {
+		return nil, err
 	}
-	if syncStorages.Len() > 0 {
-		for ele := syncStorages.Front(); ele != nil; ele = ele.Next() {
-			s := ele.Value.(*common.Instance)
-			if isExcluded(s.Server, exclude) {
-				continue
-			}
-			sg := ""
-			if s.Attributes != nil {
-				sg = s.Attributes["group"]
-			}
-			if group == "" || group == sg {
-				candidates.PushBack(&common.StorageServer{
-					Server: s.Server,
-					Group:  sg,
-				})
-			}
+	pip := &gpip.Pip{
+		Conn: *connection,
+	}
+	if authenticated == nil || !authenticated.(bool) {
+		if err = authenticate(pip, server); err != nil {
+			conn.ReturnConnection(server, connection, nil, true)
+			return nil, err
 		}
+		logger.Debug("authentication success with server ", server.ConnectionString())
 	}
-	// if no candidate server, choose from static storage servers.
-	// static server has no group configured, so here ignores the group.
-	if candidates.Len() == 0 {
-		for _, s := range c.config.StaticStorageServers {
-			if isExcluded(s.Server, exclude) {
-				continue
+	authenticated = true
+	err = pip.Send(&common.Header{
+		Operation: common.OPERATION_FILE_META,
+		Attributes: map[string]string{
+			"fileId": fileId,
+		},
+	}, nil, 0)
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return nil, err
+	}
+	var ret map[string]string
+	// receive response
+	err = pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
+		header := _header.(*common.Header)
+		if header != nil {
+			if header.Result == common.SUCCESS {
+				for k, v := range header.Attributes {
+					if ret == nil {
+						ret = make(map[string]string)
+					}
+					ret[k] = v
+				}
+				return nil
 			}
-			candidates.PushBack(s)
+			return errors.New("query file meta failed: " + header.Msg)
+		}
+		return errors.New("query file meta failed: got empty response from server")
+	})
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return nil, err
+	}
+	conn.ReturnConnection(server, connection, authenticated, false)
+	return ret, nil
+}
+
+func (c *clientAPIImpl) Allocate(group string, size int64, md5 string) ([]*common.StorageServer, error) {
+	var lastErr = NoStorageServerErr
+	for _, server := range c.config.TrackerServers {
+		ret, err := c.allocateFrom(server, group, size, md5)
+		if err != nil {
+			logger.Debug("error allocate storage servers from tracker server ", server.ConnectionString(), ": ", err)
+			lastErr = err
+			continue
 		}
+		return ret, nil
 	}
-	// select smallest weights of storage server.
-	var selectedStorage *common.StorageServer
-	gox.WalkList(candidates, func(item interface{}) bool {
-		if selectedStorage == nil {
-			selectedStorage = item.(*common.StorageServer)
-			return false
+	return nil, lastErr
+}
+
+func (c *clientAPIImpl) List(server *common.Server, query *common.ListQueryDTO) (*common.ListResultDTO, error) {
+	if server != nil {
+		return c.listFrom(server, query)
+	}
+	var lastErr = NoTrackerServerErr
+	for _, server := range c.config.TrackerServers {
+		ret, err := c.listFrom(server, query)
+		if err != nil {
+			logger.Debug("error list files from tracker server ", server.ConnectionString(), ": ", err)
+			lastErr = err
+			continue
 		}
-		if c.weights[item.(*common.StorageServer).InstanceId] < c.weights[selectedStorage.InstanceId] {
-			selectedStorage = item.(*common.StorageServer)
-			return false
+		return ret, nil
+	}
+	return nil, lastErr
+}
+
+// listFrom lists a page of files from a server.
+func (c *clientAPIImpl) listFrom(server *common.Server, query *common.ListQueryDTO) (*common.ListResultDTO, error) {
+	q, err := json.MarshalToString(query)
+	if err != nil {
+		return nil, err
+	}
+	connection, authenticated, err := conn.GetConnection(server)
+	if err != nil {
+		return nil, err
+	}
+	pip := &gpip.Pip{
+		Conn: *connection,
+	}
+	if authenticated == nil || !authenticated.(bool) {
+		if err = authenticate(pip, server); err != nil {
+			conn.ReturnConnection(server, connection, nil, true)
+			return nil, err
 		}
-		return false
-	})
-	if selectedStorage != nil {
-		c.weights[selectedStorage.InstanceId] = c.weights[selectedStorage.InstanceId] + 1
-		logger.Debug("selected storage server: ", selectedStorage.ConnectionString())
+		logger.Debug("authentication success with server ", server.ConnectionString())
 	}
-	return selectedStorage
+	authenticated = true
+	err = pip.Send(&common.Header{
+		Operation: common.OPERATION_LIST,
+		Attributes: map[string]string{
+			"query": q,
+		},
+	}, nil, 0)
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return nil, err
+	}
+	ret := &common.ListResultDTO{}
+	// receive response
+	err = pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
+		header := _header.(*common.Header)
+		if header != nil {
+			if header.Result == common.SUCCESS {
+				bs, err := ioutil.ReadAll(io.LimitReader(bodyReader, bodyLength))
+				if err != nil {
+					return err
+				}
+				return json.Unmarshal(bs, ret)
+			}
+			return errors.New("list failed: " + header.Msg)
+		}
+		return errors.New("list failed: got empty response from server")
+	})
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return nil, err
+	}
+	conn.ReturnConnection(server, connection, authenticated, false)
+	return ret, nil
+}
+
+// allocateFrom queries ranked storage servers for uploading from a tracker server.
+func (c *clientAPIImpl) allocateFrom(server *common.Server, group string, size int64, md5 string) ([]*common.StorageServer, error) {
+	connection, authenticated, err := conn.GetConnection(server)
+	if err != nil {
+		return nil, err
+	}
+	pip := &gpip.Pip{
+		Conn: *connection,
+	}
+	if authenticated == nil || !authenticated.(bool) {
+		if err = authenticate(pip, server); err != nil {
+			conn.ReturnConnection(server, connection, nil, true)
+			return nil, err
+		}
+		logger.Debug("authentication success with server ", server.ConnectionString())
+	}
+	authenticated = true
+	err = pip.Send(&common.Header{
+		Operation: common.OPERATION_ALLOCATE,
+		Attributes: map[string]string{
+			"group": group,
+			"size":  convert.Int64ToStr(size),
+			"md5":   md5,
+		},
+	}, nil, 0)
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return nil, err
+	}
+	var ret []*common.StorageServer
+	// receive response
+	err = pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
+		header := _header.(*common.Header)
+		if header != nil {
+			if header.Result == common.SUCCESS {
+				return json.UnmarshalFromString(header.Attributes["targets"], &ret)
+			}
+			return errors.New("allocate failed: " + header.Msg)
+		}
+		return errors.New("allocate failed: got empty response from server")
+	})
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return nil, err
+	}
+	conn.ReturnConnection(server, connection, authenticated, false)
+	return ret, nil
+}
+
+func (c *clientAPIImpl) Ping(server *common.Server) (map[string]string, error) {
+	connection, authenticated, err := conn.GetConnection(server)
+	if err != nil {
+		return nil, err
+	}
+	pip := &gpip.Pip{
+		Conn: *connection,
+	}
+	if authenticated == nil || !authenticated.(bool) {
+		if err = authenticate(pip, server); err != nil {
+			conn.ReturnConnection(server, connection, nil, true)
+			return nil, err
+		}
+		logger.Debug("authentication success with server ", server.ConnectionString())
+	}
+	authenticated = true
+	err = pip.Send(&common.Header{
+		Operation: common.OPERATION_PING,
+	}, nil, 0)
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return nil, err
+	}
+	var ret map[string]string
+	// receive response
+	err = pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
+		header := _header.(*common.Header)
+		if header != nil {
+			if header.Result == common.SUCCESS {
+				ret = header.Attributes
+				return nil
+			}
+			return errors.New("ping failed: " + header.Msg)
+		}
+		return errors.New("ping failed: got empty response from server")
+	})
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return nil, err
+	}
+	conn.ReturnConnection(server, connection, authenticated, false)
+	if ret == nil {
+		ret = make(map[string]string)
+	}
+	return ret, nil
+}
+
+func (c *clientAPIImpl) SetMode(server *common.Server, mode common.StorageMode) error {
+	connection, authenticated, err := conn.GetConnection(server)
+	if err != nil {
+		return err
+	}
+	pip := &gpip.Pip{
+		Conn: *connection,
+	}
+	if authenticated == nil || !authenticated.(bool) {
+		if err = authenticate(pip, server); err != nil {
+			conn.ReturnConnection(server, connection, nil, true)
+			return err
+		}
+		logger.Debug("authentication success with server ", server.ConnectionString())
+	}
+	authenticated = true
+	err = pip.Send(&common.Header{
+		Operation: common.OPERATION_SET_MODE,
+		Attributes: map[string]string{
+			"mode": string(mode),
+		},
+	}, nil, 0)
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return err
+	}
+	// receive response
+	err = pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
+		header := _header.(*common.Header)
+		if header != nil {
+			if header.Result == common.SUCCESS {
+				return nil
+			}
+			return errors.New("set mode failed: " + header.Msg)
+		}
+		return errors.New("set mode failed: got empty response from server")
+	})
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return err
+	}
+	conn.ReturnConnection(server, connection, authenticated, false)
+	return nil
+}
+
+func (c *clientAPIImpl) SyncRate(server *common.Server, rate *common.SyncRateDTO, reset bool) (*common.SyncRateDTO, error) {
+	attrs := make(map[string]string)
+	if reset {
+		attrs["reset"] = "true"
+	} else if rate != nil {
+		s, err := json.MarshalToString(rate)
+		if err != nil {
+			return nil, err
+		}
+		attrs["syncRate"] = s
+	}
+	connection, authenticated, err := conn.GetConnection(server)
+	if err != nil {
+		return nil, err
+	}
+	pip := &gpip.Pip{
+		Conn: *connection,
+	}
+	if authenticated == nil || !authenticated.(bool) {
+		if err = authenticate(pip, server); err != nil {
+			conn.ReturnConnection(server, connection, nil, true)
+			return nil, err
+		}
+		logger.Debug("authentication success with server ", server.ConnectionString())
+	}
+	authenticated = true
+	err = pip.Send(&common.Header{
+		Operation:  common.OPERATION_SYNC_RATE,
+		Attributes: attrs,
+	}, nil, 0)
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return nil, err
+	}
+	ret := &common.SyncRateDTO{}
+	// receive response
+	err = pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
+		header := _header.(*common.Header)
+		if header != nil {
+			if header.Result == common.SUCCESS {
+				return json.UnmarshalFromString(header.Attributes["syncRate"], ret)
+			}
+			return errors.New("sync rate failed: " + header.Msg)
+		}
+		return errors.New("sync rate failed: got empty response from server")
+	})
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return nil, err
+	}
+	conn.ReturnConnection(server, connection, authenticated, false)
+	return ret, nil
+}
+
+func (c *clientAPIImpl) BinlogLag(server *common.Server, pos *common.BinlogQueryDTO) (*common.BinlogLagDTO, error) {
+	s, err := json.MarshalToString(pos)
+	if err != nil {
+		return nil, err
+	}
+	ret := &common.BinlogLagDTO{}
+	err = c.querySyncStatus(server, map[string]string{"position": s}, func(header *common.Header, body []byte) error {
+		return json.UnmarshalFromString(header.Attributes["lag"], ret)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *clientAPIImpl) SyncStatus(server *common.Server) (*common.SyncStatusDTO, error) {
+	ret := &common.SyncStatusDTO{}
+	err := c.querySyncStatus(server, nil, func(header *common.Header, body []byte) error {
+		return json.Unmarshal(body, ret)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *clientAPIImpl) ClusterSyncStatus(server *common.Server, group string) (*common.ClusterSyncStatusDTO, error) {
+	servers := c.config.TrackerServers
+	if server != nil {
+		servers = []*common.Server{server}
+	}
+	var lastErr = NoTrackerServerErr
+	for _, server := range servers {
+		ret := &common.ClusterSyncStatusDTO{}
+		err := c.querySyncStatus(server, map[string]string{"group": group}, func(header *common.Header, body []byte) error {
+			return json.Unmarshal(body, ret)
+		})
+		if err != nil {
+			logger.Debug("error query sync status from tracker server ", server.ConnectionString(), ": ", err)
+			lastErr = err
+			continue
+		}
+		return ret, nil
+	}
+	return nil, lastErr
+}
+
+// querySyncStatus sends a sync status query to the server and handles the successful response.
+func (c *clientAPIImpl) querySyncStatus(server *common.Server, attrs map[string]string,
+	handler func(header *common.Header, body []byte) error) error {
+	connection, authenticated, err := conn.GetConnection(server)
+	if err != nil {
+		return err
+	}
+	pip := &gpip.Pip{
+		Conn: *connection,
+	}
+	if authenticated == nil || !authenticated.(bool) {
+		if err = authenticate(pip, server); err != nil {
+			conn.ReturnConnection(server, connection, nil, true)
+			return err
+		}
+		logger.Debug("authentication success with server ", server.ConnectionString())
+	}
+	authenticated = true
+	err = pip.Send(&common.Header{
+		Operation:  common.OPERATION_SYNC_STATUS,
+		Attributes: attrs,
+	}, nil, 0)
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return err
+	}
+	// receive response
+	err = pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
+		header := _header.(*common.Header)
+		if header != nil {
+			body, err := ioutil.ReadAll(io.LimitReader(bodyReader, bodyLength))
+			if err != nil {
+				return err
+			}
+			if header.Result == common.SUCCESS {
+				return handler(header, body)
+			}
+			return errors.New("query sync status failed: " + header.Msg)
+		}
+		return errors.New("query sync status failed: got empty response from server")
+	})
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return err
+	}
+	conn.ReturnConnection(server, connection, authenticated, false)
+	return nil
+}
+
+func (c *clientAPIImpl) AntiEntropySummary(server *common.Server) ([]common.AntiEntropyBucketDTO, error) {
+	var ret []common.AntiEntropyBucketDTO
+	err := c.queryAntiEntropy(server, common.OPERATION_ANTI_ENTROPY, nil, func(body io.Reader, bodyLength int64) error {
+		bs, err := ioutil.ReadAll(io.LimitReader(body, bodyLength))
+		if err != nil {
+			return err
+		}
+		ret, err = util.DecodeAntiEntropySummary(bs)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *clientAPIImpl) AntiEntropyFiles(server *common.Server, buckets []int) ([]common.BingLogDTO, error) {
+	bs := make([]string, len(buckets))
+	for i, b := range buckets {
+		bs[i] = convert.IntToStr(b)
+	}
+	var ret []common.BingLogDTO
+	err := c.queryAntiEntropy(server, common.OPERATION_ANTI_ENTROPY, map[string]string{
+		"buckets": strings.Join(bs, ","),
+	}, func(body io.Reader, bodyLength int64) error {
+		return binlog.DecodeStream(io.LimitReader(body, bodyLength), func(bl *common.BingLogDTO, _ *common.ReplicaDTO, _ *[2]string) error {
+			if bl != nil {
+				ret = append(ret, *bl)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *clientAPIImpl) Reconcile(server *common.Server, peer string, dryRun bool) ([]*common.AntiEntropyReportDTO, error) {
+	var ret []*common.AntiEntropyReportDTO
+	err := c.queryAntiEntropy(server, common.OPERATION_RECONCILE, map[string]string{
+		"peer":   peer,
+		"dryRun": convert.BoolToStr(dryRun),
+	}, func(body io.Reader, bodyLength int64) error {
+		bs, err := ioutil.ReadAll(io.LimitReader(body, bodyLength))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(bs, &ret)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *clientAPIImpl) Import(server *common.Server, fileId string, secret string, meta map[string]string,
+	src io.Reader, length int64) (bool, error) {
+	connection, authenticated, err := conn.GetConnection(server)
+	if err != nil {
+		return false, err
+	}
+	pip := &gpip.Pip{
+		Conn: *connection,
+	}
+	if authenticated == nil || !authenticated.(bool) {
+		if err = authenticate(pip, server); err != nil {
+			conn.ReturnConnection(server, connection, nil, true)
+			return false, err
+		}
+		logger.Debug("authentication success with server ", server.ConnectionString())
+	}
+	authenticated = true
+
+	send := func(check bool, body io.Reader, bodyLength int64) (exists bool, err error) {
+		attrs := map[string]string{
+			"fileId": fileId,
+			"secret": secret,
+			"check":  convert.BoolToStr(check),
+		}
+		if !check {
+			attrs["name"] = meta["name"]
+			attrs["contentType"] = meta["contentType"]
+		}
+		err = pip.Send(&common.Header{
+			Operation:  common.OPERATION_IMPORT,
+			Attributes: attrs,
+		}, body, bodyLength)
+		if err != nil {
+			return false, err
+		}
+		err = pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
+			header := _header.(*common.Header)
+			if header != nil {
+				if header.Result == common.SUCCESS {
+					exists = header.Attributes["exists"] == "true"
+					return nil
+				}
+				return errors.New("import failed: " + header.Msg)
+			}
+			return errors.New("import failed: got empty response from server")
+		})
+		return exists, err
+	}
+
+	// check first, the content is not sent if the server holds the file.
+	exists, err := send(true, nil, 0)
+	if err == nil && !exists {
+		_, err = send(false, src, length)
+	}
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return false, err
+	}
+	conn.ReturnConnection(server, connection, authenticated, false)
+	return !exists, nil
+}
+
+// queryAntiEntropy sends an anti-entropy request to the server and handles the body of the successful response.
+func (c *clientAPIImpl) queryAntiEntropy(server *common.Server, operation common.Operation, attrs map[string]string,
+	handler func(body io.Reader, bodyLength int64) error) error {
+	connection, authenticated, err := conn.GetConnection(server)
+	if err != nil {
+		return err
+	}
+	pip := &gpip.Pip{
+		Conn: *connection,
+	}
+	if authenticated == nil || !authenticated.(bool) {
+		if err = authenticate(pip, server); err != nil {
+			conn.ReturnConnection(server, connection, nil, true)
+			return err
+		}
+		logger.Debug("authentication success with server ", server.ConnectionString())
+	}
+	authenticated = true
+	err = pip.Send(&common.Header{
+		Operation:  operation,
+		Attributes: attrs,
+	}, nil, 0)
+	if err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return err
+	}
+	// receive response
+	err = pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
+		header := _header.(*common.Header)
+		if header != nil {
+			if header.Result == common.SUCCESS {
+				return handler(bodyReader, bodyLength)
+			}
+			return errors.New("anti-entropy failed: " + header.Msg)
+		}
+		return errors.New("anti-entropy failed: got empty response from server")
+	})
+	if err != nil {
+		// the body may be partially read, the connection can not be reused.
+		conn.ReturnConnection(server, connection, nil, true)
+		return err
+	}
+	conn.ReturnConnection(server, connection, authenticated, false)
+	return nil
+}
+
+// writeDigests appends md5 of the files stored by this storage server to the stream,
+// so that tracker servers know which server holds the file contents.
+func writeDigests(body *binlog.StreamEncoder, fileIds []string) error {
+	if common.BootAs != common.BOOT_STORAGE {
+		return nil
+	}
+	for _, fileId := range fileIds {
+		info, _, err := util.ParseAlias(fileId, common.InitializedStorageConfiguration.Secret)
+		if err != nil {
+			logger.Debug("cannot parse alias: ", fileId)
+			continue
+		}
+		if err := body.WriteDigest(fileId, info.Path[strings.LastIndex(info.Path, "/")+1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authenticate authenticates with server, tracker servers register this instance on the connection.
+func authenticate(p *gpip.Pip, server conn.Server) error {
+	return authenticateWith(p, server, true)
+}
+
+// authenticateWith authenticates with server, this instance is registered only if register is true.
+//
+// Tracker servers free the instance registered on a connection when it is closed,
+// so connections which don't serve the instance must not register it.
+func authenticateWith(p *gpip.Pip, server conn.Server, register bool) error {
+	logger.Debug("trying to authenticate with server ", server.ConnectionString())
+	secret := ""
+	if _, t := server.(*common.Server); t {
+		secret = server.(*common.Server).Secret
+	} else if _, t := server.(*common.StorageServer); t {
+		secret = server.(*common.StorageServer).Secret
+	}
+
+	// validate with instance info
+	var instance *common.Instance
+	if common.BootAs == common.BOOT_TRACKER {
+		conf := common.InitializedTrackerConfiguration
+		advPort, _ := convert.StrToUint16(convert.IntToStr(conf.AdvertisePort))
+		instance = &common.Instance{
+			Server: common.Server{
+				Host:       conf.AdvertiseAddress,
+				Port:       advPort,
+				Secret:     conf.Secret,
+				InstanceId: conf.InstanceId,
+			},
+			Role: common.ROLE_TRACKER,
+		}
+	} else if common.BootAs == common.BOOT_STORAGE {
+		conf := common.InitializedStorageConfiguration
+		advPort, _ := convert.StrToUint16(convert.IntToStr(conf.AdvertisePort))
+		instance = &common.Instance{
+			Server: common.Server{
+				Host:           conf.AdvertiseAddress,
+				Port:           advPort,
+				Secret:         conf.Secret,
+				InstanceId:     conf.InstanceId,
+				HistorySecrets: common.GetHistorySecrets(),
+			},
+			Role: common.ROLE_STORAGE,
+			Attributes: map[string]string{
+				"group":    conf.Group,
+				"readonly": convert.BoolToStr(common.GetStorageMode() != common.STORAGE_MODE_ACTIVE),
+				"mode":     string(common.GetStorageMode()),
+				"httpPort": gox.TValue(conf.EnableHttp, convert.IntToStr(conf.HttpPort), "").(string),
+			},
+		}
+	} /* else if common.BootAs == common.BOOT_PROXY {} */
+	attrs := map[string]string{
+		"secret": secret,
+	}
+	if register {
+		info, err := json.Marshal(instance)
+		if err != nil {
+			return err
+		}
+		attrs["instance"] = string(info)
+	}
+
+	err := p.Send(&common.Header{
+		Operation:  common.OPERATION_CONNECT,
+		Attributes: attrs,
+	}, nil, 0)
+	if err != nil {
+		return err
+	}
+	return p.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
+		header := _header.(*common.Header)
+		if header.Result != common.SUCCESS {
+			return errors.New("authentication failed with server: " + server.ConnectionString())
+		}
+		return nil
+	})
+}
+
+// selectStorageServer selects proper storage server.
+func (c *clientAPIImpl) selectStorageServer(group string, uploadable bool, exclude *list.List) *common.StorageServer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	logger.Debug("select storage server")
+
+	var candidates []*Candidate
+	var syncStorages *list.List
+	// if registered storage server is not empty, use it first.
+	if uploadable {
+		syncStorages = FilterUploadableInstances()
+	} else {
+		syncStorages = FilterInstances(common.ROLE_STORAGE)
+	}
+	if syncStorages.Len() > 0 {
+		for ele := syncStorages.Front(); ele != nil; ele = ele.Next() {
+			s := ele.Value.(*common.Instance)
+			if isExcluded(s.Server, exclude) || !isAvailable(s, uploadable) {
+				continue
+			}
+			sg := ""
+			if s.Attributes != nil {
+				sg = s.Attributes["group"]
+			}
+			if group == "" || group == sg {
+				candidates = append(candidates, &Candidate{
+					Server: &common.StorageServer{
+						Server: s.Server,
+						Group:  sg,
+					},
+					Load: s.Load,
+				})
+			}
+		}
+	}
+	// if no candidate server, choose from static storage servers.
+	// static server has no group configured, so here ignores the group.
+	if len(candidates) == 0 {
+		for _, s := range c.config.StaticStorageServers {
+			if isExcluded(s.Server, exclude) {
+				continue
+			}
+			candidates = append(candidates, &Candidate{
+				Server: s,
+			})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	selectedStorage := c.balancer.Select(candidates).Server
+	logger.Debug("selected storage server: ", selectedStorage.ConnectionString())
+	return selectedStorage
+}
+
+// selectLocatedServer selects the first available storage server which holds the file.
+func selectLocatedServer(located []string, exclude *list.List) *common.StorageServer {
+	for _, instanceId := range located {
+		ins := FilterInstanceByInstanceId(instanceId)
+		if ins == nil || ins.Role != common.ROLE_STORAGE ||
+			isExcluded(ins.Server, exclude) || !isAvailable(ins, false) {
+			continue
+		}
+		logger.Debug("selected located storage server: ", ins.ConnectionString())
+		return &common.StorageServer{
+			Server: ins.Server,
+			Group:  ins.Attributes["group"],
+		}
+	}
+	return nil
+}
+
+// isAvailable judges whether a storage server can be used by its register and health state.
+//
+// Freed servers lost their tracker connection and unreachable servers are never used,
+// degraded and draining servers don't accept new uploads.
+func isAvailable(ins *common.Instance, uploadable bool) bool {
+	if ins.State == common.REGISTER_FREE {
+		return false
+	}
+	switch ins.Health {
+	case common.HEALTH_UNREACHABLE:
+		return false
+	case common.HEALTH_DEGRADED, common.HEALTH_DRAINING:
+		return !uploadable
+	}
+	return true
 }
 
 // isExcluded judges whether a storage server is in the exclude list.
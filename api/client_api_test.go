@@ -120,7 +120,7 @@ func TestSyncBinlogs(t *testing.T) {
 	}, &common.BinlogQueryDTO{
 		FileIndex: 0,
 		Offset:    0,
-	})
+	}, 1000)
 
 	if err != nil {
 		logger.Fatal(err)
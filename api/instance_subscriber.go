@@ -0,0 +1,124 @@
+package api
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/gpip"
+	"github.com/hetianyi/gox/logger"
+	json "github.com/json-iterator/go"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const resubscribeInterval = time.Second * 5
+
+var (
+	instanceListeners    []func(event *common.InstanceEvent)
+	instanceListenerLock = new(sync.Mutex)
+)
+
+// AddInstanceListener adds a listener which is called when
+// an instance event is received from tracker servers.
+func AddInstanceListener(listener func(event *common.InstanceEvent)) {
+	instanceListenerLock.Lock()
+	defer instanceListenerLock.Unlock()
+	instanceListeners = append(instanceListeners, listener)
+}
+
+// subscribe keeps subscribing instance events from the tracker server,
+// it reconnects if the subscription breaks.
+func subscribe(clientAPI ClientAPI, server *common.Server, useStale bool) {
+	for {
+		err := subscribeOnce(clientAPI, server, useStale)
+		logger.Debug("instance subscription of tracker server ", server.ConnectionString(),
+			" breaks: ", err, ", retry in ", resubscribeInterval)
+		time.Sleep(resubscribeInterval)
+	}
+}
+
+// subscribeOnce subscribes instance events over a dedicated connection.
+func subscribeOnce(clientAPI ClientAPI, server *common.Server, useStale bool) error {
+	connection, err := net.DialTimeout("tcp", server.ConnectionString(), time.Second*10)
+	if err != nil {
+		return err
+	}
+	pip := &gpip.Pip{
+		Conn: connection,
+	}
+	defer pip.Close()
+
+	// the subscription doesn't register the instance,
+	// or the tracker server frees it when the subscription breaks.
+	if err = authenticateWith(pip, server, false); err != nil {
+		return err
+	}
+	if err = pip.Send(&common.Header{
+		Operation: common.OPERATION_SUBSCRIBE,
+	}, nil, 0); err != nil {
+		return err
+	}
+	subscribed := false
+	for {
+		connection.SetReadDeadline(time.Now().Add(common.SUBSCRIBE_HEARTBEAT * 3))
+		err = pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
+			header := _header.(*common.Header)
+			if header == nil {
+				return errors.New("subscribe failed: got empty response from server")
+			}
+			if header.Result != common.SUCCESS {
+				return errors.New("subscribe failed: " + header.Msg)
+			}
+			if header.Attributes == nil || header.Attributes["event"] == "" {
+				return nil
+			}
+			event := &common.InstanceEvent{}
+			if err := json.UnmarshalFromString(header.Attributes["event"], event); err != nil {
+				return err
+			}
+			applyInstanceEvent(event, useStale)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !subscribed {
+			subscribed = true
+			logger.Debug("subscribed instance events from tracker server ", server.ConnectionString())
+			// catch up the changes missed when the subscription was broken.
+			go synchronize(clientAPI, server, useStale)
+		}
+	}
+}
+
+// applyInstanceEvent updates synchronized instances by the event and notifies the listeners.
+func applyInstanceEvent(event *common.InstanceEvent, useStale bool) {
+	ins := event.Instance
+	if ins == nil {
+		return
+	}
+	logger.Debug("instance event ", event.Type, ": ", ins.InstanceId, "@", ins.ConnectionString())
+
+	syncLock.Lock()
+	if event.Type == common.INSTANCE_REMOVED {
+		delete(syncInstances, ins.InstanceId)
+	} else if ins.State != common.REGISTER_STALE || useStale {
+		syncInstances[ins.InstanceId] = &instanceStore{
+			instance:  ins,
+			fetchTime: time.Now(),
+		}
+		if common.BootAs == common.BOOT_STORAGE {
+			util.StoreSecrets(ins.InstanceId, util.CollectMapKeys(ins.Server.HistorySecrets)...)
+		}
+	}
+	syncLock.Unlock()
+
+	instanceListenerLock.Lock()
+	listeners := instanceListeners
+	instanceListenerLock.Unlock()
+	for _, l := range listeners {
+		l(event)
+	}
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"sync"
+	"testing"
+)
+
+func TestFreedInstanceNotSelected(t *testing.T) {
+	c := &clientAPIImpl{
+		config:   &Config{},
+		lock:     new(sync.Mutex),
+		balancer: NewBalancer(BALANCE_ROUND_ROBIN),
+	}
+	ins := &common.Instance{
+		Server: common.Server{
+			Host:       "127.0.0.1",
+			Port:       3000,
+			InstanceId: "storage1",
+		},
+		Role:       common.ROLE_STORAGE,
+		State:      common.REGISTER_HOLD,
+		Health:     common.HEALTH_HEALTHY,
+		Attributes: map[string]string{"group": "G01"},
+	}
+	applyInstanceEvent(&common.InstanceEvent{Type: common.INSTANCE_ADDED, Instance: ins}, false)
+	defer applyInstanceEvent(&common.InstanceEvent{Type: common.INSTANCE_REMOVED, Instance: ins}, false)
+
+	if s := c.selectStorageServer("G01", false, nil); s == nil || s.InstanceId != "storage1" {
+		t.Fatal("expect storage1 to be selected, got ", s)
+	}
+	if s := selectLocatedServer([]string{"storage1"}, nil); s == nil {
+		t.Fatal("expect located storage1 to be selected")
+	}
+
+	freed := *ins
+	freed.State = common.REGISTER_FREE
+	applyInstanceEvent(&common.InstanceEvent{Type: common.INSTANCE_CHANGED, Instance: &freed}, false)
+
+	if s := c.selectStorageServer("G01", false, nil); s != nil {
+		t.Fatal("expect freed storage1 not to be selected, got ", s.InstanceId)
+	}
+	if s := selectLocatedServer([]string{"storage1"}, nil); s != nil {
+		t.Fatal("expect freed storage1 not to be located, got ", s.InstanceId)
+	}
+}
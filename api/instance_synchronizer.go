@@ -4,7 +4,6 @@ import (
 	"container/list"
 	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/godfs/util"
-	"github.com/hetianyi/gox"
 	"github.com/hetianyi/gox/logger"
 	"github.com/hetianyi/gox/timer"
 	"sync"
@@ -30,34 +29,21 @@ type instanceStore struct {
 }
 
 func (ins *instanceStore) expired() bool {
-	return gox.GetTimestamp(time.Now().Add(common.SYNCHRONIZE_INTERVAL*2+time.Second*5)) < gox.GetTimestamp(ins.fetchTime)
+	return time.Now().After(ins.fetchTime.Add(common.SYNCHRONIZE_INTERVAL*2 + time.Second*5))
 }
 
-func tracks(clientAPI ClientAPI, server *common.Server, synchronizeOnce bool, c chan int) {
+// tracks synchronizes instances from the tracker server.
+//
+// Instances are polled every SYNCHRONIZE_INTERVAL, and unless synchronizeOnce is set,
+// instance events are also subscribed from the tracker server so that changes
+// take effect immediately, the polling remains as a fallback.
+func tracks(clientAPI ClientAPI, server *common.Server, synchronizeOnce bool, useStale bool, c chan int) {
 	if !synchronizeOnce {
 		go expireDetection()
+		go subscribe(clientAPI, server, useStale)
 	}
 	timer.Start(0, common.SYNCHRONIZE_INTERVAL, 0, func(t *timer.Timer) {
-		ret, err := clientAPI.SyncInstances(server)
-		if err != nil {
-			logger.Error("error synchronize with tracker server: ", server.ConnectionString(), ": ", err)
-		} else {
-			syncLock.Lock()
-			defer syncLock.Unlock()
-
-			if ret != nil && len(ret) > 0 {
-				now := time.Now()
-				for k, v := range ret {
-					syncInstances[k] = &instanceStore{
-						instance:  v,
-						fetchTime: now,
-					}
-					if common.BootAs == common.BOOT_STORAGE {
-						util.StoreSecrets(v.InstanceId, util.CollectMapKeys(v.Server.HistorySecrets)...)
-					}
-				}
-			}
-		}
+		err := synchronize(clientAPI, server, useStale)
 		// used by client cli.
 		if synchronizeOnce {
 			t.Destroy()
@@ -72,6 +58,32 @@ func tracks(clientAPI ClientAPI, server *common.Server, synchronizeOnce bool, c
 	})
 }
 
+// synchronize synchronizes all instances from the tracker server.
+func synchronize(clientAPI ClientAPI, server *common.Server, useStale bool) error {
+	ret, err := clientAPI.SyncInstances(server)
+	if err != nil {
+		logger.Error("error synchronize with tracker server: ", server.ConnectionString(), ": ", err)
+		return err
+	}
+	syncLock.Lock()
+	defer syncLock.Unlock()
+
+	now := time.Now()
+	for k, v := range ret {
+		if v.State == common.REGISTER_STALE && !useStale {
+			continue
+		}
+		syncInstances[k] = &instanceStore{
+			instance:  v,
+			fetchTime: now,
+		}
+		if common.BootAs == common.BOOT_STORAGE {
+			util.StoreSecrets(v.InstanceId, util.CollectMapKeys(v.Server.HistorySecrets)...)
+		}
+	}
+	return nil
+}
+
 func FilterInstances(role common.Role) *list.List {
 	syncLock.Lock()
 	defer syncLock.Unlock()
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"container/list"
-	"encoding/base64"
 	"errors"
 	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/godfs/util"
@@ -12,6 +11,7 @@ import (
 	"github.com/hetianyi/gox/convert"
 	"github.com/hetianyi/gox/file"
 	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
 	"io"
 	"os"
 	"sync"
@@ -53,11 +53,36 @@ type XBinlogManager interface {
 	Read(fileIndex int, offset int64, fetchLine int) ([]common.BingLogDTO, int64, error)
 }
 
-// NewXBinlogManager creates a new binlog manager.
+// FeedRecord is a binlog with the offset right after it in the binlog file.
+type FeedRecord struct {
+	Binlog common.BingLogDTO
+	Offset int64
+}
+
+// FeedReader is implemented by binlog managers whose binlogs can be read as a feed,
+// which are the local binlog manager and journals of the tracker binlog manager.
+type FeedReader interface {
+	XBinlogManager
+
+	// ReadFeed reads binlogs like Read, with the offset right after each binlog.
+	ReadFeed(fileIndex int, offset int64, fetchLine int) ([]FeedRecord, int64, error)
+}
+
+// LagReader is implemented by binlog managers which can tell how far a position is behind.
+type LagReader interface {
+	XBinlogManager
+
+	// Lag returns the position right after the latest binlog,
+	// and the number of binlogs after pos which is estimated from the binlog index.
+	Lag(pos common.BinlogQueryDTO) (common.BinlogQueryDTO, int64, error)
+}
+
+// NewXBinlogManager creates a new binlog manager,
+// the tracker binlog manager is created by NewTrackerBinlogManager.
 func NewXBinlogManager(managerType XBinlogManagerType) XBinlogManager {
-	defer func() {
-		TryFixBinlogFile()
-	}()
+	if managerType != LOCAL_BINLOG_MANAGER {
+		return nil
+	}
 	// check binlog dirs
 	binlogDir := getBinlogDir()
 	if err := initialBinlogDir(binlogDir); err != nil {
@@ -65,46 +90,87 @@ func NewXBinlogManager(managerType XBinlogManagerType) XBinlogManager {
 	}
 	// initialize XBinlogMapManager
 	if binlogMapManager == nil {
-		binlogMapManager = &XBinlogMapManager{
-			lock:      new(sync.Mutex),
-			buffer:    make([]byte, 8),
-			binlogDir: binlogDir,
-		}
-		if err := binlogMapManager.initMapFile(); err != nil {
+		mapManager, err := openBinlogMapManager(binlogDir)
+		if err != nil {
 			logger.Fatal("failed to initialize binlog map file: ", err)
 		}
+		binlogMapManager = mapManager
 	}
-	if managerType == LOCAL_BINLOG_MANAGER {
-		return &localBinlogManager{
-			writeLock:          new(sync.Mutex),
-			binlogSize:         0,
-			buffer:             bytes.Buffer{},
-			lengthBuffer:       make([]byte, 8),
-			singleBinlogBuffer: make([]byte, LOCAL_BINLOG_SIZE), // 8+8+86
-		}
+	m := newLocalBinlogManager(LOCAL_BINLOG_MANAGER, binlogDir, binlogMapManager, getFsyncPolicy())
+	if m.fsyncPolicy == common.BINLOG_FSYNC_INTERVAL {
+		timer.Start(0, common.BINLOG_FSYNC_PERIOD, 0, func(t *timer.Timer) {
+			if err := m.Flush(); err != nil {
+				logger.Error("error sync binlog file: ", err)
+			}
+		})
 	}
-	return nil
+	return m
+}
+
+// openBinlogMapManager loads the binlog index of the binlog dir
+// and recovers the torn tail of the latest binlog file.
+func openBinlogMapManager(binlogDir string) (*XBinlogMapManager, error) {
+	m := &XBinlogMapManager{
+		lock:      new(sync.Mutex),
+		buffer:    make([]byte, 8),
+		binlogDir: binlogDir,
+	}
+	if err := m.initMapFile(); err != nil {
+		return nil, err
+	}
+	if err := recoverBinlogFile(binlogDir, m); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
-// localBinlogManager is a binlog manager for storage server.
+func newLocalBinlogManager(managerType XBinlogManagerType, binlogDir string,
+	mapManager *XBinlogMapManager, fsyncPolicy string) *localBinlogManager {
+	return &localBinlogManager{
+		managerType:        managerType,
+		binlogDir:          binlogDir,
+		mapManager:         mapManager,
+		writeLock:          new(sync.Mutex),
+		binlogSize:         0,
+		buffer:             bytes.Buffer{},
+		lengthBuffer:       make([]byte, 8),
+		singleBinlogBuffer: make([]byte, binlogRecordSize), // 8+8+86+4
+		currentIndex:       gox.TValue(mapManager.LatestIndex() < 0, 0, mapManager.LatestIndex()).(int),
+		fsyncPolicy:        fsyncPolicy,
+	}
+}
+
+// localBinlogManager writes binlogs to the binlog files of a single dir,
+// it is the binlog manager of storage servers and a journal of tracker servers.
 type localBinlogManager struct {
+	managerType        XBinlogManagerType
+	binlogDir          string
+	mapManager         *XBinlogMapManager
 	writeLock          *sync.Mutex
 	currentBinLogFile  *os.File // current binlog file
+	currentFileSize    int64    // size of current binlog file
 	binlogSize         int      // binlog items count
 	buffer             bytes.Buffer
 	lengthBuffer       []byte
 	singleBinlogBuffer []byte
 	currentIndex       int
+	fsyncPolicy        string
+	dirty              bool // whether current binlog file has data not synced yet
 }
 
 func (m *localBinlogManager) GetType() XBinlogManagerType {
-	return LOCAL_BINLOG_MANAGER
+	return m.managerType
 }
 
 func (m *localBinlogManager) GetCurrentIndex() int {
 	return m.currentIndex
 }
 
+// Write writes binlogs to the current binlog file.
+//
+// Records of a failed write are truncated, the record count in the binlog index
+// is updated after the data and reconciled with the file on boot,
+// so the index never gets ahead of the binlog file.
 func (m *localBinlogManager) Write(bin ...*common.BingLog) error {
 
 	l := len(bin)
@@ -122,16 +188,26 @@ func (m *localBinlogManager) Write(bin ...*common.BingLog) error {
 		// file size exceed, close old file
 		if m.currentBinLogFile != nil {
 			logger.Debug("binlog exceed max size")
+			if err := m.sync(); err != nil {
+				return err
+			}
 			if err := m.currentBinLogFile.Close(); err != nil {
 				return err
 			}
+			m.currentBinLogFile = nil
 		}
 		// create new binlog file.
-		newFile, binLogSize, index, err := getCurrentBinLogFile()
+		newFile, binLogSize, index, err := getCurrentBinLogFile(m.binlogDir, m.mapManager)
+		if err != nil {
+			return err
+		}
+		info, err := newFile.Stat()
 		if err != nil {
+			newFile.Close()
 			return err
 		}
 		m.currentBinLogFile = newFile
+		m.currentFileSize = info.Size()
 		m.binlogSize = binLogSize
 		m.currentIndex = index
 	}
@@ -140,20 +216,27 @@ func (m *localBinlogManager) Write(bin ...*common.BingLog) error {
 	defer m.buffer.Reset()
 
 	for i := 0; i < l; i++ {
-		copy(m.singleBinlogBuffer[0:8], bin[i].SourceInstance[:])
-		copy(m.singleBinlogBuffer[8:16], bin[i].FileLength[:])
-		copy(m.singleBinlogBuffer[16:], bin[i].FileId[:])
-		m.buffer.WriteString(base64.RawURLEncoding.EncodeToString(m.singleBinlogBuffer))
-		m.buffer.WriteRune('\n')
+		if err := encodeRecord(bin[i], m.singleBinlogBuffer, &m.buffer); err != nil {
+			return err
+		}
 	}
 
 	// persist binlog data.
 	if _, err := m.currentBinLogFile.Write(m.buffer.Bytes()); err != nil {
+		m.rollback()
 		return err
 	}
-	m.binlogSize += 1
+	m.dirty = true
+	if m.fsyncPolicy == common.BINLOG_FSYNC_ALWAYS {
+		if err := m.sync(); err != nil {
+			m.rollback()
+			return err
+		}
+	}
+	m.currentFileSize += int64(m.buffer.Len())
+	m.binlogSize += l
 	// write binlog record size.
-	if err := binlogMapManager.SetRecords(m.currentIndex, m.binlogSize); err != nil {
+	if err := m.mapManager.SetRecords(m.currentIndex, m.binlogSize); err != nil {
 		return err
 	}
 
@@ -162,11 +245,111 @@ func (m *localBinlogManager) Write(bin ...*common.BingLog) error {
 	return nil
 }
 
+// rollback truncates partially written records of current binlog file.
+func (m *localBinlogManager) rollback() {
+	if err := m.currentBinLogFile.Truncate(m.currentFileSize); err != nil {
+		logger.Error("error truncate binlog file: ", err)
+	}
+}
+
+// sync flushes current binlog file to disk if it is dirty.
+func (m *localBinlogManager) sync() error {
+	if m.currentBinLogFile == nil || !m.dirty || m.fsyncPolicy == common.BINLOG_FSYNC_NONE {
+		return nil
+	}
+	if err := m.currentBinLogFile.Sync(); err != nil {
+		return err
+	}
+	m.dirty = false
+	return nil
+}
+
+// Flush flushes binlogs written to disk.
+func (m *localBinlogManager) Flush() error {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+	return m.sync()
+}
+
 func (m *localBinlogManager) Read(fileIndex int, offset int64, fetchLine int) ([]common.BingLogDTO, int64, error) {
+	tmpContainer := list.New()
+	nOffset, err := m.read(fileIndex, offset, fetchLine, func(bl *common.BingLog, end int64) {
+		tmpContainer.PushBack(*bl)
+	})
+	if err != nil {
+		return nil, offset, err
+	}
+	if tmpContainer.Len() == 0 {
+		return nil, nOffset, nil
+	}
+
+	ret := make([]common.BingLogDTO, tmpContainer.Len())
+	i := 0
+
+	gox.WalkList(tmpContainer, func(item interface{}) bool {
+		sit := item.(common.BingLog)
+		ret[i] = toBinlogDTO(&sit)
+		i++
+		return false
+	})
+	return ret, nOffset, nil
+}
+
+// ReadFeed reads binlogs like Read, with the offset right after each binlog.
+func (m *localBinlogManager) ReadFeed(fileIndex int, offset int64, fetchLine int) ([]FeedRecord, int64, error) {
+	var ret []FeedRecord
+	nOffset, err := m.read(fileIndex, offset, fetchLine, func(bl *common.BingLog, end int64) {
+		ret = append(ret, FeedRecord{
+			Binlog: toBinlogDTO(bl),
+			Offset: end,
+		})
+	})
+	if err != nil {
+		return nil, offset, err
+	}
+	return ret, nOffset, nil
+}
+
+func (m *localBinlogManager) Lag(pos common.BinlogQueryDTO) (common.BinlogQueryDTO, int64, error) {
+	head := common.BinlogQueryDTO{}
+	latest := m.mapManager.LatestIndex()
+	if latest < 0 {
+		return head, 0, nil
+	}
+	info, err := os.Stat(getBinLogFileNameByIndex(m.binlogDir, latest))
+	if err != nil && !os.IsNotExist(err) {
+		return head, 0, err
+	}
+	head.FileIndex = latest
+	if info != nil {
+		// a binlog being written is not a part of the head.
+		head.Offset = info.Size() - info.Size()%binlogLineSize
+	}
+	var records int64
+	for i := pos.FileIndex; i <= latest; i++ {
+		n, err := m.mapManager.GetRecords(i)
+		if err != nil {
+			return head, 0, err
+		}
+		records += int64(n)
+	}
+	if pos.FileIndex <= latest {
+		records -= pos.Offset / binlogLineSize
+	}
+	if records < 0 {
+		records = 0
+	}
+	return head, records, nil
+}
+
+// read reads at most fetchLine binlogs from the offset,
+// the handler gets every binlog and the offset right after it.
+func (m *localBinlogManager) read(fileIndex int, offset int64, fetchLine int,
+	handler func(bl *common.BingLog, end int64)) (int64, error) {
 	// prepare binlog dir if it not exists.
-	binlogDir := getBinlogDir()
+	binlogDir := m.binlogDir
 	if err := initialBinlogDir(binlogDir); err != nil {
-		return nil, offset, err
+		return offset, err
 	}
 
 	// get binlog filename.
@@ -175,169 +358,129 @@ func (m *localBinlogManager) Read(fileIndex int, offset int64, fetchLine int) ([
 	// compare file size.
 	iInfo, err := os.Stat(binLogFileName)
 	if err != nil {
-		return nil, offset, err
+		return offset, err
 	}
 	if iInfo.Size() <= offset {
-		return nil, offset, nil
+		return offset, nil
 	}
 
 	// get binlog file.
 	f, err := file.GetFile(binLogFileName)
 	if err != nil {
-		return nil, offset, err
+		return offset, err
 	}
+	defer f.Close()
 
 	// move to target offset.
 	_, err = f.Seek(offset, 0)
 	if err != nil {
-		return nil, offset, err
+		return offset, err
 	}
 
 	bf := bufio.NewReader(f)
-	tmpContainer := list.New()
 	var forwardOffset int64 = 0
 	readLines := 0
 
 	for {
 		bs, err := bf.ReadBytes('\n')
+		// to the end of the file, a partial line is a record being written.
 		if err == io.EOF {
 			break
 		}
-		// to the end of the file.
 		if err != nil {
-			return nil, offset, err
+			return offset, err
 		}
 
 		forwardOffset += int64(len(bs))
-		// invalid binlog size, skip.
-		if bs == nil || len(bs) < 2 {
+		// blank line, skip.
+		if isBlankLine(bs) {
 			continue
 		}
-		// restore binlog from
-		bs, err = base64.RawURLEncoding.DecodeString(string(bs))
+		bl, err := decodeRecord(bs)
 		if err != nil {
-			return nil, offset, err
-		}
-
-		// invalid binlog size, skip.
-		if len(bs) != LOCAL_BINLOG_SIZE {
+			logger.Error("skip corrupted binlog record in ", binLogFileName, " at offset ",
+				offset+forwardOffset-int64(len(bs)), ": ", err)
 			continue
 		}
-		bl := common.BingLog{
-			SourceInstance: Copy8(bs[0:8]),
-			FileLength:     Copy8(bs[8:16]),
-			FileId:         bs[16:],
-		}
 
 		readLines++
-		tmpContainer.PushBack(bl)
+		handler(bl, offset+forwardOffset)
 
 		if readLines >= fetchLine {
 			break
 		}
 	}
+	return offset + forwardOffset, nil
+}
 
-	ret := make([]common.BingLogDTO, tmpContainer.Len())
-	i := 0
-
-	gox.WalkList(tmpContainer, func(item interface{}) bool {
-		sit := item.(common.BingLog)
-		ret[i] = common.BingLogDTO{
-			SourceInstance: string(sit.SourceInstance[:]),
-			FileLength:     convert.Bytes2Length(sit.FileLength[:]),
-			FileId:         string(sit.FileId),
-		}
-		i++
-		return false
-	})
-	return ret, offset + forwardOffset, nil
+func toBinlogDTO(bl *common.BingLog) common.BingLogDTO {
+	return common.BingLogDTO{
+		SourceInstance: string(bl.SourceInstance[:]),
+		FileLength:     convert.Bytes2Length(bl.FileLength[:]),
+		FileId:         string(bl.FileId),
+	}
 }
 
-// Create creates binlog file under datadir.
-func create() (*os.File, int, error) {
+// Create creates a new binlog file under the binlog dir and registers it in the binlog index.
+func create(binlogDir string, mapManager *XBinlogMapManager) (*os.File, int, error) {
 	logger.Debug("creating binlog file")
 	// check binlog dirs
-	binlogDir := getBinlogDir()
 	if err := initialBinlogDir(binlogDir); err != nil {
 		return nil, 0, err
 	}
-	i := 0
-	for {
-		binLogFileName := getBinLogFileNameByIndex(binlogDir, i)
-		i++
-		if file.Exists(binLogFileName) {
-			continue
-		}
-		out, err := file.AppendFile(binLogFileName)
-		if err != nil {
-			return nil, 0, err
-		}
-		logger.Debug("binlog file created: ", binLogFileName)
-		return out, i - 1, nil
+	index := mapManager.LatestIndex() + 1
+	binLogFileName := getBinLogFileNameByIndex(binlogDir, index)
+	out, err := file.AppendFile(binLogFileName)
+	if err != nil {
+		return nil, 0, err
+	}
+	// the index entry is added after the file is created,
+	// a file without index entry is recovered when the index is loaded.
+	if _, err := mapManager.AddFile(); err != nil {
+		out.Close()
+		return nil, 0, err
 	}
+	logger.Debug("binlog file created: ", binLogFileName)
+	return out, index, nil
 }
 
 // getCurrentBinLogFile gets current binlog file for writing.
 //
+// The latest binlog file is the last entry of the binlog index.
+//
 // returns the binlog file, binlog record size, binlog file index NO., and error.
-func getCurrentBinLogFile() (*os.File, int, int, error) {
-	dataDir := ""
-	if common.BootAs == common.BOOT_TRACKER {
-		dataDir = common.InitializedTrackerConfiguration.DataDir
-	} else if common.BootAs == common.BOOT_STORAGE {
-		dataDir = common.InitializedStorageConfiguration.DataDir
-	} else {
-		logger.Fatal("unSupported boot mode: ", common.BootAs)
-	}
-
+func getCurrentBinLogFile(binlogDir string, mapManager *XBinlogMapManager) (*os.File, int, int, error) {
 	// check binlog dirs
-	binlogDir := dataDir + "/binlog"
-	if !file.Exists(binlogDir) {
-		if err := file.CreateDirs(binlogDir); err != nil {
-			return nil, 0, 0, err
-		}
+	if err := initialBinlogDir(binlogDir); err != nil {
+		return nil, 0, 0, err
 	}
 
-	latestLogFileName := ""
-	shouldExists := false
-	index := 0
-	for i := 999; i >= 0; i-- {
-		name := getBinLogFileNameByIndex(binlogDir, i)
-		// find latest binlog file.
-		if !shouldExists && file.Exists(name) {
-			index = i
-			latestLogFileName = name
-			shouldExists = true
-		}
-		// check left binlog file state.
-		if shouldExists && !file.Exists(name) {
-			return nil, 0, 0, errors.New("invalid binlog state: binlog loss")
-		}
-	}
+	index := mapManager.LatestIndex()
 	// no binlog file yet.
-	if latestLogFileName == "" {
-		ret, _index, err := create()
+	if index < 0 {
+		ret, _index, err := create(binlogDir, mapManager)
 		return ret, 0, _index, err
 	}
-	latest, err := file.GetFile(latestLogFileName)
+	binlogSize, err := mapManager.GetRecords(index)
 	if err != nil {
 		return nil, 0, 0, err
 	}
-	defer latest.Close()
-	info, err := latest.Stat()
+	latestLogFileName := getBinLogFileNameByIndex(binlogDir, index)
+	info, err := os.Stat(latestLogFileName)
 	if err != nil {
-		return nil, 0, 0, err
-	}
-	if info.IsDir() {
+		if !os.IsNotExist(err) {
+			return nil, 0, 0, err
+		}
+		// the server crashed before the registered file was created.
+		if binlogSize > 0 {
+			return nil, 0, 0, errors.New("invalid binlog state: binlog loss")
+		}
+	} else if info.IsDir() {
 		return nil, 0, 0, errors.New("binlog file must not be a directory: " + info.Name())
 	}
-	binlogSize, err := binlogMapManager.GetRecords(index)
-	if err != nil {
-		return nil, 0, 0, err
-	}
 	// this binlog file exceed max record size.
 	if binlogSize >= MAX_BINLOG_SIZE {
-		ret, _index, err := create()
+		ret, _index, err := create(binlogDir, mapManager)
 		return ret, 0, _index, err
 	}
 	logger.Debug("use binlog file: ", latestLogFileName)
@@ -345,13 +488,10 @@ func getCurrentBinLogFile() (*os.File, int, int, error) {
 	return ret, binlogSize, index, err
 }
 
+// getBinLogFileNameByIndex returns the binlog file name,
+// indexes over 999 simply get longer names, e.g. "bin.1000".
 func getBinLogFileNameByIndex(binlogDir string, i int) string {
-	if common.BootAs == common.BOOT_TRACKER {
-		return binlogDir + "/bin." + util.FixZeros(i, 3)
-	} else if common.BootAs == common.BOOT_STORAGE {
-		return binlogDir + "/bin." + util.FixZeros(i, 3)
-	}
-	return ""
+	return binlogDir + "/bin." + util.FixZeros(i, 3)
 }
 
 // CreateLocalBinlog builds an Binlog.
@@ -378,6 +518,14 @@ func Copy8(src []byte) [8]byte {
 	return target
 }
 
+// getFsyncPolicy returns the binlog fsync policy of this instance.
+func getFsyncPolicy() string {
+	if common.BootAs == common.BOOT_STORAGE && common.InitializedStorageConfiguration.BinlogFsync != "" {
+		return common.InitializedStorageConfiguration.BinlogFsync
+	}
+	return common.BINLOG_FSYNC_INTERVAL
+}
+
 func getBinlogDir() string {
 	dataDir := ""
 	if common.BootAs == common.BOOT_TRACKER {
@@ -398,15 +546,3 @@ func initialBinlogDir(path string) (err error) {
 	}
 	return
 }
-
-// TryFixBinlogFile tries to fix binlog file by appending '\n'
-// to current binlog file in every boot.
-func TryFixBinlogFile() error {
-	// create new binlog file.
-	newFile, _, _, err := getCurrentBinLogFile()
-	if err != nil {
-		return err
-	}
-	_, err = newFile.WriteString("\n")
-	return err
-}
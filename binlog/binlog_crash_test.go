@@ -0,0 +1,162 @@
+package binlog
+
+import (
+	"encoding/base64"
+	"github.com/hetianyi/godfs/common"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// bootTestBinlog simulates booting a storage server on the data dir,
+// binlog files left by the previous boot are recovered.
+func bootTestBinlog(t *testing.T, dataDir string, fsync string) *localBinlogManager {
+	common.BootAs = common.BOOT_STORAGE
+	common.InitializedStorageConfiguration = &common.StorageConfig{
+		DataDir:     dataDir,
+		BinlogFsync: fsync,
+	}
+	if binlogMapManager != nil && binlogMapManager.mapFile != nil {
+		binlogMapManager.mapFile.Close()
+	}
+	binlogMapManager = nil
+	return NewXBinlogManager(LOCAL_BINLOG_MANAGER).(*localBinlogManager)
+}
+
+func writeTestBinlogs(t *testing.T, m *localBinlogManager, n int) {
+	for i := 0; i < n; i++ {
+		fileId := strings.Repeat(string(rune('a'+i%26)), common.FILE_ID_SIZE)
+		if err := m.Write(CreateLocalBinlog(fileId, int64(i), "instance")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readAllTestBinlogs(t *testing.T, m *localBinlogManager) []common.BingLogDTO {
+	ret, _, err := m.Read(0, 0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestBinlogTornTailRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := bootTestBinlog(t, dir, common.BINLOG_FSYNC_ALWAYS)
+	writeTestBinlogs(t, m, 5)
+	m.currentBinLogFile.Close()
+	validSize := m.currentFileSize
+
+	// power cut: half of a record is written and the index got ahead of the data.
+	f, err := os.OpenFile(getBinLogFileNameByIndex(dir+"/binlog", 0), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("AAECAwQFBgcICQoLDA0ODxAR")
+	f.Close()
+	if err := binlogMapManager.SetRecords(0, 6); err != nil {
+		t.Fatal(err)
+	}
+
+	m = bootTestBinlog(t, dir, common.BINLOG_FSYNC_ALWAYS)
+	info, err := os.Stat(getBinLogFileNameByIndex(dir+"/binlog", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != validSize {
+		t.Fatal("torn tail is not truncated, expected size ", validSize, ", got ", info.Size())
+	}
+	if n, _ := binlogMapManager.GetRecords(0); n != 5 {
+		t.Fatal("binlog index is not reconciled, expected 5, got ", n)
+	}
+
+	// records written after recovery must not be glued to the torn record.
+	writeTestBinlogs(t, m, 2)
+	if ret := readAllTestBinlogs(t, m); len(ret) != 7 {
+		t.Fatal("expected 7 records, got ", len(ret))
+	}
+}
+
+func TestBinlogChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := bootTestBinlog(t, dir, common.BINLOG_FSYNC_NONE)
+	writeTestBinlogs(t, m, 3)
+	m.currentBinLogFile.Close()
+
+	// flip a byte in the middle record, which is still valid base64.
+	name := getBinLogFileNameByIndex(dir+"/binlog", 0)
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(data), "\n")
+	b := []byte(lines[1])
+	if b[20] == 'A' {
+		b[20] = 'B'
+	} else {
+		b[20] = 'A'
+	}
+	lines[1] = string(b)
+	if err := ioutil.WriteFile(name, []byte(strings.Join(lines, "\n")), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	m = bootTestBinlog(t, dir, common.BINLOG_FSYNC_NONE)
+	ret, offset, err := m.Read(0, 0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret) != 2 || ret[0].FileLength != 0 || ret[1].FileLength != 2 {
+		t.Fatal("corrupted record is not skipped: ", ret)
+	}
+	if offset != int64(len(data)) {
+		t.Fatal("corrupted record is not consumed, offset ", offset)
+	}
+	scan, err := ScanBinlogFile(dir+"/binlog", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scan.Records != 2 || scan.Corrupted != 1 {
+		t.Fatal("unexpected scan result: ", *scan)
+	}
+}
+
+func TestBinlogLegacyRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a record without checksum followed by the blank line appended by old versions.
+	bin := CreateLocalBinlog(strings.Repeat("x", common.FILE_ID_SIZE), 1024, "instance")
+	legacy := make([]byte, 0, LOCAL_BINLOG_SIZE)
+	legacy = append(legacy, bin.SourceInstance[:]...)
+	legacy = append(legacy, bin.FileLength[:]...)
+	legacy = append(legacy, bin.FileId...)
+	if err := os.MkdirAll(dir+"/binlog", 0777); err != nil {
+		t.Fatal(err)
+	}
+	content := base64.RawURLEncoding.EncodeToString(legacy) + "\n\n"
+	if err := ioutil.WriteFile(getBinLogFileNameByIndex(dir+"/binlog", 0), []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	m := bootTestBinlog(t, dir, common.BINLOG_FSYNC_INTERVAL)
+	writeTestBinlogs(t, m, 1)
+	ret := readAllTestBinlogs(t, m)
+	if len(ret) != 2 || ret[0].FileLength != 1024 {
+		t.Fatal("legacy record is not readable: ", ret)
+	}
+}
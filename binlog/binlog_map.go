@@ -1,8 +1,8 @@
 package binlog
 
 import (
+	"encoding/binary"
 	"errors"
-	"github.com/hetianyi/gox/convert"
 	"github.com/hetianyi/gox/file"
 	"github.com/hetianyi/gox/logger"
 	"io/ioutil"
@@ -10,103 +10,173 @@ import (
 	"sync"
 )
 
+const (
+	binlogIndexFileName  = "binlog.index"
+	legacyBinlogMapName  = "binlog.map"
+	legacyBinlogMapSize  = 3000 // 1000 binlog files * 3 bytes record counter
+	binlogIndexEntrySize = 8
+)
+
+// XBinlogMapManager keeps the record count of every binlog file.
+//
+// The index file "binlog.index" is a sequence of 8 bytes big-endian counters,
+// the N-th counter belongs to binlog file N, so the latest binlog file
+// is the last entry and both the file count and the record count per file are unbounded.
 type XBinlogMapManager struct {
 	lock      *sync.Mutex
 	binlogDir string
 	mapFile   *os.File
 	buffer    []byte
-	memMap    [1000][3]byte
+	records   []int
 }
 
 func (m *XBinlogMapManager) initMapFile() error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
+	return m.loadIndex()
+}
 
+// loadIndex loads the index file into memory, the caller must hold the lock.
+func (m *XBinlogMapManager) loadIndex() error {
 	// try to close old connection.
 	if m.mapFile != nil {
 		m.mapFile.Close()
+		m.mapFile = nil
 	}
 
-	binlogMapFile := m.binlogDir + "/binlog.map"
-	exist := file.Exists(binlogMapFile)
-	ret, err := file.OpenFile(binlogMapFile, os.O_RDWR|os.O_CREATE, 0666)
+	indexFile := m.binlogDir + "/" + binlogIndexFileName
+	if !file.Exists(indexFile) {
+		if err := m.migrateLegacyMap(indexFile); err != nil {
+			return err
+		}
+	}
+	data, err := ioutil.ReadFile(indexFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ret, err := file.OpenFile(indexFile, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return err
 	}
-	if !exist {
-		logger.Debug("created binlog map file")
-		ret.WriteAt([]byte{0}, 2999)
-		m.memMap = [1000][3]byte{}
-	} else {
-		fInfo, err := os.Stat(binlogMapFile)
-		if err != nil {
+	// drop the torn entry written partially before a crash.
+	if len(data)%binlogIndexEntrySize != 0 {
+		logger.Warn("binlog index is truncated to ", len(data)/binlogIndexEntrySize, " entries")
+		data = data[:len(data)-len(data)%binlogIndexEntrySize]
+		if err = ret.Truncate(int64(len(data))); err != nil {
+			ret.Close()
 			return err
 		}
-		if fInfo.Size() != 3000 {
-			return errors.New("error binlog map file")
-		}
+	}
+	m.records = make([]int, len(data)/binlogIndexEntrySize)
+	for i := range m.records {
+		m.records[i] = int(binary.BigEndian.Uint64(data[i*binlogIndexEntrySize:]))
+	}
+	m.mapFile = ret
 
-		data, err := ioutil.ReadFile(binlogMapFile)
-		if err != nil {
+	// binlog files created without an index entry, which happens
+	// when the server crashed right after creating the binlog file.
+	for file.Exists(getBinLogFileNameByIndex(m.binlogDir, len(m.records))) {
+		logger.Warn("binlog file ", len(m.records), " has no index entry, recovering")
+		if err = m.writeEntry(len(m.records), 0); err != nil {
 			return err
 		}
-		if len(data) != 3000 {
-			return errors.New("error binlog map file")
-		}
-		for i := 0; i < 1000; i++ {
-			m.memMap[i] = [3]byte{data[i*3], data[i*3+1], data[i*3+2]}
-		}
 	}
-	m.mapFile = ret
+	return nil
+}
+
+// migrateLegacyMap converts the fixed size "binlog.map" of 1000 3-bytes counters
+// to the index file, it does nothing if there is no legacy map file.
+func (m *XBinlogMapManager) migrateLegacyMap(indexFile string) error {
+	legacyFile := m.binlogDir + "/" + legacyBinlogMapName
+	if !file.Exists(legacyFile) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(legacyFile)
+	if err != nil {
+		return err
+	}
+	if len(data) != legacyBinlogMapSize {
+		return errors.New("error binlog map file")
+	}
+	// legacy binlog files are named from 0 to 999 without gaps.
+	count := 0
+	for count < legacyBinlogMapSize/3 && file.Exists(getBinLogFileNameByIndex(m.binlogDir, count)) {
+		count++
+	}
+	buf := make([]byte, count*binlogIndexEntrySize)
+	for i := 0; i < count; i++ {
+		v := uint64(data[i*3])<<16 | uint64(data[i*3+1])<<8 | uint64(data[i*3+2])
+		binary.BigEndian.PutUint64(buf[i*binlogIndexEntrySize:], v)
+	}
+	tmpFile := indexFile + ".tmp"
+	if err = ioutil.WriteFile(tmpFile, buf, 0666); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpFile, indexFile); err != nil {
+		return err
+	}
+	logger.Info("migrated binlog map of ", count, " binlog files to ", binlogIndexFileName)
+	return os.Remove(legacyFile)
+}
+
+// writeEntry persists the record count of a binlog file,
+// fileIndex can be at most the current binlog file count, which appends a new entry.
+// The caller must hold the lock.
+func (m *XBinlogMapManager) writeEntry(fileIndex int, value int) error {
+	if fileIndex < 0 || fileIndex > len(m.records) {
+		return errors.New("binlog index out of range")
+	}
+	binary.BigEndian.PutUint64(m.buffer, uint64(value))
+	if _, err := m.mapFile.WriteAt(m.buffer, int64(fileIndex*binlogIndexEntrySize)); err != nil {
+		return err
+	}
+	if fileIndex == len(m.records) {
+		m.records = append(m.records, value)
+	} else {
+		m.records[fileIndex] = value
+	}
 	return nil
 }
 
 // GetRecords get binlog record size by binlog file index.
 func (m *XBinlogMapManager) GetRecords(fileIndex int) (size int, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if fileIndex < 0 || fileIndex >= len(m.records) {
+		return 0, errors.New("binlog index out of range")
+	}
+	return m.records[fileIndex], nil
+}
+
+// SetRecords sets binlog record size of the binlog file.
+func (m *XBinlogMapManager) SetRecords(fileIndex int, value int) (err error) {
 	m.lock.Lock()
 	defer func() {
 		if err != nil {
-			m.initMapFile()
+			m.loadIndex()
 		}
 		m.lock.Unlock()
 	}()
-
-	d3 := m.memMap[fileIndex]
-	m.buffer[5] = d3[0]
-	m.buffer[6] = d3[1]
-	m.buffer[7] = d3[2]
-
-	return int(convert.Bytes2Length(m.buffer)), nil
-	/*
-		if _, err := m.mapFile.Seek(int64(fileIndex*3), 0); err != nil {
-			return 0, err
-		}
-		if _, err := io.ReadAtLeast(m.mapFile, m.buffer[5:], 3); err != nil {
-			return 0, err
-		}
-		return int(convert.Bytes2Length(m.buffer)), nil*/
+	return m.writeEntry(fileIndex, value)
 }
 
-func (m *XBinlogMapManager) SetRecords(fileIndex int, value int) (err error) {
+// AddFile registers a new binlog file and returns its index.
+func (m *XBinlogMapManager) AddFile() (fileIndex int, err error) {
 	m.lock.Lock()
 	defer func() {
 		if err != nil {
-			m.initMapFile()
+			m.loadIndex()
 		}
 		m.lock.Unlock()
 	}()
+	fileIndex = len(m.records)
+	return fileIndex, m.writeEntry(fileIndex, 0)
+}
 
-	if _, err := m.mapFile.Seek(int64(fileIndex*3), 0); err != nil {
-		return err
-	}
-	convert.Length2Bytes(int64(value), m.buffer)
-	if _, err := m.mapFile.Write(m.buffer[5:]); err != nil {
-		return err
-	}
-	d3 := m.memMap[fileIndex]
-	d3[0] = m.buffer[5]
-	d3[1] = m.buffer[6]
-	d3[2] = m.buffer[7]
-	m.memMap[fileIndex] = d3
-	return nil
+// LatestIndex returns index of the latest binlog file, -1 means there is no binlog file yet.
+func (m *XBinlogMapManager) LatestIndex() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.records) - 1
 }
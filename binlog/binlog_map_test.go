@@ -0,0 +1,85 @@
+package binlog
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func newTestMapManager(t *testing.T, dir string) *XBinlogMapManager {
+	m := &XBinlogMapManager{
+		lock:      new(sync.Mutex),
+		buffer:    make([]byte, 8),
+		binlogDir: dir,
+	}
+	if err := m.initMapFile(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMigrateLegacyBinlogMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	legacy := make([]byte, legacyBinlogMapSize)
+	legacy[0], legacy[1], legacy[2] = 0x01, 0x02, 0x03
+	legacy[5] = 7
+	if err := ioutil.WriteFile(dir+"/"+legacyBinlogMapName, legacy, 0666); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := ioutil.WriteFile(getBinLogFileNameByIndex(dir, i), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := newTestMapManager(t, dir)
+	if m.LatestIndex() != 1 {
+		t.Fatal("expected latest index 1, got ", m.LatestIndex())
+	}
+	if n, _ := m.GetRecords(0); n != 0x010203 {
+		t.Fatal("unexpected records of file 0: ", n)
+	}
+	if n, _ := m.GetRecords(1); n != 7 {
+		t.Fatal("unexpected records of file 1: ", n)
+	}
+	if _, err := os.Stat(dir + "/" + legacyBinlogMapName); !os.IsNotExist(err) {
+		t.Fatal("legacy binlog map should be removed")
+	}
+}
+
+func TestBinlogIndexUnbounded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newTestMapManager(t, dir)
+	for i := 0; i < 1200; i++ {
+		if _, err := m.AddFile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.SetRecords(1100, 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	// simulate a torn entry and a binlog file created without index entry.
+	m.mapFile.WriteAt([]byte{1, 2, 3}, 1200*binlogIndexEntrySize)
+	if err := ioutil.WriteFile(getBinLogFileNameByIndex(dir, 1200), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	m = newTestMapManager(t, dir)
+	if m.LatestIndex() != 1200 {
+		t.Fatal("expected latest index 1200, got ", m.LatestIndex())
+	}
+	if n, _ := m.GetRecords(1100); n != 1<<30 {
+		t.Fatal("unexpected records of file 1100: ", n)
+	}
+}
@@ -0,0 +1,162 @@
+package binlog
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/logger"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// A binlog record is a base64 line of
+//
+//	sourceInstance(8) + fileLength(8) + fileId(86) + crc32(4)
+//
+// the crc32 covers the leading 102 bytes. Records written before
+// checksums were introduced have no crc32 and are accepted as they are.
+const (
+	binlogCrcSize    = 4
+	binlogRecordSize = LOCAL_BINLOG_SIZE + binlogCrcSize
+)
+
+var (
+	// size of a binlog line in the binlog file, legacy lines are shorter.
+	binlogLineSize = int64(base64.RawURLEncoding.EncodedLen(binlogRecordSize) + 1)
+
+	ErrBinlogChecksum = errors.New("binlog checksum mismatch")
+	ErrBinlogSize     = errors.New("invalid binlog record size")
+)
+
+// encodeRecord appends the encoded binlog line to the buffer,
+// buf must be binlogRecordSize bytes long.
+func encodeRecord(bin *common.BingLog, buf []byte, w io.Writer) error {
+	copy(buf[0:8], bin.SourceInstance[:])
+	copy(buf[8:16], bin.FileLength[:])
+	copy(buf[16:LOCAL_BINLOG_SIZE], bin.FileId[:])
+	binary.BigEndian.PutUint32(buf[LOCAL_BINLOG_SIZE:], crc32.ChecksumIEEE(buf[:LOCAL_BINLOG_SIZE]))
+	if _, err := io.WriteString(w, base64.RawURLEncoding.EncodeToString(buf)); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte{'\n'})
+	return err
+}
+
+// decodeRecord decodes a binlog line, the trailing '\n' is optional.
+func decodeRecord(line []byte) (*common.BingLog, error) {
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+	}
+	bs := make([]byte, base64.RawURLEncoding.DecodedLen(len(line)))
+	n, err := base64.RawURLEncoding.Decode(bs, line)
+	if err != nil {
+		return nil, err
+	}
+	bs = bs[:n]
+	if n == binlogRecordSize {
+		if binary.BigEndian.Uint32(bs[LOCAL_BINLOG_SIZE:]) != crc32.ChecksumIEEE(bs[:LOCAL_BINLOG_SIZE]) {
+			return nil, ErrBinlogChecksum
+		}
+	} else if n != LOCAL_BINLOG_SIZE {
+		return nil, ErrBinlogSize
+	}
+	return &common.BingLog{
+		SourceInstance: Copy8(bs[0:8]),
+		FileLength:     Copy8(bs[8:16]),
+		FileId:         bs[16:LOCAL_BINLOG_SIZE],
+	}, nil
+}
+
+// isBlankLine judges whether the line is an empty line,
+// which was appended to the binlog file on every boot by old versions.
+func isBlankLine(line []byte) bool {
+	return len(line) == 1 && line[0] == '\n'
+}
+
+// BinlogScanResult is the result of scanning a binlog file.
+type BinlogScanResult struct {
+	Records   int   // valid records
+	Corrupted int   // complete lines which cannot be decoded or fail the checksum
+	ValidSize int64 // size of the file up to the end of the last valid record
+	Size      int64 // size of the file
+}
+
+// scanBinlog scans binlog lines and calls the handler for every corrupted line.
+func scanBinlog(r io.Reader, onCorrupted func(offset int64, err error)) (*BinlogScanResult, error) {
+	ret := &BinlogScanResult{}
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		ret.Size += int64(len(line))
+		if err == io.EOF {
+			// a partial line without '\n' is a torn write.
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isBlankLine(line) {
+			if ret.ValidSize == ret.Size-1 {
+				ret.ValidSize = ret.Size
+			}
+			continue
+		}
+		if _, err := decodeRecord(line); err != nil {
+			ret.Corrupted++
+			if onCorrupted != nil {
+				onCorrupted(ret.Size-int64(len(line)), err)
+			}
+			continue
+		}
+		ret.Records++
+		ret.ValidSize = ret.Size
+	}
+}
+
+// recoverBinlogFile verifies the latest binlog file on boot.
+//
+// Only the latest binlog file is written, so a torn write can only be at its tail:
+// partial lines and corrupted records after the last valid record are truncated,
+// and the record count in the binlog index is reconciled with the file.
+func recoverBinlogFile(binlogDir string, mapManager *XBinlogMapManager) error {
+	index := mapManager.LatestIndex()
+	if index < 0 {
+		return nil
+	}
+	name := getBinLogFileNameByIndex(binlogDir, index)
+	f, err := os.OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	ret, err := scanBinlog(f, func(offset int64, err error) {
+		logger.Warn("corrupted binlog record in ", name, " at offset ", offset, ": ", err)
+	})
+	if err != nil {
+		return err
+	}
+	if ret.Size > ret.ValidSize {
+		logger.Warn("truncating torn tail of binlog ", name, " from ", ret.Size, " to ", ret.ValidSize, " bytes")
+		if err = f.Truncate(ret.ValidSize); err != nil {
+			return err
+		}
+		if err = f.Sync(); err != nil {
+			return err
+		}
+	}
+	recorded, err := mapManager.GetRecords(index)
+	if err != nil {
+		return err
+	}
+	if recorded != ret.Records {
+		logger.Warn("binlog index of ", name, " reconciled from ", recorded, " to ", ret.Records, " records")
+		return mapManager.SetRecords(index, ret.Records)
+	}
+	return nil
+}
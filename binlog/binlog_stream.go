@@ -0,0 +1,191 @@
+package binlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"io"
+)
+
+// A binlog stream carries binlogs, replicas and digests in the gpip body
+// instead of the header, so a batch is not limited by the header size.
+//
+// Each frame is
+//
+//	type(1) + payloadLength(2) + payload
+//
+// strings in the payload are prefixed with their length(1), unknown frame
+// types are skipped so that new frame types can be added later.
+const (
+	FRAME_BINLOG  byte = 1 // fileLength(8) + sourceInstance + fileId
+	FRAME_REPLICA byte = 2 // fileId + instanceId
+	FRAME_DIGEST  byte = 3 // fileId + md5
+
+	frameHeadSize   = 3
+	maxFrameStrSize = 255
+)
+
+var ErrInvalidFrame = errors.New("invalid binlog stream frame")
+
+// StreamEncoder encodes frames into a buffer,
+// the buffer is sent as the gpip body whose length must be known in advance.
+type StreamEncoder struct {
+	buf     bytes.Buffer
+	payload []byte
+	frames  int
+}
+
+// NewStreamEncoder creates a StreamEncoder.
+func NewStreamEncoder() *StreamEncoder {
+	return &StreamEncoder{
+		payload: make([]byte, 0, 512),
+	}
+}
+
+func (e *StreamEncoder) appendStr(s string) error {
+	if len(s) > maxFrameStrSize {
+		return ErrInvalidFrame
+	}
+	e.payload = append(e.payload, byte(len(s)))
+	e.payload = append(e.payload, s...)
+	return nil
+}
+
+func (e *StreamEncoder) writeFrame(frameType byte) {
+	var head [frameHeadSize]byte
+	head[0] = frameType
+	binary.BigEndian.PutUint16(head[1:], uint16(len(e.payload)))
+	e.buf.Write(head[:])
+	e.buf.Write(e.payload)
+	e.payload = e.payload[:0]
+	e.frames++
+}
+
+// WriteBinlog appends a binlog frame.
+func (e *StreamEncoder) WriteBinlog(bl *common.BingLogDTO) error {
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(bl.FileLength))
+	e.payload = append(e.payload, length[:]...)
+	if err := e.appendStr(bl.SourceInstance); err != nil {
+		return err
+	}
+	if err := e.appendStr(bl.FileId); err != nil {
+		return err
+	}
+	e.writeFrame(FRAME_BINLOG)
+	return nil
+}
+
+// WriteReplica appends a replica frame.
+func (e *StreamEncoder) WriteReplica(r *common.ReplicaDTO) error {
+	if err := e.appendStr(r.FileId); err != nil {
+		return err
+	}
+	if err := e.appendStr(r.InstanceId); err != nil {
+		return err
+	}
+	e.writeFrame(FRAME_REPLICA)
+	return nil
+}
+
+// WriteDigest appends a digest frame.
+func (e *StreamEncoder) WriteDigest(fileId, md5 string) error {
+	if err := e.appendStr(fileId); err != nil {
+		return err
+	}
+	if err := e.appendStr(md5); err != nil {
+		return err
+	}
+	e.writeFrame(FRAME_DIGEST)
+	return nil
+}
+
+// Frames returns the number of frames written.
+func (e *StreamEncoder) Frames() int {
+	return e.frames
+}
+
+// Len returns the length of the encoded stream.
+func (e *StreamEncoder) Len() int64 {
+	return int64(e.buf.Len())
+}
+
+// Reader returns a reader of the encoded stream.
+func (e *StreamEncoder) Reader() io.Reader {
+	return bytes.NewReader(e.buf.Bytes())
+}
+
+// StreamHandler handles decoded frames, only one of the pointers is not nil.
+// digest is the [fileId, md5] pair of a digest frame.
+type StreamHandler func(bl *common.BingLogDTO, replica *common.ReplicaDTO, digest *[2]string) error
+
+// DecodeStream decodes frames from the reader one by one until EOF,
+// the reader is consumed incrementally so that a large body is never buffered in memory.
+func DecodeStream(r io.Reader, handler StreamHandler) error {
+	br := bufio.NewReader(r)
+	var head [frameHeadSize]byte
+	payload := make([]byte, 512)
+	for {
+		if _, err := io.ReadFull(br, head[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(head[1:]))
+		if n > len(payload) {
+			payload = make([]byte, n)
+		}
+		p := payload[:n]
+		if _, err := io.ReadFull(br, p); err != nil {
+			return err
+		}
+		var err error
+		switch head[0] {
+		case FRAME_BINLOG:
+			if len(p) < 8 {
+				return ErrInvalidFrame
+			}
+			bl := &common.BingLogDTO{FileLength: int64(binary.BigEndian.Uint64(p))}
+			p = p[8:]
+			if bl.SourceInstance, p, err = readFrameStr(p); err != nil {
+				return err
+			}
+			if bl.FileId, _, err = readFrameStr(p); err != nil {
+				return err
+			}
+			err = handler(bl, nil, nil)
+		case FRAME_REPLICA:
+			r := &common.ReplicaDTO{}
+			if r.FileId, p, err = readFrameStr(p); err != nil {
+				return err
+			}
+			if r.InstanceId, _, err = readFrameStr(p); err != nil {
+				return err
+			}
+			err = handler(nil, r, nil)
+		case FRAME_DIGEST:
+			var d [2]string
+			if d[0], p, err = readFrameStr(p); err != nil {
+				return err
+			}
+			if d[1], _, err = readFrameStr(p); err != nil {
+				return err
+			}
+			err = handler(nil, nil, &d)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func readFrameStr(p []byte) (string, []byte, error) {
+	if len(p) < 1 || len(p) < 1+int(p[0]) {
+		return "", nil, ErrInvalidFrame
+	}
+	n := int(p[0])
+	return string(p[1 : 1+n]), p[1+n:], nil
+}
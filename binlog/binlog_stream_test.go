@@ -0,0 +1,58 @@
+package binlog
+
+import (
+	"bytes"
+	"github.com/hetianyi/godfs/common"
+	"strings"
+	"testing"
+)
+
+func TestBinlogStream(t *testing.T) {
+	e := NewStreamEncoder()
+	fileId := strings.Repeat("x", common.FILE_ID_SIZE)
+	for i := 0; i < 3000; i++ {
+		if err := e.WriteBinlog(&common.BingLogDTO{SourceInstance: "instance", FileLength: int64(i), FileId: fileId}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.WriteReplica(&common.ReplicaDTO{FileId: fileId, InstanceId: "replica"})
+	e.WriteDigest(fileId, "d41d8cd98f00b204e9800998ecf8427e")
+	// an unknown frame of a newer version is skipped.
+	e.payload = append(e.payload, 1, 2, 3)
+	e.writeFrame(99)
+
+	var bls []common.BingLogDTO
+	var replicas []common.ReplicaDTO
+	var digests [][2]string
+	err := DecodeStream(e.Reader(), func(bl *common.BingLogDTO, r *common.ReplicaDTO, d *[2]string) error {
+		if bl != nil {
+			bls = append(bls, *bl)
+		} else if r != nil {
+			replicas = append(replicas, *r)
+		} else if d != nil {
+			digests = append(digests, *d)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bls) != 3000 || bls[2999].FileLength != 2999 || bls[0].FileId != fileId || bls[0].SourceInstance != "instance" {
+		t.Fatal("unexpected binlogs: ", len(bls))
+	}
+	if len(replicas) != 1 || replicas[0].InstanceId != "replica" {
+		t.Fatal("unexpected replicas: ", replicas)
+	}
+	if len(digests) != 1 || digests[0][1] != "d41d8cd98f00b204e9800998ecf8427e" {
+		t.Fatal("unexpected digests: ", digests)
+	}
+
+	// a truncated stream is an error.
+	data := make([]byte, e.Len()-5)
+	e.Reader().Read(data)
+	if err := DecodeStream(bytes.NewReader(data), func(*common.BingLogDTO, *common.ReplicaDTO, *[2]string) error {
+		return nil
+	}); err == nil {
+		t.Fatal("truncated stream is not detected")
+	}
+}
@@ -0,0 +1,212 @@
+package binlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/file"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Functions in this file work on the binlog dir of a stopped instance,
+// they never go through the binlog manager of the running instance.
+
+// ListBinlogFiles returns indexes of the binlog files in ascending order.
+func ListBinlogFiles(binlogDir string) ([]int, error) {
+	infos, err := ioutil.ReadDir(binlogDir)
+	if err != nil {
+		return nil, err
+	}
+	var ret []int
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasPrefix(info.Name(), "bin.") {
+			continue
+		}
+		i, err := convert.StrToInt(strings.TrimPrefix(info.Name(), "bin."))
+		if err != nil || i < 0 {
+			continue
+		}
+		ret = append(ret, i)
+	}
+	sort.Ints(ret)
+	return ret, nil
+}
+
+// BinlogFileName returns the binlog file name of the index.
+func BinlogFileName(binlogDir string, fileIndex int) string {
+	return getBinLogFileNameByIndex(binlogDir, fileIndex)
+}
+
+// ReadBinlogIndex reads record counts of binlog files from the binlog index,
+// or from the legacy binlog map if the binlog dir is not migrated yet.
+// Nothing is modified.
+func ReadBinlogIndex(binlogDir string) (records []int, legacy bool, err error) {
+	data, err := ioutil.ReadFile(binlogDir + "/" + binlogIndexFileName)
+	if err == nil {
+		records = make([]int, len(data)/binlogIndexEntrySize)
+		for i := range records {
+			records[i] = int(binary.BigEndian.Uint64(data[i*binlogIndexEntrySize:]))
+		}
+		return records, false, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	data, err = ioutil.ReadFile(binlogDir + "/" + legacyBinlogMapName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, true, err
+	}
+	if len(data) != legacyBinlogMapSize {
+		return nil, true, errors.New("error binlog map file")
+	}
+	// legacy counters of files which do not exist are always 0.
+	for i := 0; i < legacyBinlogMapSize/3; i++ {
+		if !file.Exists(getBinLogFileNameByIndex(binlogDir, i)) {
+			break
+		}
+		records = append(records, int(data[i*3])<<16|int(data[i*3+1])<<8|int(data[i*3+2]))
+	}
+	return records, true, nil
+}
+
+// DumpBinlogFile decodes every record of a binlog file,
+// the handler gets either the decoded record or the error of a corrupted line.
+func DumpBinlogFile(binlogDir string, fileIndex int, handler func(offset int64, bl *common.BingLogDTO, err error) error) error {
+	f, err := os.Open(getBinLogFileNameByIndex(binlogDir, fileIndex))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return handler(offset, nil, errors.New("torn record at the end of binlog file"))
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !isBlankLine(line) {
+			bl, err := decodeRecord(line)
+			if err != nil {
+				err = handler(offset, nil, err)
+			} else {
+				err = handler(offset, &common.BingLogDTO{
+					SourceInstance: string(bl.SourceInstance[:]),
+					FileLength:     convert.Bytes2Length(bl.FileLength[:]),
+					FileId:         string(bl.FileId),
+				}, nil)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		offset += int64(len(line))
+	}
+}
+
+// ScanBinlogFile scans a binlog file by index.
+func ScanBinlogFile(binlogDir string, fileIndex int, onCorrupted func(offset int64, err error)) (*BinlogScanResult, error) {
+	f, err := os.Open(getBinLogFileNameByIndex(binlogDir, fileIndex))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return scanBinlog(f, onCorrupted)
+}
+
+// RepairResult is the result of repairing a binlog dir.
+type RepairResult struct {
+	Files     int   `json:"files"`     // binlog files in the rebuilt index
+	Records   int   `json:"records"`   // valid records of all binlog files
+	Corrupted int   `json:"corrupted"` // corrupted records left in the middle of binlog files
+	Truncated int64 `json:"truncated"` // bytes of torn tails truncated
+	Created   []int `json:"created"`   // empty binlog files created for missing indexes
+}
+
+// RepairBinlog truncates torn tails of binlog files and rebuilds the binlog index from them.
+//
+// Missing binlog files are replaced by empty files so that the indexes stay contiguous,
+// corrupted records in the middle of a binlog file cannot be restored and are left as they are.
+func RepairBinlog(binlogDir string) (*RepairResult, error) {
+	indexes, err := ListBinlogFiles(binlogDir)
+	if err != nil {
+		return nil, err
+	}
+	ret := &RepairResult{}
+	if len(indexes) == 0 {
+		return ret, writeBinlogIndex(binlogDir, nil)
+	}
+	existing := make(map[int]bool)
+	for _, i := range indexes {
+		existing[i] = true
+	}
+	latest := indexes[len(indexes)-1]
+	records := make([]int, latest+1)
+	for i := 0; i <= latest; i++ {
+		if !existing[i] {
+			ret.Created = append(ret.Created, i)
+		}
+		f, err := os.OpenFile(getBinLogFileNameByIndex(binlogDir, i), os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, err
+		}
+		var corrupted []int64
+		scan, err := scanBinlog(f, func(offset int64, err error) {
+			corrupted = append(corrupted, offset)
+		})
+		if err == nil && scan.Size > scan.ValidSize {
+			ret.Truncated += scan.Size - scan.ValidSize
+			if err = f.Truncate(scan.ValidSize); err == nil {
+				err = f.Sync()
+			}
+		}
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		records[i] = scan.Records
+		ret.Records += scan.Records
+		// corrupted lines in the truncated tail are gone.
+		for _, offset := range corrupted {
+			if offset < scan.ValidSize {
+				ret.Corrupted++
+			}
+		}
+	}
+	ret.Files = len(records)
+	return ret, writeBinlogIndex(binlogDir, records)
+}
+
+// writeBinlogIndex replaces the binlog index atomically and removes the legacy binlog map.
+func writeBinlogIndex(binlogDir string, records []int) error {
+	buf := make([]byte, len(records)*binlogIndexEntrySize)
+	for i, v := range records {
+		binary.BigEndian.PutUint64(buf[i*binlogIndexEntrySize:], uint64(v))
+	}
+	indexFile := binlogDir + "/" + binlogIndexFileName
+	tmpFile := indexFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, buf, 0666); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, indexFile); err != nil {
+		return err
+	}
+	if err := os.Remove(binlogDir + "/" + legacyBinlogMapName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package binlog
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/file"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// hexJournalPrefix marks journal dirs whose instanceId is not a safe file name.
+const hexJournalPrefix = "x-"
+
+var ErrJournalNotFound = errors.New("binlog journal not found")
+
+// TrackerBinlogManager journals binlogs pushed to a tracker server.
+//
+// Every source instance has its own journal under "binlog/<instanceId>",
+// a journal is a binlog dir of its own and is read like the binlogs of storage servers.
+//
+// It is not a XBinlogManager, binlogs of different source instances
+// have no common position and are only read by journal.
+type TrackerBinlogManager interface {
+
+	// GetType returns TRACKER_BINLOG_MANAGER.
+	GetType() XBinlogManagerType
+
+	// Write writes binlogs to the journals of their source instances.
+	Write(bin ...*common.BingLog) error
+
+	// Journal returns the journal of the source instance,
+	// ErrJournalNotFound is returned if nothing is journaled for it.
+	Journal(instanceId string) (XBinlogManager, error)
+
+	// Instances returns source instances which have a journal.
+	Instances() ([]string, error)
+}
+
+// trackerBinlogManager routes binlogs to the journal of their source instance.
+type trackerBinlogManager struct {
+	lock      *sync.Mutex
+	binlogDir string
+	journals  map[string]*localBinlogManager
+}
+
+// NewTrackerBinlogManager creates the binlog manager of tracker servers.
+func NewTrackerBinlogManager() TrackerBinlogManager {
+	binlogDir := getBinlogDir()
+	if err := initialBinlogDir(binlogDir); err != nil {
+		logger.Fatal("failed to create binlog dir: ", err)
+	}
+	m := &trackerBinlogManager{
+		lock:      new(sync.Mutex),
+		binlogDir: binlogDir,
+		journals:  make(map[string]*localBinlogManager),
+	}
+	// a single timer flushes all journals.
+	timer.Start(0, common.BINLOG_FSYNC_PERIOD, 0, func(t *timer.Timer) {
+		m.lock.Lock()
+		journals := make([]*localBinlogManager, 0, len(m.journals))
+		for _, j := range m.journals {
+			journals = append(journals, j)
+		}
+		m.lock.Unlock()
+		for _, j := range journals {
+			if err := j.Flush(); err != nil {
+				logger.Error("error sync binlog journal ", j.binlogDir, ": ", err)
+			}
+		}
+	})
+	return m
+}
+
+func (m *trackerBinlogManager) GetType() XBinlogManagerType {
+	return TRACKER_BINLOG_MANAGER
+}
+
+func (m *trackerBinlogManager) Write(bin ...*common.BingLog) error {
+	if len(bin) == 0 {
+		return nil
+	}
+	// keep the order of binlogs of the same source instance.
+	var instances []string
+	groups := make(map[string][]*common.BingLog)
+	for _, b := range bin {
+		instanceId := string(b.SourceInstance[:])
+		if groups[instanceId] == nil {
+			instances = append(instances, instanceId)
+		}
+		groups[instanceId] = append(groups[instanceId], b)
+	}
+	for _, instanceId := range instances {
+		j, err := m.journal(instanceId, true)
+		if err != nil {
+			return err
+		}
+		if err := j.Write(groups[instanceId]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *trackerBinlogManager) Journal(instanceId string) (XBinlogManager, error) {
+	return m.journal(instanceId, false)
+}
+
+func (m *trackerBinlogManager) journal(instanceId string, create bool) (*localBinlogManager, error) {
+	if instanceId == "" {
+		return nil, errors.New("empty source instance")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if j := m.journals[instanceId]; j != nil {
+		return j, nil
+	}
+	dir := m.binlogDir + "/" + journalDirName(instanceId)
+	if !create && !file.Exists(dir) {
+		return nil, ErrJournalNotFound
+	}
+	if err := initialBinlogDir(dir); err != nil {
+		return nil, err
+	}
+	mapManager, err := openBinlogMapManager(dir)
+	if err != nil {
+		return nil, err
+	}
+	j := newLocalBinlogManager(TRACKER_BINLOG_MANAGER, dir, mapManager, common.BINLOG_FSYNC_INTERVAL)
+	m.journals[instanceId] = j
+	return j, nil
+}
+
+func (m *trackerBinlogManager) Instances() ([]string, error) {
+	infos, err := ioutil.ReadDir(m.binlogDir)
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		if instanceId, ok := parseJournalDirName(info.Name()); ok {
+			ret = append(ret, instanceId)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// journalDirName returns the dir name of the journal,
+// instanceIds which are not safe file names are hex encoded.
+func journalDirName(instanceId string) string {
+	for _, c := range instanceId {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return hexJournalPrefix + hex.EncodeToString([]byte(instanceId))
+		}
+	}
+	return instanceId
+}
+
+func parseJournalDirName(name string) (string, bool) {
+	if !strings.HasPrefix(name, hexJournalPrefix) {
+		return name, true
+	}
+	bs, err := hex.DecodeString(strings.TrimPrefix(name, hexJournalPrefix))
+	if err != nil {
+		return "", false
+	}
+	return string(bs), true
+}
@@ -0,0 +1,61 @@
+package binlog
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTrackerBinlogJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	common.BootAs = common.BOOT_TRACKER
+	common.InitializedTrackerConfiguration = &common.TrackerConfig{
+		DataDir: dir,
+	}
+	m := NewTrackerBinlogManager()
+	fileId := strings.Repeat("x", common.FILE_ID_SIZE)
+	err = m.Write(
+		CreateLocalBinlog(fileId, 1, "instanc1"),
+		CreateLocalBinlog(fileId, 2, "instanc2"),
+		CreateLocalBinlog(fileId, 3, "instanc1"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Journal("unknown1"); err != ErrJournalNotFound {
+		t.Fatal("expected ErrJournalNotFound, got ", err)
+	}
+	instances, err := m.Instances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 2 || instances[0] != "instanc1" || instances[1] != "instanc2" {
+		t.Fatal("unexpected instances: ", instances)
+	}
+
+	j, err := m.Journal("instanc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, offset, err := j.Read(0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret) != 1 || ret[0].FileLength != 1 {
+		t.Fatal("unexpected binlogs: ", ret)
+	}
+	if ret, _, err = j.Read(0, offset, 10); err != nil || len(ret) != 1 || ret[0].FileLength != 3 {
+		t.Fatal("unexpected binlogs: ", ret, err)
+	}
+	head, lag, err := j.(LagReader).Lag(common.BinlogQueryDTO{Offset: offset})
+	if err != nil || lag != 1 || head.Offset != offset*2 {
+		t.Fatal("unexpected lag: ", head, lag, err)
+	}
+}
@@ -33,11 +33,41 @@ func call(cmd common.Command) {
 		ConfigAssembly(common.BOOT_CLIENT)
 		handleInspectFile()
 		break
+	case common.CMD_LIST_FILES:
+		common.BootAs = common.BOOT_CLIENT
+		ConfigAssembly(common.BOOT_CLIENT)
+		handleListFiles()
+		break
 	case common.CMD_TEST_UPLOAD:
 		common.BootAs = common.BOOT_CLIENT
 		ConfigAssembly(common.BOOT_CLIENT)
 		handleTestUploadFile()
 		break
+	case common.CMD_ADMIN_DRAIN:
+		common.BootAs = common.BOOT_CLIENT
+		ConfigAssembly(common.BOOT_CLIENT)
+		handleAdminDrain()
+		break
+	case common.CMD_ADMIN_SYNC_RATE:
+		common.BootAs = common.BOOT_CLIENT
+		ConfigAssembly(common.BOOT_CLIENT)
+		handleAdminSyncRate()
+		break
+	case common.CMD_ADMIN_SYNC_STATUS:
+		common.BootAs = common.BOOT_CLIENT
+		ConfigAssembly(common.BOOT_CLIENT)
+		handleAdminSyncStatus()
+		break
+	case common.CMD_ADMIN_RECONCILE:
+		common.BootAs = common.BOOT_CLIENT
+		ConfigAssembly(common.BOOT_CLIENT)
+		handleAdminReconcile()
+		break
+	case common.CMD_BINLOG_DUMP, common.CMD_BINLOG_VERIFY, common.CMD_BINLOG_STAT, common.CMD_BINLOG_REPAIR:
+		// binlog tools work on the data dir of a stopped storage server.
+		common.BootAs = common.BOOT_STORAGE
+		handleBinlogTool(cmd)
+		break
 	case common.CMD_GENERATE_TOKEN:
 		common.BootAs = common.BOOT_CLIENT
 		handleGenerateToken()
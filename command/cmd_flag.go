@@ -100,6 +100,17 @@ func Parse(arguments []string) {
 					Usage:       "enable http mime type",
 					Destination: &enableMimetypes,
 				},
+				cli.BoolFlag{
+					Name:        "enable-http-probe",
+					Usage:       "probe http port of storage servers when checking health",
+					Destination: &enableHttpProbe,
+				},
+				cli.StringFlag{
+					Name:        "feed-key",
+					Value:       "",
+					Usage:       "read-only key for the binlog feed, besides the secret",
+					Destination: &feedKey,
+				},
 				cli.StringFlag{
 					Name:        "allowed-domains",
 					Usage:       "allowed access domains",
@@ -224,6 +235,101 @@ func Parse(arguments []string) {
 					Usage:       "enable http mime type",
 					Destination: &enableMimetypes,
 				},
+				cli.StringFlag{
+					Name:        "mime-types-file",
+					Value:       "",
+					Usage:       "extra mime types file, in the format of /etc/mime.types",
+					Destination: &mimeTypesFile,
+				},
+				cli.StringFlag{
+					Name:  "webhooks",
+					Value: "",
+					Usage: `webhook urls notified on file events, example:
+	http://host1/hook1,http://host2/hook2`,
+					Destination: &webhooks,
+				},
+				cli.StringFlag{
+					Name:        "webhook-secret",
+					Value:       "",
+					Usage:       "secret used for signing webhook requests",
+					Destination: &webhookSecret,
+				},
+				cli.StringFlag{
+					Name:        "feed-key",
+					Value:       "",
+					Usage:       "read-only key for the binlog feed, besides the secret",
+					Destination: &feedKey,
+				},
+				cli.BoolFlag{
+					Name:        "bootstrap",
+					Usage:       "bootstrap a new group member from a peer in bulk before following binlogs",
+					Destination: &bootstrap,
+				},
+				cli.IntFlag{
+					Name:        "bootstrap-workers",
+					Value:       common.DEFAULT_BOOTSTRAP_WORKERS,
+					Usage:       "parallel file downloads when bootstrapping",
+					Destination: &bootstrapWorkers,
+				},
+				cli.StringFlag{
+					Name:        "anti-entropy-interval",
+					Value:       common.DEFAULT_ANTI_ENTROPY,
+					Usage:       "interval of anti-entropy between group members, 0 disables it",
+					Destination: &antiEntropyInterval,
+				},
+				cli.BoolFlag{
+					Name:        "anti-entropy-dry-run",
+					Usage:       "only report differences found by anti-entropy without repairing them",
+					Destination: &antiEntropyDryRun,
+				},
+				cli.StringFlag{
+					Name: "dr-storages",
+					Usage: `replicate files of the group to storage servers of a disaster recovery cluster,
+	enable it on only one member of the group, example:
+	<secret>@host1:port1,<secret>@host2:port2`,
+					Destination: &drStorages,
+				},
+				cli.StringFlag{
+					Name: "dr-sources",
+					Usage: `accept files replicated from storage servers of these hosts as a disaster recovery cluster,
+	the secret of the source cluster is only imported from them, example:
+	host1,host2`,
+					Destination: &drSources,
+				},
+				cli.IntFlag{
+					Name:        "sync-workers",
+					Value:       common.DEFAULT_SYNC_WORKERS,
+					Usage:       "parallel file downloads of file synchronization",
+					Destination: &syncWorkers,
+				},
+				cli.StringFlag{
+					Name:  "sync-rate",
+					Value: "",
+					Usage: `byte rate limit of file synchronization from group members, example:
+	512K, 10M, unlimited`,
+					Destination: &syncRate,
+				},
+				cli.StringFlag{
+					Name:  "sync-peer-rates",
+					Value: "",
+					Usage: `byte rate limits of file synchronization from single group members, example:
+	<instanceId1>=10M,<instanceId2>=512K`,
+					Destination: &syncPeerRates,
+				},
+				cli.StringFlag{
+					Name:  "sync-rate-schedule",
+					Value: "",
+					Usage: `time of day windows replacing the sync rate, example:
+	22:00-06:00=unlimited,09:00-18:00=5M`,
+					Destination: &syncRateSchedule,
+				},
+				cli.StringFlag{
+					Name:  "binlog-fsync",
+					Value: "interval",
+					Usage: `binlog fsync policy, available options:
+	(always|interval|none)`,
+					Destination: &binlogFsync,
+				},
 				cli.BoolFlag{
 					Name:        "readonly, r",
 					Usage:       "read only mode(cannot upload file through this instance)",
@@ -314,6 +420,13 @@ Usage: godfs client upload <file1> <file2> ...`)
 							Usage:       "mark as public files",
 							Destination: &publicUpload,
 						},
+						cli.StringFlag{
+							Name:  "balance",
+							Value: "round-robin",
+							Usage: `storage server balancing strategy, available options:
+	(round-robin|least-load|power-of-two|weighted-random)`,
+							Destination: &balanceStrategy,
+						},
 						cli.StringFlag{
 							Name:  "storages",
 							Value: "",
@@ -419,6 +532,106 @@ Usage: godfs client inspect <fid1> <fid2> ...`)
 							Name:  "log-level",
 							Value: "",
 							Usage: `set log level, available options:
+	(trace|debug|info|warn|error|fatal)`,
+							Destination: &logLevel,
+						},
+					},
+				},
+				{
+					Name:  "ls",
+					Usage: "list files page by page",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_LIST_FILES
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:        "group, g",
+							Value:       "",
+							Usage:       "list files of specific group",
+							Destination: &listQuery.Group,
+						},
+						cli.StringFlag{
+							Name:  "from",
+							Value: "",
+							Usage: `list files created since the time, example:
+	(2006-01-02|"2006-01-02 15:04:05"|<unix seconds>)`,
+							Destination: &listFrom,
+						},
+						cli.StringFlag{
+							Name:  "to",
+							Value: "",
+							Usage: `list files created until the time, example:
+	(2006-01-02|"2006-01-02 15:04:05"|<unix seconds>)`,
+							Destination: &listTo,
+						},
+						cli.StringFlag{
+							Name:        "source",
+							Value:       "",
+							Usage:       "list files uploaded to specific storage instance",
+							Destination: &listQuery.Source,
+						},
+						cli.Int64Flag{
+							Name:        "min-size",
+							Value:       0,
+							Usage:       "list files not smaller than the size in bytes",
+							Destination: &listQuery.MinSize,
+						},
+						cli.Int64Flag{
+							Name:        "max-size",
+							Value:       0,
+							Usage:       "list files not larger than the size in bytes, 0 means unlimited",
+							Destination: &listQuery.MaxSize,
+						},
+						cli.StringFlag{
+							Name:  "access-mode",
+							Value: "",
+							Usage: `list files of specific access mode, available options:
+	(private|public)`,
+							Destination: &listQuery.AccessMode,
+						},
+						cli.IntFlag{
+							Name:        "limit, n",
+							Value:       100,
+							Usage:       "page size",
+							Destination: &listQuery.Limit,
+						},
+						cli.StringFlag{
+							Name:        "cursor",
+							Value:       "",
+							Usage:       "cursor returned by the previous page",
+							Destination: &listQuery.Cursor,
+						},
+						cli.BoolFlag{
+							Name:        "all, a",
+							Usage:       "list all pages",
+							Destination: &listAll,
+						},
+						cli.StringFlag{
+							Name:  "server",
+							Value: "",
+							Usage: `list files from specific tracker or storage server instead of all tracker servers,
+	the server must be one of "--trackers" or "--storages"`,
+							Destination: &listServer,
+						},
+						cli.StringFlag{
+							Name:  "storages",
+							Value: "",
+							Usage: `set storage servers, example:
+	[<secret1>@]host1:port1,[<secret2>@]host2:port2`,
+							Destination: &storages,
+						},
+						cli.StringFlag{
+							Name:  "trackers",
+							Value: "",
+							Usage: `set tracker servers, example:
+	[<secret1>@]host1:port1,[<secret2>@]host2:port2`,
+							Destination: &trackers,
+						},
+						cli.StringFlag{
+							Name:  "log-level",
+							Value: "",
+							Usage: `set log level, available options:
 	(trace|debug|info|warn|error|fatal)`,
 							Destination: &logLevel,
 						},
@@ -476,6 +689,13 @@ Usage: godfs client token <fid1> <fid2> ...`)
 							Usage:       "mark as public files",
 							Destination: &publicUpload,
 						},
+						cli.StringFlag{
+							Name:  "balance",
+							Value: "round-robin",
+							Usage: `storage server balancing strategy, available options:
+	(round-robin|least-load|power-of-two|weighted-random)`,
+							Destination: &balanceStrategy,
+						},
 						cli.IntFlag{
 							Name:        "scale, s",
 							Usage:       "test scale",
@@ -506,6 +726,322 @@ Usage: godfs client token <fid1> <fid2> ...`)
 							Name:  "log-level",
 							Value: "",
 							Usage: `set log level, available options:
+	(trace|debug|info|warn|error|fatal)`,
+							Destination: &logLevel,
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "binlog",
+			Usage: "godfs offline binlog tools",
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) == 0 {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(0)
+				}
+				return nil
+			},
+			Subcommands: cli.Commands{
+				{
+					Name:  "dump",
+					Usage: "decode binlog records into json lines",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_BINLOG_DUMP
+						if dataDir == "" {
+							return errors.New("Err: no data directory provided.")
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:        "data-dir",
+							Value:       "",
+							Usage:       "data directory of the stopped storage server",
+							Destination: &dataDir,
+						},
+						cli.IntFlag{
+							Name:        "file, f",
+							Value:       -1,
+							Usage:       "index of the binlog file to be dumped, -1 dumps all binlog files",
+							Destination: &binlogFileIndex,
+						},
+						cli.StringFlag{
+							Name:  "secret, s",
+							Value: "",
+							Usage: `extra secrets for decoding fileIds besides the secrets saved in the data directory, example:
+	secret1,secret2`,
+							Destination: &secret,
+						},
+					},
+				},
+				{
+					Name:  "verify",
+					Usage: "check consistency between binlog files, binlog index, dataset and data files",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_BINLOG_VERIFY
+						if dataDir == "" {
+							return errors.New("Err: no data directory provided.")
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:        "data-dir",
+							Value:       "",
+							Usage:       "data directory of the stopped storage server",
+							Destination: &dataDir,
+						},
+						cli.StringFlag{
+							Name:  "secret, s",
+							Value: "",
+							Usage: `extra secrets for decoding fileIds besides the secrets saved in the data directory, example:
+	secret1,secret2`,
+							Destination: &secret,
+						},
+					},
+				},
+				{
+					Name:  "stat",
+					Usage: "show binlog files and binlog index",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_BINLOG_STAT
+						if dataDir == "" {
+							return errors.New("Err: no data directory provided.")
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:        "data-dir",
+							Value:       "",
+							Usage:       "data directory of the stopped storage server",
+							Destination: &dataDir,
+						},
+					},
+				},
+				{
+					Name:  "repair",
+					Usage: "truncate torn binlog tails and rebuild binlog index from binlog files",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_BINLOG_REPAIR
+						if dataDir == "" {
+							return errors.New("Err: no data directory provided.")
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:        "data-dir",
+							Value:       "",
+							Usage:       "data directory of the stopped storage server",
+							Destination: &dataDir,
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "admin",
+			Usage: "godfs admin cli",
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) == 0 {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(0)
+				}
+				return nil
+			},
+			Subcommands: cli.Commands{
+				{
+					Name:  "drain",
+					Usage: "switch storage server between active, readonly and draining mode",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_ADMIN_DRAIN
+						if len(c.Args()) == 0 {
+							return errors.New(`Err: no parameters provided.
+Usage: godfs admin drain <instance>`)
+						}
+						adminTarget = c.Args()[0]
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "mode, m",
+							Value: "draining",
+							Usage: `storage mode, available options:
+	(active|readonly|draining)`,
+							Destination: &storageMode,
+						},
+						cli.StringFlag{
+							Name:  "storages",
+							Value: "",
+							Usage: `set storage servers, example:
+	[<secret1>@]host1:port1,[<secret2>@]host2:port2`,
+							Destination: &storages,
+						},
+						cli.StringFlag{
+							Name:  "trackers",
+							Value: "",
+							Usage: `set tracker servers, example:
+	[<secret1>@]host1:port1,[<secret2>@]host2:port2`,
+							Destination: &trackers,
+						},
+						cli.StringFlag{
+							Name:  "log-level",
+							Value: "",
+							Usage: `set log level, available options:
+	(trace|debug|info|warn|error|fatal)`,
+							Destination: &logLevel,
+						},
+					},
+				},
+				{
+					Name:  "sync-rate",
+					Usage: "show or adjust byte rate limits of file synchronization of storage server",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_ADMIN_SYNC_RATE
+						if len(c.Args()) == 0 {
+							return errors.New(`Err: no parameters provided.
+Usage: godfs admin sync-rate <instance>`)
+						}
+						adminTarget = c.Args()[0]
+						for _, name := range []string{"rate", "peer-rates", "schedule"} {
+							if c.IsSet(name) {
+								syncRateFlags = append(syncRateFlags, name)
+							}
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name: "rate",
+							Usage: `byte rate limit of file synchronization from group members, example:
+	512K, 10M, unlimited`,
+							Destination: &syncRate,
+						},
+						cli.StringFlag{
+							Name: "peer-rates",
+							Usage: `byte rate limits of file synchronization from single group members, example:
+	<instanceId1>=10M,<instanceId2>=512K`,
+							Destination: &syncPeerRates,
+						},
+						cli.StringFlag{
+							Name: "schedule",
+							Usage: `time of day windows replacing the sync rate, example:
+	22:00-06:00=unlimited,09:00-18:00=5M`,
+							Destination: &syncRateSchedule,
+						},
+						cli.BoolFlag{
+							Name:        "reset",
+							Usage:       "reset to the sync rate limits of the configuration",
+							Destination: &resetSyncRate,
+						},
+						cli.StringFlag{
+							Name:  "storages",
+							Value: "",
+							Usage: `set storage servers, example:
+	[<secret1>@]host1:port1,[<secret2>@]host2:port2`,
+							Destination: &storages,
+						},
+						cli.StringFlag{
+							Name:  "trackers",
+							Value: "",
+							Usage: `set tracker servers, example:
+	[<secret1>@]host1:port1,[<secret2>@]host2:port2`,
+							Destination: &trackers,
+						},
+						cli.StringFlag{
+							Name:  "log-level",
+							Value: "",
+							Usage: `set log level, available options:
+	(trace|debug|info|warn|error|fatal)`,
+							Destination: &logLevel,
+						},
+					},
+				},
+				{
+					Name:  "sync-status",
+					Usage: "show synchronization state of groups, or of a storage server with its group members",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_ADMIN_SYNC_STATUS
+						if len(c.Args()) > 0 {
+							adminTarget = c.Args()[0]
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:        "group, g",
+							Value:       "",
+							Usage:       "show synchronization state of the group only",
+							Destination: &syncStatusGroup,
+						},
+						cli.StringFlag{
+							Name:  "storages",
+							Value: "",
+							Usage: `set storage servers, example:
+	[<secret1>@]host1:port1,[<secret2>@]host2:port2`,
+							Destination: &storages,
+						},
+						cli.StringFlag{
+							Name:  "trackers",
+							Value: "",
+							Usage: `set tracker servers, example:
+	[<secret1>@]host1:port1,[<secret2>@]host2:port2`,
+							Destination: &trackers,
+						},
+						cli.StringFlag{
+							Name:  "log-level",
+							Value: "",
+							Usage: `set log level, available options:
+	(trace|debug|info|warn|error|fatal)`,
+							Destination: &logLevel,
+						},
+					},
+				},
+				{
+					Name:  "reconcile",
+					Usage: "run anti-entropy of a storage server with its group members and repair missing files",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_ADMIN_RECONCILE
+						if len(c.Args()) == 0 {
+							return errors.New(`Err: no parameters provided.
+Usage: godfs admin reconcile <instance>`)
+						}
+						adminTarget = c.Args()[0]
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:        "peer",
+							Value:       "",
+							Usage:       "instance id of the group member to reconcile with, all group members if not provided",
+							Destination: &reconcilePeer,
+						},
+						cli.BoolFlag{
+							Name:        "dry-run",
+							Usage:       "only report differences without repairing them",
+							Destination: &reconcileDryRun,
+						},
+						cli.StringFlag{
+							Name:  "storages",
+							Value: "",
+							Usage: `set storage servers, example:
+	[<secret1>@]host1:port1,[<secret2>@]host2:port2`,
+							Destination: &storages,
+						},
+						cli.StringFlag{
+							Name:  "trackers",
+							Value: "",
+							Usage: `set tracker servers, example:
+	[<secret1>@]host1:port1,[<secret2>@]host2:port2`,
+							Destination: &trackers,
+						},
+						cli.StringFlag{
+							Name:  "log-level",
+							Value: "",
+							Usage: `set log level, available options:
 	(trace|debug|info|warn|error|fatal)`,
 							Destination: &logLevel,
 						},
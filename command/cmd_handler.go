@@ -1,9 +1,11 @@
 package command
 
 import (
+	"errors"
 	"fmt"
 	"github.com/hetianyi/godfs/api"
 	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/svc"
 	"github.com/hetianyi/godfs/util"
 	"github.com/hetianyi/gox"
 	"github.com/hetianyi/gox/convert"
@@ -14,6 +16,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
@@ -57,6 +60,7 @@ func initClient() error {
 		SynchronizeOnceCallback: readyChan,
 		StaticStorageServers:    staticServer,
 		TrackerServers:          trackerServers,
+		BalanceStrategy:         balanceStrategy,
 	})
 
 	if readyChan != nil {
@@ -98,6 +102,7 @@ func handleUploadFile() error {
 				fi, err := file.GetFile(inf.Name())
 				if err != nil {
 					logger.Error(err)
+					continue
 				}
 				r := &pg.WrappedReader{Reader: fi}
 				// show upload progressbar.
@@ -106,7 +111,8 @@ func handleUploadFile() error {
 					name = name[0:10] + "..." + name[len(name)-10:]
 				}
 				pro := pg.NewWrappedReaderProgress(inf.Size(), 50, "uploading: ["+name+"]", pg.Top, r)
-				ret, err := client.Upload(r, inf.Size(), group, common.InitializedClientConfiguration.PrivateUpload)
+				ret, err := client.UploadWithOptions(r, inf.Size(), group, common.InitializedClientConfiguration.PrivateUpload,
+					&api.UploadOptions{FileName: inf.Name()})
 				fi.Close()
 				if err != nil {
 					pro.Destroy()
@@ -137,7 +143,8 @@ func handleUploadFile() error {
 				name = name[0:10] + "..." + name[len(name)-10:]
 			}
 			pro := pg.NewWrappedReaderProgress(inf.Size(), 50, "uploading: ["+name+"]", pg.Top, r)
-			ret, err := client.Upload(r, inf.Size(), group, common.InitializedClientConfiguration.PrivateUpload)
+			ret, err := client.UploadWithOptions(r, inf.Size(), group, common.InitializedClientConfiguration.PrivateUpload,
+				&api.UploadOptions{FileName: inf.Name()})
 			if err != nil {
 				pro.Destroy()
 				logger.Error(err)
@@ -283,6 +290,241 @@ func handleInspectFile() error {
 	return nil
 }
 
+// handleAdminDrain switches the runtime mode of a storage server.
+func handleAdminDrain() {
+	mode := common.StorageMode(storageMode)
+	if !common.ValidStorageMode(mode) {
+		logger.Fatal("invalid storage mode: ", storageMode)
+	}
+	server := adminStorageServer()
+	if err := client.SetMode(server, mode); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Info("storage server ", adminTarget, " switched to ", mode, " mode")
+}
+
+// handleAdminSyncRate shows or adjusts byte-rate limits of file synchronization of a storage server.
+//
+// Limits which are not provided by flags are kept.
+func handleAdminSyncRate() {
+	server := adminStorageServer()
+	if resetSyncRate {
+		rate, err := client.SyncRate(server, nil, true)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Info("sync rate of storage server ", adminTarget, " is reset:\n", formatSyncRate(rate))
+		return
+	}
+	rate, err := client.SyncRate(server, nil, false)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if len(syncRateFlags) == 0 {
+		logger.Info("sync rate of storage server ", adminTarget, ":\n", formatSyncRate(rate))
+		return
+	}
+	for _, name := range syncRateFlags {
+		switch name {
+		case "rate":
+			if rate.Rate, err = util.ParseByteRate(syncRate); err != nil {
+				logger.Fatal(err)
+			}
+		case "peer-rates":
+			if rate.Peers, err = util.ParseSyncPeerRates(strings.Split(syncPeerRates, ",")); err != nil {
+				logger.Fatal(err)
+			}
+		case "schedule":
+			if rate.Schedule, err = util.ParseSyncRateSchedule(strings.Split(syncRateSchedule, ",")); err != nil {
+				logger.Fatal(err)
+			}
+		}
+	}
+	if rate, err = client.SyncRate(server, rate, false); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Info("sync rate of storage server ", adminTarget, " is changed:\n", formatSyncRate(rate))
+}
+
+// handleAdminSyncStatus shows the synchronization state of groups aggregated by tracker servers,
+// or of the target storage server with its group members.
+func handleAdminSyncStatus() {
+	var status interface{}
+	var err error
+	if adminTarget != "" {
+		status, err = client.SyncStatus(adminStorageServer())
+	} else {
+		// initialize APIClient
+		if err := initClient(); err != nil {
+			logger.Fatal(err)
+		}
+		status, err = client.ClusterSyncStatus(nil, syncStatusGroup)
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+	bs, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	fmt.Println(string(bs))
+}
+
+func handleAdminReconcile() {
+	reports, err := client.Reconcile(adminStorageServer(), reconcilePeer, reconcileDryRun)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	bs, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	fmt.Println(string(bs))
+}
+
+// adminStorageServer returns the storage server managed by admin commands.
+//
+// The target can be an instance id synchronized from tracker servers
+// or the address of a storage server provided by "--storages".
+func adminStorageServer() *common.Server {
+	// initialize APIClient
+	if err := initClient(); err != nil {
+		logger.Fatal(err)
+	}
+	if ins := api.FilterInstanceByInstanceId(adminTarget); ins != nil && ins.Role == common.ROLE_STORAGE {
+		return &ins.Server
+	}
+	staticServers, err := util.ParseServers(storages)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	for _, s := range staticServers {
+		if s.ConnectionString() == adminTarget {
+			return s
+		}
+	}
+	logger.Fatal("storage server not found: ", adminTarget)
+	return nil
+}
+
+func formatSyncRate(rate *common.SyncRateDTO) string {
+	var buff strings.Builder
+	buff.WriteString("  rate: " + util.FormatByteRate(rate.Rate) + "\n")
+	peers := make([]string, 0, len(rate.Peers))
+	for peer := range rate.Peers {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	for _, peer := range peers {
+		buff.WriteString("  peer " + peer + ": " + util.FormatByteRate(rate.Peers[peer]) + "\n")
+	}
+	for _, w := range rate.Schedule {
+		buff.WriteString("  schedule: " + util.FormatSyncRateWindow(w) + "\n")
+	}
+	return buff.String()
+}
+
+// handleListFiles lists files page by page by client cli.
+//
+// Files are listed from tracker servers by default,
+// if no tracker server is provided, the first storage server is used.
+func handleListFiles() {
+	var err error
+	if listQuery.StartTime, err = parseListTime(listFrom); err != nil {
+		logger.Fatal(err)
+	}
+	if listQuery.EndTime, err = parseListTime(listTo); err != nil {
+		logger.Fatal(err)
+	}
+	if listQuery.AccessMode != "" && listQuery.AccessMode != "private" && listQuery.AccessMode != "public" {
+		logger.Fatal("invalid access mode: ", listQuery.AccessMode)
+	}
+	// initialize APIClient
+	if err := initClient(); err != nil {
+		logger.Fatal(err)
+	}
+	trackerServers, _ := util.ParseServers(trackers)
+	staticServers, _ := util.ParseServers(storages)
+	var server *common.Server
+	if listServer != "" {
+		for _, s := range append(trackerServers, staticServers...) {
+			if s.ConnectionString() == listServer {
+				server = s
+				break
+			}
+		}
+		if server == nil {
+			logger.Fatal("server not found: ", listServer)
+		}
+	} else if len(trackerServers) == 0 && len(staticServers) > 0 {
+		server = staticServers[0]
+	}
+	for {
+		ret, err := client.List(server, &listQuery)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		for _, f := range ret.Files {
+			fmt.Printf("%s\t%s\t%d\t%s\t%s\t%s\n", f.FileId, f.Group, f.FileLength,
+				time.Unix(f.CreateTime, 0).Format("2006-01-02 15:04:05"),
+				f.InstanceId, gox.TValue(f.IsPrivate, "private", "public"))
+		}
+		listQuery.Cursor = ret.Cursor
+		if ret.Cursor == "" {
+			break
+		}
+		if !listAll {
+			fmt.Println("next cursor:", ret.Cursor)
+			break
+		}
+	}
+}
+
+// parseListTime parses time of list filters,
+// it can be a date, a date time or unix seconds.
+func parseListTime(t string) (int64, error) {
+	if t == "" {
+		return 0, nil
+	}
+	if ts, err := convert.StrToInt64(t); err == nil {
+		return ts, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if tm, err := time.ParseInLocation(layout, t, time.Local); err == nil {
+			return tm.Unix(), nil
+		}
+	}
+	return 0, errors.New("invalid time: " + t)
+}
+
+// handleBinlogTool runs offline binlog tools on the data dir of a stopped storage server.
+func handleBinlogTool(cmd common.Command) {
+	var secrets []string
+	if secret != "" {
+		secrets = strings.Split(secret, ",")
+	}
+	var err error
+	switch cmd {
+	case common.CMD_BINLOG_DUMP:
+		err = svc.DumpBinlogs(dataDir, secrets, binlogFileIndex, os.Stdout)
+	case common.CMD_BINLOG_STAT:
+		err = svc.StatBinlogs(dataDir, os.Stdout)
+	case common.CMD_BINLOG_REPAIR:
+		err = svc.RepairBinlogs(dataDir, os.Stdout)
+	case common.CMD_BINLOG_VERIFY:
+		var problems int
+		problems, err = svc.VerifyBinlogs(dataDir, secrets, os.Stdout)
+		if err == nil && problems > 0 {
+			fmt.Fprintln(os.Stderr, "binlog verification failed with", problems, "problems")
+			os.Exit(1)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
 // handleGenerateToken
 func handleGenerateToken() {
 	ts := convert.Int64ToStr(gox.GetTimestamp(time.Now().Add(time.Second * time.Duration(tokenLife))))
@@ -39,13 +39,43 @@ var (
 	disableHttp            bool
 	httpPort               int
 	enableMimetypes        bool
+	mimeTypesFile          string
+	enableHttpProbe        bool
+	webhooks               string // webhook urls of storage server
+	webhookSecret          string // secret for signing webhook requests
+	binlogFsync            string // binlog fsync policy: always, interval or none
+	feedKey                string // read-only key of the binlog feed
+	bootstrap              bool   // bootstrap a new group member from a peer in bulk
+	bootstrapWorkers       int    // parallel file downloads when bootstrapping
+	syncWorkers            int    // parallel file downloads of file synchronization
+	antiEntropyInterval    string // interval of anti-entropy between group members
+	antiEntropyDryRun      bool   // only report differences found by anti-entropy
+	drStorages             string // storage servers of the disaster recovery cluster
+	drSources              string // hosts of the source cluster allowed to import its secret
+	syncRate               string // byte rate limit of file synchronization
+	syncPeerRates          string // byte rate limits of file synchronization from single group members
+	syncRateSchedule       string // time of day windows replacing the sync rate
 	readOnly               bool
 	allowedDomains         string
 	logDir                 string
 	disableSaveLogfile     bool
 	tokenFileId            string
-	tokenLife              int    // token life(in seconds)
-	tokenFormat            string // token format: url or json
+	tokenLife              int      // token life(in seconds)
+	tokenFormat            string   // token format: url or json
+	balanceStrategy        string   // storage server balancing strategy of client
+	adminTarget            string   // instance id or address of the storage server to be managed
+	storageMode            string   // runtime mode of storage server: active, readonly or draining
+	syncRateFlags          []string // sync rate flags provided to admin sync-rate
+	resetSyncRate          bool     // reset sync rate limits to the configuration
+	syncStatusGroup        string   // group of admin sync-status
+	reconcilePeer          string   // group member of admin reconcile
+	reconcileDryRun        bool     // only report differences found by admin reconcile
+	listQuery              common.ListQueryDTO
+	listFrom               string // list files created after this time
+	listTo                 string // list files created before this time
+	listServer             string // list files from a specific tracker or storage server
+	listAll                bool   // list all pages
+	binlogFileIndex        int    // binlog file to be dumped, -1 means all
 	finalCommand           common.Command
 )
 
@@ -80,6 +110,7 @@ func ConfigAssembly(bm common.BootMode) interface{} {
 		}
 		c.DataDir = dataDir
 		c.TmpDir = dataDir + "/tmp"
+		c.PartialDir = dataDir + "/partial"
 
 		if advertisePort == 0 {
 			advertisePort = c.Port
@@ -97,6 +128,31 @@ func ConfigAssembly(bm common.BootMode) interface{} {
 		}
 		c.BindAddress = bindAddress
 		c.EnableMimeTypes = enableMimetypes
+		c.MimeTypesFile = mimeTypesFile
+		c.WebhookSecret = webhookSecret
+		c.BinlogFsync = binlogFsync
+		c.FeedKey = feedKey
+		c.Bootstrap = bootstrap
+		c.BootstrapWorkers = bootstrapWorkers
+		c.SyncWorkers = syncWorkers
+		c.AntiEntropyInterval = antiEntropyInterval
+		c.AntiEntropyDryRun = antiEntropyDryRun
+		if drStorages != "" {
+			c.DrStorages = strings.Split(drStorages, ",")
+		}
+		if drSources != "" {
+			c.DrSources = strings.Split(drSources, ",")
+		}
+		c.SyncRate = syncRate
+		if syncPeerRates != "" {
+			c.SyncPeerRates = strings.Split(syncPeerRates, ",")
+		}
+		if syncRateSchedule != "" {
+			c.SyncRateSchedule = strings.Split(syncRateSchedule, ",")
+		}
+		if webhooks != "" {
+			c.Webhooks = strings.Split(webhooks, ",")
+		}
 		c.EnableHttp = !disableHttp
 
 		if trackers != "" {
@@ -144,6 +200,8 @@ func ConfigAssembly(bm common.BootMode) interface{} {
 		}
 		c.BindAddress = bindAddress
 		c.EnableHttp = !disableHttp
+		c.EnableHttpProbe = enableHttpProbe
+		c.FeedKey = feedKey
 
 		if trackers != "" {
 			c.Trackers = strings.Split(trackers, ",")
@@ -3,6 +3,7 @@ package common
 import (
 	"errors"
 	"regexp"
+	"sync"
 	"time"
 )
 
@@ -26,6 +27,12 @@ const (
 	DEFAULT_TRACKER_HTTP_PORT = 12222
 	BUFFER_SIZE               = 1 << 15 // 32k
 	DEFAULT_GROUP             = "G01"
+	DEFAULT_BOOTSTRAP_WORKERS = 8 // parallel file downloads when bootstrapping
+	MAX_BOOTSTRAP_WORKERS     = 64
+	DEFAULT_SYNC_WORKERS      = 4 // parallel file downloads of file synchronization
+	MAX_SYNC_WORKERS          = 64
+	ANTI_ENTROPY_BUCKETS      = 4096 // buckets of anti-entropy summaries, bucketed by md5 of fileId
+	DEFAULT_ANTI_ENTROPY      = "6h" // interval of anti-entropy between group members
 	//
 	OPERATION_RESPONSE       Operation = 0
 	OPERATION_CONNECT        Operation = 1
@@ -35,6 +42,18 @@ const (
 	OPERATION_SYNC_INSTANCES Operation = 5
 	OPERATION_PUSH_BINLOGS   Operation = 6
 	OPERATION_SYNC_BINLOGS   Operation = 7
+	OPERATION_LOCATE         Operation = 8
+	OPERATION_PING           Operation = 9
+	OPERATION_SET_MODE       Operation = 10
+	OPERATION_ALLOCATE       Operation = 11
+	OPERATION_SUBSCRIBE      Operation = 12
+	OPERATION_LIST           Operation = 13
+	OPERATION_SYNC_RATE      Operation = 14
+	OPERATION_SYNC_STATUS    Operation = 15
+	OPERATION_ANTI_ENTROPY   Operation = 16
+	OPERATION_RECONCILE      Operation = 17
+	OPERATION_IMPORT         Operation = 18
+	OPERATION_FILE_META      Operation = 19
 	//
 	SUCCESS           OperationResult = 0
 	ERROR             OperationResult = 1
@@ -42,17 +61,26 @@ const (
 	NOT_FOUND         OperationResult = 3
 	UNKNOWN_OPERATION OperationResult = 4
 	//
-	CMD_SHOW_HELP      Command = 0
-	CMD_SHOW_VERSION   Command = 1
-	CMD_UPDATE_CONFIG  Command = 2
-	CMD_SHOW_CONFIG    Command = 3
-	CMD_UPLOAD_FILE    Command = 4
-	CMD_DOWNLOAD_FILE  Command = 5
-	CMD_INSPECT_FILE   Command = 6
-	CMD_BOOT_TRACKER   Command = 7
-	CMD_BOOT_STORAGE   Command = 8
-	CMD_TEST_UPLOAD    Command = 9
-	CMD_GENERATE_TOKEN Command = 10
+	CMD_SHOW_HELP         Command = 0
+	CMD_SHOW_VERSION      Command = 1
+	CMD_UPDATE_CONFIG     Command = 2
+	CMD_SHOW_CONFIG       Command = 3
+	CMD_UPLOAD_FILE       Command = 4
+	CMD_DOWNLOAD_FILE     Command = 5
+	CMD_INSPECT_FILE      Command = 6
+	CMD_BOOT_TRACKER      Command = 7
+	CMD_BOOT_STORAGE      Command = 8
+	CMD_TEST_UPLOAD       Command = 9
+	CMD_GENERATE_TOKEN    Command = 10
+	CMD_ADMIN_DRAIN       Command = 11
+	CMD_LIST_FILES        Command = 12
+	CMD_BINLOG_DUMP       Command = 13
+	CMD_BINLOG_VERIFY     Command = 14
+	CMD_BINLOG_STAT       Command = 15
+	CMD_BINLOG_REPAIR     Command = 16
+	CMD_ADMIN_SYNC_RATE   Command = 17
+	CMD_ADMIN_SYNC_STATUS Command = 18
+	CMD_ADMIN_RECONCILE   Command = 19
 	//
 	ROLE_TRACKER Role = 1
 	ROLE_STORAGE Role = 2
@@ -60,17 +88,50 @@ const (
 	ROLE_CLIENT  Role = 4
 	ROLE_ANY     Role = 5
 	//
-	REGISTER_HOLD RegisterState = 1
-	REGISTER_FREE RegisterState = 2
+	REGISTER_HOLD  RegisterState = 1
+	REGISTER_FREE  RegisterState = 2
+	REGISTER_STALE RegisterState = 3 // restored from disk and not verified yet
 	//
-	REGISTER_INTERVAL    = time.Second * 30
-	SYNCHRONIZE_INTERVAL = time.Second * 45
+	HEALTH_UNKNOWN     HealthState = 0
+	HEALTH_HEALTHY     HealthState = 1
+	HEALTH_DEGRADED    HealthState = 2 // alive but cannot write files or serve http
+	HEALTH_UNREACHABLE HealthState = 3
+	HEALTH_DRAINING    HealthState = 4 // no new uploads, downloads are still served
+	//
+	INSTANCE_ADDED   InstanceEventType = 1
+	INSTANCE_REMOVED InstanceEventType = 2
+	INSTANCE_CHANGED InstanceEventType = 3 // state, health or mode changed
+	//
+	STORAGE_MODE_ACTIVE   StorageMode = "active"
+	STORAGE_MODE_READONLY StorageMode = "readonly"
+	STORAGE_MODE_DRAINING StorageMode = "draining" // no new uploads, in-flight uploads and downloads continue
+	//
+	REGISTER_INTERVAL     = time.Second * 30
+	SYNCHRONIZE_INTERVAL  = time.Second * 45
+	HEALTH_CHECK_INTERVAL = time.Second * 10
+	SUBSCRIBE_HEARTBEAT   = time.Second * 5
 
 	FILE_ID_SIZE = 86
 
 	BUCKET_KEY_CONFIGMAP         = "configMap"
 	BUCKET_KEY_FAILED_BINLOG_POS = "failedBinlogPos"
 	BUCKET_KEY_FILEID            = "fileIds"
+	BUCKET_KEY_FILE_META         = "fileMeta"
+	BUCKET_KEY_INSTANCES         = "instances"
+	BUCKET_KEY_FILE_LOCATIONS    = "fileLocations"
+	BUCKET_KEY_CONTENT_LOCATIONS = "contentLocations"
+	BUCKET_KEY_WEBHOOK_OUTBOX    = "webhookOutbox"
+	BUCKET_KEY_PEER_REPLICAS     = "peerReplicas"
+	BUCKET_KEY_DR_RETRY          = "drRetry"
+	//
+	WEBHOOK_FILE_UPLOADED   = "file.uploaded"
+	WEBHOOK_FILE_REPLICATED = "file.replicated"
+	WEBHOOK_FILE_DELETED    = "file.deleted" // reserved, never fired since storage servers cannot delete files
+	//
+	BINLOG_FSYNC_ALWAYS   = "always"   // fsync after every binlog write
+	BINLOG_FSYNC_INTERVAL = "interval" // fsync dirty binlog file every BINLOG_FSYNC_PERIOD
+	BINLOG_FSYNC_NONE     = "none"     // leave it to the operating system
+	BINLOG_FSYNC_PERIOD   = time.Second
 )
 
 var (
@@ -84,6 +145,9 @@ var (
 	BootAs                          BootMode
 	configMap                       *ConfigMap
 	CusterSecret                    = make(map[string]string)
+	storageMode                     = STORAGE_MODE_ACTIVE
+	storageModeLock                 = new(sync.Mutex)
+	historySecretsLock              = new(sync.Mutex)
 )
 
 func SetConfigMap(config *ConfigMap) {
@@ -94,6 +158,40 @@ func GetConfigMap() *ConfigMap {
 	return configMap
 }
 
+// SetStorageMode switches the runtime mode of this storage server.
+func SetStorageMode(mode StorageMode) {
+	storageModeLock.Lock()
+	defer storageModeLock.Unlock()
+	storageMode = mode
+}
+
+// GetStorageMode returns the runtime mode of this storage server.
+func GetStorageMode() StorageMode {
+	storageModeLock.Lock()
+	defer storageModeLock.Unlock()
+	return storageMode
+}
+
+// SetHistorySecrets replaces the history secrets of this storage server,
+// secrets imported at runtime are registered to tracker servers with them.
+func SetHistorySecrets(secrets map[string]string) {
+	historySecretsLock.Lock()
+	defer historySecretsLock.Unlock()
+	InitializedStorageConfiguration.HistorySecrets = secrets
+}
+
+// GetHistorySecrets returns the history secrets of this storage server, the map must not be modified.
+func GetHistorySecrets() map[string]string {
+	historySecretsLock.Lock()
+	defer historySecretsLock.Unlock()
+	return InitializedStorageConfiguration.HistorySecrets
+}
+
+// ValidStorageMode judges whether the mode is a known storage mode.
+func ValidStorageMode(mode StorageMode) bool {
+	return mode == STORAGE_MODE_ACTIVE || mode == STORAGE_MODE_READONLY || mode == STORAGE_MODE_DRAINING
+}
+
 func AddSecret(instanceId string, secret ...string) {
 	if secret == nil {
 		return
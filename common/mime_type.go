@@ -1,6 +1,8 @@
 package common
 
 import (
+	"bufio"
+	"os"
 	"strings"
 )
 
@@ -121,6 +123,44 @@ func GetMimeType(ext string) string {
 	return format
 }
 
+// LookupMimeType gets mime type by file ext,
+// the second return value reports whether the ext is known.
+func LookupMimeType(ext string) (string, bool) {
+	format := mimeTypes[strings.ToLower(strings.TrimLeft(ext, "."))]
+	return format, format != ""
+}
+
 func AddWebMimeType(ext string, mimetype string) {
 	mimeTypes[ext] = mimetype
 }
+
+// LoadMimeTypes extends the mime table from a file in the format of '/etc/mime.types':
+//
+//	# comment
+//	image/webp    webp
+//	text/x-go     go golang
+//
+// Entries in the file override the builtin ones.
+func LoadMimeTypes(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			AddWebMimeType(strings.ToLower(strings.TrimLeft(ext, ".")), fields[0])
+		}
+	}
+	return scanner.Err()
+}
@@ -1,6 +1,8 @@
 package common
 
 import (
+	"bytes"
+	"encoding/binary"
 	"github.com/boltdb/bolt"
 	"github.com/hetianyi/gox/convert"
 	"github.com/hetianyi/gox/logger"
@@ -16,6 +18,9 @@ type OperationResult byte
 type BootMode uint32
 type Role byte
 type RegisterState byte
+type HealthState byte
+type StorageMode string
+type InstanceEventType byte
 
 type StorageConfig struct {
 	Trackers              []string `json:"trackers"`
@@ -35,13 +40,32 @@ type StorageConfig struct {
 	EnableHttp            bool     `json:"enableHttp"`
 	HttpPort              int      `json:"httpPort"`
 	EnableMimeTypes       bool     `json:"enableMimeTypes"`
+	MimeTypesFile         string   `json:"mimeTypesFile"`
 	Readonly              bool     `json:"readonly"`
 	PublicAccessMode      bool     `json:"publicAccessMode"`
 	AllowedDomains        []string `json:"allowedDomains"`
+	Webhooks              []string `json:"webhooks"`
+	WebhookSecret         string   `json:"webhookSecret"`
+	BinlogFsync           string   `json:"binlogFsync"`
+	FeedKey               string   `json:"feedKey"`
+	Bootstrap             bool     `json:"bootstrap"`
+	BootstrapWorkers      int      `json:"bootstrapWorkers"`
+	SyncWorkers           int      `json:"syncWorkers"`
+	AntiEntropyInterval   string   `json:"antiEntropyInterval"`
+	AntiEntropyDryRun     bool     `json:"antiEntropyDryRun"`
+	DrStorages            []string `json:"drStorages"`
+	DrSources             []string `json:"drSources"`
+	SyncRate              string   `json:"syncRate"`
+	SyncPeerRates         []string `json:"syncPeerRates"`
+	SyncRateSchedule      []string `json:"syncRateSchedule"`
 	InstanceId            string
 	HistorySecrets        map[string]string
 	TmpDir                string
+	PartialDir            string // partial replicas kept across restarts
 	ParsedTrackers        []Server
+	ParsedDrStorages      []Server
+	ParsedSyncRate        SyncRateDTO
+	ParsedAntiEntropy     time.Duration
 }
 
 type TrackerConfig struct {
@@ -61,6 +85,8 @@ type TrackerConfig struct {
 	LogRotationInterval   string `json:"logRotationInterval"`
 	EnableHttp            bool   `json:"enableHttp"`
 	HttpPort              int    `json:"httpPort"`
+	EnableHttpProbe       bool   `json:"enableHttpProbe"`
+	FeedKey               string `json:"feedKey"`
 	HistorySecrets        map[string]string
 	ParsedTrackers        []Server
 }
@@ -139,6 +165,114 @@ type Instance struct {
 	Attributes   map[string]string `json:"ats"`
 	RegisterTime int64             `json:"ts"`
 	State        RegisterState     `json:"state"`
+	Health       HealthState       `json:"health"`
+	Load         *LoadInfo         `json:"load"`
+}
+
+// InstanceEvent is pushed to the subscribers of tracker server when an instance changes.
+type InstanceEvent struct {
+	Type     InstanceEventType `json:"type"`
+	Instance *Instance         `json:"instance"`
+}
+
+// ListQueryDTO is the query of file listing.
+type ListQueryDTO struct {
+	Group      string `json:"group"`
+	Cursor     string `json:"cursor"` // empty cursor means the first page
+	Limit      int    `json:"limit"`
+	Source     string `json:"source"`     // instanceId which the files were uploaded to
+	StartTime  int64  `json:"startTime"`  // unix seconds, 0 means unlimited
+	EndTime    int64  `json:"endTime"`    // unix seconds, 0 means unlimited
+	MinSize    int64  `json:"minSize"`    // bytes
+	MaxSize    int64  `json:"maxSize"`    // bytes, 0 means unlimited
+	AccessMode string `json:"accessMode"` // private, public or empty for both
+}
+
+// Match judges whether the file matches the query.
+func (q *ListQueryDTO) Match(info *FileInfo) bool {
+	if q.Group != "" && info.Group != q.Group {
+		return false
+	}
+	if q.Source != "" && info.InstanceId != q.Source {
+		return false
+	}
+	if (q.StartTime > 0 && info.CreateTime < q.StartTime) || (q.EndTime > 0 && info.CreateTime > q.EndTime) {
+		return false
+	}
+	if info.FileLength < q.MinSize || (q.MaxSize > 0 && info.FileLength > q.MaxSize) {
+		return false
+	}
+	if (q.AccessMode == "private" && !info.IsPrivate) || (q.AccessMode == "public" && info.IsPrivate) {
+		return false
+	}
+	return true
+}
+
+// ListItemDTO is a file in the listing result.
+type ListItemDTO struct {
+	FileId string `json:"fileId"`
+	FileInfo
+}
+
+// ListResultDTO is a page of file listing.
+type ListResultDTO struct {
+	Files  []*ListItemDTO `json:"files"`
+	Cursor string         `json:"cursor"` // cursor of the next page, empty if there is no more file
+}
+
+// WebhookEvent is the payload posted to webhooks.
+type WebhookEvent struct {
+	Id         string            `json:"id"`
+	Event      string            `json:"event"`
+	FileId     string            `json:"fileId"`
+	Group      string            `json:"group"`
+	Instance   string            `json:"instance"`
+	Source     string            `json:"source,omitempty"` // source instance of replicated files
+	Size       int64             `json:"size"`
+	Md5        string            `json:"md5"`
+	Meta       map[string]string `json:"meta,omitempty"`
+	CreateTime int64             `json:"createTime"`
+}
+
+// WebhookDelivery is a webhook request waiting in the outbox.
+type WebhookDelivery struct {
+	Key        uint64 `json:"-"`
+	Url        string `json:"url"`
+	Event      string `json:"event"`
+	EventId    string `json:"eventId"`
+	FileId     string `json:"fileId"`
+	Payload    string `json:"payload"`
+	Attempts   int    `json:"attempts"`
+	Pending    bool   `json:"pending,omitempty"` // the file of the event is not committed yet
+	CreateTime int64  `json:"createTime"`        // unix nano
+	NextTime   int64  `json:"nextTime"`          // unix nano
+}
+
+// LoadInfo is the live load of a storage server reported to tracker servers.
+type LoadInfo struct {
+	Connections int   `json:"conns"`      // active tcp connections
+	Uploads     int   `json:"uploads"`    // in-flight uploads
+	Throughput  int64 `json:"throughput"` // transferred bytes per second within the last minute
+	FreeDisk    int64 `json:"free"`       // free bytes of data dir
+	TotalDisk   int64 `json:"total"`      // total bytes of data dir
+}
+
+// Score evaluates the load of a storage server, smaller is better.
+//
+// Unknown load is treated as idle.
+func (l *LoadInfo) Score() float64 {
+	if l == nil {
+		return 0
+	}
+	score := float64(l.Connections) + float64(l.Uploads)*4 + float64(l.Throughput)/(1<<20)
+	// punish the servers running out of disk space.
+	if l.TotalDisk > 0 {
+		used := 1 - float64(l.FreeDisk)/float64(l.TotalDisk)
+		if used > 0.9 {
+			score += (used - 0.9) * 1000
+		}
+	}
+	return score
 }
 
 type InstanceMap struct {
@@ -157,6 +291,12 @@ type BingLogDTO struct {
 	FileId         string
 }
 
+// ReplicaDTO reports that an instance holds a replica of the file.
+type ReplicaDTO struct {
+	FileId     string `json:"fileId"`
+	InstanceId string `json:"instance"`
+}
+
 // FileId is a file
 type FileId struct {
 	FileId     string
@@ -165,15 +305,169 @@ type FileId struct {
 }
 
 // BinlogQueryDTO is the binlog query entity between storage servers.
+//
+// Instance selects the binlog journal of a source instance on tracker servers.
 type BinlogQueryDTO struct {
-	FileIndex int   `json:"fileIndex"`
-	Offset    int64 `json:"offset"`
+	FileIndex int    `json:"fileIndex"`
+	Offset    int64  `json:"offset"`
+	Instance  string `json:"instance,omitempty"`
 }
 
 // BinlogQueryResultDTO is the binlog query result entity between storage servers.
+//
+// Journals lists the source instances journaled by a tracker server,
+// it is returned when the query has no instance.
 type BinlogQueryResultDTO struct {
 	BinlogQueryDTO
-	Logs []BingLogDTO `json:"logs"`
+	Logs     []BingLogDTO `json:"logs"`
+	Journals []string     `json:"journals,omitempty"`
+}
+
+// FeedEventDTO is an event of the binlog feed.
+//
+// Cursor is the position right after the event, a feed resumed from it
+// starts with the next event. File is absent if the fileId cannot be decoded.
+type FeedEventDTO struct {
+	Cursor         BinlogQueryDTO `json:"cursor"`
+	FileId         string         `json:"fileId"`
+	SourceInstance string         `json:"sourceInstance"`
+	Length         int64          `json:"length"`
+	File           *FileInfo      `json:"file,omitempty"`
+}
+
+// FeedResultDTO is a page of the binlog feed, Cursor is where the next page starts.
+type FeedResultDTO struct {
+	Events []*FeedEventDTO `json:"events"`
+	Cursor BinlogQueryDTO  `json:"cursor"`
+}
+
+// BinlogLagDTO is how far a binlog position is behind the latest binlog of a storage server.
+//
+// Oldest is the create time of the first binlog after the position, 0 if there is none.
+type BinlogLagDTO struct {
+	Head   BinlogQueryDTO `json:"head"`
+	Gap    int64          `json:"gap"`
+	Oldest int64          `json:"oldest"`
+}
+
+// PeerSyncStatusDTO is the synchronization state of a storage server with a group member.
+//
+// Gap is the binlogs of the member not synchronized yet, it is -1 if the member is unreachable.
+// Pending and Failed are files from the member not downloaded yet or failed to download.
+// OldestUnsyncedAge is the age in seconds of the oldest binlog or file not synchronized yet.
+// Rejected is the replicas from the member rejected by length or md5 verification since startup.
+type PeerSyncStatusDTO struct {
+	InstanceId        string          `json:"instanceId"`
+	Position          BinlogQueryDTO  `json:"position"`
+	Head              *BinlogQueryDTO `json:"head,omitempty"`
+	Gap               int64           `json:"gap"`
+	Pending           int64           `json:"pending"`
+	Failed            int64           `json:"failed"`
+	Rejected          int64           `json:"rejected"`
+	OldestUnsyncedAge int64           `json:"oldestUnsyncedAge"`
+	InSync            bool            `json:"inSync"`
+	Error             string          `json:"error,omitempty"`
+}
+
+// SyncStatusDTO is the synchronization state of a storage server.
+//
+// Download is the position of file synchronization in the local binlog.
+// Estimated is true if pending files of peers are counted from part of the local binlog.
+type SyncStatusDTO struct {
+	InstanceId string               `json:"instanceId"`
+	Group      string               `json:"group"`
+	Head       BinlogQueryDTO       `json:"head"`
+	Download   BinlogQueryDTO       `json:"download"`
+	Pending    int64                `json:"pending"`
+	Failed     int64                `json:"failed"`
+	Rejected   int64                `json:"rejected"`
+	Estimated  bool                 `json:"estimated,omitempty"`
+	InSync     bool                 `json:"inSync"`
+	Peers      []*PeerSyncStatusDTO `json:"peers"`
+	DrLink     *DrLinkStatusDTO     `json:"drLink,omitempty"`
+	Time       int64                `json:"time"`
+}
+
+// DrLinkStatusDTO is the state of the replication link of a storage server to a disaster recovery cluster.
+//
+// Position is where the link is in the local binlog, Gap is the binlogs not pushed yet
+// and OldestUnsyncedAge is the age in seconds of the oldest of them.
+// Skipped is the files given up after failing too many times since startup.
+type DrLinkStatusDTO struct {
+	Targets           []string       `json:"targets"`
+	Position          BinlogQueryDTO `json:"position"`
+	Gap               int64          `json:"gap"`
+	OldestUnsyncedAge int64          `json:"oldestUnsyncedAge"`
+	Pushed            int64          `json:"pushed"`
+	Skipped           int64          `json:"skipped"`
+	LastPush          int64          `json:"lastPush,omitempty"`
+	Error             string         `json:"error,omitempty"`
+}
+
+// GroupSyncStatusDTO is the synchronization state of a group aggregated by tracker servers.
+type GroupSyncStatusDTO struct {
+	Group             string           `json:"group"`
+	InSync            bool             `json:"inSync"`
+	MaxGap            int64            `json:"maxGap"`
+	Pending           int64            `json:"pending"`
+	Failed            int64            `json:"failed"`
+	Rejected          int64            `json:"rejected"`
+	OldestUnsyncedAge int64            `json:"oldestUnsyncedAge"`
+	Members           []*SyncStatusDTO `json:"members"`
+	Unreachable       []string         `json:"unreachable,omitempty"`
+}
+
+// ClusterSyncStatusDTO is the synchronization state of all groups.
+type ClusterSyncStatusDTO struct {
+	Groups []*GroupSyncStatusDTO `json:"groups"`
+	Time   int64                 `json:"time"`
+}
+
+// AntiEntropyBucketDTO is the summary of files held by a storage server in a bucket,
+// Hash is the sum of hashes of the fileIds.
+type AntiEntropyBucketDTO struct {
+	Count uint64
+	Hash  uint64
+}
+
+// AntiEntropyReportDTO is the result of an anti-entropy round with a group member.
+//
+// Missing are files the member holds and this server lacks, PeerMissing are files this server
+// holds and the member lacks. Both lists are truncated, the counts are complete.
+// Truncated is true if more buckets differ than compared in a round.
+type AntiEntropyReportDTO struct {
+	InstanceId       string   `json:"instanceId"`
+	Peer             string   `json:"peer"`
+	DryRun           bool     `json:"dryRun"`
+	DiffBuckets      int      `json:"diffBuckets"`
+	ComparedBuckets  int      `json:"comparedBuckets"`
+	Truncated        bool     `json:"truncated,omitempty"`
+	MissingCount     int      `json:"missingCount"`
+	Missing          []string `json:"missing"`
+	PeerMissingCount int      `json:"peerMissingCount"`
+	PeerMissing      []string `json:"peerMissing"`
+	Repaired         int      `json:"repaired"`
+	Failed           int      `json:"failed"`
+	Time             int64    `json:"time"`
+}
+
+// SyncRateDTO is the byte-rate limits of file synchronization from group members,
+// rates are bytes per second and 0 is unlimited.
+//
+// Peers limits the synchronization from a single group member by its instanceId,
+// the window of Schedule covering the current time of day replaces Rate.
+type SyncRateDTO struct {
+	Rate     int64            `json:"rate"`
+	Peers    map[string]int64 `json:"peers,omitempty"`
+	Schedule []SyncRateWindow `json:"schedule,omitempty"`
+}
+
+// SyncRateWindow is a time of day window of the sync rate schedule,
+// From and To are minutes since midnight, the window ends the next day if To is before From.
+type SyncRateWindow struct {
+	From int   `json:"from"`
+	To   int   `json:"to"`
+	Rate int64 `json:"rate"`
 }
 
 type ConfigMap struct {
@@ -201,6 +495,36 @@ func NewConfigMap(path string) (*ConfigMap, error) {
 			if e != nil {
 				return nil
 			}
+			_, e = tx.CreateBucketIfNotExists([]byte(BUCKET_KEY_INSTANCES))
+			if e != nil {
+				return e
+			}
+			_, e = tx.CreateBucketIfNotExists([]byte(BUCKET_KEY_FILE_LOCATIONS))
+			if e != nil {
+				return e
+			}
+			_, e = tx.CreateBucketIfNotExists([]byte(BUCKET_KEY_CONTENT_LOCATIONS))
+			if e != nil {
+				return e
+			}
+			_, e = tx.CreateBucketIfNotExists([]byte(BUCKET_KEY_PEER_REPLICAS))
+			if e != nil {
+				return e
+			}
+		}
+		if BootAs == BOOT_STORAGE {
+			_, e = tx.CreateBucketIfNotExists([]byte(BUCKET_KEY_FILE_META))
+			if e != nil {
+				return e
+			}
+			_, e = tx.CreateBucketIfNotExists([]byte(BUCKET_KEY_WEBHOOK_OUTBOX))
+			if e != nil {
+				return e
+			}
+			_, e = tx.CreateBucketIfNotExists([]byte(BUCKET_KEY_DR_RETRY))
+			if e != nil {
+				return e
+			}
 		}
 		return e
 	})
@@ -236,9 +560,22 @@ func (c *ConfigMap) PutConfig(key string, value []byte) error {
 	})
 }
 
+// OpenConfigMapReadOnly opens the config map of a stopped instance,
+// it fails after the timeout if the instance is still running.
+func OpenConfigMapReadOnly(path string, timeout time.Duration) (*ConfigMap, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	return &ConfigMap{db: db}, nil
+}
+
 func (c *ConfigMap) GetConfig(key string) (ret []byte, err error) {
 	err = c.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BUCKET_KEY_CONFIGMAP))
+		if b == nil {
+			return nil
+		}
 		ret = b.Get([]byte(key))
 		return nil
 	})
@@ -265,6 +602,34 @@ func (c *ConfigMap) PutFile(binlogs []BingLogDTO) error {
 	})
 }
 
+// IterateFiles iterates fileIds and file sizes saved by PutFile in the order of fileId,
+// it starts from the fileId next to after and stops when the iterator returns false.
+func (c *ConfigMap) IterateFiles(after string, iterator func(fileId string, size int64) bool) error {
+	return c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_KEY_FILEID))
+		if b == nil {
+			return nil
+		}
+		cur := b.Cursor()
+		var k, v []byte
+		if after == "" {
+			k, v = cur.First()
+		} else {
+			k, v = cur.Seek([]byte(after))
+			if k != nil && string(k) == after {
+				k, v = cur.Next()
+			}
+		}
+		for ; k != nil; k, v = cur.Next() {
+			size, _ := convert.StrToInt64(string(v))
+			if !iterator(string(k), size) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
 func (c *ConfigMap) GetFile(key string) (ret []byte, err error) {
 	err = c.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BUCKET_KEY_FILEID))
@@ -274,6 +639,391 @@ func (c *ConfigMap) GetFile(key string) (ret []byte, err error) {
 	return
 }
 
+// PutFileMeta saves metadata of a file, such as the original file name and content type.
+func (c *ConfigMap) PutFileMeta(fileId string, meta map[string]string) error {
+	configMapLock.Lock()
+	defer func() {
+		configMapLock.Unlock()
+		if err := recover(); err != nil {
+			logger.Error("error performing action PutFileMeta: ", err)
+		}
+	}()
+
+	bs, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return c.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_KEY_FILE_META)).Put([]byte(fileId), bs)
+	})
+}
+
+// GetFileMeta gets metadata of a file, it returns nil if the file has no metadata.
+func (c *ConfigMap) GetFileMeta(fileId string) (meta map[string]string, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_KEY_FILE_META))
+		if b == nil {
+			return nil
+		}
+		bs := b.Get([]byte(fileId))
+		if bs == nil {
+			return nil
+		}
+		return json.Unmarshal(bs, &meta)
+	})
+	return
+}
+
+// AddFileLocations adds instances which hold the files,
+// the key of the map is fileId and the value is instanceIds.
+func (c *ConfigMap) AddFileLocations(locations map[string][]string) error {
+	return c.addLocations(BUCKET_KEY_FILE_LOCATIONS, locations)
+}
+
+// GetFileLocations returns instanceIds of the storage servers which hold the file.
+func (c *ConfigMap) GetFileLocations(fileId string) ([]string, error) {
+	return c.getLocations(BUCKET_KEY_FILE_LOCATIONS, fileId)
+}
+
+// AddContentLocations adds instances which hold the file contents,
+// the key of the map is md5 of the file and the value is instanceIds.
+func (c *ConfigMap) AddContentLocations(locations map[string][]string) error {
+	return c.addLocations(BUCKET_KEY_CONTENT_LOCATIONS, locations)
+}
+
+// GetContentLocations returns instanceIds of the storage servers which hold the file content.
+func (c *ConfigMap) GetContentLocations(md5 string) ([]string, error) {
+	return c.getLocations(BUCKET_KEY_CONTENT_LOCATIONS, md5)
+}
+
+// addLocations merges comma separated instanceIds of the keys in the bucket.
+func (c *ConfigMap) addLocations(bucket string, locations map[string][]string) error {
+	configMapLock.Lock()
+	defer func() {
+		configMapLock.Unlock()
+		if err := recover(); err != nil {
+			logger.Error("error performing action addLocations: ", err)
+		}
+	}()
+
+	return c.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		for key, instances := range locations {
+			old := b.Get([]byte(key))
+			merged := string(old)
+			for _, ins := range instances {
+				if ins == "" || containsLocation(merged, ins) {
+					continue
+				}
+				if merged != "" {
+					merged += ","
+				}
+				merged += ins
+			}
+			if merged == string(old) {
+				continue
+			}
+			if err := b.Put([]byte(key), []byte(merged)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// containsLocation checks if the comma separated instanceIds contain the instance.
+func containsLocation(locations string, instanceId string) bool {
+	for _, ins := range strings.Split(locations, ",") {
+		if ins == instanceId {
+			return true
+		}
+	}
+	return false
+}
+
+// getLocations returns instanceIds of the key in the bucket.
+func (c *ConfigMap) getLocations(bucket string, key string) (ret []string, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(key))
+		if len(v) > 0 {
+			ret = strings.Split(string(v), ",")
+		}
+		return nil
+	})
+	return
+}
+
+// PutPeerReplicas saves replicas waiting to be replicated to the peer tracker servers.
+func (c *ConfigMap) PutPeerReplicas(peers []string, replicas []ReplicaDTO) error {
+	return c.BatchUpdate(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_KEY_PEER_REPLICAS))
+		for _, peer := range peers {
+			for i := range replicas {
+				if err := b.Put(peerReplicaKey(peer, &replicas[i]), []byte{1}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// GetPeerReplicas returns at most limit replicas waiting to be replicated to the peer tracker server.
+func (c *ConfigMap) GetPeerReplicas(peer string, limit int) (ret []ReplicaDTO, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_KEY_PEER_REPLICAS))
+		if b == nil {
+			return nil
+		}
+		prefix := []byte(peer + "\x00")
+		cur := b.Cursor()
+		for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && len(ret) < limit; k, _ = cur.Next() {
+			parts := strings.Split(string(k[len(prefix):]), "\x00")
+			if len(parts) != 2 {
+				continue
+			}
+			ret = append(ret, ReplicaDTO{FileId: parts[0], InstanceId: parts[1]})
+		}
+		return nil
+	})
+	return
+}
+
+// RemovePeerReplicas removes replicas which are replicated to the peer tracker server.
+func (c *ConfigMap) RemovePeerReplicas(peer string, replicas []ReplicaDTO) error {
+	return c.BatchUpdate(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_KEY_PEER_REPLICAS))
+		for i := range replicas {
+			if err := b.Delete(peerReplicaKey(peer, &replicas[i])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func peerReplicaKey(peer string, replica *ReplicaDTO) []byte {
+	return []byte(peer + "\x00" + replica.FileId + "\x00" + replica.InstanceId)
+}
+
+// PutDrRetry saves a binlog whose file is given up by the replication link to be retried later.
+func (c *ConfigMap) PutDrRetry(bl *BingLogDTO) error {
+	bs, err := json.Marshal(bl)
+	if err != nil {
+		return err
+	}
+	return c.BatchUpdate(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_KEY_DR_RETRY)).Put([]byte(bl.FileId), bs)
+	})
+}
+
+// GetDrRetries returns at most limit binlogs to be retried by the replication link
+// whose fileId is after the fileId "after", an empty "after" starts from the first one.
+func (c *ConfigMap) GetDrRetries(after string, limit int) (ret []BingLogDTO, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_KEY_DR_RETRY))
+		if b == nil {
+			return nil
+		}
+		cur := b.Cursor()
+		k, v := cur.First()
+		if after != "" {
+			k, v = cur.Seek([]byte(after))
+			if k != nil && string(k) == after {
+				k, v = cur.Next()
+			}
+		}
+		for ; k != nil && len(ret) < limit; k, v = cur.Next() {
+			bl := BingLogDTO{}
+			if err := json.Unmarshal(v, &bl); err != nil {
+				return err
+			}
+			ret = append(ret, bl)
+		}
+		return nil
+	})
+	return
+}
+
+// CountDrRetries returns the number of binlogs to be retried by the replication link.
+func (c *ConfigMap) CountDrRetries() (ret int, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(BUCKET_KEY_DR_RETRY)); b != nil {
+			ret = b.Stats().KeyN
+		}
+		return nil
+	})
+	return
+}
+
+// RemoveDrRetry removes a binlog which is retried successfully by the replication link.
+func (c *ConfigMap) RemoveDrRetry(fileId string) error {
+	return c.BatchUpdate(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_KEY_DR_RETRY)).Delete([]byte(fileId))
+	})
+}
+
+// PutWebhookDeliveries appends webhook deliveries to the outbox.
+//
+// The outbox is ordered by the next time of deliveries, so that due deliveries are found without a scan.
+func (c *ConfigMap) PutWebhookDeliveries(deliveries ...*WebhookDelivery) error {
+	configMapLock.Lock()
+	defer func() {
+		configMapLock.Unlock()
+		if err := recover(); err != nil {
+			logger.Error("error performing action PutWebhookDeliveries: ", err)
+		}
+	}()
+
+	return c.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_KEY_WEBHOOK_OUTBOX))
+		for _, d := range deliveries {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			d.Key = seq
+			bs, err := json.Marshal(d)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(outboxKey(d.NextTime, seq), bs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RescheduleWebhookDeliveries saves the retry state of webhook deliveries
+// and moves them to the next time.
+func (c *ConfigMap) RescheduleWebhookDeliveries(nextTime int64, deliveries ...*WebhookDelivery) error {
+	return c.BatchUpdate(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_KEY_WEBHOOK_OUTBOX))
+		for _, d := range deliveries {
+			if err := b.Delete(outboxKey(d.NextTime, d.Key)); err != nil {
+				return err
+			}
+			d.NextTime = nextTime
+			bs, err := json.Marshal(d)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(outboxKey(d.NextTime, d.Key), bs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveWebhookDelivery removes a webhook delivery from the outbox.
+func (c *ConfigMap) RemoveWebhookDelivery(delivery *WebhookDelivery) error {
+	return c.BatchUpdate(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_KEY_WEBHOOK_OUTBOX)).Delete(outboxKey(delivery.NextTime, delivery.Key))
+	})
+}
+
+// GetDueWebhookDeliveries returns at most limit webhook deliveries which are due at the time,
+// the earliest ones come first.
+func (c *ConfigMap) GetDueWebhookDeliveries(now int64, limit int) (ret []*WebhookDelivery, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_KEY_WEBHOOK_OUTBOX))
+		if b == nil {
+			return nil
+		}
+		cur := b.Cursor()
+		for k, v := cur.First(); k != nil && len(ret) < limit; k, v = cur.Next() {
+			if len(k) != 16 {
+				continue
+			}
+			if int64(binary.BigEndian.Uint64(k)) > now {
+				break
+			}
+			d := &WebhookDelivery{}
+			if err := json.Unmarshal(v, d); err != nil {
+				return err
+			}
+			d.Key = binary.BigEndian.Uint64(k[8:])
+			ret = append(ret, d)
+		}
+		return nil
+	})
+	return
+}
+
+// outboxKey converts the next time and sequence to bolt key which keeps the order.
+func outboxKey(nextTime int64, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(nextTime))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+// PutInstances saves registered instances.
+func (c *ConfigMap) PutInstances(instances ...*Instance) error {
+	configMapLock.Lock()
+	defer func() {
+		configMapLock.Unlock()
+		if err := recover(); err != nil {
+			logger.Error("error performing action PutInstances: ", err)
+		}
+	}()
+
+	return c.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_KEY_INSTANCES))
+		for _, ins := range instances {
+			bs, err := json.Marshal(ins)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(ins.InstanceId), bs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveInstance removes a saved instance.
+func (c *ConfigMap) RemoveInstance(instanceId string) error {
+	configMapLock.Lock()
+	defer func() {
+		configMapLock.Unlock()
+		if err := recover(); err != nil {
+			logger.Error("error performing action RemoveInstance: ", err)
+		}
+	}()
+
+	return c.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_KEY_INSTANCES)).Delete([]byte(instanceId))
+	})
+}
+
+// GetInstances loads all saved instances.
+func (c *ConfigMap) GetInstances() (map[string]*Instance, error) {
+	ret := make(map[string]*Instance)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_KEY_INSTANCES))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			ins := &Instance{}
+			if err := json.Unmarshal(v, ins); err != nil {
+				return err
+			}
+			ret[string(k)] = ins
+			return nil
+		})
+	})
+	return ret, err
+}
+
 func (c *ConfigMap) PutFailedBinlogPos(binlogPos *BinlogQueryDTO) error {
 	configMapLock.Lock()
 	defer func() {
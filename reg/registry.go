@@ -10,6 +10,7 @@ import (
 	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/godfs/util"
 	"github.com/hetianyi/gox"
+	"github.com/hetianyi/gox/convert"
 	"github.com/hetianyi/gox/logger"
 	"github.com/hetianyi/gox/timer"
 	"sync"
@@ -21,14 +22,110 @@ var (
 	instanceSet    = make(map[string]*common.Instance)
 	lock           = new(sync.Mutex)
 	ExpirationTime = time.Second * 30 // 30s
+	// StaleExpirationTime is how long the instances restored from disk
+	// wait for reconnecting after the registry is initialized.
+	StaleExpirationTime = common.REGISTER_INTERVAL * 2
+	initTime            time.Time
+	// subscribers of instance events.
+	subscribers     = make(map[int]chan *common.InstanceEvent)
+	subscriberIndex = 0
 )
 
-// InitRegistry starts a timer job for instance expiration detection
-// in a single goroutine.
+const subscriberBufferSize = 256
+
+// InitRegistry restores instances saved before and starts a timer job
+// for instance expiration detection in a single goroutine.
 func InitRegistry() {
+	restore()
 	go expirationDetection()
 }
 
+// restore loads instances saved by last running, the instances are marked as
+// REGISTER_STALE until they register again.
+func restore() {
+	lock.Lock()
+	defer lock.Unlock()
+
+	initTime = time.Now()
+	configMap := common.GetConfigMap()
+	if configMap == nil {
+		return
+	}
+	saved, err := configMap.GetInstances()
+	if err != nil {
+		logger.Error("error restore registered instances: ", err)
+		return
+	}
+	for k, ins := range saved {
+		ins.State = common.REGISTER_STALE
+		instanceSet[k] = ins
+		if ins.Role == common.ROLE_STORAGE {
+			util.StoreSecrets(ins.InstanceId, util.CollectMapKeys(ins.Server.HistorySecrets)...)
+		}
+	}
+	logger.Info("restored ", len(saved), " instances from disk")
+}
+
+// persist saves instances to disk, the saved RegisterTime is the last seen time of the instance.
+func persist(ins ...*common.Instance) {
+	configMap := common.GetConfigMap()
+	if configMap == nil || len(ins) == 0 {
+		return
+	}
+	if err := configMap.PutInstances(ins...); err != nil {
+		logger.Error("error save registered instances: ", err)
+	}
+}
+
+// unPersist removes the saved instance from disk.
+func unPersist(instanceId string) {
+	configMap := common.GetConfigMap()
+	if configMap == nil {
+		return
+	}
+	if err := configMap.RemoveInstance(instanceId); err != nil {
+		logger.Error("error remove saved instance: ", err)
+	}
+}
+
+// Subscribe subscribes instance events, the returned channel is closed
+// if the subscriber cannot keep up with the events.
+func Subscribe() (int, <-chan *common.InstanceEvent) {
+	lock.Lock()
+	defer lock.Unlock()
+	subscriberIndex++
+	ch := make(chan *common.InstanceEvent, subscriberBufferSize)
+	subscribers[subscriberIndex] = ch
+	return subscriberIndex, ch
+}
+
+// Unsubscribe removes the subscriber.
+func Unsubscribe(id int) {
+	lock.Lock()
+	defer lock.Unlock()
+	if ch := subscribers[id]; ch != nil {
+		delete(subscribers, id)
+		close(ch)
+	}
+}
+
+// publish sends an instance event to all subscribers, it must be called with lock held.
+func publish(eventType common.InstanceEventType, ins *common.Instance) {
+	event := &common.InstanceEvent{
+		Type:     eventType,
+		Instance: ins,
+	}
+	for id, ch := range subscribers {
+		select {
+		case ch <- event:
+		default:
+			logger.Warn("instance event subscriber is too slow, drop it")
+			delete(subscribers, id)
+			close(ch)
+		}
+	}
+}
+
 // Put registers a new Instance.
 //
 // It returns an error if the new Instance is conflict with the registered Instance,
@@ -44,10 +141,16 @@ func Put(ins *common.Instance) error {
 	logger.Debug("registered new instance: ", ins.InstanceId, "@", ins.Server.ConnectionString())
 	ins.State = common.REGISTER_HOLD
 	ins.RegisterTime = time.Now().UnixNano()
+	eventType := common.INSTANCE_CHANGED
+	if instanceSet[ins.InstanceId] == nil {
+		eventType = common.INSTANCE_ADDED
+	}
 	instanceSet[ins.InstanceId] = ins
 	if ins.Role == common.ROLE_STORAGE {
 		util.StoreSecrets(ins.InstanceId, util.CollectMapKeys(ins.Server.HistorySecrets)...)
 	}
+	persist(ins)
+	publish(eventType, ins)
 	return nil
 }
 
@@ -58,8 +161,13 @@ func Free(instanceId string) {
 	ins := instanceSet[instanceId]
 	if ins != nil {
 		logger.Debug("free instance: ", ins.InstanceId, "@", ins.Server.ConnectionString())
-		ins.RegisterTime = time.Now().UnixNano()
-		ins.State = common.REGISTER_FREE
+		// published instances are never modified.
+		cp := *ins
+		cp.RegisterTime = time.Now().UnixNano()
+		cp.State = common.REGISTER_FREE
+		instanceSet[instanceId] = &cp
+		persist(&cp)
+		publish(common.INSTANCE_CHANGED, &cp)
 	}
 }
 
@@ -69,6 +177,59 @@ func Remove(ins *common.Instance) {
 	defer lock.Unlock()
 	logger.Debug("deregister instance: ", ins.InstanceId, "@", ins.Server.ConnectionString())
 	delete(instanceSet, ins.InstanceId)
+	unPersist(ins.InstanceId)
+	publish(common.INSTANCE_REMOVED, ins)
+}
+
+// SetHealth updates the health state of a registered instance.
+//
+// The instance is replaced by a copy so that snapshots taken before stay unchanged.
+func SetHealth(instanceId string, health common.HealthState) {
+	lock.Lock()
+	defer lock.Unlock()
+	ins := instanceSet[instanceId]
+	if ins == nil || ins.Health == health {
+		return
+	}
+	logger.Debug("instance ", instanceId, "@", ins.Server.ConnectionString(), " health changed: ", ins.Health, " -> ", health)
+	cp := *ins
+	cp.Health = health
+	instanceSet[instanceId] = &cp
+	publish(common.INSTANCE_CHANGED, &cp)
+}
+
+// SetMode updates the runtime mode of a registered storage instance.
+func SetMode(instanceId string, mode common.StorageMode) {
+	lock.Lock()
+	defer lock.Unlock()
+	ins := instanceSet[instanceId]
+	if ins == nil || mode == "" || common.StorageMode(ins.Attributes["mode"]) == mode {
+		return
+	}
+	logger.Debug("instance ", instanceId, "@", ins.Server.ConnectionString(), " mode changed: ", mode)
+	cp := *ins
+	cp.Attributes = make(map[string]string)
+	for k, v := range ins.Attributes {
+		cp.Attributes[k] = v
+	}
+	cp.Attributes["mode"] = string(mode)
+	cp.Attributes["readonly"] = convert.BoolToStr(mode != common.STORAGE_MODE_ACTIVE)
+	instanceSet[instanceId] = &cp
+	persist(&cp)
+	publish(common.INSTANCE_CHANGED, &cp)
+}
+
+// SetLoad updates the live load of a registered storage instance.
+func SetLoad(instanceId string, load *common.LoadInfo) {
+	lock.Lock()
+	defer lock.Unlock()
+	ins := instanceSet[instanceId]
+	if ins == nil || load == nil {
+		return
+	}
+	cp := *ins
+	cp.Load = load
+	instanceSet[instanceId] = &cp
 }
 
 // InstanceSetSnapshot takes a snapshot for current instances.
@@ -86,7 +247,9 @@ func InstanceSetSnapshot() map[string]*common.Instance {
 // is conflict with other registered instance.
 func isInstanceConflict(ins *common.Instance) *common.Instance {
 	i := instanceSet[ins.InstanceId]
-	if i != nil && ins.Server.InstanceId == i.Server.InstanceId &&
+	// restored instance may come back with a new address.
+	if i != nil && i.State != common.REGISTER_STALE &&
+		ins.Server.InstanceId == i.Server.InstanceId &&
 		i.Server.ConnectionString() != ins.Server.ConnectionString() {
 		return i
 	}
@@ -95,26 +258,41 @@ func isInstanceConflict(ins *common.Instance) *common.Instance {
 
 // expirationDetection is a timer job for removing expired instance.
 func expirationDetection() {
-	timerTask := func() {
-		lock.Lock()
-		defer lock.Unlock()
-
-		logger.Debug("current instances: ", len(instanceSet)) // TODO remove
-
-		deadLine := time.Now().UnixNano() - int64(ExpirationTime)
-		for _, i := range instanceSet {
-			if i.State == common.REGISTER_FREE && i.RegisterTime <= deadLine {
-				logger.Debug("instance expired: ", i.InstanceId, "@", i.Server.ConnectionString())
-				delete(instanceSet, i.InstanceId)
-			}
-		}
-	}
-
 	timer.Start(0, ExpirationTime, 0, func(t *timer.Timer) {
 		gox.Try(func() {
-			timerTask()
+			expire(time.Now())
 		}, func(e interface{}) {
 			logger.Error("expire err: ", e)
 		})
 	})
 }
+
+// expire removes instances freed before ExpirationTime,
+// and instances restored from disk which don't register again within StaleExpirationTime.
+func expire(now time.Time) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger.Debug("current instances: ", len(instanceSet)) // TODO remove
+
+	deadLine := now.UnixNano() - int64(ExpirationTime)
+	staleExpired := now.Sub(initTime) >= StaleExpirationTime
+	var alive []*common.Instance
+	for _, i := range instanceSet {
+		if (i.State == common.REGISTER_FREE && i.RegisterTime <= deadLine) ||
+			(i.State == common.REGISTER_STALE && staleExpired) {
+			logger.Debug("instance expired: ", i.InstanceId, "@", i.Server.ConnectionString())
+			delete(instanceSet, i.InstanceId)
+			unPersist(i.InstanceId)
+			publish(common.INSTANCE_REMOVED, i)
+			continue
+		}
+		// refresh last seen time of the connected instances.
+		if i.State == common.REGISTER_HOLD {
+			cp := *i
+			cp.RegisterTime = now.UnixNano()
+			alive = append(alive, &cp)
+		}
+	}
+	persist(alive...)
+}
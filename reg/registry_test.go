@@ -0,0 +1,58 @@
+package reg
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRestoreStaleInstances(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	common.BootAs = common.BOOT_TRACKER
+	configMap, err := common.NewConfigMap(dir + "/config.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	common.SetConfigMap(configMap)
+
+	// the tracker restarts 20s after the instance was seen last time.
+	if err := configMap.PutInstances(&common.Instance{
+		Server: common.Server{
+			Host:       "127.0.0.1",
+			Port:       3000,
+			InstanceId: "storage1",
+		},
+		Role:         common.ROLE_STORAGE,
+		State:        common.REGISTER_HOLD,
+		RegisterTime: time.Now().Add(-time.Second * 20).UnixNano(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	restore()
+	defer delete(instanceSet, "storage1")
+
+	if ins := instanceSet["storage1"]; ins == nil || ins.State != common.REGISTER_STALE {
+		t.Fatal("expect storage1 to be restored as stale, got ", ins)
+	}
+	expire(initTime.Add(StaleExpirationTime / 2))
+	if instanceSet["storage1"] == nil {
+		t.Fatal("expect storage1 to wait for reconnecting")
+	}
+	expire(initTime.Add(StaleExpirationTime))
+	if instanceSet["storage1"] != nil {
+		t.Fatal("expect storage1 to expire")
+	}
+	saved, err := configMap.GetInstances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 0 {
+		t.Fatal("expect no saved instance, got ", len(saved))
+	}
+}
@@ -0,0 +1,385 @@
+package svc
+
+import (
+	"bytes"
+	"errors"
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	json "github.com/json-iterator/go"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxAntiEntropyBuckets = 64               // differing buckets compared in a round
+	maxAntiEntropyReport  = 1000             // fileIds listed in a report
+	antiEntropySummaryTTL = time.Minute * 10 // bucket summaries are reused for this long
+)
+
+var (
+	// 1 while an anti-entropy round is running.
+	reconciling int32
+	// index of the group member of the next periodic round.
+	antiEntropyNext int
+	// cached bucket summary of local files.
+	summaryCache     []common.AntiEntropyBucketDTO
+	summaryCacheTime time.Time
+	summaryCacheLock = new(sync.Mutex)
+)
+
+// initAntiEntropy starts periodic anti-entropy rounds,
+// each round reconciles with the next group member in turn.
+func initAntiEntropy() {
+	interval := common.InitializedStorageConfiguration.ParsedAntiEntropy
+	if interval <= 0 {
+		logger.Info("anti-entropy is disabled")
+		return
+	}
+	dryRun := common.InitializedStorageConfiguration.AntiEntropyDryRun
+	timer.Start(interval, interval, 0, func(t *timer.Timer) {
+		if isBootstrapping() {
+			return
+		}
+		peers := antiEntropyPeers("")
+		if len(peers) == 0 {
+			return
+		}
+		peer := peers[antiEntropyNext%len(peers)]
+		antiEntropyNext++
+		report, err := reconcile(peer, dryRun)
+		if err != nil {
+			logger.Error("error reconcile with ", peer.ConnectionString(), "(", peer.InstanceId, "): ", err)
+			return
+		}
+		logAntiEntropyReport(report)
+	})
+}
+
+// antiEntropyPeers returns available group members sorted by instanceId,
+// or only the member of the instanceId if it is not empty.
+func antiEntropyPeers(instanceId string) []*common.Server {
+	var ret []*common.Server
+	members := filterGroupMembers(api.FilterInstances(common.ROLE_STORAGE), common.InitializedStorageConfiguration.Group)
+	for ele := members.Front(); ele != nil; ele = ele.Next() {
+		ins := ele.Value.(*common.Instance)
+		if instanceId == "" || ins.InstanceId == instanceId {
+			ret = append(ret, &ins.Server)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].InstanceId < ret[j].InstanceId
+	})
+	return ret
+}
+
+func logAntiEntropyReport(r *common.AntiEntropyReportDTO) {
+	if r.DiffBuckets == 0 {
+		logger.Debug("anti-entropy with ", r.Peer, ": no differences")
+		return
+	}
+	if r.DryRun {
+		logger.Info("anti-entropy with ", r.Peer, " (dry run): ", r.DiffBuckets, " buckets differ, ",
+			r.MissingCount, " files missing, ", r.PeerMissingCount, " files missing on the peer, missing: ",
+			strings.Join(r.Missing, ","))
+		return
+	}
+	logger.Info("anti-entropy with ", r.Peer, ": ", r.DiffBuckets, " buckets differ, ",
+		r.MissingCount, " files missing, ", r.Repaired, " repaired, ", r.Failed, " failed, ",
+		r.PeerMissingCount, " files missing on the peer")
+}
+
+// reconcile compares the files held by this storage server with a group member
+// and downloads the missing files by file synchronization unless dryRun is true.
+//
+// Bucket summaries are compared first, fileIds are only exchanged for differing buckets.
+// Files missing on the group member are only reported, they are repaired by the anti-entropy of the member.
+func reconcile(peer *common.Server, dryRun bool) (*common.AntiEntropyReportDTO, error) {
+	if !atomic.CompareAndSwapInt32(&reconciling, 0, 1) {
+		return nil, errors.New("anti-entropy is already running")
+	}
+	defer atomic.StoreInt32(&reconciling, 0)
+
+	report := &common.AntiEntropyReportDTO{
+		InstanceId:  common.InitializedStorageConfiguration.InstanceId,
+		Peer:        peer.InstanceId,
+		DryRun:      dryRun,
+		Missing:     []string{},
+		PeerMissing: []string{},
+		Time:        time.Now().Unix(),
+	}
+	peerSummary, err := clientAPI.AntiEntropySummary(peer)
+	if err != nil {
+		return nil, err
+	}
+	summary := localAntiEntropySummary()
+	var buckets []int
+	for i := range summary {
+		if summary[i] != peerSummary[i] {
+			report.DiffBuckets++
+			if len(buckets) < maxAntiEntropyBuckets {
+				buckets = append(buckets, i)
+			}
+		}
+	}
+	report.ComparedBuckets = len(buckets)
+	report.Truncated = report.DiffBuckets > len(buckets)
+	if len(buckets) == 0 {
+		return report, nil
+	}
+
+	peerFiles, err := clientAPI.AntiEntropyFiles(peer, buckets)
+	if err != nil {
+		return nil, err
+	}
+	localFiles, err := localBucketFiles(buckets)
+	if err != nil {
+		return nil, err
+	}
+	local := make(map[string]bool)
+	for _, bl := range localFiles {
+		local[bl.FileId] = true
+	}
+	var missing []common.BingLogDTO
+	for _, bl := range peerFiles {
+		if local[bl.FileId] {
+			delete(local, bl.FileId)
+			continue
+		}
+		missing = append(missing, bl)
+		if len(report.Missing) < maxAntiEntropyReport {
+			report.Missing = append(report.Missing, bl.FileId)
+		}
+	}
+	report.MissingCount = len(missing)
+	report.PeerMissingCount = len(local)
+	for fileId := range local {
+		if len(report.PeerMissing) >= maxAntiEntropyReport {
+			break
+		}
+		report.PeerMissing = append(report.PeerMissing, fileId)
+	}
+	sort.Strings(report.PeerMissing)
+	if dryRun || len(missing) == 0 {
+		return report, nil
+	}
+
+	if err := repairBinlogs(missing); err != nil {
+		return nil, err
+	}
+	report.Failed = syncFiles(missing)
+	report.Repaired = len(missing) - report.Failed
+	if report.Repaired > 0 {
+		invalidateAntiEntropySummary()
+	}
+	return report, nil
+}
+
+// localAntiEntropySummary summarizes files held by this storage server by buckets.
+//
+// Building the summary walks the whole dataset, so it is reused for antiEntropySummaryTTL.
+// A stale summary only delays the detection of differences,
+// fileIds of differing buckets are always listed from the files stored now.
+func localAntiEntropySummary() []common.AntiEntropyBucketDTO {
+	summaryCacheLock.Lock()
+	defer summaryCacheLock.Unlock()
+
+	if summaryCache != nil && time.Since(summaryCacheTime) < antiEntropySummaryTTL {
+		return summaryCache
+	}
+	ret := make([]common.AntiEntropyBucketDTO, common.ANTI_ENTROPY_BUCKETS)
+	if err := walkLocalFiles(nil, func(bl *common.BingLogDTO, bucket int, hash uint64) {
+		ret[bucket].Count++
+		ret[bucket].Hash += hash
+	}); err != nil {
+		logger.Error("error summarize local files: ", err)
+		return ret
+	}
+	summaryCache = ret
+	summaryCacheTime = time.Now()
+	return ret
+}
+
+// invalidateAntiEntropySummary drops the cached summary after files are repaired.
+func invalidateAntiEntropySummary() {
+	summaryCacheLock.Lock()
+	defer summaryCacheLock.Unlock()
+
+	summaryCache = nil
+}
+
+// localBucketFiles returns files held by this storage server in the buckets.
+func localBucketFiles(buckets []int) ([]common.BingLogDTO, error) {
+	set := make(map[int]bool)
+	for _, b := range buckets {
+		set[b] = true
+	}
+	var ret []common.BingLogDTO
+	err := walkLocalFiles(set, func(bl *common.BingLogDTO, bucket int, hash uint64) {
+		ret = append(ret, *bl)
+	})
+	return ret, err
+}
+
+// walkLocalFiles walks fileIds of the dataset whose files are stored on disk,
+// only fileIds in the buckets are walked if buckets is not nil.
+//
+// Files are walked from the dataset instead of binlogs,
+// so that files whose binlogs are lost are still summarized.
+// The source instance is the instance creating the fileId and the length is read from disk.
+func walkLocalFiles(buckets map[int]bool, handler func(bl *common.BingLogDTO, bucket int, hash uint64)) error {
+	return walkDataSet(func(fileId string) bool {
+		b, h := util.AntiEntropyBucket(fileId)
+		if buckets != nil && !buckets[b] {
+			return true
+		}
+		info, _, err := util.ParseAlias(fileId, common.InitializedStorageConfiguration.Secret)
+		if err != nil {
+			return true
+		}
+		stat, err := os.Stat(common.InitializedStorageConfiguration.DataDir + "/" + info.Path)
+		if err != nil {
+			return true
+		}
+		handler(&common.BingLogDTO{
+			SourceInstance: info.InstanceId,
+			FileLength:     stat.Size() - int64(len(tailRefCount)),
+			FileId:         fileId,
+		}, b, h)
+		return true
+	})
+}
+
+// repairBinlogs writes local binlogs of the missing files before downloading them,
+// so that they are synchronized by other group members.
+//
+// Files never synchronized are added to the dataset,
+// binlogs of files already in the dataset are written again if they are lost from local binlogs.
+func repairBinlogs(missing []common.BingLogDTO) error {
+	var unknown []common.BingLogDTO
+	lost := make(map[string]*common.BingLogDTO)
+	for i := range missing {
+		c, err := Contains(missing[i].FileId)
+		if err != nil {
+			return err
+		}
+		if c {
+			lost[missing[i].FileId] = &missing[i]
+		} else {
+			unknown = append(unknown, missing[i])
+		}
+	}
+	if _, err := bootstrapBinlogs(unknown); err != nil {
+		return err
+	}
+	if len(lost) == 0 {
+		return nil
+	}
+	scanBinlogs(common.BinlogQueryDTO{}, 0, func(bl *common.BingLogDTO) {
+		delete(lost, bl.FileId)
+	})
+	if len(lost) == 0 {
+		return nil
+	}
+	var bls []*common.BingLog
+	for _, v := range lost {
+		bls = append(bls, binlog.CreateLocalBinlog(v.FileId, v.FileLength, v.SourceInstance))
+	}
+	logger.Info("anti-entropy writes ", len(bls), " lost binlogs again")
+	return writableBinlogManager.Write(bls...)
+}
+
+// antiEntropyHandler returns the bucket summaries of this storage server in the body,
+// or binlogs of files in the buckets of the attribute "buckets" as a binlog stream.
+func antiEntropyHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	s := header.Attributes["buckets"]
+	if s == "" {
+		bs := util.EncodeAntiEntropySummary(localAntiEntropySummary())
+		return &common.Header{
+			Result: common.SUCCESS,
+		}, bytes.NewReader(bs), int64(len(bs)), nil
+	}
+	var buckets []int
+	for _, v := range strings.Split(s, ",") {
+		b, err := convert.StrToInt(v)
+		if err != nil || b < 0 || b >= common.ANTI_ENTROPY_BUCKETS {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    "invalid bucket \"" + v + "\"",
+			}, nil, 0, nil
+		}
+		buckets = append(buckets, b)
+	}
+	files, err := localBucketFiles(buckets)
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "error list local files: " + err.Error(),
+		}, nil, 0, nil
+	}
+	body := binlog.NewStreamEncoder()
+	for _, bl := range files {
+		bl := bl
+		if err := body.WriteBinlog(&bl); err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    "error encode binlog: " + err.Error(),
+			}, nil, 0, nil
+		}
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+	}, body.Reader(), body.Len(), nil
+}
+
+// reconcileHandler runs an anti-entropy round with the group member of the attribute "peer",
+// or with every available group member, and returns the reports in the body.
+// Differences are only reported if the attribute "dryRun" is "true".
+func reconcileHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	if isBootstrapping() {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "storage server is bootstrapping",
+		}, nil, 0, nil
+	}
+	peer := header.Attributes["peer"]
+	peers := antiEntropyPeers(peer)
+	if len(peers) == 0 {
+		msg := "no group member available"
+		if peer != "" {
+			msg = "group member " + peer + " is not available"
+		}
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    msg,
+		}, nil, 0, nil
+	}
+	reports := []*common.AntiEntropyReportDTO{}
+	for _, p := range peers {
+		report, err := reconcile(p, header.Attributes["dryRun"] == "true")
+		if err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    "error reconcile with " + p.InstanceId + ": " + err.Error(),
+			}, nil, 0, nil
+		}
+		logAntiEntropyReport(report)
+		reports = append(reports, report)
+	}
+	bs, err := json.Marshal(reports)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+	}, bytes.NewReader(bs), int64(len(bs)), nil
+}
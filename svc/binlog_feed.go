@@ -0,0 +1,300 @@
+package svc
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/logger"
+	json "github.com/json-iterator/go"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultFeedLimit     = 100
+	maxFeedLimit         = 1000
+	maxFeedScan          = 10000 // max binlogs scanned for a page when events are filtered by group
+	maxFeedWait          = 60    // max long-poll seconds
+	feedPollInterval     = time.Millisecond * 500
+	feedKeepAlivePeriod  = time.Second * 15
+	feedEventStreamType  = "text/event-stream"
+	feedAuthHeaderPrefix = "Bearer "
+)
+
+// feedQuery is the query of the binlog feed.
+type feedQuery struct {
+	cursor common.BinlogQueryDTO
+	group  string
+	limit  int
+	wait   int
+	sse    bool
+}
+
+// httpStorageFeed serves binlogs of this storage server as a feed.
+func httpStorageFeed(w http.ResponseWriter, r *http.Request) {
+	if !feedAuthorized(r, common.InitializedStorageConfiguration.Secret, common.InitializedStorageConfiguration.FeedKey) {
+		util.HttpForbiddenError(w, "invalid feed key")
+		return
+	}
+	m, ok := writableBinlogManager.(binlog.FeedReader)
+	if !ok {
+		util.HttpInternalServerError(w, "binlog feed is not supported")
+		return
+	}
+	serveFeed(w, r, m, common.InitializedStorageConfiguration.Secret)
+}
+
+// httpTrackerFeed serves the binlog journal of a source instance as a feed.
+func httpTrackerFeed(w http.ResponseWriter, r *http.Request) {
+	if !feedAuthorized(r, common.InitializedTrackerConfiguration.Secret, common.InitializedTrackerConfiguration.FeedKey) {
+		util.HttpForbiddenError(w, "invalid feed key")
+		return
+	}
+	instance := r.URL.Query().Get("instance")
+	if instance == "" {
+		util.HttpWriteResponse(w, http.StatusBadRequest, "instance is required")
+		return
+	}
+	journal, err := journalBinlogManager.Journal(instance)
+	if err == binlog.ErrJournalNotFound {
+		util.HttpFileNotFoundError(w)
+		return
+	}
+	if err != nil {
+		util.HttpInternalServerError(w, err.Error())
+		return
+	}
+	m, ok := journal.(binlog.FeedReader)
+	if !ok {
+		util.HttpInternalServerError(w, "binlog feed is not supported")
+		return
+	}
+	serveFeed(w, r, m, "")
+}
+
+// httpTrackerFeedJournals lists the source instances journaled by this tracker.
+func httpTrackerFeedJournals(w http.ResponseWriter, r *http.Request) {
+	if !feedAuthorized(r, common.InitializedTrackerConfiguration.Secret, common.InitializedTrackerConfiguration.FeedKey) {
+		util.HttpForbiddenError(w, "invalid feed key")
+		return
+	}
+	journals, err := journalBinlogManager.Instances()
+	if err != nil {
+		util.HttpInternalServerError(w, err.Error())
+		return
+	}
+	writeFeedJson(w, &common.BinlogQueryResultDTO{Journals: journals})
+}
+
+// feedAuthorized accepts the cluster secret and the read-only feed key,
+// passed by "Authorization: Bearer <key>" or the query parameter "key".
+func feedAuthorized(r *http.Request, secret, feedKey string) bool {
+	key := r.URL.Query().Get("key")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, feedAuthHeaderPrefix) {
+		key = strings.TrimPrefix(auth, feedAuthHeaderPrefix)
+	}
+	if key == "" {
+		return secret == "" && feedKey == ""
+	}
+	return secret != "" && subtle.ConstantTimeCompare([]byte(key), []byte(secret)) == 1 ||
+		feedKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(feedKey)) == 1
+}
+
+// parseFeedQuery parses the feed query,
+// the cursor is "fileIndex" and "offset", or "Last-Event-ID" of a reconnected event stream.
+func parseFeedQuery(r *http.Request) (*feedQuery, error) {
+	qs := r.URL.Query()
+	q := &feedQuery{
+		group: qs.Get("group"),
+		limit: defaultFeedLimit,
+		sse:   qs.Get("mode") == "sse" || strings.Contains(r.Header.Get("Accept"), feedEventStreamType),
+	}
+	q.cursor.Instance = qs.Get("instance")
+	var err error
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		if q.cursor.FileIndex, q.cursor.Offset, err = parseBinlogCursor(id); err != nil {
+			return nil, err
+		}
+	} else {
+		if v := qs.Get("fileIndex"); v != "" {
+			if q.cursor.FileIndex, err = convert.StrToInt(v); err != nil || q.cursor.FileIndex < 0 {
+				return nil, errors.New("invalid parameter: fileIndex")
+			}
+		}
+		if v := qs.Get("offset"); v != "" {
+			if q.cursor.Offset, err = convert.StrToInt64(v); err != nil || q.cursor.Offset < 0 {
+				return nil, errors.New("invalid parameter: offset")
+			}
+		}
+	}
+	if v := qs.Get("limit"); v != "" {
+		if q.limit, err = convert.StrToInt(v); err != nil || q.limit <= 0 {
+			return nil, errors.New("invalid parameter: limit")
+		}
+		if q.limit > maxFeedLimit {
+			q.limit = maxFeedLimit
+		}
+	}
+	if v := qs.Get("wait"); v != "" {
+		if q.wait, err = convert.StrToInt(v); err != nil || q.wait < 0 {
+			return nil, errors.New("invalid parameter: wait")
+		}
+		if q.wait > maxFeedWait {
+			q.wait = maxFeedWait
+		}
+	}
+	return q, nil
+}
+
+// serveFeed serves a page of events, which waits for new events if the query has "wait",
+// or an endless event stream in the Server-Sent Events mode.
+func serveFeed(w http.ResponseWriter, r *http.Request, m binlog.FeedReader, secret string) {
+	q, err := parseFeedQuery(r)
+	if err != nil {
+		util.HttpWriteResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if q.sse {
+		serveFeedStream(w, r, m, q, secret)
+		return
+	}
+	deadline := time.Now().Add(time.Second * time.Duration(q.wait))
+	for {
+		events, err := readFeed(m, &q.cursor, q.group, q.limit, secret)
+		if err != nil {
+			util.HttpInternalServerError(w, err.Error())
+			return
+		}
+		if len(events) > 0 || !time.Now().Before(deadline) {
+			writeFeedJson(w, &common.FeedResultDTO{
+				Events: events,
+				Cursor: q.cursor,
+			})
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(feedPollInterval):
+		}
+	}
+}
+
+// serveFeedStream writes events as Server-Sent Events until the client disconnects,
+// the event id is the cursor "fileIndex:offset" to resume from.
+func serveFeedStream(w http.ResponseWriter, r *http.Request, m binlog.FeedReader, q *feedQuery, secret string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		util.HttpInternalServerError(w, "streaming is not supported")
+		return
+	}
+	w.Header().Set("Content-Type", feedEventStreamType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	lastWrite := time.Now()
+	for {
+		events, err := readFeed(m, &q.cursor, q.group, q.limit, secret)
+		if err != nil {
+			logger.Debug("error read binlog feed: ", err)
+			return
+		}
+		for _, e := range events {
+			data, _ := json.Marshal(e)
+			if _, err := w.Write([]byte("id: " + convert.IntToStr(e.Cursor.FileIndex) + ":" +
+				convert.Int64ToStr(e.Cursor.Offset) + "\ndata: " + string(data) + "\n\n")); err != nil {
+				return
+			}
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+			lastWrite = time.Now()
+			continue
+		}
+		if time.Since(lastWrite) >= feedKeepAlivePeriod {
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+			lastWrite = time.Now()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(feedPollInterval):
+		}
+	}
+}
+
+// readFeed reads events from the cursor and moves the cursor forward,
+// binlog files are crossed until limit events are read or the latest binlog is reached.
+func readFeed(m binlog.FeedReader, cursor *common.BinlogQueryDTO, group string, limit int, secret string) ([]*common.FeedEventDTO, error) {
+	events := []*common.FeedEventDTO{}
+	scanned := 0
+	for len(events) < limit && scanned < maxFeedScan {
+		records, nOffset, err := m.ReadFeed(cursor.FileIndex, cursor.Offset, limit-len(events))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			// the binlog file is not created yet, or lost.
+			if cursor.FileIndex >= m.GetCurrentIndex() {
+				break
+			}
+			cursor.FileIndex++
+			cursor.Offset = 0
+			continue
+		}
+		for _, rec := range records {
+			cursor.Offset = rec.Offset
+			if e := feedEvent(&rec.Binlog, *cursor, group, secret); e != nil {
+				events = append(events, e)
+			}
+		}
+		cursor.Offset = nOffset
+		scanned += len(records)
+		if len(records) == 0 {
+			if m.GetCurrentIndex() > cursor.FileIndex {
+				cursor.FileIndex++
+				cursor.Offset = 0
+				continue
+			}
+			break
+		}
+	}
+	return events, nil
+}
+
+// feedEvent returns the event of the binlog if it belongs to the group.
+func feedEvent(bl *common.BingLogDTO, cursor common.BinlogQueryDTO, group string, secret string) *common.FeedEventDTO {
+	e := &common.FeedEventDTO{
+		Cursor:         cursor,
+		FileId:         bl.FileId,
+		SourceInstance: bl.SourceInstance,
+		Length:         bl.FileLength,
+	}
+	if info, _, err := util.ParseAlias(bl.FileId, secret); err == nil {
+		e.File = info
+	}
+	if group != "" && (e.File == nil || e.File.Group != group) {
+		return nil
+	}
+	return e
+}
+
+func writeFeedJson(w http.ResponseWriter, v interface{}) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		util.HttpInternalServerError(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bs)
+}
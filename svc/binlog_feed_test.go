@@ -0,0 +1,122 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// fakeFeedReader keeps binlog files in memory, every binlog takes 10 bytes.
+type fakeFeedReader struct {
+	binlog.FeedReader
+	files [][]common.BingLogDTO
+}
+
+func (f *fakeFeedReader) GetCurrentIndex() int {
+	return len(f.files) - 1
+}
+
+func (f *fakeFeedReader) ReadFeed(fileIndex int, offset int64, fetchLine int) ([]binlog.FeedRecord, int64, error) {
+	if fileIndex >= len(f.files) {
+		return nil, offset, os.ErrNotExist
+	}
+	var ret []binlog.FeedRecord
+	for i := int(offset / 10); i < len(f.files[fileIndex]) && len(ret) < fetchLine; i++ {
+		offset = int64(i+1) * 10
+		ret = append(ret, binlog.FeedRecord{Binlog: f.files[fileIndex][i], Offset: offset})
+	}
+	return ret, offset, nil
+}
+
+func TestReadFeed(t *testing.T) {
+	util.GenerateDecKey("123456")
+	bl := func(group string) common.BingLogDTO {
+		return common.BingLogDTO{
+			FileId:         util.CreateAlias(group+"/00/01/0123456789abcdef0123456789abcdef", "storage1", false, time.Now()),
+			SourceInstance: "storage1",
+			FileLength:     7,
+		}
+	}
+	m := &fakeFeedReader{files: [][]common.BingLogDTO{
+		{bl("G01"), bl("G02"), bl("G01")},
+		{bl("G01")},
+	}}
+
+	// events are read across binlog files.
+	cursor := &common.BinlogQueryDTO{}
+	events, err := readFeed(m, cursor, "", 3, "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[2].Cursor.Offset != 30 || events[0].File == nil {
+		t.Fatal("expect 3 events of the first binlog file, got ", len(events))
+	}
+	events, err = readFeed(m, cursor, "", 3, "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Cursor.FileIndex != 1 || events[0].Cursor.Offset != 10 {
+		t.Fatal("expect an event of the second binlog file, got ", len(events))
+	}
+	// the feed is resumed from the cursor with nothing new.
+	if events, _ := readFeed(m, cursor, "", 3, "123456"); len(events) != 0 || cursor.FileIndex != 1 || cursor.Offset != 10 {
+		t.Fatal("expect no more events at ", cursor.FileIndex, ":", cursor.Offset)
+	}
+
+	// events of other groups are filtered out but the cursor moves past them.
+	cursor = &common.BinlogQueryDTO{}
+	events, err = readFeed(m, cursor, "G02", 10, "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Cursor.Offset != 20 || cursor.FileIndex != 1 || cursor.Offset != 10 {
+		t.Fatal("expect an event of G02, got ", len(events))
+	}
+}
+
+func TestParseFeedQuery(t *testing.T) {
+	r := httptest.NewRequest("GET", "/feed?fileIndex=2&offset=30&limit=5000&wait=100&group=G01", nil)
+	q, err := parseFeedQuery(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.cursor.FileIndex != 2 || q.cursor.Offset != 30 || q.limit != maxFeedLimit || q.wait != maxFeedWait || q.group != "G01" || q.sse {
+		t.Fatal("unexpected feed query ", *q)
+	}
+
+	// a reconnected event stream resumes from the last event.
+	r = httptest.NewRequest("GET", "/feed?fileIndex=2&offset=30", nil)
+	r.Header.Set("Accept", feedEventStreamType)
+	r.Header.Set("Last-Event-ID", "3:40")
+	if q, err = parseFeedQuery(r); err != nil {
+		t.Fatal(err)
+	}
+	if q.cursor.FileIndex != 3 || q.cursor.Offset != 40 || !q.sse {
+		t.Fatal("unexpected feed query ", *q)
+	}
+
+	if _, err := parseFeedQuery(httptest.NewRequest("GET", "/feed?offset=-1", nil)); err == nil {
+		t.Fatal("expect invalid offset")
+	}
+}
+
+func TestFeedAuthorized(t *testing.T) {
+	r := httptest.NewRequest("GET", "/feed", nil)
+	r.Header.Set("Authorization", feedAuthHeaderPrefix+"feed-key")
+	if !feedAuthorized(r, "secret", "feed-key") {
+		t.Fatal("expect the feed key accepted")
+	}
+	if feedAuthorized(r, "secret", "") {
+		t.Fatal("expect the feed key rejected when it is not configured")
+	}
+	if !feedAuthorized(httptest.NewRequest("GET", "/feed?key=secret", nil), "secret", "feed-key") {
+		t.Fatal("expect the secret accepted")
+	}
+	if feedAuthorized(httptest.NewRequest("GET", "/feed", nil), "secret", "") {
+		t.Fatal("expect no key rejected")
+	}
+}
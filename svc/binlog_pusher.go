@@ -6,13 +6,81 @@ import (
 	"github.com/hetianyi/gox/convert"
 	"github.com/hetianyi/gox/logger"
 	"github.com/hetianyi/gox/timer"
+	"sync"
 	"time"
 )
 
+const (
+	maxBinlogsPerPush  = 1000 // binlogs and their digests are streamed in the body
+	maxReplicasPerPush = 1000
+	maxPendingReplicas = 100000
+)
+
+var (
+	// replicas waiting to be reported to each tracker server.
+	//
+	// They are kept in memory only and lost on restart, the tracker then
+	// doesn't locate the file on this server, and clients fall back to
+	// other group members which are selected without the location index.
+	pendingReplicas = make(map[string][]common.ReplicaDTO)
+	replicaLock     = new(sync.Mutex)
+)
+
+// reportReplica marks the file as synchronized by this storage server,
+// it will be pushed to all tracker servers by binlogPusher.
+func reportReplica(fileId string) {
+	replicaLock.Lock()
+	defer replicaLock.Unlock()
+
+	for k, v := range pendingReplicas {
+		if len(v) >= maxPendingReplicas {
+			logger.Warn("too many pending replicas for tracker ", k, ", drop replica ", fileId)
+			continue
+		}
+		pendingReplicas[k] = append(v, common.ReplicaDTO{
+			FileId:     fileId,
+			InstanceId: common.InitializedStorageConfiguration.InstanceId,
+		})
+	}
+}
+
+// pushReplicas pushes pending replicas to the tracker server.
+func pushReplicas(server *common.Server) {
+	key := server.ConnectionString()
+	for {
+		replicaLock.Lock()
+		pending := pendingReplicas[key]
+		n := len(pending)
+		if n > maxReplicasPerPush {
+			n = maxReplicasPerPush
+		}
+		batch := pending[:n]
+		replicaLock.Unlock()
+
+		if n == 0 {
+			return
+		}
+		if err := clientAPI.PushReplicas(server, batch); err != nil {
+			logger.Error("error push replicas: ", err)
+			return
+		}
+		replicaLock.Lock()
+		pendingReplicas[key] = pendingReplicas[key][n:]
+		replicaLock.Unlock()
+	}
+}
+
 // binlogPusher starts a timer job for pushing binlog to a tracker.
 func binlogPusher(server *common.Server) {
+	replicaLock.Lock()
+	pendingReplicas[server.ConnectionString()] = nil
+	replicaLock.Unlock()
+
 	// allow 2 round failure synchronization
 	timer.Start(time.Second*3, time.Second*10, 0, func(t *timer.Timer) {
+		if server.InstanceId != "" {
+			pushReplicas(server)
+		}
 		for true {
 			// waiting for instanceId
 			if server.InstanceId == "" {
@@ -30,7 +98,7 @@ func binlogPusher(server *common.Server) {
 			logger.Debug("tracker instanceId: ", server.InstanceId,
 				", pusher status: binlog index is ", fileIndex, " and binlog offset is ", offset)
 
-			bls, nOffset, err := writableBinlogManager.Read(fileIndex, offset, 10)
+			bls, nOffset, err := writableBinlogManager.Read(fileIndex, offset, maxBinlogsPerPush)
 			if err != nil {
 				logger.Error("error reading binlog: ", err)
 				break
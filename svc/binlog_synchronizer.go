@@ -15,6 +15,11 @@ import (
 	"time"
 )
 
+const (
+	maxSyncFetch = 2000 // binlogs requested per synchronization
+	minSyncFetch = 50
+)
+
 var (
 	// storage servers who is being watching.
 	watchingMembers map[string]*common.Server
@@ -24,6 +29,7 @@ var (
 	configKeyPrefix      = "binlogSynchronizationState:"
 	syncLock             *sync.Mutex
 	configChangeLock     *sync.Mutex
+	memberRefreshLock    = new(sync.Mutex)
 )
 
 func init() {
@@ -133,35 +139,50 @@ func InitStorageMemberBinlogWatcher() {
 
 	// timer task: check and watch storage server instances
 	timer.Start(time.Second*5, common.SYNCHRONIZE_INTERVAL, 0, func(t *timer.Timer) {
-		ss := filterGroupMembers(api.FilterInstances(common.ROLE_STORAGE),
-			common.InitializedStorageConfiguration.Group)
-		if ss == nil || ss.Len() == 0 {
-			return
+		refreshWatchingMembers()
+	})
+	// watch or unwatch group members as soon as instances change.
+	api.AddInstanceListener(func(event *common.InstanceEvent) {
+		if event.Instance.Role == common.ROLE_STORAGE &&
+			event.Instance.Attributes["group"] == common.InitializedStorageConfiguration.Group {
+			go refreshWatchingMembers()
 		}
+	})
+}
 
-		expiredInstances := list.New()
+// refreshWatchingMembers watches new group members and unwatches the members gone.
+func refreshWatchingMembers() {
+	memberRefreshLock.Lock()
+	defer memberRefreshLock.Unlock()
 
-		for k, v := range watchingMembers {
-			c := false
-			gox.WalkList(ss, func(item interface{}) bool {
-				if item.(*common.Instance).InstanceId == k {
-					c = true
-					return true
-				}
-				return false
-			})
-			if !c {
-				expiredInstances.PushBack(&v)
-			}
-		}
-		gox.WalkList(expiredInstances, func(item interface{}) bool {
-			unWatch(item.(*common.Server))
-			return false
-		})
+	ss := filterGroupMembers(api.FilterInstances(common.ROLE_STORAGE),
+		common.InitializedStorageConfiguration.Group)
+
+	expiredInstances := list.New()
+
+	syncLock.Lock()
+	for k, v := range watchingMembers {
+		c := false
 		gox.WalkList(ss, func(item interface{}) bool {
-			watch(&item.(*common.Instance).Server)
+			if item.(*common.Instance).InstanceId == k {
+				c = true
+				return true
+			}
 			return false
 		})
+		if !c {
+			expiredInstances.PushBack(v)
+		}
+	}
+	syncLock.Unlock()
+
+	gox.WalkList(expiredInstances, func(item interface{}) bool {
+		unWatch(item.(*common.Server))
+		return false
+	})
+	gox.WalkList(ss, func(item interface{}) bool {
+		watch(&item.(*common.Instance).Server)
+		return false
 	})
 }
 
@@ -183,6 +204,10 @@ func watch(server *common.Server) {
 
 	binlogList := list.New()
 
+	// the batch size is halved when a synchronization fails
+	// and grows back when it succeeds, so a slow link is not flooded.
+	fetch := maxSyncFetch
+
 	timer.Start(0, time.Second*10, 0, func(t *timer.Timer) {
 
 		for true {
@@ -196,6 +221,11 @@ func watch(server *common.Server) {
 				break
 			}
 
+			// the binlog position is handed over when bootstrap finishes.
+			if isBootstrapping() {
+				break
+			}
+
 			// get state
 			config, err := loadSynchronizationConfig(server.InstanceId)
 			if err != nil {
@@ -203,12 +233,18 @@ func watch(server *common.Server) {
 				break
 			}
 
-			ret, err := clientAPI.SyncBinlog(server, config)
+			ret, err := clientAPI.SyncBinlog(server, config, fetch)
 			if err != nil {
 				logger.Debug("error synchronize binlog from storage server: ",
 					server.ConnectionString(), "(", server.InstanceId, "): ", err)
+				if fetch /= 2; fetch < minSyncFetch {
+					fetch = minSyncFetch
+				}
 				break
 			}
+			if fetch *= 2; fetch > maxSyncFetch {
+				fetch = maxSyncFetch
+			}
 
 			if ret.FileIndex == config.FileIndex && ret.Offset == config.Offset {
 				logger.Debug("nothing changed")
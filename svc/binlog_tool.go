@@ -0,0 +1,313 @@
+package svc
+
+import (
+	"crypto/md5"
+	"errors"
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/file"
+	json "github.com/json-iterator/go"
+	"io"
+	"os"
+	"time"
+)
+
+// binlogDumpRecord is a line of binlog dump.
+type binlogDumpRecord struct {
+	File           int              `json:"file"`
+	Offset         int64            `json:"offset"`
+	FileId         string           `json:"fileId,omitempty"`
+	SourceInstance string           `json:"sourceInstance,omitempty"`
+	Length         int64            `json:"length"`
+	Alias          *common.FileInfo `json:"alias,omitempty"`
+	Error          string           `json:"error,omitempty"`
+}
+
+// binlogProblem is a problem found by binlog verification.
+type binlogProblem struct {
+	Problem string `json:"problem"`
+	File    int    `json:"file"`
+	Offset  int64  `json:"offset"`
+	FileId  string `json:"fileId,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// binlogFileStat is the stat of a binlog file.
+type binlogFileStat struct {
+	File    int    `json:"file"`
+	Size    int64  `json:"size"`
+	Records int    `json:"records"` // record count in the binlog index
+	Missing bool   `json:"missing,omitempty"`
+	Name    string `json:"name"`
+}
+
+// openOfflineDataDir prepares the data dir of a stopped storage server for binlog tools,
+// secrets saved in the data dir and extra secrets are used to decode fileIds.
+func openOfflineDataDir(dataDir string, secrets []string) (string, error) {
+	dataDir = file.FixPath(dataDir)
+	binlogDir := dataDir + "/binlog"
+	if !file.Exists(binlogDir) {
+		return "", errors.New("binlog dir not found: " + binlogDir)
+	}
+	common.BootAs = common.BOOT_STORAGE
+	common.InitializedStorageConfiguration = &common.StorageConfig{
+		DataDir: dataDir,
+	}
+	cfg := dataDir + "/cfg.dat"
+	if file.Exists(cfg) {
+		configMap, err := common.OpenConfigMapReadOnly(cfg, time.Second*3)
+		if err != nil {
+			return "", errors.New("cannot open " + cfg + ", make sure the instance is stopped: " + err.Error())
+		}
+		common.SetConfigMap(configMap)
+		saved, err := util.GetSecrets()
+		if err != nil {
+			return "", err
+		}
+		util.AddSecretEncryptKeys(util.CollectMapKeys(saved)...)
+	}
+	if len(secrets) > 0 {
+		util.GenerateDecKey(secrets[0])
+		util.AddSecretEncryptKeys(secrets...)
+	}
+	return binlogDir, nil
+}
+
+// binlogFilesToCheck returns all binlog file indexes in the binlog index or in the binlog dir.
+func binlogFilesToCheck(binlogDir string, records []int) ([]int, error) {
+	files, err := binlog.ListBinlogFiles(binlogDir)
+	if err != nil {
+		return nil, err
+	}
+	last := len(records) - 1
+	if len(files) > 0 && files[len(files)-1] > last {
+		last = files[len(files)-1]
+	}
+	ret := make([]int, last+1)
+	for i := range ret {
+		ret[i] = i
+	}
+	return ret, nil
+}
+
+func writeJsonLine(w io.Writer, v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(bs, '\n'))
+	return err
+}
+
+// DumpBinlogs decodes binlog records of a stopped storage server into json lines,
+// fileIndex -1 dumps all binlog files.
+func DumpBinlogs(dataDir string, secrets []string, fileIndex int, w io.Writer) error {
+	binlogDir, err := openOfflineDataDir(dataDir, secrets)
+	if err != nil {
+		return err
+	}
+	files := []int{fileIndex}
+	if fileIndex < 0 {
+		if files, err = binlog.ListBinlogFiles(binlogDir); err != nil {
+			return err
+		}
+	}
+	for _, i := range files {
+		err := binlog.DumpBinlogFile(binlogDir, i, func(offset int64, bl *common.BingLogDTO, err error) error {
+			rec := &binlogDumpRecord{
+				File:   i,
+				Offset: offset,
+			}
+			if err != nil {
+				rec.Error = err.Error()
+			} else {
+				rec.FileId = bl.FileId
+				rec.SourceInstance = bl.SourceInstance
+				rec.Length = bl.FileLength
+				if info, _, err := util.ParseAlias(bl.FileId, ""); err == nil {
+					rec.Alias = info
+				} else {
+					rec.Error = "cannot decode fileId: " + err.Error()
+				}
+			}
+			return writeJsonLine(w, rec)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StatBinlogs prints binlog files and the binlog index of a stopped storage server.
+func StatBinlogs(dataDir string, w io.Writer) error {
+	binlogDir, err := openOfflineDataDir(dataDir, nil)
+	if err != nil {
+		return err
+	}
+	records, legacy, err := binlog.ReadBinlogIndex(binlogDir)
+	if err != nil {
+		return err
+	}
+	files, err := binlogFilesToCheck(binlogDir, records)
+	if err != nil {
+		return err
+	}
+	stat := struct {
+		BinlogDir   string            `json:"binlogDir"`
+		LegacyIndex bool              `json:"legacyIndex"`
+		IndexSize   int               `json:"indexSize"`
+		Records     int               `json:"records"`
+		Size        int64             `json:"size"`
+		Files       []*binlogFileStat `json:"files"`
+	}{
+		BinlogDir:   binlogDir,
+		LegacyIndex: legacy,
+		IndexSize:   len(records),
+		Files:       []*binlogFileStat{},
+	}
+	for _, i := range files {
+		fs := &binlogFileStat{
+			File: i,
+			Name: binlog.BinlogFileName(binlogDir, i),
+		}
+		if i < len(records) {
+			fs.Records = records[i]
+		}
+		if info, err := os.Stat(fs.Name); err == nil {
+			fs.Size = info.Size()
+		} else {
+			fs.Missing = true
+		}
+		stat.Records += fs.Records
+		stat.Size += fs.Size
+		stat.Files = append(stat.Files, fs)
+	}
+	bs, err := json.MarshalIndent(stat, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(bs, '\n'))
+	return err
+}
+
+// loadDataSetFiles reads digests of all fileIds in the dataset,
+// digests are kept instead of fileIds to save memory.
+func loadDataSetFiles() (map[[md5.Size]byte]bool, error) {
+	ret := make(map[[md5.Size]byte]bool)
+	err := walkDataSet(func(fileId string) bool {
+		ret[md5.Sum([]byte(fileId))] = true
+		return true
+	})
+	return ret, err
+}
+
+// VerifyBinlogs checks consistency between binlog files, the binlog index,
+// the dataset and the data files of a stopped storage server.
+//
+// Every problem is printed as a json line, it returns the number of problems.
+func VerifyBinlogs(dataDir string, secrets []string, w io.Writer) (int, error) {
+	binlogDir, err := openOfflineDataDir(dataDir, secrets)
+	if err != nil {
+		return 0, err
+	}
+	records, legacy, err := binlog.ReadBinlogIndex(binlogDir)
+	if err != nil {
+		return 0, err
+	}
+	files, err := binlogFilesToCheck(binlogDir, records)
+	if err != nil {
+		return 0, err
+	}
+	dataDir = common.InitializedStorageConfiguration.DataDir
+	problems := 0
+	report := func(p *binlogProblem) error {
+		problems++
+		return writeJsonLine(w, p)
+	}
+	if legacy {
+		if err := report(&binlogProblem{Problem: "index", File: -1, Detail: "legacy binlog map is not migrated"}); err != nil {
+			return problems, err
+		}
+	}
+
+	// the dataset is only checked if it exists, its append file is read
+	// without opening the dataset, so it is never created or modified.
+	var datasetFiles map[[md5.Size]byte]bool
+	checkDataset := file.Exists(dataDir + "/aof")
+	if checkDataset {
+		if datasetFiles, err = loadDataSetFiles(); err != nil {
+			return problems, err
+		}
+	}
+
+	for _, i := range files {
+		name := binlog.BinlogFileName(binlogDir, i)
+		if !file.Exists(name) {
+			if err := report(&binlogProblem{Problem: "index", File: i, Detail: "binlog file is missing"}); err != nil {
+				return problems, err
+			}
+			continue
+		}
+		if i >= len(records) {
+			if err := report(&binlogProblem{Problem: "index", File: i, Detail: "binlog file is not in the binlog index"}); err != nil {
+				return problems, err
+			}
+		}
+		valid := 0
+		err := binlog.DumpBinlogFile(binlogDir, i, func(offset int64, bl *common.BingLogDTO, err error) error {
+			if err != nil {
+				return report(&binlogProblem{Problem: "corrupted", File: i, Offset: offset, Detail: err.Error()})
+			}
+			valid++
+			info, _, err := util.ParseAlias(bl.FileId, "")
+			if err != nil {
+				return report(&binlogProblem{Problem: "alias", File: i, Offset: offset, FileId: bl.FileId, Detail: err.Error()})
+			}
+			if checkDataset {
+				if !datasetFiles[md5.Sum([]byte(bl.FileId))] {
+					if err := report(&binlogProblem{Problem: "dataset", File: i, Offset: offset, FileId: bl.FileId,
+						Detail: "fileId is not in the dataset"}); err != nil {
+						return err
+					}
+				}
+			}
+			if !file.Exists(dataDir + "/" + info.Path) {
+				return report(&binlogProblem{Problem: "data", File: i, Offset: offset, FileId: bl.FileId,
+					Detail: "data file is missing: " + info.Path})
+			}
+			return nil
+		})
+		if err != nil {
+			return problems, err
+		}
+		if i < len(records) && records[i] != valid {
+			err := report(&binlogProblem{Problem: "index", File: i,
+				Detail: "binlog index has " + convert.IntToStr(records[i]) + " records but the file has " + convert.IntToStr(valid)})
+			if err != nil {
+				return problems, err
+			}
+		}
+	}
+	return problems, nil
+}
+
+// RepairBinlogs truncates torn tails and rebuilds the binlog index of a stopped storage server.
+func RepairBinlogs(dataDir string, w io.Writer) error {
+	binlogDir, err := openOfflineDataDir(dataDir, nil)
+	if err != nil {
+		return err
+	}
+	ret, err := binlog.RepairBinlog(binlogDir)
+	if err != nil {
+		return err
+	}
+	bs, err := json.MarshalIndent(ret, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(bs, '\n'))
+	return err
+}
@@ -21,17 +21,18 @@ import (
 const (
 	MaxConnPerServer uint = 100
 	counterLoopSize       = 60
-	maxUploadFactor       = 1000 // max uploads per sec of.
 )
 
 var (
 	clientAPI             api.ClientAPI
 	writableBinlogManager binlog.XBinlogManager
+	// journals binlogs pushed to tracker servers.
+	journalBinlogManager binlog.TrackerBinlogManager
 	// counting traffic within 1 minutes
-	counterLoop         [counterLoopSize]int // 64, about 1 minute.
-	counterPos          int
-	counterLock         *sync.Mutex
-	millionSecPerUpload = float32(1000) / float32(maxUploadFactor)
+	counterLoop [counterLoopSize]int   // 64, about 1 minute.
+	trafficLoop [counterLoopSize]int64 // transferred bytes of each second.
+	counterPos  int
+	counterLock *sync.Mutex
 )
 
 func init() {
@@ -168,6 +169,27 @@ func increaseCountForTheSecond() {
 	counterLoop[counterPos] = counterLoop[counterPos] + 1
 }
 
+func increaseTrafficForTheSecond(n int64) {
+	if n <= 0 {
+		return
+	}
+	counterLock.Lock()
+	defer counterLock.Unlock()
+
+	trafficLoop[counterPos] = trafficLoop[counterPos] + n
+}
+
+func sumTraffic() int64 {
+	counterLock.Lock()
+	defer counterLock.Unlock()
+
+	var ret int64 = 0
+	for _, v := range trafficLoop {
+		ret += v
+	}
+	return ret
+}
+
 func sumCounter() int {
 	counterLock.Lock()
 	defer counterLock.Unlock()
@@ -189,14 +211,6 @@ func startCounterLoop() {
 			counterPos = 0
 		}
 		counterLoop[counterPos] = 0
+		trafficLoop[counterPos] = 0
 	})
 }
-
-func limit() {
-	s := sumCounter()
-	if s > 0 {
-		a := int(float32(s) / float32(counterLoopSize) * millionSecPerUpload)
-		// fmt.Println(s, "sleep ", a, "ms")
-		time.Sleep(time.Millisecond * time.Duration(a))
-	}
-}
@@ -1,12 +1,18 @@
 package svc
 
 import (
+	"bufio"
 	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/gox/logger"
 	"github.com/hetianyi/gox/set"
+	"io"
+	"os"
 	"sync"
 )
 
+// datasetStep is the continuous fileId space of every slot in the append file.
+const datasetStep = 2
+
 var (
 	dataset   *set.DataSet
 	initLock  *sync.Mutex
@@ -49,18 +55,13 @@ func initDataSet() error {
 
 	logger.Debug("slot size: ", slotSize)
 
-	dataDir := ""
-	if common.BootAs == common.BOOT_TRACKER {
-		dataDir = common.InitializedTrackerConfiguration.DataDir
-	} else {
-		dataDir = common.InitializedStorageConfiguration.DataDir
-	}
+	dataDir := datasetDir()
 
 	m, err := set.NewFileMap(slotNum, 8, dataDir+"/index")
 	if err != nil {
 		return err
 	}
-	a, err := set.NewAppendFile(slotSize, 2, dataDir+"/aof")
+	a, err := set.NewAppendFile(slotSize, datasetStep, dataDir+"/aof")
 	if err != nil {
 		return err
 	}
@@ -72,6 +73,59 @@ func initDataSet() error {
 	return nil
 }
 
+func datasetDir() string {
+	if common.BootAs == common.BOOT_TRACKER {
+		return common.InitializedTrackerConfiguration.DataDir
+	}
+	return common.InitializedStorageConfiguration.DataDir
+}
+
+// walkDataSet walks fileIds in the dataset database by reading its append file,
+// it stops if the handler returns false.
+func walkDataSet(handler func(fileId string) bool) error {
+	return walkDataSetFrom(0, func(pos int64, fileId string) bool {
+		return handler(fileId)
+	})
+}
+
+// walkDataSetFrom walks fileIds in the dataset database from the entry position,
+// the handler gets the position of every fileId and it stops if the handler returns false.
+//
+// The append file consists of blocks of the same size, each block holds datasetStep fileIds
+// followed by a byte which is 1 if the fileId is present, and the address of the next block.
+func walkDataSetFrom(start int64, handler func(pos int64, fileId string) bool) error {
+	f, err := os.Open(datasetDir() + "/aof")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entrySize := common.FILE_ID_SIZE + 1
+	block := make([]byte, entrySize*datasetStep+9)
+	pos := start - start%datasetStep
+	if _, err := f.Seek(pos/datasetStep*int64(len(block)), io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(f, len(block)*256)
+	for ; ; pos += datasetStep {
+		if _, err := io.ReadFull(r, block); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+		for i := 0; i < datasetStep; i++ {
+			entry := block[entrySize*i : entrySize*(i+1)]
+			if pos+int64(i) < start || entry[common.FILE_ID_SIZE] != 1 {
+				continue
+			}
+			if !handler(pos+int64(i), string(entry[:common.FILE_ID_SIZE])) {
+				return nil
+			}
+		}
+	}
+}
+
 // Add adds fileId to dataset database.
 func Add(fileId string) error {
 	return dataset.Add([]byte(fileId))
@@ -0,0 +1,611 @@
+package svc
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/file"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	"github.com/hetianyi/gox/uuid"
+	json "github.com/json-iterator/go"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	drLinkPosKey      = "drLinkPos"
+	drLinkInterval    = time.Second * 10
+	drLinkWorkers     = 4                // parallel file pushes of the replication link
+	drLinkRetryBatch  = 50               // files given up before which are retried in a round
+	maxDrLinkAttempts = 10               // a file failed this many times in a row is given up
+	maxDrLinkWaits    = 360              // a file not synchronized to this server after this many checks is given up
+	maxDrLinkBackoff  = time.Minute * 10 // the longest delay of rounds after failures
+)
+
+var (
+	// replication link to the disaster recovery cluster, nil if it is not configured.
+	drLink *drLinkState
+	// serializes importing secrets of source clusters.
+	importSecretLock = new(sync.Mutex)
+)
+
+// drLinkState follows the local binlog and pushes files to storage servers of the disaster recovery cluster.
+//
+// Files are pushed in the order of the binlog, the position only advances past pushed files,
+// so the link continues from where it stops after restart.
+// A file which keeps failing while the disaster recovery cluster is available is given up
+// to unblock the files after it, it is saved in the retry bucket and retried every round until it is pushed.
+type drLinkState struct {
+	lock       *sync.Mutex
+	targets    []common.Server
+	pos        common.BinlogQueryDTO
+	attempts   int // failed attempts in a row of the file at the position
+	waits      int // checks of the file at the position which is not synchronized to this server
+	failures   int // failed rounds in a row
+	nextRound  time.Time
+	retryAfter string // fileId after which files given up before are retried next round
+	pushed     int64
+	lastPush   int64
+	lastError  string
+}
+
+// initDrLink starts the replication link if storage servers of the disaster recovery cluster are configured.
+//
+// The link should be enabled on only one member of a group,
+// because every member holds the files of the whole group.
+func initDrLink() {
+	targets := common.InitializedStorageConfiguration.ParsedDrStorages
+	if len(targets) == 0 {
+		return
+	}
+	l, err := newDrLink(targets)
+	if err != nil {
+		logger.Error("error load replication link position: ", err)
+		return
+	}
+	drLink = l
+	logger.Info("replication link to ", len(targets), " disaster recovery storage servers starts from binlog ",
+		l.pos.FileIndex, ":", l.pos.Offset)
+	timer.Start(drLinkInterval, drLinkInterval, 0, func(t *timer.Timer) {
+		if isBootstrapping() || !l.due() {
+			return
+		}
+		l.follow()
+	})
+}
+
+// newDrLink creates the replication link from the saved position.
+func newDrLink(targets []common.Server) (*drLinkState, error) {
+	l := &drLinkState{
+		lock:    new(sync.Mutex),
+		targets: targets,
+	}
+	bs, err := common.GetConfigMap().GetConfig(drLinkPosKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) > 0 {
+		if err := json.Unmarshal(bs, &l.pos); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// follow pushes files of local binlogs from the position until the latest binlog,
+// or until a file which is not synchronized to this server yet.
+func (l *drLinkState) follow() {
+	reader, ok := writableBinlogManager.(binlog.FeedReader)
+	if !ok {
+		logger.Error("binlog manager cannot be read by position")
+		return
+	}
+	targets := l.checkTargets()
+	if len(targets) == 0 {
+		// the position never advances while the disaster recovery cluster is unavailable.
+		l.fail(errors.New("no disaster recovery storage server available"), false)
+		l.backOff()
+		return
+	}
+	l.retryGivenUp(targets)
+	pos := l.position()
+	for {
+		records, _, err := reader.ReadFeed(pos.FileIndex, pos.Offset, syncFetchSize)
+		if err != nil {
+			logger.Debug("error read binlog: ", err)
+			return
+		}
+		if len(records) == 0 {
+			if writableBinlogManager.GetCurrentIndex() <= pos.FileIndex {
+				return
+			}
+			// move to the next binlog file.
+			pos = common.BinlogQueryDTO{FileIndex: pos.FileIndex + 1}
+			if err := l.advance(pos, false, nil); err != nil {
+				return
+			}
+			continue
+		}
+		// files are pushed in the order of the binlog.
+		n := len(records)
+		for i := range records {
+			info, _, err := util.ParseAlias(records[i].Binlog.FileId, common.InitializedStorageConfiguration.Secret)
+			if err == nil && !util.ExistsFile(info) {
+				n = i
+				break
+			}
+		}
+		if n == 0 {
+			// a file lost on every group member never comes, it is given up after waiting for long.
+			err := errors.New("waiting for file " + records[0].Binlog.FileId + " to be synchronized")
+			if !l.wait(err) {
+				return
+			}
+			pos.Offset = records[0].Offset
+			if err := l.giveUp(&records[0].Binlog, pos, err); err != nil {
+				return
+			}
+			continue
+		}
+		errs := l.pushAll(targets, records[:n])
+		for i := 0; i < n; i++ {
+			pos.Offset = records[i].Offset
+			if err := errs[i]; err != nil {
+				if !l.fail(err, true) {
+					l.backOff()
+					return
+				}
+				if err := l.giveUp(&records[i].Binlog, pos, err); err != nil {
+					return
+				}
+				continue
+			}
+			if err := l.advance(pos, true, nil); err != nil {
+				return
+			}
+		}
+		if n < len(records) {
+			return
+		}
+	}
+}
+
+// pushAll pushes files of the binlogs by parallel workers and returns the error of every file.
+func (l *drLinkState) pushAll(targets []common.Server, records []binlog.FeedRecord) []error {
+	errs := make([]error, len(records))
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < drLinkWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				errs[j] = pushDrFile(targets, &records[j].Binlog)
+			}
+		}()
+	}
+	for i := range records {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return errs
+}
+
+// pushDrFile pushes a file to the first available storage server of the disaster recovery cluster,
+// the file is synchronized to the other members of that group by the group itself.
+func pushDrFile(targets []common.Server, bl *common.BingLogDTO) error {
+	info, secret, err := util.ParseAlias(bl.FileId, common.InitializedStorageConfiguration.Secret)
+	if err != nil {
+		return errors.New("cannot parse alias: " + bl.FileId)
+	}
+	fullPath := common.InitializedStorageConfiguration.DataDir + "/" + info.Path
+	meta, err := common.GetConfigMap().GetFileMeta(bl.FileId)
+	if err != nil {
+		logger.Debug("error get file meta: ", err)
+	}
+	var lastErr error
+	for i := range targets {
+		lastErr = func() error {
+			fi, err := os.Open(fullPath)
+			if err != nil {
+				return err
+			}
+			defer fi.Close()
+			stat, err := fi.Stat()
+			if err != nil {
+				return err
+			}
+			// the reference count mark is not a part of the content.
+			length := stat.Size() - int64(len(tailRefCount))
+			if length < 0 {
+				return errors.New("invalid format file")
+			}
+			_, err = clientAPI.Import(&targets[i], bl.FileId, secret, meta, io.LimitReader(fi, length), length)
+			return err
+		}()
+		if lastErr == nil {
+			return nil
+		}
+		logger.Debug("error replicate file ", bl.FileId, " to ", targets[i].ConnectionString(), ": ", lastErr)
+	}
+	return lastErr
+}
+
+// checkTargets returns the storage servers of the disaster recovery cluster which are available
+// and in the group of this server, all of them are checked every round.
+//
+// Clients look for a file in the group of its fileId, so servers of other groups are dropped.
+func (l *drLinkState) checkTargets() []common.Server {
+	l.lock.Lock()
+	targets := l.targets
+	l.lock.Unlock()
+
+	group := common.InitializedStorageConfiguration.Group
+	var ret, keep []common.Server
+	for i := range targets {
+		t := targets[i]
+		attrs, err := clientAPI.Ping(&t)
+		if err != nil {
+			logger.Debug("error check disaster recovery storage server ", t.ConnectionString(), ": ", err)
+			keep = append(keep, t)
+			continue
+		}
+		if attrs["group"] != group {
+			logger.Error("disaster recovery storage server ", t.ConnectionString(), " is in group \"",
+				attrs["group"], "\" instead of \"", group, "\", files are not replicated to it")
+			continue
+		}
+		ret = append(ret, t)
+		keep = append(keep, t)
+	}
+	l.lock.Lock()
+	l.targets = keep
+	l.lock.Unlock()
+	return ret
+}
+
+// retryGivenUp pushes files given up before, a round retries at most drLinkRetryBatch files
+// and the next round continues after them.
+func (l *drLinkState) retryGivenUp(targets []common.Server) {
+	l.lock.Lock()
+	after := l.retryAfter
+	l.lock.Unlock()
+
+	bls, err := common.GetConfigMap().GetDrRetries(after, drLinkRetryBatch)
+	if err != nil {
+		logger.Error("error load files to retry of replication link: ", err)
+		return
+	}
+	if len(bls) < drLinkRetryBatch {
+		after = ""
+	} else {
+		after = bls[len(bls)-1].FileId
+	}
+	l.lock.Lock()
+	l.retryAfter = after
+	l.lock.Unlock()
+
+	for i := range bls {
+		info, _, err := util.ParseAlias(bls[i].FileId, common.InitializedStorageConfiguration.Secret)
+		if err != nil || !util.ExistsFile(info) {
+			continue
+		}
+		if err := pushDrFile(targets, &bls[i]); err != nil {
+			logger.Debug("error retry replicating file ", bls[i].FileId, " to disaster recovery cluster: ", err)
+			continue
+		}
+		if err := common.GetConfigMap().RemoveDrRetry(bls[i].FileId); err != nil {
+			logger.Error("error remove file to retry of replication link: ", err)
+			continue
+		}
+		logger.Info("file ", bls[i].FileId, " given up before is replicated to disaster recovery cluster")
+		l.lock.Lock()
+		l.pushed++
+		l.lastPush = time.Now().Unix()
+		l.lock.Unlock()
+	}
+}
+
+func (l *drLinkState) position() common.BinlogQueryDTO {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.pos
+}
+
+// advance saves the position after the file which is pushed or given up,
+// or at the beginning of the next binlog file if isFile is false.
+func (l *drLinkState) advance(pos common.BinlogQueryDTO, isFile bool, err error) error {
+	bs, e := json.Marshal(&pos)
+	if e != nil {
+		return e
+	}
+	if e := common.GetConfigMap().PutConfig(drLinkPosKey, bs); e != nil {
+		logger.Error("error save replication link position: ", e)
+		return e
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.pos = pos
+	l.attempts = 0
+	l.waits = 0
+	l.failures = 0
+	l.nextRound = time.Time{}
+	if !isFile || err != nil {
+		return nil
+	}
+	l.pushed++
+	l.lastPush = time.Now().Unix()
+	l.lastError = ""
+	return nil
+}
+
+// giveUp saves the file at the position to the retry bucket and advances the position past it.
+func (l *drLinkState) giveUp(bl *common.BingLogDTO, pos common.BinlogQueryDTO, err error) error {
+	logger.Error("give up replicating file ", bl.FileId, " to disaster recovery cluster and retry it later: ", err)
+	if e := common.GetConfigMap().PutDrRetry(bl); e != nil {
+		logger.Error("error save file to retry of replication link: ", e)
+		return e
+	}
+	return l.advance(pos, true, err)
+}
+
+// backOff delays the next round after a failed round.
+func (l *drLinkState) backOff() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.failures < 16 {
+		l.failures++
+	}
+	delay := drLinkInterval << uint(l.failures-1)
+	if delay > maxDrLinkBackoff {
+		delay = maxDrLinkBackoff
+	}
+	l.nextRound = time.Now().Add(delay)
+}
+
+// due checks if the next round is not delayed by backOff.
+func (l *drLinkState) due() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return !time.Now().Before(l.nextRound)
+}
+
+// fail records the error of the file at the position,
+// it returns true if the file is failed too many times and should be given up.
+func (l *drLinkState) fail(err error, attempt bool) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.lastError = err.Error()
+	if !attempt {
+		return false
+	}
+	l.attempts++
+	return l.attempts >= maxDrLinkAttempts
+}
+
+// wait records the file at the position is not synchronized to this server yet,
+// it returns true if the file is waited for too long and should be given up.
+func (l *drLinkState) wait(err error) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.lastError = err.Error()
+	l.waits++
+	return l.waits >= maxDrLinkWaits
+}
+
+// status returns the state of the replication link, the lag is computed from the local binlog.
+func (l *drLinkState) status() *common.DrLinkStatusDTO {
+	l.lock.Lock()
+	ret := &common.DrLinkStatusDTO{
+		Position: l.pos,
+		Pushed:   l.pushed,
+		LastPush: l.lastPush,
+		Error:    l.lastError,
+	}
+	targets := l.targets
+	l.lock.Unlock()
+
+	for _, t := range targets {
+		ret.Targets = append(ret.Targets, t.ConnectionString())
+	}
+	// files given up are skipped until they are retried successfully.
+	skipped, err := common.GetConfigMap().CountDrRetries()
+	if err != nil {
+		ret.Error = err.Error()
+	}
+	ret.Skipped = int64(skipped)
+	lag, err := binlogLag(ret.Position)
+	if err != nil {
+		ret.Gap = -1
+		if ret.Error == "" {
+			ret.Error = err.Error()
+		}
+		return ret
+	}
+	ret.Gap = lag.Gap
+	if now := time.Now().Unix(); lag.Oldest > 0 && now > lag.Oldest {
+		ret.OldestUnsyncedAge = now - lag.Oldest
+	}
+	return ret
+}
+
+// importFileHandler imports a file replicated from another cluster keeping its fileId.
+//
+// The attribute "secret" is the secret of the source cluster, it is imported into the history secrets
+// so that the fileId can be resolved in this cluster. If the attribute "check" is "true",
+// it only answers whether the file exists in the attribute "exists".
+// Only files of the group of this server are imported, clients look for files by the group in the fileId.
+func importFileHandler(header *common.Header, bodyReader io.Reader, bodyLength int64,
+	remoteAddr net.Addr) (*common.Header, io.Reader, int64, error) {
+	// drop the file body to keep the connection reusable if the file is not imported.
+	reject := func(msg string) (*common.Header, io.Reader, int64, error) {
+		if _, err := io.Copy(ioutil.Discard, io.LimitReader(bodyReader, bodyLength)); err != nil {
+			return nil, nil, 0, err
+		}
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    msg,
+		}, nil, 0, nil
+	}
+	fileId := header.Attributes["fileId"]
+	fInfo, err := parseImportedAlias(fileId, header.Attributes["secret"], remoteAddr)
+	if err != nil {
+		return reject(err.Error())
+	}
+	exists, err := Contains(fileId)
+	if err != nil {
+		return reject(err.Error())
+	}
+	exists = exists && util.ExistsFile(fInfo)
+	if header.Attributes["check"] == "true" || exists {
+		if _, err := io.Copy(ioutil.Discard, io.LimitReader(bodyReader, bodyLength)); err != nil {
+			return nil, nil, 0, err
+		}
+		return &common.Header{
+			Result: common.SUCCESS,
+			Attributes: map[string]string{
+				"exists": convert.BoolToStr(exists),
+			},
+		}, nil, 0, nil
+	}
+	if msg := uploadRejectedMsg(); msg != "" {
+		return reject(msg)
+	}
+
+	increaseCountForTheSecond()
+	defer beginUpload()()
+
+	tmpFileName := common.InitializedStorageConfiguration.TmpDir + "/" + uuid.UUID()
+	out, err := file.CreateFile(tmpFileName)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer func() {
+		out.Close()
+		file.Delete(tmpFileName)
+	}()
+	h := util.CreateMd5Hash()
+	n, err := io.Copy(io.MultiWriter(out, h), &trafficReader{io.LimitReader(bodyReader, bodyLength)})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if n != bodyLength {
+		return nil, nil, 0, io.ErrUnexpectedEOF
+	}
+	md5 := fInfo.Path[len(fInfo.Path)-32:]
+	if s := util.GetMd5HashString(h); s != md5 {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "md5 mismatch of file " + fileId + ": expect " + md5 + ", got " + s,
+		}, nil, 0, nil
+	}
+	// write reference count mark.
+	if _, err := out.Write(tailRefCount); err != nil {
+		return nil, nil, 0, err
+	}
+	out.Close()
+
+	saveFileMeta(fileId, header.Attributes["name"], header.Attributes["contentType"])
+	if err := fireFileEvent(common.WEBHOOK_FILE_REPLICATED, fileId, bodyLength, fInfo.InstanceId); err != nil {
+		return nil, nil, 0, err
+	}
+	if err := storeReplicaFile(fileId, fInfo, tmpFileName); err != nil {
+		return nil, nil, 0, err
+	}
+	// the file is imported as if it is uploaded to this server,
+	// so that it is synchronized to the group members from this server.
+	if err := DoIfNotExist(fileId, func() error {
+		if err := writableBinlogManager.Write(binlog.CreateLocalBinlog(fileId,
+			bodyLength, common.InitializedStorageConfiguration.InstanceId)); err != nil {
+			return errors.New("error writing binlog: " + err.Error())
+		}
+		return Add(fileId)
+	}); err != nil {
+		return nil, nil, 0, err
+	}
+	reportReplica(fileId)
+	return &common.Header{
+		Result: common.SUCCESS,
+		Attributes: map[string]string{
+			"exists": "false",
+		},
+	}, nil, 0, nil
+}
+
+// parseImportedAlias parses a fileId of another cluster,
+// the secret of that cluster is imported into the history secrets the first time.
+//
+// History secrets are registered to tracker servers, which distribute them to the whole cluster,
+// so a secret is only imported from the hosts of the source cluster in DrSources.
+func parseImportedAlias(fileId, secret string, remoteAddr net.Addr) (*common.FileInfo, error) {
+	info, _, err := util.ParseAlias(fileId, common.InitializedStorageConfiguration.Secret)
+	imported := false
+	if err != nil && secret != "" {
+		info, err = util.ParseAliasWithSecret(fileId, secret)
+		imported = err == nil
+	}
+	if err != nil {
+		return nil, errors.New("cannot parse alias: " + fileId)
+	}
+	if group := common.InitializedStorageConfiguration.Group; info.Group != group {
+		return nil, errors.New("file of group \"" + info.Group + "\" cannot be imported into group \"" + group + "\"")
+	}
+	if !imported {
+		return info, nil
+	}
+	host, _, _ := net.SplitHostPort(remoteAddr.String())
+	if !isDrSource(host) {
+		return nil, errors.New("secret of the source cluster is not accepted from " + host)
+	}
+
+	importSecretLock.Lock()
+	defer importSecretLock.Unlock()
+
+	if err := util.StoreSecrets(info.InstanceId, secret); err != nil {
+		return nil, err
+	}
+	secrets, err := util.GetSecrets()
+	if err != nil {
+		return nil, err
+	}
+	common.SetHistorySecrets(secrets)
+	logger.Info("secret of instance ", info.InstanceId, " is imported from ", host)
+	return info, nil
+}
+
+// isDrSource judges whether the host is a storage server of the source cluster in DrSources.
+func isDrSource(host string) bool {
+	for _, s := range common.InitializedStorageConfiguration.DrSources {
+		if s == "" {
+			continue
+		}
+		if s == host {
+			return true
+		}
+		addrs, err := net.LookupHost(s)
+		if err != nil {
+			logger.Debug("error resolve disaster recovery source ", s, ": ", err)
+			continue
+		}
+		for _, addr := range addrs {
+			if addr == host {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package svc
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/file"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDrAPI is the storage servers of the disaster recovery cluster.
+type fakeDrAPI struct {
+	api.ClientAPI
+	lock     sync.Mutex
+	down     bool
+	failing  map[string]bool
+	imported []string
+}
+
+func (f *fakeDrAPI) Ping(server *common.Server) (map[string]string, error) {
+	if f.down {
+		return nil, errors.New("connection refused")
+	}
+	return map[string]string{"group": "G01"}, nil
+}
+
+func (f *fakeDrAPI) Import(server *common.Server, fileId string, secret string, meta map[string]string,
+	src io.Reader, length int64) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.down {
+		return false, errors.New("connection refused")
+	}
+	if f.failing[fileId] {
+		return false, errors.New("import failed")
+	}
+	if _, err := io.Copy(ioutil.Discard, src); err != nil {
+		return false, err
+	}
+	f.imported = append(f.imported, fileId)
+	return true, nil
+}
+
+// storeTestFile stores a file in the data dir and writes its binlog.
+func storeTestFile(t *testing.T, i int) string {
+	fileId := writeTestFile(t, i)
+	if err := writableBinlogManager.Write(binlog.CreateLocalBinlog(fileId, 7,
+		common.InitializedStorageConfiguration.InstanceId)); err != nil {
+		t.Fatal(err)
+	}
+	return fileId
+}
+
+// writeTestFile stores a file in the data dir.
+func writeTestFile(t *testing.T, i int) string {
+	md5 := strconv.Itoa(i) + "0123456789abcdef0123456789abcdef"[1:]
+	fileId := util.CreateAlias("G01/00/01/"+md5, common.InitializedStorageConfiguration.InstanceId, false, time.Now())
+	fullPath := common.InitializedStorageConfiguration.DataDir + "/00/01/" + md5
+	if err := file.CreateDirs(common.InitializedStorageConfiguration.DataDir + "/00/01"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fullPath, append([]byte("content"), tailRefCount...), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return fileId
+}
+
+// followNow runs a round of the replication link ignoring the backoff.
+func followNow(l *drLinkState) {
+	l.lock.Lock()
+	l.nextRound = time.Time{}
+	l.lock.Unlock()
+	l.follow()
+}
+
+func TestDrLinkPushAdvanceResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	initTestConfigMap(t, common.BOOT_STORAGE)
+	common.InitializedStorageConfiguration = &common.StorageConfig{
+		DataDir:    dir,
+		Group:      "G01",
+		InstanceId: "storage1",
+		Secret:     "123456",
+	}
+	util.GenerateDecKey("123456")
+	writableBinlogManager = binlog.NewXBinlogManager(binlog.LOCAL_BINLOG_MANAGER)
+	fake := &fakeDrAPI{failing: make(map[string]bool)}
+	clientAPI = fake
+	defer func() {
+		clientAPI = nil
+	}()
+	targets := []common.Server{{Host: "127.0.0.1", Port: 1024}}
+
+	f1, f2, f3 := storeTestFile(t, 1), storeTestFile(t, 2), storeTestFile(t, 3)
+	l, err := newDrLink(targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the disaster recovery cluster is down for long, nothing is given up.
+	fake.lock.Lock()
+	fake.down = true
+	fake.lock.Unlock()
+	for i := 0; i < maxDrLinkAttempts*3; i++ {
+		followNow(l)
+	}
+	if s := l.status(); s.Pushed != 0 || s.Skipped != 0 || s.Position.Offset != 0 {
+		t.Fatal("expect nothing pushed or skipped, got ", s.Pushed, s.Skipped, s.Position)
+	}
+	if l.due() {
+		t.Fatal("expect the next round to be delayed")
+	}
+
+	// the cluster is back but the second file keeps failing,
+	// files after it are pushed again after it is given up.
+	fake.lock.Lock()
+	fake.down = false
+	fake.failing[f2] = true
+	fake.lock.Unlock()
+	followNow(l)
+	if s := l.status(); s.Pushed != 1 || countImported(fake, f1) != 1 {
+		t.Fatal("expect ", f1, " pushed, got ", fake.imported)
+	}
+	for i := 1; i < maxDrLinkAttempts; i++ {
+		followNow(l)
+	}
+	if s := l.status(); s.Pushed != 2 || s.Skipped != 1 || s.Gap != 0 || countImported(fake, f3) == 0 {
+		t.Fatal("expect ", f3, " pushed and 1 skipped, got ", s.Pushed, s.Skipped, s.Gap)
+	}
+
+	// the file given up is retried.
+	fake.lock.Lock()
+	fake.failing[f2] = false
+	fake.lock.Unlock()
+	followNow(l)
+	if s := l.status(); s.Skipped != 0 || s.Pushed != 3 || countImported(fake, f2) != 1 {
+		t.Fatal("expect ", f2, " pushed by retry, got ", s.Skipped, s.Pushed)
+	}
+
+	// the link resumes from the saved position after restart.
+	f4 := storeTestFile(t, 4)
+	l, err = newDrLink(targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	followNow(l)
+	if countImported(fake, f4) != 1 || countImported(fake, f1) != 1 || countImported(fake, f2) != 1 {
+		t.Fatal("expect only ", f4, " pushed after restart, got ", fake.imported)
+	}
+}
+
+func countImported(f *fakeDrAPI, fileId string) int {
+	n := 0
+	for _, v := range f.imported {
+		if v == fileId {
+			n++
+		}
+	}
+	return n
+}
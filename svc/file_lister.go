@@ -0,0 +1,181 @@
+package svc
+
+import (
+	"bytes"
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/convert"
+	json "github.com/json-iterator/go"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+	// maxListScan limits the records scanned by one page,
+	// a page with fewer files than the limit and a non-empty cursor
+	// means the scan budget is exhausted rather than the listing is finished.
+	maxListScan = 20000
+)
+
+// parseListQuery parses the list query in the header and normalizes the page size.
+func parseListQuery(header *common.Header) (*common.ListQueryDTO, error) {
+	if header.Attributes == nil || header.Attributes["query"] == "" {
+		return nil, errors.New("invalid header: missing list query")
+	}
+	query := &common.ListQueryDTO{}
+	if err := json.UnmarshalFromString(header.Attributes["query"], query); err != nil {
+		return nil, errors.New("invalid list query: " + err.Error())
+	}
+	if query.Limit <= 0 {
+		query.Limit = defaultListLimit
+	}
+	if query.Limit > maxListLimit {
+		query.Limit = maxListLimit
+	}
+	return query, nil
+}
+
+// listResponse writes the listing result into the body,
+// because a page of files easily exceeds the limit of the header size.
+func listResponse(result *common.ListResultDTO, err error) (*common.Header, io.Reader, int64, error) {
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	bs, err := json.Marshal(result)
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+	}, bytes.NewReader(bs), int64(len(bs)), nil
+}
+
+// listFilesHandler lists files stored on the storage server by walking its dataset,
+// files which are known by binlogs but not synchronized to this server yet are not listed.
+//
+// The cursor is the dataset position of the next file,
+// so it is only valid on the storage server which returned it.
+// Files stored while listing may be missed if they take free positions before the cursor.
+func listFilesHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	query, err := parseListQuery(header)
+	if err != nil {
+		return listResponse(nil, err)
+	}
+	return listResponse(listLocalFiles(query))
+}
+
+func listLocalFiles(query *common.ListQueryDTO) (*common.ListResultDTO, error) {
+	var start int64
+	if query.Cursor != "" {
+		var err error
+		if start, err = convert.StrToInt64(query.Cursor); err != nil || start < 0 {
+			return nil, errors.New("invalid cursor: " + query.Cursor)
+		}
+	}
+	result := &common.ListResultDTO{Files: []*common.ListItemDTO{}}
+	scanned := 0
+	err := walkDataSetFrom(start, func(pos int64, fileId string) bool {
+		if len(result.Files) >= query.Limit || scanned >= maxListScan {
+			result.Cursor = convert.Int64ToStr(pos)
+			return false
+		}
+		scanned++
+		info, _, err := util.ParseAlias(fileId, common.InitializedStorageConfiguration.Secret)
+		if err != nil {
+			return true
+		}
+		stat, err := os.Stat(common.InitializedStorageConfiguration.DataDir + "/" + info.Path)
+		if err != nil {
+			return true
+		}
+		// the reference count mark is not a part of the content.
+		info.FileLength = stat.Size() - int64(len(tailRefCount))
+		if item := matchFileInfo(query, fileId, info); item != nil {
+			result.Files = append(result.Files, item)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// parseBinlogCursor parses a binlog cursor "fileIndex:offset", empty cursor starts from the first binlog.
+func parseBinlogCursor(cursor string) (fileIndex int, offset int64, err error) {
+	if cursor == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(cursor, ":")
+	if len(parts) == 2 {
+		if fileIndex, err = convert.StrToInt(parts[0]); err == nil {
+			if offset, err = convert.StrToInt64(parts[1]); err == nil && fileIndex >= 0 && offset >= 0 {
+				return fileIndex, offset, nil
+			}
+		}
+	}
+	return 0, 0, errors.New("invalid cursor: " + cursor)
+}
+
+// trackerListFilesHandler lists files known by the tracker,
+// which are collected from the binlogs pushed by storage servers.
+//
+// The cursor is the last fileId of the previous page,
+// files are ordered by fileId so the cursor is valid on every tracker.
+func trackerListFilesHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	query, err := parseListQuery(header)
+	if err != nil {
+		return listResponse(nil, err)
+	}
+	result := &common.ListResultDTO{Files: []*common.ListItemDTO{}}
+	scanned := 0
+	last := query.Cursor
+	finished := true
+	err = common.GetConfigMap().IterateFiles(query.Cursor, func(fileId string, size int64) bool {
+		if len(result.Files) >= query.Limit || scanned >= maxListScan {
+			finished = false
+			return false
+		}
+		scanned++
+		last = fileId
+		if item := matchListItem(query, fileId, size, ""); item != nil {
+			result.Files = append(result.Files, item)
+		}
+		return true
+	})
+	if !finished {
+		result.Cursor = last
+	}
+	return listResponse(result, err)
+}
+
+// matchListItem returns the list item of the file if it matches the query.
+func matchListItem(query *common.ListQueryDTO, fileId string, size int64, secret string) *common.ListItemDTO {
+	info, _, err := util.ParseAlias(fileId, secret)
+	if err != nil {
+		return nil
+	}
+	info.FileLength = size
+	return matchFileInfo(query, fileId, info)
+}
+
+// matchFileInfo returns the list item of the parsed file if it matches the query.
+func matchFileInfo(query *common.ListQueryDTO, fileId string, info *common.FileInfo) *common.ListItemDTO {
+	if !query.Match(info) {
+		return nil
+	}
+	return &common.ListItemDTO{
+		FileId:   fileId,
+		FileInfo: *info,
+	}
+}
@@ -0,0 +1,84 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestListLocalFilesPaging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	initTestConfigMap(t, common.BOOT_STORAGE)
+	common.InitializedStorageConfiguration = &common.StorageConfig{
+		DataDir:    dir,
+		Group:      "G01",
+		InstanceId: "storage1",
+		Secret:     "123456",
+	}
+	util.GenerateDecKey("123456")
+	initTestDataSet(t)
+
+	stored := make(map[string]bool)
+	for i := 1; i <= 5; i++ {
+		fileId := writeTestFile(t, i)
+		if err := Add(fileId); err != nil {
+			t.Fatal(err)
+		}
+		stored[fileId] = true
+	}
+	// a file known by the dataset but not synchronized yet is not listed.
+	missing := util.CreateAlias("G01/00/02/0123456789abcdef0123456789abcdef", "storage2", false, time.Now())
+	if err := Add(missing); err != nil {
+		t.Fatal(err)
+	}
+
+	listed := make(map[string]bool)
+	query := &common.ListQueryDTO{Group: "G01", Limit: 2}
+	for pages := 1; ; pages++ {
+		ret, err := listLocalFiles(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ret.Files) > 2 {
+			t.Fatal("expect at most 2 files in a page, got ", len(ret.Files))
+		}
+		for _, f := range ret.Files {
+			if !stored[f.FileId] || listed[f.FileId] {
+				t.Fatal("unexpected file listed ", f.FileId)
+			}
+			// the reference count mark is not a part of the content.
+			if f.FileLength != 7 || f.InstanceId != "storage1" {
+				t.Fatal("unexpected file info ", f.FileLength, f.InstanceId)
+			}
+			listed[f.FileId] = true
+		}
+		if ret.Cursor == "" {
+			break
+		}
+		if pages > 5 {
+			t.Fatal("expect the listing finished")
+		}
+		query.Cursor = ret.Cursor
+	}
+	if len(listed) != len(stored) {
+		t.Fatal("expect ", len(stored), " files listed, got ", len(listed))
+	}
+
+	ret, err := listLocalFiles(&common.ListQueryDTO{Group: "G01", Limit: 10, MinSize: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret.Files) != 0 || ret.Cursor != "" {
+		t.Fatal("expect no file larger than 7 bytes, got ", len(ret.Files))
+	}
+	if _, err := listLocalFiles(&common.ListQueryDTO{Cursor: "x", Limit: 10}); err == nil {
+		t.Fatal("expect invalid cursor")
+	}
+}
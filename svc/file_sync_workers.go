@@ -0,0 +1,177 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/logger"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const syncCheckpointInterval = time.Second
+
+var (
+	// tasks of the file synchronization worker pool.
+	syncTasks = make(chan *syncTask)
+)
+
+// syncTask is a file to be synchronized by the worker pool,
+// done is called with the result when the file is finished.
+type syncTask struct {
+	binlog *common.BingLogDTO
+	done   func(err error)
+}
+
+// startSyncWorkers starts the worker pool of file synchronization.
+//
+// Files which are downloading are still deduplicated by registerDownloadingFile,
+// so a file referred by more than one binlog is downloaded once,
+// and the duplicate waits for the result of the download in flight.
+func startSyncWorkers(workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range syncTasks {
+				task.done(syncFile(task.binlog, nil))
+			}
+		}()
+	}
+}
+
+// syncCheckpoint advances the download binlog position
+// only past the contiguous prefix of finished binlogs.
+//
+// Binlogs are finished out of order by workers, a binlog finished early waits
+// until all binlogs before it are finished, so a crash never skips a file.
+// Positions before failed binlogs are saved together with the position
+// and files of them are retried by retryFiles.
+type syncCheckpoint struct {
+	lock     *sync.Mutex
+	next     int64                         // sequence of the first unfinished binlog
+	finished map[int64]*syncCheckpointTask // binlogs finished out of order
+	pos      common.BinlogQueryDTO         // position right after the finished prefix
+	failed   []common.BinlogQueryDTO       // positions before failed binlogs, not saved yet
+	dirty    bool
+	lastSave time.Time
+	// saveState persists the position and failed positions, saveDownloadState by default.
+	saveState func(pos *common.BinlogQueryDTO, failed []common.BinlogQueryDTO) error
+}
+
+type syncCheckpointTask struct {
+	from common.BinlogQueryDTO // position right before the binlog
+	to   common.BinlogQueryDTO // position right after the binlog
+	err  error
+}
+
+func newSyncCheckpoint(pos common.BinlogQueryDTO) *syncCheckpoint {
+	return &syncCheckpoint{
+		lock:      new(sync.Mutex),
+		finished:  make(map[int64]*syncCheckpointTask),
+		pos:       pos,
+		lastSave:  time.Now(),
+		saveState: saveDownloadState,
+	}
+}
+
+// finish marks the binlog of the sequence finished and advances the position if possible.
+func (c *syncCheckpoint) finish(seq int64, task *syncCheckpointTask) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.finished[seq] = task
+	for {
+		t := c.finished[c.next]
+		if t == nil {
+			break
+		}
+		delete(c.finished, c.next)
+		c.next++
+		c.pos = t.to
+		c.dirty = true
+		if t.err != nil {
+			c.failed = append(c.failed, t.from)
+		}
+	}
+	if c.dirty && time.Since(c.lastSave) >= syncCheckpointInterval {
+		c.save()
+	}
+}
+
+// flush saves the position which is not saved yet.
+func (c *syncCheckpoint) flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.dirty {
+		c.save()
+	}
+}
+
+func (c *syncCheckpoint) save() {
+	if err := c.saveState(&c.pos, c.failed); err != nil {
+		logger.Error("error save file synchronization position: ", err)
+		return
+	}
+	c.failed = nil
+	c.dirty = false
+	c.lastSave = time.Now()
+}
+
+// syncFromBinlogPos synchronizes files of local binlogs from the position
+// by the worker pool until the latest binlog.
+func syncFromBinlogPos(pos common.BinlogQueryDTO) {
+	reader, ok := writableBinlogManager.(binlog.FeedReader)
+	if !ok {
+		logger.Error("binlog manager cannot be read by position")
+		return
+	}
+	checkpoint := newSyncCheckpoint(pos)
+	wg := sync.WaitGroup{}
+	var seq int64
+	var failed int32
+
+	for !isBootstrapping() {
+		records, _, err := reader.ReadFeed(pos.FileIndex, pos.Offset, syncFetchSize)
+		if err != nil {
+			logger.Debug(err)
+			break
+		}
+		if len(records) == 0 {
+			if writableBinlogManager.GetCurrentIndex() <= pos.FileIndex {
+				break
+			}
+			// move to the next binlog file.
+			task := &syncCheckpointTask{from: pos}
+			pos = common.BinlogQueryDTO{FileIndex: pos.FileIndex + 1}
+			task.to = pos
+			checkpoint.finish(seq, task)
+			seq++
+			continue
+		}
+		logger.Debug("load ", len(records), " binlogs")
+		for i := range records {
+			task := &syncCheckpointTask{from: pos}
+			pos.Offset = records[i].Offset
+			task.to = pos
+			s := seq
+			seq++
+			wg.Add(1)
+			syncTasks <- &syncTask{
+				binlog: &records[i].Binlog,
+				done: func(err error) {
+					if err != nil {
+						atomic.AddInt32(&failed, 1)
+					}
+					task.err = err
+					checkpoint.finish(s, task)
+					wg.Done()
+				},
+			}
+		}
+	}
+	wg.Wait()
+	checkpoint.flush()
+	if failed > 0 {
+		logger.Debug(failed, " files failed to synchronize, they will be retried later")
+	}
+}
@@ -0,0 +1,76 @@
+package svc
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"testing"
+)
+
+func TestSyncCheckpointOutOfOrder(t *testing.T) {
+	var saved common.BinlogQueryDTO
+	var failed []common.BinlogQueryDTO
+	c := newSyncCheckpoint(common.BinlogQueryDTO{FileIndex: 0, Offset: 0})
+	c.saveState = func(pos *common.BinlogQueryDTO, f []common.BinlogQueryDTO) error {
+		saved = *pos
+		failed = append(failed, f...)
+		return nil
+	}
+	task := func(from, to int64, err error) *syncCheckpointTask {
+		return &syncCheckpointTask{
+			from: common.BinlogQueryDTO{FileIndex: 0, Offset: from},
+			to:   common.BinlogQueryDTO{FileIndex: 0, Offset: to},
+			err:  err,
+		}
+	}
+
+	// binlogs 0..3 finished as 2, 1(failed), 3, 0.
+	c.finish(2, task(20, 30, nil))
+	c.finish(1, task(10, 20, errors.New("download failed")))
+	c.finish(3, task(30, 40, nil))
+	c.flush()
+	if saved.Offset != 0 || len(failed) != 0 {
+		t.Fatal("position saved before the first binlog finished: ", saved.Offset, failed)
+	}
+
+	c.finish(0, task(0, 10, nil))
+	c.flush()
+	if saved.Offset != 40 {
+		t.Fatal("expect position 40, got ", saved.Offset)
+	}
+	if len(failed) != 1 || failed[0].Offset != 10 {
+		t.Fatal("expect failed position 10, got ", failed)
+	}
+
+	// failed positions are saved once.
+	c.finish(4, task(40, 50, nil))
+	c.flush()
+	if saved.Offset != 50 || len(failed) != 1 {
+		t.Fatal("expect position 50 and 1 failed position, got ", saved.Offset, failed)
+	}
+}
+
+func TestSyncCheckpointSaveError(t *testing.T) {
+	var failed []common.BinlogQueryDTO
+	saveErr := errors.New("disk full")
+	c := newSyncCheckpoint(common.BinlogQueryDTO{})
+	c.saveState = func(pos *common.BinlogQueryDTO, f []common.BinlogQueryDTO) error {
+		if saveErr != nil {
+			return saveErr
+		}
+		failed = append(failed, f...)
+		return nil
+	}
+	c.finish(0, &syncCheckpointTask{
+		from: common.BinlogQueryDTO{Offset: 0},
+		to:   common.BinlogQueryDTO{Offset: 10},
+		err:  errors.New("download failed"),
+	})
+	c.flush()
+
+	// failed positions are kept until they are saved.
+	saveErr = nil
+	c.flush()
+	if len(failed) != 1 || failed[0].Offset != 0 {
+		t.Fatal("expect failed position 0, got ", failed)
+	}
+}
@@ -11,103 +11,96 @@ import (
 	"github.com/hetianyi/gox/file"
 	"github.com/hetianyi/gox/logger"
 	"github.com/hetianyi/gox/timer"
-	"github.com/hetianyi/gox/uuid"
 	json "github.com/json-iterator/go"
-	"io"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const syncFetchSize = 50
+
 var (
 	downloadBinlogPosKey = []byte("downloadBinlogPos")
-	downloadingFiles     = make(map[string]byte)
+	downloadingFiles     = make(map[string]*downloadingFile)
 	downloadingFileLock  = new(sync.Mutex)
-	downloadBinlogPos    = 0
-	fetchSize            = 50
 )
 
-func registerDownloadingFile(fileId string) bool {
+// downloadingFile is a file in flight, done is closed with err set when the download finishes.
+type downloadingFile struct {
+	done chan struct{}
+	err  error
+}
+
+// registerDownloadingFile marks the file downloading,
+// it returns the download in flight and false if the file is already downloading.
+func registerDownloadingFile(fileId string) (*downloadingFile, bool) {
 	downloadingFileLock.Lock()
 	defer downloadingFileLock.Unlock()
 
-	if downloadingFiles[fileId] == 1 {
-		return false
+	if d := downloadingFiles[fileId]; d != nil {
+		return d, false
 	}
-	downloadingFiles[fileId] = 1
-	return true
+	d := &downloadingFile{done: make(chan struct{})}
+	downloadingFiles[fileId] = d
+	return d, true
 }
 
-func unregisterDownloadingFile(fileId string) {
+func unregisterDownloadingFile(fileId string, d *downloadingFile, err error) {
 	downloadingFileLock.Lock()
 	defer downloadingFileLock.Unlock()
 
 	delete(downloadingFiles, fileId)
+	d.err = err
+	close(d.done)
 }
 
 // InitFileSynchronization starts a timer job for file synchronization.
 func InitFileSynchronization() {
+	startSyncWorkers(common.InitializedStorageConfiguration.SyncWorkers)
 	timer.Start(time.Second*5, time.Second*5, 0, func(t *timer.Timer) {
-		config := common.GetConfigMap()
-		for true {
-			// filter group members.
-			ins := filterGroupMembers(api.FilterInstances(common.ROLE_STORAGE), common.InitializedStorageConfiguration.Group)
-			if ins.Len() == 0 {
-				// logger.Debug("no group member available")
-				break
-			}
+		if isBootstrapping() {
+			return
+		}
+		// filter group members.
+		ins := filterGroupMembers(api.FilterInstances(common.ROLE_STORAGE), common.InitializedStorageConfiguration.Group)
+		if ins.Len() == 0 {
+			// logger.Debug("no group member available")
+			return
+		}
 
-			// get current binlog read position
-			bs, err := config.GetConfig(string(downloadBinlogPosKey))
-			if err != nil {
+		// get current binlog read position
+		bs, err := common.GetConfigMap().GetConfig(string(downloadBinlogPosKey))
+		if err != nil {
+			logger.Debug(err)
+			return
+		}
+		pos := common.BinlogQueryDTO{}
+		if len(bs) > 0 {
+			if err := json.Unmarshal(bs, &pos); err != nil {
 				logger.Debug(err)
-				break
-			}
-
-			if n, _ := fromBinlogPos(bs, false); n == 0 {
-				break
+				return
 			}
 		}
+		syncFromBinlogPos(pos)
 	})
 	retryFiles()
 }
 
-func fromBinlogPos(bs []byte, isRetry bool) (int, []common.BingLogDTO) {
-
+// fromBinlogPos synchronizes files of binlogs from a failed binlog position again.
+func fromBinlogPos(bs []byte) []common.BingLogDTO {
 	ret := &common.BinlogQueryDTO{}
-	if bs != nil && len(bs) > 0 {
-		if err := json.Unmarshal(bs, ret); err != nil {
-			logger.Debug(err)
-			return 0, nil
-		}
+	if err := json.Unmarshal(bs, ret); err != nil {
+		logger.Debug(err)
+		return nil
 	}
-
-	old := *ret
-
-	bls, nOffset, err := writableBinlogManager.Read(ret.FileIndex, ret.Offset, 50)
+	bls, _, err := writableBinlogManager.Read(ret.FileIndex, ret.Offset, syncFetchSize)
 	if err != nil {
 		logger.Debug(err)
-		return len(bls), bls
-	}
-	ret.Offset = nOffset
-
-	if writableBinlogManager.GetCurrentIndex() > ret.FileIndex && len(bls) == 0 {
-		ret.FileIndex = ret.FileIndex + 1
-		ret.Offset = 0
+		return bls
 	}
-
-	// save config
-	// download files
-	failed := syncFiles(bls)
-
-	if !isRetry {
-		// save binlog position and fail position.
-		if err := saveDownloadStateConfig(ret, &old, failed); err != nil {
-			logger.Debug(err)
-		}
-	}
-
-	return len(bls), bls
+	syncFiles(bls)
+	return bls
 }
 
 // retryFiles starts a timer job which retries to synchronize files failed before.
@@ -160,7 +153,7 @@ func retryFiles() {
 			// retry download files.
 			gox.WalkList(temp, func(item interface{}) bool {
 				k := item.([]byte)
-				_, bls := fromBinlogPos(k, true)
+				bls := fromBinlogPos(k)
 				// check if all binlog of this position are finished.
 				finished := 0
 				for _, v := range bls {
@@ -200,7 +193,7 @@ func retryFiles() {
 	})
 }
 
-// syncFiles synchronizes files by binlogs.
+// syncFiles synchronizes files by binlogs with the worker pool.
 func syncFiles(bls []common.BingLogDTO) int {
 	if len(bls) == 0 {
 		return 0
@@ -208,25 +201,26 @@ func syncFiles(bls []common.BingLogDTO) int {
 
 	logger.Debug("load ", len(bls), " binlogs")
 
-	failed := 0
-	for _, v := range bls {
-		// skip own binlog.
-		if v.FileId == common.InitializedStorageConfiguration.InstanceId {
-			continue
-		}
-		if err := syncFile(&v, nil); err != nil {
-			failed++
+	var failed int32
+	wg := sync.WaitGroup{}
+	for i := range bls {
+		wg.Add(1)
+		syncTasks <- &syncTask{
+			binlog: &bls[i],
+			done: func(err error) {
+				if err != nil {
+					atomic.AddInt32(&failed, 1)
+				}
+				wg.Done()
+			},
 		}
 	}
-
-	return failed
+	wg.Wait()
+	return int(failed)
 }
 
 // syncFile synchronizes a single file.
-func syncFile(binlog *common.BingLogDTO, server *common.Server) error {
-
-	limit()
-
+func syncFile(binlog *common.BingLogDTO, server *common.Server) (err error) {
 	if binlog == nil {
 		return nil
 	}
@@ -251,131 +245,134 @@ func syncFile(binlog *common.BingLogDTO, server *common.Server) error {
 		// filter group members.
 		ins = filterGroupMembers(ins, common.InitializedStorageConfiguration.Group)
 
-		// download from source server first.
-		var srcServer *common.Server
+		// download from source server first,
+		// and from the group member which sent a corrupted replica of the file at last.
+		var servers []*common.Server
+		var rejectedServer *common.Server
+		rejected := replicaRejectedBy(binlog.FileId)
 		gox.WalkList(ins, func(item interface{}) bool {
-			if item.(*common.Instance).InstanceId == binlog.SourceInstance {
-				srcServer = &item.(*common.Instance).Server
-				return true
+			s := &item.(*common.Instance).Server
+			if s.InstanceId == rejected {
+				rejectedServer = s
+			} else if s.InstanceId == binlog.SourceInstance {
+				servers = append([]*common.Server{s}, servers...)
+			} else {
+				servers = append(servers, s)
 			}
 			return false
 		})
-
-		var lasErr error
-
-		if srcServer != nil {
-			if err := syncFile(binlog, srcServer); err != nil {
-				lasErr = err
-			}
-			if lasErr == nil {
-				return nil
-			}
+		if rejectedServer != nil {
+			servers = append(servers, rejectedServer)
+		}
+		if len(servers) == 0 {
+			return errors.New("no group member available")
 		}
 
-		logger.Debug("cannot download from source server, try other servers: ", lasErr)
-
-		// fallback, download from other servers.
-		for ele := ins.Front(); ele != nil; ele = ele.Next() {
-			s := ele.Value.(*common.Instance)
-			if s.InstanceId == binlog.SourceInstance {
-				continue
+		var lasErr error
+		for _, s := range servers {
+			if lasErr != nil {
+				logger.Debug("trying to download from ",
+					s.ConnectionString(), "(", s.InstanceId, "), last error: ", lasErr)
 			}
-
-			server = &s.Server
-
-			logger.Debug("trying to download from ",
-				server.ConnectionString(), "(", server.InstanceId, ")")
-
-			if err := syncFile(binlog, &s.Server); err != nil {
-				lasErr = err
-				continue
+			if lasErr = syncFile(binlog, s); lasErr == nil {
+				break
 			}
-			// upload success, clear error.
-			lasErr = nil
-			break
 		}
 		return lasErr
 	}
 
-	if !registerDownloadingFile(binlog.FileId) {
-		logger.Debug("file is downloading, skip")
-		return nil
+	// the file is referred by another binlog which is downloading it,
+	// wait for the result so the binlog is not finished before the file is stored.
+	d, ok := registerDownloadingFile(binlog.FileId)
+	if !ok {
+		logger.Debug("file is downloading, wait for the result")
+		<-d.done
+		return d.err
 	}
-	defer unregisterDownloadingFile(binlog.FileId)
+	defer func() {
+		unregisterDownloadingFile(binlog.FileId, d, err)
+	}()
 
 	logger.Debug("begin to synchronize file ", binlog.FileId, " from ",
 		server.ConnectionString(), "(", server.InstanceId, ")")
 
-	return clientAPI.DownloadFrom(binlog.FileId, 0, -1, server, func(body io.Reader, bodyLength int64) error {
-		tmpFileName := common.InitializedStorageConfiguration.TmpDir + "/" + uuid.UUID()
-		out, err := file.CreateFile(tmpFileName)
-		if err != nil {
+	replicaFile, err := downloadReplica(binlog, fInfo.Path[strings.LastIndex(fInfo.Path, "/")+1:], server)
+	if err != nil {
+		return err
+	}
+	replicateFileMeta(binlog.FileId, server)
+	if err = fireFileEvent(common.WEBHOOK_FILE_REPLICATED, binlog.FileId, binlog.FileLength, binlog.SourceInstance); err != nil {
+		file.Delete(replicaFile)
+		return err
+	}
+	err = storeReplicaFile(binlog.FileId, fInfo, replicaFile)
+	file.Delete(replicaFile)
+	if err != nil {
+		return err
+	}
+	logger.Debug("download success")
+	acceptReplica(binlog.FileId)
+	reportReplica(binlog.FileId)
+	return nil
+}
+
+// replicateFileMeta copies the metadata of the file from the group member which sent the replica,
+// the file is still served without metadata if it fails.
+func replicateFileMeta(fileId string, server *common.Server) {
+	meta, err := clientAPI.FileMeta(server, fileId)
+	if err != nil {
+		logger.Debug("error replicate file meta of ", fileId, " from ", server.ConnectionString(), ": ", err)
+		return
+	}
+	if len(meta) == 0 {
+		return
+	}
+	if err := common.GetConfigMap().PutFileMeta(fileId, meta); err != nil {
+		logger.Debug("error save file meta: ", err)
+	}
+}
+
+// storeReplicaFile moves a verified replica file of the fileId into the data dir,
+// or increases the reference count if the content is already stored for another fileId.
+func storeReplicaFile(fileId string, fInfo *common.FileInfo, replicaFile string) error {
+	targetLoc := common.InitializedStorageConfiguration.DataDir + "/" + fInfo.Path[0:strings.LastIndex(fInfo.Path, "/")]
+	targetFile := common.InitializedStorageConfiguration.DataDir + "/" + fInfo.Path
+
+	if !file.Exists(targetLoc) {
+		if err := file.CreateDirs(targetLoc); err != nil {
 			return err
 		}
-		defer func() {
-			out.Close()
-			file.Delete(tmpFileName)
-		}()
-
-		proxy := &DigestProxyWriter{
-			crcH: util.CreateCrc32Hash(),
-			md5H: util.CreateMd5Hash(),
-			out:  out,
-		}
+	}
 
-		logger.Debug("copy file")
-		_, err = io.Copy(proxy, io.LimitReader(body, bodyLength))
-		if err != nil {
+	if !file.Exists(targetFile) {
+		logger.Debug("file not exists, move to target dir.")
+		if err := file.MoveFile(replicaFile, targetFile); err != nil {
 			return err
 		}
-
-		logger.Debug("write tail")
-		// write reference count mark.
-		_, err = out.Write(tailRefCount)
+	} else {
+		logger.Debug("file already exists, increasing reference count.")
+		c, err := Contains(fileId)
 		if err != nil {
 			return err
 		}
-		out.Close()
-
-		targetLoc := common.InitializedStorageConfiguration.DataDir + "/" + fInfo.Path[0:strings.LastIndex(fInfo.Path, "/")]
-		targetFile := common.InitializedStorageConfiguration.DataDir + "/" + fInfo.Path
-
-		if !file.Exists(targetLoc) {
-			if err := file.CreateDirs(targetLoc); err != nil {
-				return err
-			}
+		if c {
+			logger.Debug("file already exists")
+			return nil
 		}
-
-		if !file.Exists(targetFile) {
-			logger.Debug("file not exists, move to target dir.")
-			if err := file.MoveFile(tmpFileName, targetFile); err != nil {
-				return err
-			}
-		} else {
-			logger.Debug("file already exists, increasing reference count.")
-			c, err := Contains(binlog.FileId)
-			if err != nil {
-				return err
-			}
-			if c {
-				logger.Debug("file already exists")
-				return nil
-			}
-			// increase file reference count.
-			if err = updateFileReferenceCount(targetFile, 1); err != nil {
-				return err
-			}
+		// increase file reference count.
+		if err = updateFileReferenceCount(targetFile, 1); err != nil {
+			return err
 		}
-		logger.Debug("download success")
-		return nil
-	})
+	}
+	return nil
 }
 
 func filterGroupMembers(members *list.List, group string) *list.List {
 	ret := list.New()
 	gox.WalkList(members, func(item interface{}) bool {
 		if item.(*common.Instance).Attributes["group"] == group &&
-			item.(*common.Instance).InstanceId != common.InitializedStorageConfiguration.InstanceId {
+			item.(*common.Instance).InstanceId != common.InitializedStorageConfiguration.InstanceId &&
+			item.(*common.Instance).Health != common.HEALTH_UNREACHABLE {
 			ret.PushBack(item.(*common.Instance))
 		}
 		return false
@@ -383,29 +380,30 @@ func filterGroupMembers(members *list.List, group string) *list.List {
 	return ret
 }
 
-func saveDownloadStateConfig(n *common.BinlogQueryDTO, o *common.BinlogQueryDTO, failed int) error {
-	bs1, err := json.Marshal(n)
-	if err != nil {
-		return nil
-	}
-	bs2, err := json.Marshal(o)
+// saveDownloadState saves the binlog position of file synchronization,
+// and positions before failed binlogs which are retried later.
+func saveDownloadState(pos *common.BinlogQueryDTO, failed []common.BinlogQueryDTO) error {
+	bs, err := json.Marshal(pos)
 	if err != nil {
-		return nil
+		return err
 	}
 	config := common.GetConfigMap()
 
 	return config.BatchUpdate(func(tx *bolt.Tx) error {
 		b1 := tx.Bucket([]byte(common.BUCKET_KEY_CONFIGMAP))
-		err := b1.Put(downloadBinlogPosKey, bs1)
+		err := b1.Put(downloadBinlogPosKey, bs)
 		if err != nil {
 			return err
 		}
-		// mark failed binlog position
-		if failed > 0 {
-			b2 := tx.Bucket([]byte(common.BUCKET_KEY_FAILED_BINLOG_POS))
-			if b2.Get(bs2) == nil {
-				err = b2.Put(bs2, []byte{1})
-				if err != nil {
+		// mark failed binlog positions
+		b2 := tx.Bucket([]byte(common.BUCKET_KEY_FAILED_BINLOG_POS))
+		for i := range failed {
+			k, err := json.Marshal(&failed[i])
+			if err != nil {
+				return err
+			}
+			if b2.Get(k) == nil {
+				if err = b2.Put(k, []byte{1}); err != nil {
 					return err
 				}
 			}
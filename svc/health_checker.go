@@ -0,0 +1,106 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/reg"
+	"github.com/hetianyi/gox"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	json "github.com/json-iterator/go"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// pingFailures records continuous ping failures of storage servers.
+	pingFailures    = make(map[string]int)
+	pingFailureLock = new(sync.Mutex)
+	probeClient     = &http.Client{Timeout: time.Second * 5}
+)
+
+// initHealthChecker starts a timer job which checks health of
+// registered storage servers actively.
+func initHealthChecker() {
+	timer.Start(common.HEALTH_CHECK_INTERVAL, common.HEALTH_CHECK_INTERVAL, 0, func(t *timer.Timer) {
+		gox.Try(func() {
+			checkHealth()
+		}, func(e interface{}) {
+			logger.Error("health check err: ", e)
+		})
+	})
+}
+
+// checkHealth pings all storage servers concurrently and waits for the results.
+func checkHealth() {
+	wg := sync.WaitGroup{}
+	for _, ins := range reg.InstanceSetSnapshot() {
+		if ins.Role != common.ROLE_STORAGE || ins.State != common.REGISTER_HOLD {
+			continue
+		}
+		wg.Add(1)
+		go func(ins *common.Instance) {
+			defer wg.Done()
+			health, attrs := probe(ins)
+			reg.SetHealth(ins.InstanceId, health)
+			reg.SetMode(ins.InstanceId, common.StorageMode(attrs["mode"]))
+			if attrs["load"] != "" {
+				load := &common.LoadInfo{}
+				if err := json.UnmarshalFromString(attrs["load"], load); err != nil {
+					logger.Debug("error parse load of instance ", ins.InstanceId, ": ", err)
+					return
+				}
+				reg.SetLoad(ins.InstanceId, load)
+			}
+		}(ins)
+	}
+	wg.Wait()
+}
+
+// probe checks a single storage server and evaluates its health state,
+// it also returns the status attributes reported by the server.
+func probe(ins *common.Instance) (common.HealthState, map[string]string) {
+	attrs, err := clientAPI.Ping(&ins.Server)
+
+	pingFailureLock.Lock()
+	if err != nil {
+		pingFailures[ins.InstanceId]++
+	} else {
+		delete(pingFailures, ins.InstanceId)
+	}
+	failures := pingFailures[ins.InstanceId]
+	pingFailureLock.Unlock()
+
+	if err != nil {
+		logger.Debug("ping ", ins.Server.ConnectionString(), " failed: ", err)
+		if failures >= 2 {
+			return common.HEALTH_UNREACHABLE, attrs
+		}
+		return common.HEALTH_DEGRADED, attrs
+	}
+	if attrs["draining"] == "true" {
+		return common.HEALTH_DRAINING, attrs
+	}
+	if attrs["writable"] == "false" {
+		return common.HEALTH_DEGRADED, attrs
+	}
+	if common.InitializedTrackerConfiguration.EnableHttpProbe && !probeHttp(ins) {
+		return common.HEALTH_DEGRADED, attrs
+	}
+	return common.HEALTH_HEALTHY, attrs
+}
+
+// probeHttp checks the http port of the storage server.
+func probeHttp(ins *common.Instance) bool {
+	httpPort := ins.Attributes["httpPort"]
+	if httpPort == "" {
+		return true
+	}
+	resp, err := probeClient.Get("http://" + ins.Server.Host + ":" + httpPort + "/ping")
+	if err != nil {
+		logger.Debug("http probe ", ins.Server.Host, ":", httpPort, " failed: ", err)
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
@@ -0,0 +1,58 @@
+package svc
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/common"
+	"testing"
+)
+
+// fakePingAPI is a storage server answering pings with the attributes, or failing if err is set.
+type fakePingAPI struct {
+	api.ClientAPI
+	attrs map[string]string
+	err   error
+}
+
+func (f *fakePingAPI) Ping(server *common.Server) (map[string]string, error) {
+	return f.attrs, f.err
+}
+
+func TestProbeHealthStates(t *testing.T) {
+	common.InitializedTrackerConfiguration = &common.TrackerConfig{}
+	fake := &fakePingAPI{}
+	clientAPI = fake
+	defer func() {
+		clientAPI = nil
+	}()
+	ins := &common.Instance{Server: common.Server{InstanceId: "storage1"}}
+
+	fake.err = errors.New("connection refused")
+	if h, _ := probe(ins); h != common.HEALTH_DEGRADED {
+		t.Fatal("expect degraded after a failed ping, got ", h)
+	}
+	if h, _ := probe(ins); h != common.HEALTH_UNREACHABLE {
+		t.Fatal("expect unreachable after continuous failed pings, got ", h)
+	}
+
+	fake.err = nil
+	fake.attrs = map[string]string{"writable": "true"}
+	if h, _ := probe(ins); h != common.HEALTH_HEALTHY {
+		t.Fatal("expect healthy, got ", h)
+	}
+	// failures are counted again from the beginning.
+	fake.err = errors.New("connection refused")
+	if h, _ := probe(ins); h != common.HEALTH_DEGRADED {
+		t.Fatal("expect degraded after a failed ping, got ", h)
+	}
+
+	fake.err = nil
+	fake.attrs = map[string]string{"writable": "false"}
+	if h, _ := probe(ins); h != common.HEALTH_DEGRADED {
+		t.Fatal("expect degraded if the data dir is not writable, got ", h)
+	}
+	fake.attrs = map[string]string{"writable": "true", "draining": "true"}
+	if h, _ := probe(ins); h != common.HEALTH_DRAINING {
+		t.Fatal("expect draining, got ", h)
+	}
+}
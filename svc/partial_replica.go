@@ -0,0 +1,182 @@
+package svc
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/file"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	"github.com/hetianyi/gox/uuid"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	maxReplicaResumes     = 3                  // immediate resumes of an interrupted replica download
+	maxPartialReplicaAge  = time.Hour * 24 * 7 // partial replicas not resumed for this long are removed
+	partialReplicaCleanup = time.Hour * 24     // interval of removing stale partial replicas
+)
+
+var (
+	// replicas rejected by verification since startup, by group members sending them.
+	rejectedReplicas     = make(map[string]int64)
+	rejectedReplicaPeers = make(map[string]string) // fileId -> instanceId of the last group member sending a rejected replica
+	rejectedReplicaLock  = new(sync.Mutex)
+)
+
+// partialReplicaPath returns the partial replica file of the fileId,
+// it is kept across restarts so that an interrupted download is resumed.
+func partialReplicaPath(fileId string) string {
+	h := util.CreateMd5Hash()
+	h.Write([]byte(fileId))
+	return common.InitializedStorageConfiguration.PartialDir + "/" + util.GetMd5HashString(h)
+}
+
+// downloadReplica downloads the file from the server into its partial replica file,
+// resuming from the end of the content downloaded before.
+//
+// The length and the md5 of the whole content are verified against the binlog and the fileId,
+// a mismatched replica is rejected and downloaded from the beginning next time.
+// It returns a temporary file of the verified replica with the reference count mark written.
+func downloadReplica(bl *common.BingLogDTO, md5 string, server *common.Server) (string, error) {
+	fileId := bl.FileId
+	partial := partialReplicaPath(fileId)
+	out, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	// content downloaded before is hashed again and appended to.
+	h := util.CreateMd5Hash()
+	offset, err := io.Copy(h, out)
+	if err != nil {
+		return "", err
+	}
+	if offset > 0 {
+		logger.Info("resume replica ", fileId, " from offset ", offset)
+	}
+
+	for retry := 0; ; retry++ {
+		var n int64
+		err = clientAPI.DownloadFrom(fileId, offset, -1, server, func(body io.Reader, bodyLength int64) error {
+			var err error
+			n, err = io.Copy(io.MultiWriter(out, h), &syncRateReader{
+				r:    io.LimitReader(body, bodyLength),
+				peer: server.InstanceId,
+			})
+			if err == nil && n < bodyLength {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		})
+		offset += n
+		if err == nil {
+			break
+		}
+		if n == 0 || retry >= maxReplicaResumes {
+			if offset == 0 {
+				out.Close()
+				file.Delete(partial)
+			}
+			return "", err
+		}
+		logger.Debug("replica ", fileId, " is interrupted at offset ", offset, ", resume: ", err)
+	}
+
+	var verifyErr error
+	if bl.FileLength > 0 && offset != bl.FileLength {
+		verifyErr = errors.New("length mismatch of replica " + fileId + ": expect " +
+			convert.Int64ToStr(bl.FileLength) + ", got " + convert.Int64ToStr(offset))
+	} else if s := util.GetMd5HashString(h); s != md5 {
+		verifyErr = errors.New("md5 mismatch of replica " + fileId + ": expect " + md5 + ", got " + s)
+	}
+	if verifyErr != nil {
+		out.Close()
+		file.Delete(partial)
+		rejectReplica(fileId, server.InstanceId)
+		logger.Warn("replica from ", server.ConnectionString(), "(", server.InstanceId, ") is rejected: ", verifyErr)
+		return "", verifyErr
+	}
+	// the verified replica is moved out of the partial replicas before the reference count mark is written,
+	// so that a partial replica never ends with the mark and is resumed from a wrong offset after a crash.
+	out.Close()
+	replica := common.InitializedStorageConfiguration.TmpDir + "/" + uuid.UUID()
+	if err := file.MoveFile(partial, replica); err != nil {
+		file.Delete(partial)
+		return "", err
+	}
+	fo, err := os.OpenFile(replica, os.O_WRONLY|os.O_APPEND, 0666)
+	if err == nil {
+		// write reference count mark.
+		_, err = fo.Write(tailRefCount)
+		fo.Close()
+	}
+	if err != nil {
+		file.Delete(replica)
+		return "", err
+	}
+	return replica, nil
+}
+
+// rejectReplica records a replica rejected by verification,
+// the group member sending it is tried at last when the file is synchronized again.
+func rejectReplica(fileId string, instanceId string) {
+	rejectedReplicaLock.Lock()
+	defer rejectedReplicaLock.Unlock()
+
+	rejectedReplicas[instanceId]++
+	rejectedReplicaPeers[fileId] = instanceId
+}
+
+// acceptReplica forgets the rejected replicas of the file once it is synchronized.
+func acceptReplica(fileId string) {
+	rejectedReplicaLock.Lock()
+	defer rejectedReplicaLock.Unlock()
+
+	delete(rejectedReplicaPeers, fileId)
+}
+
+// replicaRejectedBy returns the group member which sent the last rejected replica of the file.
+func replicaRejectedBy(fileId string) string {
+	rejectedReplicaLock.Lock()
+	defer rejectedReplicaLock.Unlock()
+
+	return rejectedReplicaPeers[fileId]
+}
+
+// rejectedReplicaCounts returns the replicas rejected by verification since startup by group members.
+func rejectedReplicaCounts() map[string]int64 {
+	rejectedReplicaLock.Lock()
+	defer rejectedReplicaLock.Unlock()
+
+	ret := make(map[string]int64, len(rejectedReplicas))
+	for k, v := range rejectedReplicas {
+		ret[k] = v
+	}
+	return ret
+}
+
+// initPartialReplicaCleaner periodically removes partial replicas which are not resumed for long,
+// files of them are synchronized by other group members or never retried.
+func initPartialReplicaCleaner() {
+	timer.Start(0, partialReplicaCleanup, 0, func(t *timer.Timer) {
+		infos, err := ioutil.ReadDir(common.InitializedStorageConfiguration.PartialDir)
+		if err != nil {
+			logger.Debug("error read partial replicas: ", err)
+			return
+		}
+		for _, info := range infos {
+			if info.IsDir() || time.Since(info.ModTime()) < maxPartialReplicaAge {
+				continue
+			}
+			logger.Debug("remove stale partial replica ", info.Name())
+			file.Delete(common.InitializedStorageConfiguration.PartialDir + "/" + info.Name())
+		}
+	})
+}
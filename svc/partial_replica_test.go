@@ -0,0 +1,148 @@
+package svc
+
+import (
+	"bytes"
+	"errors"
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/file"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// fakeReplicaAPI is a group member sending replicas,
+// it sends at most limit bytes of the content and fails afterwards.
+type fakeReplicaAPI struct {
+	api.ClientAPI
+	content []byte
+	limit   int64
+	offsets []int64
+}
+
+func (f *fakeReplicaAPI) DownloadFrom(fileId string, offset int64, length int64, server *common.Server,
+	handler func(body io.Reader, bodyLength int64) error) error {
+	f.offsets = append(f.offsets, offset)
+	if f.limit >= 0 && offset >= f.limit {
+		return errors.New("connection reset")
+	}
+	body := f.content[offset:]
+	if f.limit >= 0 {
+		body = f.content[offset:f.limit]
+	}
+	return handler(bytes.NewReader(body), int64(len(f.content))-offset)
+}
+
+func initReplicaTest(t *testing.T, content []byte) (*common.BingLogDTO, string) {
+	dir, err := ioutil.TempDir("", "godfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+		clientAPI = nil
+	})
+	common.InitializedStorageConfiguration = &common.StorageConfig{
+		DataDir:    dir,
+		TmpDir:     dir + "/tmp",
+		PartialDir: dir + "/partial",
+	}
+	if err := file.CreateDirs(dir + "/tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.CreateDirs(dir + "/partial"); err != nil {
+		t.Fatal(err)
+	}
+	h := util.CreateMd5Hash()
+	h.Write(content)
+	md5 := util.GetMd5HashString(h)
+	return &common.BingLogDTO{
+		FileId:         "G01/00/01/" + md5,
+		FileLength:     int64(len(content)),
+		SourceInstance: "storage2",
+	}, md5
+}
+
+func TestDownloadReplicaResume(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	bl, md5 := initReplicaTest(t, content)
+	server := &common.Server{InstanceId: "storage2"}
+
+	// the download is interrupted at offset 8 and the peer is gone.
+	fake := &fakeReplicaAPI{content: content, limit: 8}
+	clientAPI = fake
+	if _, err := downloadReplica(bl, md5, server); err == nil {
+		t.Fatal("expect the download to fail")
+	}
+	partial, err := ioutil.ReadFile(partialReplicaPath(bl.FileId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the partial replica holds the content only, without the reference count mark.
+	if string(partial) != "01234567" {
+		t.Fatal("unexpected partial replica ", string(partial))
+	}
+
+	// it is resumed from offset 8 after a restart.
+	fake = &fakeReplicaAPI{content: content, limit: -1}
+	clientAPI = fake
+	replica, err := downloadReplica(bl, md5, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Delete(replica)
+	if len(fake.offsets) != 1 || fake.offsets[0] != 8 {
+		t.Fatal("expect resumed from offset 8, got ", fake.offsets)
+	}
+	bs, err := ioutil.ReadFile(replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, append(append([]byte{}, content...), tailRefCount...)) {
+		t.Fatal("expect the content followed by the reference count mark, got ", bs)
+	}
+	if file.Exists(partialReplicaPath(bl.FileId)) {
+		t.Fatal("expect the partial replica removed")
+	}
+}
+
+func TestDownloadReplicaRejected(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	bl, md5 := initReplicaTest(t, content)
+	server := &common.Server{InstanceId: "storage2"}
+
+	// same length, different content.
+	clientAPI = &fakeReplicaAPI{content: []byte("0123456789ABCDEFGHIJ"), limit: -1}
+	if _, err := downloadReplica(bl, md5, server); err == nil {
+		t.Fatal("expect md5 mismatch")
+	}
+	if file.Exists(partialReplicaPath(bl.FileId)) {
+		t.Fatal("expect the rejected partial replica removed")
+	}
+	if p := replicaRejectedBy(bl.FileId); p != "storage2" {
+		t.Fatal("expect rejected by storage2, got ", p)
+	}
+
+	// truncated content.
+	clientAPI = &fakeReplicaAPI{content: content[:10], limit: -1}
+	if _, err := downloadReplica(bl, md5, server); err == nil {
+		t.Fatal("expect length mismatch")
+	}
+	if file.Exists(partialReplicaPath(bl.FileId)) {
+		t.Fatal("expect the rejected partial replica removed")
+	}
+
+	// the replica is accepted from a good peer.
+	clientAPI = &fakeReplicaAPI{content: content, limit: -1}
+	replica, err := downloadReplica(bl, md5, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Delete(replica)
+	acceptReplica(bl.FileId)
+	if p := replicaRejectedBy(bl.FileId); p != "" {
+		t.Fatal("expect no rejection after accepted, got ", p)
+	}
+}
@@ -30,6 +30,9 @@ func BootStorageServer() {
 
 	// initialize dataset.
 	initDataSet()
+	initStorageMode()
+	initSyncRate()
+	initWebhookDelivery()
 
 	startCounterLoop()
 
@@ -40,8 +43,14 @@ func BootStorageServer() {
 	if common.InitializedStorageConfiguration.EnableHttp {
 		StartStorageHttpServer(common.InitializedStorageConfiguration)
 	}
+	if common.InitializedStorageConfiguration.Bootstrap {
+		startBootstrap()
+	}
 	// start member binlog synchronizer.
 	InitStorageMemberBinlogWatcher()
+	initAntiEntropy()
+	initPartialReplicaCleaner()
+	initDrLink()
 	// start tcp server.
 	StartStorageTcpServer()
 }
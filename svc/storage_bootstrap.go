@@ -0,0 +1,269 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	json "github.com/json-iterator/go"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const bootstrapStateKey = "bootstrapState"
+
+var (
+	// 1 while this storage server is bootstrapping,
+	// binlog and file synchronization are paused until it finishes.
+	bootstrapping int32
+)
+
+// bootstrapState is the progress of bootstrapping, it is saved after every page
+// so that a restarted bootstrap continues from the last page.
+type bootstrapState struct {
+	Peer       string                `json:"peer"`       // instanceId of the group member bootstrapped from
+	Snapshot   bool                  `json:"snapshot"`   // whether the snapshot position of the peer is taken
+	Cursor     common.BinlogQueryDTO `json:"cursor"`     // binlog position of the peer when the snapshot is taken
+	ListCursor string                `json:"listCursor"` // dataset cursor of the peer, empty for the first page
+	Done       bool                  `json:"done"`
+	Files      int                   `json:"files"`  // files downloaded
+	Failed     int                   `json:"failed"` // files failed, retried by file synchronization later
+}
+
+func isBootstrapping() bool {
+	return atomic.LoadInt32(&bootstrapping) == 1
+}
+
+// startBootstrap bootstraps a new group member from a peer in bulk.
+//
+// The head of the peer binlog is taken as the snapshot position first,
+// then the dataset of the peer is listed page by page and the files of each page
+// are downloaded by parallel workers. When the listing is finished,
+// the snapshot position is handed over to the binlog synchronizer,
+// which follows the peer from that exact position.
+func startBootstrap() {
+	state, err := loadBootstrapState()
+	if err != nil {
+		logger.Error("error load bootstrap state: ", err)
+		return
+	}
+	if state.Done {
+		logger.Info("bootstrap is already finished")
+		return
+	}
+	atomic.StoreInt32(&bootstrapping, 1)
+
+	timer.Start(time.Second*5, time.Second*5, 0, func(t *timer.Timer) {
+		peer := selectBootstrapPeer(state.Peer)
+		if peer == nil {
+			logger.Debug("waiting for a group member to bootstrap from")
+			return
+		}
+		if state.Peer != peer.InstanceId {
+			// binlog positions of different servers are not comparable.
+			logger.Info("bootstrap from group member ", peer.ConnectionString(), "(", peer.InstanceId, ")")
+			state.Peer = peer.InstanceId
+			state.Snapshot = false
+			state.Cursor = common.BinlogQueryDTO{}
+			state.ListCursor = ""
+		}
+		if err := bootstrapFrom(peer, state); err != nil {
+			logger.Error("error bootstrap from ", peer.ConnectionString(), "(", peer.InstanceId, "): ", err)
+			return
+		}
+		if err := handOverBootstrap(state); err != nil {
+			logger.Error("error save synchronization state: ", err)
+			return
+		}
+		state.Done = true
+		if err := saveBootstrapState(state); err != nil {
+			logger.Error("error save bootstrap state: ", err)
+			return
+		}
+		t.Destroy()
+		atomic.StoreInt32(&bootstrapping, 0)
+		logger.Info("bootstrap finished, ", state.Files, " files downloaded, ", state.Failed,
+			" files failed and will be retried by file synchronization")
+	})
+}
+
+// selectBootstrapPeer returns the group member bootstrapped from before if it is available,
+// or any available group member.
+func selectBootstrapPeer(instanceId string) *common.Server {
+	members := filterGroupMembers(api.FilterInstances(common.ROLE_STORAGE), common.InitializedStorageConfiguration.Group)
+	var ret *common.Server
+	for ele := members.Front(); ele != nil; ele = ele.Next() {
+		ins := ele.Value.(*common.Instance)
+		if ret == nil || ins.InstanceId == instanceId {
+			ret = &ins.Server
+		}
+	}
+	return ret
+}
+
+// bootstrapFrom takes the snapshot position of the peer and lists its dataset page by page
+// until there are no more files.
+//
+// Files stored on the peer after the snapshot position are synchronized by following its binlogs,
+// files which the peer has not synchronized yet are not listed,
+// they are synchronized from the group members holding them by their binlogs.
+func bootstrapFrom(peer *common.Server, state *bootstrapState) error {
+	if !state.Snapshot {
+		status, err := clientAPI.SyncStatus(peer)
+		if err != nil {
+			return err
+		}
+		state.Snapshot = true
+		state.Cursor = common.BinlogQueryDTO{FileIndex: status.Head.FileIndex, Offset: status.Head.Offset}
+		state.ListCursor = ""
+		if err := saveBootstrapState(state); err != nil {
+			return err
+		}
+		logger.Info("bootstrap snapshot of ", peer.InstanceId, " is taken at binlog ",
+			state.Cursor.FileIndex, ":", state.Cursor.Offset)
+	}
+	for {
+		ret, err := clientAPI.List(peer, &common.ListQueryDTO{
+			Group:  common.InitializedStorageConfiguration.Group,
+			Cursor: state.ListCursor,
+			Limit:  maxListLimit,
+		})
+		if err != nil {
+			return err
+		}
+		logs := make([]common.BingLogDTO, len(ret.Files))
+		for i, f := range ret.Files {
+			logs[i] = common.BingLogDTO{
+				SourceInstance: f.InstanceId,
+				FileLength:     f.FileLength,
+				FileId:         f.FileId,
+			}
+		}
+		bls, err := bootstrapBinlogs(logs)
+		if err != nil {
+			return err
+		}
+		files, failed := bootstrapFiles(peer, bls, common.InitializedStorageConfiguration.BootstrapWorkers)
+		state.ListCursor = ret.Cursor
+		state.Files += files
+		state.Failed += failed
+		if err := saveBootstrapState(state); err != nil {
+			return err
+		}
+		logger.Info("bootstrap progress: ", state.Files, " files downloaded from ", peer.InstanceId,
+			", ", state.Failed, " failed")
+		if ret.Cursor == "" {
+			return nil
+		}
+	}
+}
+
+// bootstrapBinlogs writes binlogs of new files like the binlog synchronizer,
+// binlog first and dataset after, and returns the binlogs of new files.
+func bootstrapBinlogs(logs []common.BingLogDTO) ([]common.BingLogDTO, error) {
+	var ret []common.BingLogDTO
+	var bls []*common.BingLog
+	seen := make(map[string]bool)
+	for _, v := range logs {
+		if v.SourceInstance == common.InitializedStorageConfiguration.InstanceId || seen[v.FileId] {
+			continue
+		}
+		seen[v.FileId] = true
+		v := v
+		if err := DoIfNotExist(v.FileId, func() error {
+			ret = append(ret, v)
+			bls = append(bls, binlog.CreateLocalBinlog(v.FileId, v.FileLength, v.SourceInstance))
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if len(bls) == 0 {
+		return nil, nil
+	}
+	if err := writableBinlogManager.Write(bls...); err != nil {
+		return nil, err
+	}
+	for _, v := range ret {
+		if err := Add(v.FileId); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// bootstrapFiles downloads files by parallel workers,
+// a file failed on the peer is downloaded from other group members.
+func bootstrapFiles(peer *common.Server, bls []common.BingLogDTO, workers int) (files int, failed int) {
+	if len(bls) == 0 {
+		return 0, 0
+	}
+	var nFiles, nFailed int32
+	jobs := make(chan *common.BingLogDTO)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for bl := range jobs {
+				err := syncFile(bl, peer)
+				if err != nil {
+					err = syncFile(bl, nil)
+				}
+				if err != nil {
+					logger.Debug("error bootstrap file ", bl.FileId, ": ", err)
+					atomic.AddInt32(&nFailed, 1)
+					continue
+				}
+				atomic.AddInt32(&nFiles, 1)
+			}
+		}()
+	}
+	for i := range bls {
+		jobs <- &bls[i]
+	}
+	close(jobs)
+	wg.Wait()
+	return int(nFiles), int(nFailed)
+}
+
+// handOverBootstrap saves the binlog position of the peer as its synchronization state,
+// so the binlog synchronizer continues from where the bootstrap ends.
+func handOverBootstrap(state *bootstrapState) error {
+	pos := state.Cursor
+	bs, err := json.Marshal(&pos)
+	if err != nil {
+		return err
+	}
+	syncLock.Lock()
+	defer syncLock.Unlock()
+	if err := common.GetConfigMap().PutConfig(configKeyPrefix+state.Peer, bs); err != nil {
+		return err
+	}
+	synchronizationState[state.Peer] = &pos
+	return nil
+}
+
+func loadBootstrapState() (*bootstrapState, error) {
+	ret := &bootstrapState{}
+	bs, err := common.GetConfigMap().GetConfig(bootstrapStateKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) > 0 {
+		if err := json.Unmarshal(bs, ret); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func saveBootstrapState(state *bootstrapState) error {
+	bs, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return common.GetConfigMap().PutConfig(bootstrapStateKey, bs)
+}
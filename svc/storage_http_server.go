@@ -29,6 +29,8 @@ const (
 	FORM_TEXT          = "text"
 	FORM_FILE          = "file"
 	ContentTypePattern = "^multipart/form-data; boundary=(.*)$"
+	defaultContentType = "application/octet-stream"
+	sniffLen           = 512
 )
 
 var (
@@ -61,6 +63,9 @@ func StartStorageHttpServer(c *common.StorageConfig) {
 	// r.HandleFunc("/upload1", httpUpload).Methods("POST")
 	r.HandleFunc("/dl", httpDownload).Methods("GET")
 	r.HandleFunc("/download", httpDownload).Methods("GET")
+	r.HandleFunc("/ping", httpPing).Methods("GET")
+	r.HandleFunc("/feed", httpStorageFeed).Methods("GET")
+	r.HandleFunc("/sync/status", httpStorageSyncStatus).Methods("GET")
 
 	srv := &http.Server{
 		Handler:           r,
@@ -78,13 +83,24 @@ func StartStorageHttpServer(c *common.StorageConfig) {
 	}()
 }
 
+// httpPing handles http health check.
+func httpPing(w http.ResponseWriter, r *http.Request) {
+	util.HttpWriteResponse(w, http.StatusOK, "pong")
+}
+
 // httpUpload handles http file upload.
 func httpUpload(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	logger.Debug("accept new upload request")
 
+	if msg := uploadRejectedMsg(); msg != "" {
+		util.HttpWriteResponse(w, http.StatusServiceUnavailable, msg)
+		return
+	}
+
 	increaseCountForTheSecond()
+	defer beginUpload()()
 
 	// file is private or public
 	s := strings.TrimSpace(r.URL.Query().Get("s"))
@@ -175,6 +191,11 @@ func httpUpload(w http.ResponseWriter, r *http.Request) {
 				logger.Debug("create alias")
 				finalFileId = util.CreateAlias(finalFileId, common.InitializedStorageConfiguration.InstanceId, isPrivate, time.Now())
 
+				saveFileMeta(finalFileId, fileName, "")
+				if err := fireFileEvent(common.WEBHOOK_FILE_UPLOADED, finalFileId, fInfo.Size()-int64(len(tailRefCount)), ""); err != nil {
+					return err
+				}
+
 				if !file.Exists(targetLoc) {
 					if err := file.CreateDirs(targetLoc); err != nil {
 						return err
@@ -259,7 +280,13 @@ func httpUpload1(w http.ResponseWriter, r *http.Request) {
 
 	logger.Debug("accept new upload request")
 
+	if msg := uploadRejectedMsg(); msg != "" {
+		util.HttpWriteResponse(w, http.StatusServiceUnavailable, msg)
+		return
+	}
+
 	increaseCountForTheSecond()
+	defer beginUpload()()
 
 	// file is private or public
 	s := strings.TrimSpace(r.URL.Query().Get("s"))
@@ -339,7 +366,7 @@ func httpUpload1(w http.ResponseWriter, r *http.Request) {
 			md5H: util.CreateMd5Hash(),
 			out:  out,
 		}
-		n, err := io.Copy(proxy, p)
+		n, err := io.Copy(proxy, &trafficReader{p})
 		if err != nil {
 			logger.Debug(err)
 			lastErr = err
@@ -373,6 +400,14 @@ func httpUpload1(w http.ResponseWriter, r *http.Request) {
 
 		finalFileId = util.CreateAlias(finalFileId, common.InitializedStorageConfiguration.InstanceId, isPrivate, time.Now())
 
+		saveFileMeta(finalFileId, p.FileName(), p.Header.Get("Content-Type"))
+		if err := fireFileEvent(common.WEBHOOK_FILE_UPLOADED, finalFileId, n, ""); err != nil {
+			logger.Debug(err)
+			lastErr = err
+			clean()
+			break
+		}
+
 		if !file.Exists(targetLoc) {
 			if err := file.CreateDirs(targetLoc); err != nil {
 				logger.Debug(err)
@@ -487,8 +522,8 @@ func httpDownload(w http.ResponseWriter, r *http.Request) {
 	token := ""
 	timestamp := ""
 	fileName := ""
-	// if EnableMimeTypes is on and fileName is not empty,
-	// EnableMimeTypes will be ignored.
+	// if EnableMimeTypes is on, the extension of fileName(or the type parameter)
+	// is used when the file has no stored content type.
 	ext := ""
 	qs := r.URL.Query()
 	if qs != nil {
@@ -565,10 +600,64 @@ func httpDownload(w http.ResponseWriter, r *http.Request) {
 	}
 	sr := io.NewSectionReader(outFile, 0, fileInfo.Size()-4)
 
+	if common.InitializedStorageConfiguration.EnableMimeTypes {
+		headers.Set("Content-Type", resolveContentType(fid, ext, sr))
+	}
+
 	if fileName != "" {
 		headers.Set("Content-Disposition", "attachment;filename=\""+fileName+"\"")
 	} else if fileName == "" && ext != "" {
 		fileName = uuid.UUID() + "." + ext
 	}
-	httpx.ServeContent(w, r, fileName, fileInfo.ModTime(), sr, fileInfo.Size()-4)
+	httpx.ServeContent(w, r, fileName, fileInfo.ModTime(), &trafficReadSeeker{sr}, fileInfo.Size()-4)
+}
+
+// saveFileMeta saves the original file name and content type of an uploaded file.
+//
+// The content type is taken from the form part if it is meaningful,
+// otherwise it is guessed from the file name extension.
+func saveFileMeta(fileId, fileName, contentType string) {
+	if contentType == defaultContentType {
+		contentType = ""
+	}
+	if contentType == "" && fileName != "" {
+		contentType, _ = common.LookupMimeType(file.GetFileExt(fileName))
+	}
+	meta := make(map[string]string)
+	if fileName != "" {
+		meta["name"] = fileName
+	}
+	if contentType != "" {
+		meta["contentType"] = contentType
+	}
+	if len(meta) == 0 {
+		return
+	}
+	if err := common.GetConfigMap().PutFileMeta(fileId, meta); err != nil {
+		logger.Debug("error save file meta: ", err)
+	}
+}
+
+// resolveContentType determines the Content-Type of a download from,
+// in order, the stored file metadata, the requested filename extension
+// and the magic bytes of the first 512 bytes of the file.
+func resolveContentType(fileId, ext string, content io.ReadSeeker) string {
+	meta, err := common.GetConfigMap().GetFileMeta(fileId)
+	if err != nil {
+		logger.Debug("error get file meta: ", err)
+	}
+	if meta != nil && meta["contentType"] != "" {
+		return meta["contentType"]
+	}
+	if ext != "" {
+		if t, ok := common.LookupMimeType(ext); ok {
+			return t
+		}
+	}
+	var buf [sniffLen]byte
+	n, _ := io.ReadFull(content, buf[:])
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return defaultContentType
+	}
+	return http.DetectContentType(buf[:n])
 }
@@ -0,0 +1,39 @@
+package svc
+
+import (
+	"bytes"
+	"github.com/boltdb/bolt"
+	"github.com/hetianyi/godfs/common"
+	"testing"
+)
+
+func TestResolveContentType(t *testing.T) {
+	initTestConfigMap(t, common.BOOT_STORAGE)
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+
+	// the magic bytes are sniffed without metadata and extension.
+	if ct := resolveContentType("G01/00/01/a", "", bytes.NewReader(png)); ct != "image/png" {
+		t.Fatal("expect image/png, got ", ct)
+	}
+	// the requested extension wins over sniffing.
+	if ct := resolveContentType("G01/00/01/a", "txt", bytes.NewReader(png)); ct != "text/plain" {
+		t.Fatal("expect text/plain, got ", ct)
+	}
+	// the content is rewound after sniffing.
+	content := bytes.NewReader(png)
+	resolveContentType("G01/00/01/a", "", content)
+	if content.Len() != len(png) {
+		t.Fatal("expect the content rewound")
+	}
+
+	// the saved metadata wins over all.
+	if err := common.GetConfigMap().BatchUpdate(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(common.BUCKET_KEY_FILE_META)).Put([]byte("G01/00/01/a"),
+			[]byte(`{"name":"a.json","contentType":"application/json"}`))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ct := resolveContentType("G01/00/01/a", "txt", bytes.NewReader(png)); ct != "application/json" {
+		t.Fatal("expect application/json, got ", ct)
+	}
+}
@@ -0,0 +1,60 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/logger"
+	"io"
+	"sync/atomic"
+)
+
+var (
+	activeConnections int32
+	inflightUploads   int32
+)
+
+// trafficReader counts the bytes read through it as traffic of this server.
+type trafficReader struct {
+	io.Reader
+}
+
+func (r *trafficReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	increaseTrafficForTheSecond(int64(n))
+	return n, err
+}
+
+// trafficReadSeeker is a seekable trafficReader.
+type trafficReadSeeker struct {
+	io.ReadSeeker
+}
+
+func (r *trafficReadSeeker) Read(p []byte) (n int, err error) {
+	n, err = r.ReadSeeker.Read(p)
+	increaseTrafficForTheSecond(int64(n))
+	return n, err
+}
+
+// beginUpload marks an upload in-flight, the returned function must be called when it finishes.
+func beginUpload() func() {
+	atomic.AddInt32(&inflightUploads, 1)
+	return func() {
+		atomic.AddInt32(&inflightUploads, -1)
+	}
+}
+
+// collectLoad collects live load of this storage server.
+func collectLoad() *common.LoadInfo {
+	load := &common.LoadInfo{
+		Connections: int(atomic.LoadInt32(&activeConnections)),
+		Uploads:     int(atomic.LoadInt32(&inflightUploads)),
+		Throughput:  sumTraffic() / counterLoopSize,
+	}
+	free, total, err := util.DiskUsage(common.InitializedStorageConfiguration.DataDir)
+	if err != nil {
+		logger.Debug("error get disk usage: ", err)
+	}
+	load.FreeDisk = free
+	load.TotalDisk = total
+	return load
+}
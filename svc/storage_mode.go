@@ -0,0 +1,65 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/logger"
+	"io"
+)
+
+const storageModeKey = "storageMode"
+
+// initStorageMode restores the runtime mode switched by admin before,
+// the readonly boot flag wins over the saved mode.
+func initStorageMode() {
+	bs, err := common.GetConfigMap().GetConfig(storageModeKey)
+	if err != nil {
+		logger.Debug("error load storage mode: ", err)
+	}
+	saved := common.StorageMode(bs)
+	if common.InitializedStorageConfiguration.Readonly {
+		if common.ValidStorageMode(saved) && saved != common.STORAGE_MODE_READONLY {
+			logger.Warn("saved storage mode ", saved, " is overridden by the readonly flag")
+		}
+		common.SetStorageMode(common.STORAGE_MODE_READONLY)
+		return
+	}
+	if common.ValidStorageMode(saved) {
+		common.SetStorageMode(saved)
+	}
+}
+
+// uploadRejectedMsg returns the reason why new uploads are not accepted,
+// it returns empty string if this server accepts uploads.
+func uploadRejectedMsg() string {
+	mode := common.GetStorageMode()
+	if mode == common.STORAGE_MODE_ACTIVE {
+		return ""
+	}
+	return "storage server is in " + string(mode) + " mode"
+}
+
+// setModeHandler switches the runtime mode of this storage server.
+func setModeHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	mode := common.StorageMode(header.Attributes["mode"])
+	if !common.ValidStorageMode(mode) {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "invalid storage mode: " + string(mode),
+		}, nil, 0, nil
+	}
+	if err := common.GetConfigMap().PutConfig(storageModeKey, []byte(mode)); err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	old := common.GetStorageMode()
+	common.SetStorageMode(mode)
+	logger.Info("storage mode changed: ", old, " -> ", mode)
+	return &common.Header{
+		Result: common.SUCCESS,
+		Attributes: map[string]string{
+			"mode": string(mode),
+		},
+	}, nil, 0, nil
+}
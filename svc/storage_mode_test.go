@@ -0,0 +1,27 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"testing"
+)
+
+func TestInitStorageModeReadonlyFlagWins(t *testing.T) {
+	initTestConfigMap(t, common.BOOT_STORAGE)
+	defer common.SetStorageMode(common.STORAGE_MODE_ACTIVE)
+	if err := common.GetConfigMap().PutConfig(storageModeKey, []byte(common.STORAGE_MODE_ACTIVE)); err != nil {
+		t.Fatal(err)
+	}
+
+	common.InitializedStorageConfiguration = &common.StorageConfig{Readonly: true}
+	initStorageMode()
+	if mode := common.GetStorageMode(); mode != common.STORAGE_MODE_READONLY {
+		t.Fatal("expect readonly mode, got ", mode)
+	}
+
+	// the saved mode is restored without the flag.
+	common.InitializedStorageConfiguration = &common.StorageConfig{}
+	initStorageMode()
+	if mode := common.GetStorageMode(); mode != common.STORAGE_MODE_ACTIVE {
+		t.Fatal("expect active mode, got ", mode)
+	}
+}
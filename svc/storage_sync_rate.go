@@ -0,0 +1,189 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/logger"
+	json "github.com/json-iterator/go"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	syncRateKey     = "syncRate"
+	minSyncRateRead = 1 << 10
+)
+
+var (
+	// byte-rate limits of file synchronization, adjusted by admin at runtime.
+	syncRate      common.SyncRateDTO
+	syncRateLock  = new(sync.Mutex)
+	nodeSyncRate  = &rateBucket{}
+	peerSyncRates = make(map[string]*rateBucket)
+)
+
+// rateBucket is a token bucket holding at most one second of tokens.
+type rateBucket struct {
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take takes n tokens and returns how long to wait until the tokens are filled,
+// the rate is passed every time because it can be changed at runtime.
+func (b *rateBucket) take(n int, rate int64) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	if rate <= 0 {
+		b.tokens = 0
+		b.last = now
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// syncRateReader limits reading a file synchronized from a group member
+// to both the rate of this node and the rate of the group member.
+type syncRateReader struct {
+	r    io.Reader
+	peer string
+}
+
+func (r *syncRateReader) Read(p []byte) (int, error) {
+	nodeRate, peerRate, peerBucket := currentSyncRate(r.peer)
+	// read small pieces at low rates, so that rates changed by admin apply soon.
+	rate := nodeRate
+	if rate <= 0 || peerRate > 0 && peerRate < rate {
+		rate = peerRate
+	}
+	if rate > 0 {
+		max := int(rate / 4)
+		if max < minSyncRateRead {
+			max = minSyncRateRead
+		}
+		if len(p) > max {
+			p = p[:max]
+		}
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		wait := nodeSyncRate.take(n, nodeRate)
+		if w := peerBucket.take(n, peerRate); w > wait {
+			wait = w
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return n, err
+}
+
+// currentSyncRate returns the rate of this node at the time of day,
+// and the rate and the bucket of the group member.
+func currentSyncRate(peer string) (int64, int64, *rateBucket) {
+	syncRateLock.Lock()
+	defer syncRateLock.Unlock()
+
+	b := peerSyncRates[peer]
+	if b == nil {
+		b = &rateBucket{}
+		peerSyncRates[peer] = b
+	}
+	return util.NodeSyncRate(&syncRate, time.Now()), syncRate.Peers[peer], b
+}
+
+func getSyncRate() common.SyncRateDTO {
+	syncRateLock.Lock()
+	defer syncRateLock.Unlock()
+
+	return syncRate
+}
+
+func setSyncRate(rate *common.SyncRateDTO) {
+	syncRateLock.Lock()
+	defer syncRateLock.Unlock()
+
+	syncRate = *rate
+}
+
+// initSyncRate restores the sync rate limits adjusted by admin before,
+// the limits of the configuration are used if nothing was saved.
+func initSyncRate() {
+	setSyncRate(&common.InitializedStorageConfiguration.ParsedSyncRate)
+	bs, err := common.GetConfigMap().GetConfig(syncRateKey)
+	if err != nil {
+		logger.Debug("error load sync rate: ", err)
+		return
+	}
+	if len(bs) == 0 {
+		return
+	}
+	rate := &common.SyncRateDTO{}
+	if err := json.Unmarshal(bs, rate); err != nil {
+		logger.Error("error load sync rate: ", err)
+		return
+	}
+	setSyncRate(rate)
+	logger.Info("sync rate adjusted by admin is restored: ", util.FormatByteRate(rate.Rate))
+}
+
+// syncRateHandler queries or adjusts the sync rate limits of this storage server.
+//
+// The limits are replaced by the attribute "syncRate", or reset to the limits of the configuration
+// if the attribute "reset" is "true". The current limits are returned in both cases.
+func syncRateHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	var rate *common.SyncRateDTO
+	saved := []byte{}
+	if header.Attributes["reset"] == "true" {
+		rate = &common.InitializedStorageConfiguration.ParsedSyncRate
+	} else if s := header.Attributes["syncRate"]; s != "" {
+		rate = &common.SyncRateDTO{}
+		if err := json.UnmarshalFromString(s, rate); err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    "invalid sync rate: " + err.Error(),
+			}, nil, 0, nil
+		}
+		if err := util.ValidateSyncRate(rate); err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    err.Error(),
+			}, nil, 0, nil
+		}
+		saved = []byte(s)
+	}
+	if rate != nil {
+		if err := common.GetConfigMap().PutConfig(syncRateKey, saved); err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    err.Error(),
+			}, nil, 0, nil
+		}
+		setSyncRate(rate)
+		logger.Info("sync rate changed: ", util.FormatByteRate(rate.Rate), ", ",
+			len(rate.Peers), " peer rates, ", len(rate.Schedule), " schedule windows")
+	}
+	current := getSyncRate()
+	s, err := json.MarshalToString(&current)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+		Attributes: map[string]string{
+			"syncRate": s,
+		},
+	}, nil, 0, nil
+}
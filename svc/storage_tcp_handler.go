@@ -15,13 +15,20 @@ import (
 	json "github.com/json-iterator/go"
 	"github.com/logrusorgru/aurora"
 	"io"
+	"io/ioutil"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var tailRefCount = []byte{0, 0, 0, 1}
 
+const (
+	legacyBinlogFetch = 30   // binlogs per sync for clients which read binlogs from the header
+	maxBinlogFetch    = 5000 // max binlogs per sync streamed in the body
+)
+
 func StartStorageTcpServer() {
 
 	listener, err := net.Listen("tcp",
@@ -38,7 +45,8 @@ func StartStorageTcpServer() {
 		common.InitializedStorageConfiguration.Port)
 	logger.Info("my instance id: ", common.InitializedStorageConfiguration.InstanceId)
 	logger.Info(aurora.BrightGreen("::: storage server started " +
-		gox.TValue(common.InitializedStorageConfiguration.Readonly, "in READONLY mode ", "").(string) + ":::"))
+		gox.TValue(common.GetStorageMode() != common.STORAGE_MODE_ACTIVE,
+			"in "+strings.ToUpper(string(common.GetStorageMode()))+" mode ", "").(string) + ":::"))
 
 	// running in cluster mode.
 	if common.InitializedStorageConfiguration.ParsedTrackers != nil &&
@@ -74,6 +82,8 @@ func storageClientConnHandler(conn net.Conn) {
 		Conn: conn,
 	}
 	defer pip.Close()
+	atomic.AddInt32(&activeConnections, 1)
+	defer atomic.AddInt32(&activeConnections, -1)
 	authorized := false
 	for {
 		err := pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
@@ -109,12 +119,24 @@ func storageClientConnHandler(conn net.Conn) {
 					return err
 				}
 				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_IMPORT {
+				h, b, l, err := importFileHandler(header, bodyReader, bodyLength, conn.RemoteAddr())
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
 			} else if header.Operation == common.OPERATION_DOWNLOAD {
 				h, b, l, err := downFileHandler(header)
 				if err != nil {
 					return err
 				}
 				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_FILE_META {
+				h, b, l, err := fileMetaHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
 			} else if header.Operation == common.OPERATION_QUERY {
 				h, b, l, err := inspectFileHandler(header)
 				if err != nil {
@@ -122,7 +144,51 @@ func storageClientConnHandler(conn net.Conn) {
 				}
 				return pip.Send(h, b, l)
 			} else if header.Operation == common.OPERATION_SYNC_BINLOGS {
-				h, b, l, err := syncBinlogHandler(header)
+				h, b, l, err := syncBinlogHandler(header, func(*common.BinlogQueryDTO) (binlog.XBinlogManager, error) {
+					return writableBinlogManager, nil
+				})
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_PING {
+				h, b, l, err := pingHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_SET_MODE {
+				h, b, l, err := setModeHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_SYNC_RATE {
+				h, b, l, err := syncRateHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_SYNC_STATUS {
+				h, b, l, err := syncStatusHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_ANTI_ENTROPY {
+				h, b, l, err := antiEntropyHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_RECONCILE {
+				h, b, l, err := reconcileHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_LIST {
+				h, b, l, err := listFilesHandler(header)
 				if err != nil {
 					return err
 				}
@@ -148,7 +214,19 @@ func uploadFileHandler(header *common.Header, bodyReader io.Reader, bodyLength i
 
 	logger.Debug("receive file")
 
+	if msg := uploadRejectedMsg(); msg != "" {
+		// drop the file body to keep the connection reusable.
+		if _, err := io.Copy(ioutil.Discard, io.LimitReader(bodyReader, bodyLength)); err != nil {
+			return nil, nil, 0, err
+		}
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    msg,
+		}, nil, 0, nil
+	}
+
 	increaseCountForTheSecond()
+	defer beginUpload()()
 
 	tmpFileName := common.InitializedStorageConfiguration.TmpDir + "/" + uuid.UUID()
 	out, err := file.CreateFile(tmpFileName)
@@ -174,7 +252,7 @@ func uploadFileHandler(header *common.Header, bodyReader io.Reader, bodyLength i
 	}
 
 	logger.Debug("copy file")
-	_, err = io.Copy(proxy, io.LimitReader(bodyReader, bodyLength))
+	_, err = io.Copy(proxy, &trafficReader{io.LimitReader(bodyReader, bodyLength)})
 	if err != nil {
 		return nil, nil, 0, err
 	}
@@ -199,6 +277,12 @@ func uploadFileHandler(header *common.Header, bodyReader io.Reader, bodyLength i
 	logger.Debug("create alias")
 	now := time.Now()
 	finalFileId := util.CreateAlias(_finalFileId, common.InitializedStorageConfiguration.InstanceId, isPrivate, now)
+
+	saveFileMeta(finalFileId, header.Attributes["name"], header.Attributes["contentType"])
+	if err := fireFileEvent(common.WEBHOOK_FILE_UPLOADED, finalFileId, bodyLength, ""); err != nil {
+		return nil, nil, 0, err
+	}
+
 	if !file.Exists(targetLoc) {
 		if err := file.CreateDirs(targetLoc); err != nil {
 			return nil, nil, 0, err
@@ -292,7 +376,23 @@ func downFileHandler(header *common.Header) (*common.Header, io.Reader, int64, e
 	}
 	return &common.Header{
 		Result: common.SUCCESS,
-	}, readyReader, realLen, nil
+	}, &trafficReader{readyReader}, realLen, nil
+}
+
+// fileMetaHandler returns the metadata of the file in the attributes,
+// so that group members replicating the file serve it the same way.
+func fileMetaHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	meta, err := common.GetConfigMap().GetFileMeta(header.Attributes["fileId"])
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	return &common.Header{
+		Result:     common.SUCCESS,
+		Attributes: meta,
+	}, nil, 0, nil
 }
 
 // inspectFileHandler inspects file's information
@@ -343,8 +443,9 @@ func inspectFileHandler(header *common.Header) (*common.Header, io.Reader, int64
 	}, nil, 0, nil
 }
 
-// syncBinlogHandler gets local binlogs for other storage server.
-func syncBinlogHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+// syncBinlogHandler gets binlogs for other servers from the binlog manager of the query.
+func syncBinlogHandler(header *common.Header,
+	binlogManager func(bq *common.BinlogQueryDTO) (binlog.XBinlogManager, error)) (*common.Header, io.Reader, int64, error) {
 	if header.Attributes == nil {
 		return &common.Header{
 			Result: common.ERROR,
@@ -375,8 +476,31 @@ func syncBinlogHandler(header *common.Header) (*common.Header, io.Reader, int64,
 		}, nil, 0, nil
 	}
 
-	// fetch 30+ once a tiem will exceed pip header size
-	bls, nOffset, err := writableBinlogManager.Read(bq.FileIndex, bq.Offset, 30)
+	// legacy clients get binlogs in the header, 30+ once a time will exceed pip header size.
+	fetch := legacyBinlogFetch
+	stream := header.Attributes["fetch"] != ""
+	if stream {
+		n, err := convert.StrToInt(header.Attributes["fetch"])
+		if err != nil || n <= 0 {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    "invalid header(4)",
+			}, nil, 0, nil
+		}
+		fetch = n
+		if fetch > maxBinlogFetch {
+			fetch = maxBinlogFetch
+		}
+	}
+
+	m, err := binlogManager(bq)
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "error query binlog: " + err.Error(),
+		}, nil, 0, nil
+	}
+	bls, nOffset, err := m.Read(bq.FileIndex, bq.Offset, fetch)
 	if err != nil {
 		return &common.Header{
 			Result: common.ERROR,
@@ -385,21 +509,37 @@ func syncBinlogHandler(header *common.Header) (*common.Header, io.Reader, int64,
 	}
 
 	result := &common.BinlogQueryResultDTO{}
-	result.Logs = bls
+	result.Instance = bq.Instance
 	result.FileIndex = bq.FileIndex
 	result.Offset = nOffset
 
-	if bq.FileIndex == writableBinlogManager.GetCurrentIndex() && bq.Offset == nOffset {
+	if bq.FileIndex == m.GetCurrentIndex() && bq.Offset == nOffset {
 		result.Offset = bq.Offset
 		result.FileIndex = bq.FileIndex
 	}
 
-	if writableBinlogManager.GetCurrentIndex() > bq.FileIndex &&
+	if m.GetCurrentIndex() > bq.FileIndex &&
 		(bls == nil || len(bls) == 0) {
 		result.FileIndex = bq.FileIndex + 1
 		result.Offset = 0
 	}
 
+	// binlogs are streamed in the body, the header only holds the new position.
+	var body *binlog.StreamEncoder
+	if stream {
+		body = binlog.NewStreamEncoder()
+		for i := range bls {
+			if err := body.WriteBinlog(&bls[i]); err != nil {
+				return &common.Header{
+					Result: common.ERROR,
+					Msg:    "error encode binlog: " + err.Error(),
+				}, nil, 0, nil
+			}
+		}
+	} else {
+		result.Logs = bls
+	}
+
 	jr, err := json.MarshalToString(result)
 	if err != nil {
 		return &common.Header{
@@ -408,10 +548,51 @@ func syncBinlogHandler(header *common.Header) (*common.Header, io.Reader, int64,
 		}, nil, 0, nil
 	}
 
-	return &common.Header{
+	h := &common.Header{
 		Result: common.SUCCESS,
 		Attributes: map[string]string{
 			"result": jr,
 		},
+	}
+	if body == nil {
+		return h, nil, 0, nil
+	}
+	return h, body.Reader(), body.Len(), nil
+}
+
+// loadString returns the live load of this server in json format.
+func loadString() string {
+	s, err := json.MarshalToString(collectLoad())
+	if err != nil {
+		logger.Debug("error marshal load: ", err)
+	}
+	return s
+}
+
+// pingHandler answers the health check of tracker servers.
+//
+// It reports whether the data directory is still writable.
+func pingHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	writable := true
+	probeFile := common.InitializedStorageConfiguration.TmpDir + "/" + uuid.UUID()
+	out, err := file.CreateFile(probeFile)
+	if err == nil {
+		_, err = out.Write(tailRefCount)
+		out.Close()
+		file.Delete(probeFile)
+	}
+	if err != nil {
+		logger.Debug("data dir is not writable: ", err)
+		writable = false
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+		Attributes: map[string]string{
+			"writable": convert.BoolToStr(writable),
+			"mode":     string(common.GetStorageMode()),
+			"draining": convert.BoolToStr(common.GetStorageMode() == common.STORAGE_MODE_DRAINING),
+			"load":     loadString(),
+			"group":    common.InitializedStorageConfiguration.Group,
+		},
 	}, nil, 0, nil
 }
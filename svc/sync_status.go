@@ -0,0 +1,365 @@
+package svc
+
+import (
+	"bytes"
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/reg"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/logger"
+	json "github.com/json-iterator/go"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSyncStatusScan is the max local binlogs scanned for pending files,
+	// and the max failed positions counted.
+	maxSyncStatusScan  = 20000
+	maxBinlogScanFetch = 1000 // binlogs read at a time by scanBinlogs
+)
+
+// binlogLag computes how far a binlog position of a group member is behind this storage server.
+func binlogLag(pos common.BinlogQueryDTO) (*common.BinlogLagDTO, error) {
+	m, ok := writableBinlogManager.(binlog.LagReader)
+	if !ok {
+		return nil, errors.New("binlog lag is not supported")
+	}
+	head, gap, err := m.Lag(pos)
+	if err != nil {
+		return nil, err
+	}
+	ret := &common.BinlogLagDTO{Head: head, Gap: gap}
+	if gap > 0 {
+		scanBinlogs(pos, 1, func(bl *common.BingLogDTO) {
+			ret.Oldest = fileCreateTime(bl.FileId)
+		})
+	}
+	return ret, nil
+}
+
+// scanBinlogs reads at most limit local binlogs from the position across binlog files,
+// limit <= 0 means all binlogs. It returns the number of binlogs read.
+func scanBinlogs(pos common.BinlogQueryDTO, limit int, handler func(bl *common.BingLogDTO)) int {
+	m, ok := writableBinlogManager.(binlog.FeedReader)
+	if !ok {
+		return 0
+	}
+	n := 0
+	for limit <= 0 || n < limit {
+		fetch := maxBinlogScanFetch
+		if limit > 0 && limit-n < fetch {
+			fetch = limit - n
+		}
+		records, nOffset, err := m.ReadFeed(pos.FileIndex, pos.Offset, fetch)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Debug("error read binlog: ", err)
+			break
+		}
+		for i := range records {
+			handler(&records[i].Binlog)
+		}
+		n += len(records)
+		pos.Offset = nOffset
+		if len(records) == 0 {
+			if m.GetCurrentIndex() <= pos.FileIndex {
+				break
+			}
+			pos.FileIndex++
+			pos.Offset = 0
+		}
+	}
+	return n
+}
+
+func fileCreateTime(fileId string) int64 {
+	info, _, err := util.ParseAlias(fileId, common.InitializedStorageConfiguration.Secret)
+	if err != nil {
+		return 0
+	}
+	return info.CreateTime
+}
+
+// collectSyncStatus computes the synchronization state of this storage server with every group member.
+//
+// The binlog gap of a member is queried from the member, pending and failed files are
+// attributed to the member by the source instance of their binlogs.
+func collectSyncStatus() (*common.SyncStatusDTO, error) {
+	lagReader, ok := writableBinlogManager.(binlog.LagReader)
+	if !ok {
+		return nil, errors.New("binlog lag is not supported")
+	}
+	now := time.Now().Unix()
+	status := &common.SyncStatusDTO{
+		InstanceId: common.InitializedStorageConfiguration.InstanceId,
+		Group:      common.InitializedStorageConfiguration.Group,
+		Peers:      []*common.PeerSyncStatusDTO{},
+		Time:       now,
+	}
+	bs, err := common.GetConfigMap().GetConfig(string(downloadBinlogPosKey))
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) > 0 {
+		if err := json.Unmarshal(bs, &status.Download); err != nil {
+			return nil, err
+		}
+	}
+	if status.Head, status.Pending, err = lagReader.Lag(status.Download); err != nil {
+		return nil, err
+	}
+
+	peers := make(map[string]*common.PeerSyncStatusDTO)
+	oldest := make(map[string]int64)
+	peer := func(instanceId string) *common.PeerSyncStatusDTO {
+		p := peers[instanceId]
+		if p == nil {
+			p = &common.PeerSyncStatusDTO{InstanceId: instanceId}
+			peers[instanceId] = p
+		}
+		return p
+	}
+	unsynced := func(instanceId string, createTime int64) {
+		if createTime > 0 && (oldest[instanceId] == 0 || createTime < oldest[instanceId]) {
+			oldest[instanceId] = createTime
+		}
+	}
+
+	// files not downloaded by file synchronization yet.
+	scanned := scanBinlogs(status.Download, maxSyncStatusScan, func(bl *common.BingLogDTO) {
+		if bl.SourceInstance == status.InstanceId {
+			return
+		}
+		peer(bl.SourceInstance).Pending++
+		unsynced(bl.SourceInstance, fileCreateTime(bl.FileId))
+	})
+	status.Estimated = int64(scanned) < status.Pending
+
+	// files failed to download, they are retried from the failed positions.
+	var failed []common.BinlogQueryDTO
+	if err := common.GetConfigMap().IteratorFailedBinlog(func(c *bolt.Cursor) error {
+		for k, _ := c.First(); k != nil && len(failed) < maxSyncStatusScan; k, _ = c.Next() {
+			pos := common.BinlogQueryDTO{}
+			if err := json.Unmarshal(k, &pos); err == nil {
+				failed = append(failed, pos)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for _, pos := range failed {
+		status.Failed++
+		scanBinlogs(pos, 1, func(bl *common.BingLogDTO) {
+			peer(bl.SourceInstance).Failed++
+			unsynced(bl.SourceInstance, fileCreateTime(bl.FileId))
+		})
+	}
+
+	// replicas rejected by verification.
+	for instanceId, n := range rejectedReplicaCounts() {
+		peer(instanceId).Rejected = n
+		status.Rejected += n
+	}
+
+	// binlogs of group members not synchronized yet.
+	lock := new(sync.Mutex)
+	wg := sync.WaitGroup{}
+	for ele := api.FilterInstances(common.ROLE_STORAGE).Front(); ele != nil; ele = ele.Next() {
+		ins := ele.Value.(*common.Instance)
+		if ins.Attributes["group"] != status.Group || ins.InstanceId == status.InstanceId {
+			continue
+		}
+		state, err := loadSynchronizationConfig(ins.InstanceId)
+		if err != nil {
+			return nil, err
+		}
+		p := peer(ins.InstanceId)
+		p.Position = *state
+		wg.Add(1)
+		go func(server common.Server, p *common.PeerSyncStatusDTO) {
+			defer wg.Done()
+			lag, err := clientAPI.BinlogLag(&server, &p.Position)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				p.Gap = -1
+				p.Error = err.Error()
+				return
+			}
+			p.Head = &lag.Head
+			p.Gap = lag.Gap
+			unsynced(p.InstanceId, lag.Oldest)
+		}(ins.Server, p)
+	}
+	wg.Wait()
+
+	if drLink != nil {
+		status.DrLink = drLink.status()
+	}
+
+	status.InSync = status.Pending == 0 && status.Failed == 0
+	for _, p := range peers {
+		if oldest[p.InstanceId] > 0 && now > oldest[p.InstanceId] {
+			p.OldestUnsyncedAge = now - oldest[p.InstanceId]
+		}
+		p.InSync = p.Gap == 0 && p.Pending == 0 && p.Failed == 0 && p.Error == ""
+		status.InSync = status.InSync && p.InSync
+		status.Peers = append(status.Peers, p)
+	}
+	sort.Slice(status.Peers, func(i, j int) bool {
+		return status.Peers[i].InstanceId < status.Peers[j].InstanceId
+	})
+	return status, nil
+}
+
+// collectClusterSyncStatus collects the synchronization state of all storage servers
+// and aggregates it by group, an empty group means all groups.
+func collectClusterSyncStatus(group string) *common.ClusterSyncStatusDTO {
+	groups := make(map[string]*common.GroupSyncStatusDTO)
+	lock := new(sync.Mutex)
+	wg := sync.WaitGroup{}
+	for _, ins := range reg.InstanceSetSnapshot() {
+		g := ins.Attributes["group"]
+		if ins.Role != common.ROLE_STORAGE || ins.State != common.REGISTER_HOLD || group != "" && g != group {
+			continue
+		}
+		if groups[g] == nil {
+			groups[g] = &common.GroupSyncStatusDTO{Group: g, Members: []*common.SyncStatusDTO{}}
+		}
+		wg.Add(1)
+		go func(ins *common.Instance, g *common.GroupSyncStatusDTO) {
+			defer wg.Done()
+			status, err := clientAPI.SyncStatus(&ins.Server)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				logger.Debug("error query sync status of ", ins.Server.ConnectionString(), "(", ins.InstanceId, "): ", err)
+				g.Unreachable = append(g.Unreachable, ins.InstanceId)
+				return
+			}
+			g.Members = append(g.Members, status)
+		}(ins, groups[g])
+	}
+	wg.Wait()
+
+	ret := &common.ClusterSyncStatusDTO{
+		Groups: []*common.GroupSyncStatusDTO{},
+		Time:   time.Now().Unix(),
+	}
+	for _, g := range groups {
+		g.InSync = len(g.Unreachable) == 0
+		for _, m := range g.Members {
+			g.InSync = g.InSync && m.InSync
+			g.Pending += m.Pending
+			g.Failed += m.Failed
+			g.Rejected += m.Rejected
+			for _, p := range m.Peers {
+				if p.Gap > g.MaxGap {
+					g.MaxGap = p.Gap
+				}
+				if p.OldestUnsyncedAge > g.OldestUnsyncedAge {
+					g.OldestUnsyncedAge = p.OldestUnsyncedAge
+				}
+			}
+		}
+		sort.Slice(g.Members, func(i, j int) bool {
+			return g.Members[i].InstanceId < g.Members[j].InstanceId
+		})
+		sort.Strings(g.Unreachable)
+		ret.Groups = append(ret.Groups, g)
+	}
+	sort.Slice(ret.Groups, func(i, j int) bool {
+		return ret.Groups[i].Group < ret.Groups[j].Group
+	})
+	return ret
+}
+
+// syncStatusHandler returns the synchronization state of this storage server in the body,
+// or the lag of the binlog position in the attribute "position" which is queried by group members.
+func syncStatusHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	if s := header.Attributes["position"]; s != "" {
+		pos := common.BinlogQueryDTO{}
+		if err := json.UnmarshalFromString(s, &pos); err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    "invalid binlog position: " + err.Error(),
+			}, nil, 0, nil
+		}
+		lag, err := binlogLag(pos)
+		if err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    err.Error(),
+			}, nil, 0, nil
+		}
+		ls, err := json.MarshalToString(lag)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		return &common.Header{
+			Result: common.SUCCESS,
+			Attributes: map[string]string{
+				"lag": ls,
+			},
+		}, nil, 0, nil
+	}
+	status, err := collectSyncStatus()
+	return syncStatusResponse(status, err)
+}
+
+// trackerSyncStatusHandler returns the synchronization state of groups in the body.
+func trackerSyncStatusHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	return syncStatusResponse(collectClusterSyncStatus(header.Attributes["group"]), nil)
+}
+
+// syncStatusResponse writes the synchronization state into the body,
+// because states of many group members easily exceed the limit of the header size.
+func syncStatusResponse(status interface{}, err error) (*common.Header, io.Reader, int64, error) {
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	bs, err := json.Marshal(status)
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+	}, bytes.NewReader(bs), int64(len(bs)), nil
+}
+
+// httpStorageSyncStatus serves the synchronization state of this storage server.
+func httpStorageSyncStatus(w http.ResponseWriter, r *http.Request) {
+	if !feedAuthorized(r, common.InitializedStorageConfiguration.Secret, common.InitializedStorageConfiguration.FeedKey) {
+		util.HttpForbiddenError(w, "invalid key")
+		return
+	}
+	status, err := collectSyncStatus()
+	if err != nil {
+		util.HttpInternalServerError(w, err.Error())
+		return
+	}
+	writeFeedJson(w, status)
+}
+
+// httpTrackerSyncStatus serves the synchronization state of groups, which can be filtered by "group".
+func httpTrackerSyncStatus(w http.ResponseWriter, r *http.Request) {
+	if !feedAuthorized(r, common.InitializedTrackerConfiguration.Secret, common.InitializedTrackerConfiguration.FeedKey) {
+		util.HttpForbiddenError(w, "invalid key")
+		return
+	}
+	writeFeedJson(w, collectClusterSyncStatus(r.URL.Query().Get("group")))
+}
@@ -2,6 +2,7 @@ package svc
 
 import (
 	"fmt"
+	"github.com/hetianyi/godfs/binlog"
 	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/godfs/reg"
 	"github.com/hetianyi/godfs/util"
@@ -25,6 +26,7 @@ func BootTrackerServer() {
 
 	// initialize dataset.
 	initDataSet()
+	journalBinlogManager = binlog.NewTrackerBinlogManager()
 
 	util.PrintLogo()
 
@@ -0,0 +1,98 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/reg"
+	"github.com/hetianyi/gox"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/logger"
+	json "github.com/json-iterator/go"
+	"io"
+	"sort"
+)
+
+const maxAllocateTargets = 10
+
+// allocateHandler returns ranked storage servers for a new upload.
+//
+// The storage servers are filtered by group, health, mode and free disk space,
+// servers which already hold the file content come first and the rest are
+// ordered by their live load.
+func allocateHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	if header.Attributes == nil {
+		header.Attributes = make(map[string]string)
+	}
+	group := header.Attributes["group"]
+	md5 := header.Attributes["md5"]
+	size, _ := convert.StrToInt64(header.Attributes["size"])
+
+	holders := make(map[string]bool)
+	if md5 != "" {
+		located, err := common.GetConfigMap().GetContentLocations(md5)
+		if err != nil {
+			logger.Debug("error locate content ", md5, ": ", err)
+		}
+		for _, instanceId := range located {
+			holders[instanceId] = true
+		}
+	}
+
+	var candidates []*common.Instance
+	for _, ins := range allocatableInstances() {
+		if ins.Role != common.ROLE_STORAGE || ins.State != common.REGISTER_HOLD ||
+			ins.Attributes["readonly"] == "true" {
+			continue
+		}
+		if ins.Health == common.HEALTH_UNREACHABLE || ins.Health == common.HEALTH_DEGRADED ||
+			ins.Health == common.HEALTH_DRAINING {
+			continue
+		}
+		if group != "" && ins.Attributes["group"] != group {
+			continue
+		}
+		if ins.Load != nil && ins.Load.TotalDisk > 0 && ins.Load.FreeDisk < size && !holders[ins.InstanceId] {
+			continue
+		}
+		candidates = append(candidates, ins)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		hi, hj := holders[candidates[i].InstanceId], holders[candidates[j].InstanceId]
+		if hi != hj {
+			return hi
+		}
+		return candidates[i].Load.Score() < candidates[j].Load.Score()
+	})
+	if len(candidates) > maxAllocateTargets {
+		candidates = candidates[:maxAllocateTargets]
+	}
+
+	targets := make([]common.StorageServer, len(candidates))
+	for i, ins := range candidates {
+		targets[i] = common.StorageServer{
+			Server: ins.Server,
+			Group:  ins.Attributes["group"],
+		}
+	}
+	ret, _ := json.MarshalToString(targets)
+	return &common.Header{
+		Result: common.SUCCESS,
+		Attributes: map[string]string{
+			"targets": ret,
+		},
+	}, nil, 0, nil
+}
+
+// allocatableInstances returns the instances registered to this tracker
+// merged with the instances synchronized from peer trackers.
+func allocatableInstances() map[string]*common.Instance {
+	instances := reg.InstanceSetSnapshot()
+	gox.WalkList(api.FilterInstances(common.ROLE_STORAGE), func(item interface{}) bool {
+		ins := item.(*common.Instance)
+		if instances[ins.InstanceId] == nil {
+			instances[ins.InstanceId] = ins
+		}
+		return false
+	})
+	return instances
+}
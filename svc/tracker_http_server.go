@@ -12,6 +12,9 @@ import (
 // StartTrackerHttpServer starts a tracker http server.
 func StartTrackerHttpServer(c *common.TrackerConfig) {
 	r := mux.NewRouter()
+	r.HandleFunc("/feed", httpTrackerFeed).Methods("GET")
+	r.HandleFunc("/feed/journals", httpTrackerFeedJournals).Methods("GET")
+	r.HandleFunc("/sync/status", httpTrackerSyncStatus).Methods("GET")
 	srv := &http.Server{
 		Handler: r,
 		Addr:    c.BindAddress + ":" + convert.IntToStr(c.HttpPort),
@@ -0,0 +1,181 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/logger"
+	json "github.com/json-iterator/go"
+	"time"
+)
+
+const (
+	replicationInterval = time.Second * 3
+	maxReplicationDelay = time.Second * 30
+)
+
+var (
+	// signals of the replication workers of peer tracker servers.
+	replicationSignals = make(map[string]chan struct{})
+)
+
+// initTrackerReplication starts a replication worker for each peer tracker server.
+//
+// Binlogs pushed by storage servers are forwarded to all peer trackers,
+// so any tracker of the cluster knows all the files.
+//
+// Workers replay the binlog journals from the position persisted for each peer tracker
+// and replicas are saved in the config map until they are replicated,
+// so a peer tracker which is down or slow catches up once it is available again.
+func initTrackerReplication(servers []*common.Server) {
+	for _, s := range servers {
+		signal := make(chan struct{}, 1)
+		replicationSignals[s.ConnectionString()] = signal
+		go replicationWorker(s, signal)
+	}
+}
+
+// saveReplicas saves replicas received from a storage server for all peer trackers.
+func saveReplicas(replicas []common.ReplicaDTO) error {
+	if len(replicas) == 0 || len(replicationSignals) == 0 {
+		return nil
+	}
+	peers := make([]string, 0, len(replicationSignals))
+	for k := range replicationSignals {
+		peers = append(peers, k)
+	}
+	return common.GetConfigMap().PutPeerReplicas(peers, replicas)
+}
+
+// notifyReplication wakes up the replication workers.
+func notifyReplication() {
+	for _, signal := range replicationSignals {
+		select {
+		case signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicationWorker replicates binlogs and replicas to a peer tracker server
+// every replicationInterval or when it is notified,
+// it backs off if the peer tracker fails.
+func replicationWorker(server *common.Server, signal chan struct{}) {
+	ticker := time.NewTicker(replicationInterval)
+	defer ticker.Stop()
+
+	retry := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-signal:
+		}
+		// never push to myself.
+		if server.InstanceId == common.InitializedTrackerConfiguration.InstanceId {
+			continue
+		}
+		err := replicateTo(server)
+		if err == nil {
+			retry = 0
+			continue
+		}
+		retry++
+		delay := time.Second * time.Duration(retry*2)
+		if delay > maxReplicationDelay {
+			delay = maxReplicationDelay
+		}
+		logger.Debug("error replicate to tracker ", server.ConnectionString(),
+			": ", err, ", retry in ", delay)
+		time.Sleep(delay)
+	}
+}
+
+// replicateTo replicates binlogs of all journals and the saved replicas to the peer tracker server.
+//
+// Binlogs pushed by peer trackers are journaled too and replicated again,
+// the peer tracker ignores the binlogs it already has.
+func replicateTo(server *common.Server) error {
+	instances, err := journalBinlogManager.Instances()
+	if err != nil {
+		return err
+	}
+	for _, instanceId := range instances {
+		if err := replicateJournal(server, instanceId); err != nil {
+			return err
+		}
+	}
+	return replicateReplicas(server)
+}
+
+// replicateJournal pushes binlogs of the journal to the peer tracker server
+// from the persisted position until the latest binlog.
+func replicateJournal(server *common.Server, instanceId string) error {
+	journal, err := journalBinlogManager.Journal(instanceId)
+	if err != nil {
+		return err
+	}
+	key := "replication_pos_" + server.ConnectionString() + "_" + instanceId
+	pos, err := getReplicationPos(key)
+	if err != nil {
+		return err
+	}
+	for {
+		bls, nOffset, err := journal.Read(pos.FileIndex, pos.Offset, maxBinlogsPerPush)
+		if err != nil {
+			return err
+		}
+		if len(bls) == 0 {
+			if journal.GetCurrentIndex() <= pos.FileIndex {
+				return nil
+			}
+			// move to the next binlog file.
+			pos = common.BinlogQueryDTO{FileIndex: pos.FileIndex + 1}
+		} else {
+			if err := clientAPI.PushBinlog(server, bls); err != nil {
+				return err
+			}
+			logger.Debug(len(bls), " binlogs of ", instanceId, " replicated to tracker ", server.ConnectionString())
+			pos.Offset = nOffset
+		}
+		if err := setReplicationPos(key, &pos); err != nil {
+			return err
+		}
+	}
+}
+
+// replicateReplicas pushes the saved replicas to the peer tracker server.
+func replicateReplicas(server *common.Server) error {
+	peer := server.ConnectionString()
+	for {
+		replicas, err := common.GetConfigMap().GetPeerReplicas(peer, maxReplicasPerPush)
+		if err != nil {
+			return err
+		}
+		if len(replicas) == 0 {
+			return nil
+		}
+		if err := clientAPI.PushReplicas(server, replicas); err != nil {
+			return err
+		}
+		logger.Debug(len(replicas), " replicas replicated to tracker ", peer)
+		if err := common.GetConfigMap().RemovePeerReplicas(peer, replicas); err != nil {
+			return err
+		}
+	}
+}
+
+func getReplicationPos(key string) (common.BinlogQueryDTO, error) {
+	pos := common.BinlogQueryDTO{}
+	bs, err := common.GetConfigMap().GetConfig(key)
+	if err != nil || len(bs) == 0 {
+		return pos, err
+	}
+	err = json.Unmarshal(bs, &pos)
+	return pos, err
+}
+
+func setReplicationPos(key string, pos *common.BinlogQueryDTO) error {
+	bs, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	return common.GetConfigMap().PutConfig(key, bs)
+}
@@ -0,0 +1,101 @@
+package svc
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fakePeerAPI records binlogs and replicas pushed to peer trackers.
+type fakePeerAPI struct {
+	api.ClientAPI
+	err      error
+	binlogs  []common.BingLogDTO
+	replicas []common.ReplicaDTO
+}
+
+func (f *fakePeerAPI) PushBinlog(server *common.Server, binlogs []common.BingLogDTO) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.binlogs = append(f.binlogs, binlogs...)
+	return nil
+}
+
+func (f *fakePeerAPI) PushReplicas(server *common.Server, replicas []common.ReplicaDTO) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.replicas = append(f.replicas, replicas...)
+	return nil
+}
+
+func TestReplicateToPeerCatchesUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	initTestConfigMap(t, common.BOOT_TRACKER)
+	common.InitializedTrackerConfiguration = &common.TrackerConfig{
+		DataDir:    dir,
+		InstanceId: "tracker1",
+	}
+	journalBinlogManager = binlog.NewTrackerBinlogManager()
+	peer := &common.Server{Host: "127.0.0.1", Port: 1022, InstanceId: "tracker2"}
+	replicationSignals = map[string]chan struct{}{peer.ConnectionString(): make(chan struct{}, 1)}
+	defer func() {
+		replicationSignals = make(map[string]chan struct{})
+	}()
+	fake := &fakePeerAPI{}
+	clientAPI = fake
+	defer func() {
+		clientAPI = nil
+	}()
+
+	write := func(lengths ...int64) {
+		for _, l := range lengths {
+			fileId := strings.Repeat("x", common.FILE_ID_SIZE-1) + string(rune('a'+l))
+			if err := journalBinlogManager.Write(binlog.CreateLocalBinlog(fileId, l, "storage1")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write(1, 2, 3)
+	if err := saveReplicas([]common.ReplicaDTO{{FileId: "file1", InstanceId: "storage2"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer tracker is down.
+	fake.err = errors.New("connection refused")
+	if err := replicateTo(peer); err == nil {
+		t.Fatal("expect error")
+	}
+	write(4)
+
+	// the peer tracker is available again.
+	fake.err = nil
+	if err := replicateTo(peer); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.binlogs) != 4 || fake.binlogs[0].FileLength != 1 || fake.binlogs[3].FileLength != 4 {
+		t.Fatal("expect 4 binlogs replicated, got ", fake.binlogs)
+	}
+	if len(fake.replicas) != 1 || fake.replicas[0].InstanceId != "storage2" {
+		t.Fatal("expect 1 replica replicated, got ", fake.replicas)
+	}
+
+	// only new binlogs and replicas are replicated later.
+	write(5)
+	if err := replicateTo(peer); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.binlogs) != 5 || fake.binlogs[4].FileLength != 5 || len(fake.replicas) != 1 {
+		t.Fatal("expect 5 binlogs and 1 replica replicated, got ", fake.binlogs, fake.replicas)
+	}
+}
@@ -0,0 +1,59 @@
+package svc
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/reg"
+	"github.com/hetianyi/gox/gpip"
+	"github.com/hetianyi/gox/logger"
+	json "github.com/json-iterator/go"
+	"time"
+)
+
+// subscribeHandler streams instance events to the subscriber.
+//
+// A header without event is sent every SUBSCRIBE_HEARTBEAT so that
+// the subscriber can detect broken connections.
+// It never returns until the connection breaks.
+func subscribeHandler(pip *gpip.Pip) error {
+	id, events := reg.Subscribe()
+	defer reg.Unsubscribe(id)
+
+	logger.Debug("new instance event subscriber: ", id)
+
+	if err := pip.Send(&common.Header{
+		Result: common.SUCCESS,
+	}, nil, 0); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(common.SUBSCRIBE_HEARTBEAT)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return errors.New("instance event subscriber is dropped")
+			}
+			s, err := json.MarshalToString(event)
+			if err != nil {
+				return err
+			}
+			if err := pip.Send(&common.Header{
+				Result: common.SUCCESS,
+				Attributes: map[string]string{
+					"event": s,
+				},
+			}, nil, 0); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := pip.Send(&common.Header{
+				Result: common.SUCCESS,
+			}, nil, 0); err != nil {
+				return err
+			}
+		}
+	}
+}
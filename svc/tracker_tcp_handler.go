@@ -3,18 +3,24 @@ package svc
 import (
 	"errors"
 	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/binlog"
 	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/godfs/reg"
+	"github.com/hetianyi/gox"
 	"github.com/hetianyi/gox/convert"
 	"github.com/hetianyi/gox/gpip"
 	"github.com/hetianyi/gox/logger"
 	json "github.com/json-iterator/go"
 	"github.com/logrusorgru/aurora"
 	"io"
+	"io/ioutil"
 	"net"
 	"time"
 )
 
+// maxPushBodySize limits the body of a binlog push, which is decoded into memory.
+const maxPushBodySize = 16 << 20
+
 func StartTrackerTcpServer() {
 
 	listener, err := net.Listen("tcp",
@@ -32,21 +38,21 @@ func StartTrackerTcpServer() {
 	logger.Info("my instance id: ", common.InitializedTrackerConfiguration.InstanceId)
 	logger.Info(aurora.BrightGreen("::: tracker server started :::"))
 
+	servers := make([]*common.Server, len(common.InitializedTrackerConfiguration.ParsedTrackers))
+	for i := range common.InitializedTrackerConfiguration.ParsedTrackers {
+		servers[i] = &common.InitializedTrackerConfiguration.ParsedTrackers[i]
+	}
+	// client api is also used by health checker.
+	InitializeClientAPI(&api.Config{
+		MaxConnectionsPerServer: MaxConnPerServer,
+		SynchronizeOnce:         false,
+		TrackerServers:          servers,
+	})
 	// running in cluster mode.
-	if common.InitializedTrackerConfiguration.ParsedTrackers != nil &&
-		len(common.InitializedTrackerConfiguration.ParsedTrackers) > 0 {
-
-		servers := make([]*common.Server, len(common.InitializedTrackerConfiguration.ParsedTrackers))
-		for i := range common.InitializedTrackerConfiguration.ParsedTrackers {
-			servers[i] = &common.InitializedTrackerConfiguration.ParsedTrackers[i]
-		}
-		config := &api.Config{
-			MaxConnectionsPerServer: MaxConnPerServer,
-			SynchronizeOnce:         false,
-			TrackerServers:          servers,
-		}
-		InitializeClientAPI(config)
+	if len(servers) > 0 {
+		initTrackerReplication(servers)
 	}
+	initHealthChecker()
 
 	for {
 		conn, err := listener.Accept()
@@ -110,13 +116,46 @@ func trackerClientConnHandler(conn net.Conn) {
 			}
 
 			if header.Operation == common.OPERATION_SYNC_INSTANCES {
-				h, b, l, err := synchronizeInstancesHandler(header)
+				h, b, l, err := synchronizeInstancesHandler(header, registeredInstance)
 				if err != nil {
 					return err
 				}
 				return pip.Send(h, b, l)
 			} else if header.Operation == common.OPERATION_PUSH_BINLOGS {
-				h, b, l, err := pushStorageBinLogHandler(header, registeredInstance.InstanceId)
+				h, b, l, err := pushStorageBinLogHandler(header, registeredInstance, bodyReader, bodyLength)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_SYNC_BINLOGS {
+				h, b, l, err := trackerSyncBinlogHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_LOCATE {
+				h, b, l, err := locateFileHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_SUBSCRIBE {
+				// the connection is occupied by the subscription until it breaks.
+				return subscribeHandler(pip)
+			} else if header.Operation == common.OPERATION_ALLOCATE {
+				h, b, l, err := allocateHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_SYNC_STATUS {
+				h, b, l, err := trackerSyncStatusHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_LIST {
+				h, b, l, err := trackerListFilesHandler(header)
 				if err != nil {
 					return err
 				}
@@ -135,9 +174,23 @@ func trackerClientConnHandler(conn net.Conn) {
 	}
 }
 
-// inspectFileHandler inspects file's information
-func synchronizeInstancesHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+// synchronizeInstancesHandler returns all instances known by this tracker.
+//
+// For clients and storage servers, the instances registered to this tracker
+// are merged with the instances synchronized from peer trackers.
+// Peer trackers only get the instances registered to this tracker,
+// otherwise dead instances would be passed around between trackers forever.
+func synchronizeInstancesHandler(header *common.Header, client *common.Instance) (*common.Header, io.Reader, int64, error) {
 	snapshot := reg.InstanceSetSnapshot()
+	if client == nil || client.Role != common.ROLE_TRACKER {
+		gox.WalkList(api.FilterInstances(common.ROLE_ANY), func(item interface{}) bool {
+			ins := item.(*common.Instance)
+			if snapshot[ins.InstanceId] == nil {
+				snapshot[ins.InstanceId] = ins
+			}
+			return false
+		})
+	}
 	ret, _ := json.Marshal(snapshot)
 	return &common.Header{
 		Result: common.SUCCESS,
@@ -148,63 +201,249 @@ func synchronizeInstancesHandler(header *common.Header) (*common.Header, io.Read
 	}, nil, 0, nil
 }
 
-// syncStorageBinLog saves storage server binlog.
-func pushStorageBinLogHandler(header *common.Header, clientId string) (*common.Header, io.Reader, int64, error) {
+// pushStorageBinLogHandler saves binlogs and replicas pushed by storage servers or peer trackers.
+//
+// They are streamed in the body, clients of old versions put them in header attributes.
+func pushStorageBinLogHandler(header *common.Header, client *common.Instance,
+	bodyReader io.Reader, bodyLength int64) (*common.Header, io.Reader, int64, error) {
 
-	logger.Debug("push binlog from storage client \"", clientId, "\"")
+	logger.Debug("push binlog from client \"", client.InstanceId, "\"")
 
-	jsonAddr := ""
-	if header.Attributes != nil && len(header.Attributes) > 0 {
-		jsonAddr = header.Attributes["binlogs"]
-	} else {
+	if bodyLength > maxPushBodySize {
+		// drain the body to keep the connection usable.
+		if _, err := io.Copy(ioutil.Discard, bodyReader); err != nil {
+			return nil, nil, 0, err
+		}
 		return &common.Header{
-			Result: common.SUCCESS,
+			Result: common.ERROR,
+			Msg:    "too many binlogs in a push",
 		}, nil, 0, nil
 	}
 
 	var ret []common.BingLogDTO
-	if err := json.UnmarshalFromString(jsonAddr, &ret); err != nil {
+	var replicas []common.ReplicaDTO
+	// md5 of the files, reported by storage servers only.
+	digests := make(map[string]string)
+
+	if bodyLength > 0 {
+		err := binlog.DecodeStream(bodyReader, func(bl *common.BingLogDTO, r *common.ReplicaDTO, d *[2]string) error {
+			if bl != nil {
+				ret = append(ret, *bl)
+			} else if r != nil {
+				replicas = append(replicas, *r)
+			} else if d != nil {
+				digests[d[0]] = d[1]
+			}
+			return nil
+		})
+		if err != nil {
+			// the rest of the body is unknown, the connection must be closed.
+			return nil, nil, 0, err
+		}
+	}
+
+	if jsonAttr := header.Attributes["binlogs"]; jsonAttr != "" {
+		if err := json.UnmarshalFromString(jsonAttr, &ret); err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    err.Error(),
+			}, nil, 0, nil
+		}
+	}
+	if jsonAttr := header.Attributes["replicas"]; jsonAttr != "" {
+		if err := json.UnmarshalFromString(jsonAttr, &replicas); err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    err.Error(),
+			}, nil, 0, nil
+		}
+	}
+	if jsonAttr := header.Attributes["digests"]; jsonAttr != "" {
+		if err := json.UnmarshalFromString(jsonAttr, &digests); err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    err.Error(),
+			}, nil, 0, nil
+		}
+	}
+
+	if len(ret) == 0 && len(replicas) == 0 {
+		return pushBinlogSuccess(), nil, 0, nil
+	}
+
+	// replicas pushed by peer trackers are not replicated again,
+	// binlogs are replicated from the journals.
+	if client.Role == common.ROLE_STORAGE {
+		if err := saveReplicas(replicas); err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    "error save replicas: " + err.Error(),
+			}, nil, 0, nil
+		}
+	}
+
+	// fileIds are kept for listing files on trackers.
+	configMap := common.GetConfigMap()
+	if err := configMap.PutFile(ret); err != nil {
 		return &common.Header{
 			Result: common.ERROR,
 			Msg:    err.Error(),
 		}, nil, 0, nil
 	}
 
-	/*configMap := common.GetConfigMap()
-	if err := configMap.PutFile(ret); err != nil {
+	// the source instance of a binlog always holds the file.
+	locations := make(map[string][]string)
+	contents := make(map[string][]string)
+	var newFiles []*common.BingLog
+	journaled := make(map[string]bool)
+	for _, f := range ret {
+		locations[f.FileId] = append(locations[f.FileId], f.SourceInstance)
+		if md5 := digests[f.FileId]; md5 != "" {
+			contents[md5] = append(contents[md5], f.SourceInstance)
+		}
+		c, err := Contains(f.FileId)
+		if err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    err.Error(),
+			}, nil, 0, nil
+		}
+		if c || journaled[f.FileId] {
+			logger.Debug("fileId already exists: ", f.FileId)
+			continue
+		}
+		journaled[f.FileId] = true
+		if len(f.FileId) != common.FILE_ID_SIZE || len(f.SourceInstance) != 8 {
+			logger.Warn("invalid binlog from client \"", client.InstanceId, "\": ", f.FileId)
+			continue
+		}
+		newFiles = append(newFiles, binlog.CreateLocalBinlog(f.FileId, f.FileLength, f.SourceInstance))
+	}
+
+	// journal binlogs first and dataset after,
+	// a file is journaled again if the dataset is not updated.
+	if err := journalBinlogManager.Write(newFiles...); err != nil {
 		return &common.Header{
 			Result: common.ERROR,
-			Msg:    err.Error(),
+			Msg:    "error journal binlog: " + err.Error(),
 		}, nil, 0, nil
-	}*/
-
-	if len(ret) > 0 {
-		for _, f := range ret {
-			c, err := Contains(f.FileId)
-			if err != nil {
-				return &common.Header{
-					Result: common.ERROR,
-					Msg:    err.Error(),
-				}, nil, 0, nil
-			}
-			if c {
-				logger.Debug("fileId already exists: ", f.FileId)
-				return &common.Header{
-					Result: common.SUCCESS,
-				}, nil, 0, nil
-			}
-			if err := Add(f.FileId); err != nil {
-				return &common.Header{
-					Result: common.ERROR,
-					Msg:    err.Error(),
-				}, nil, 0, nil
-			}
+	}
+	for _, b := range newFiles {
+		if err := Add(string(b.FileId)); err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    err.Error(),
+			}, nil, 0, nil
+		}
+	}
+	for _, r := range replicas {
+		locations[r.FileId] = append(locations[r.FileId], r.InstanceId)
+		if md5 := digests[r.FileId]; md5 != "" {
+			contents[md5] = append(contents[md5], r.InstanceId)
+		}
+	}
+	if len(locations) > 0 {
+		if err := common.GetConfigMap().AddFileLocations(locations); err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    err.Error(),
+			}, nil, 0, nil
+		}
+	}
+
+	if len(contents) > 0 {
+		if err := common.GetConfigMap().AddContentLocations(contents); err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    err.Error(),
+			}, nil, 0, nil
 		}
 	}
 
-	logger.Debug("binlog write success: ", len(ret))
+	logger.Debug("binlog write success: ", len(ret), ", replicas: ", len(replicas))
+	notifyReplication()
+
+	return pushBinlogSuccess(), nil, 0, nil
+}
+
+// pushBinlogSuccess is the response of a successful push,
+// the attribute "stream" tells clients that records in the body are accepted,
+// trackers of old versions ignore the body and only accept binlogs in header attributes.
+func pushBinlogSuccess() *common.Header {
+	return &common.Header{
+		Result: common.SUCCESS,
+		Attributes: map[string]string{
+			"stream": "true",
+		},
+	}
+}
+
+// trackerSyncBinlogHandler serves the binlog journal of a source instance,
+// for storage servers bootstrapping and peer trackers catching up.
+//
+// A query without instance gets the source instances journaled by this tracker.
+func trackerSyncBinlogHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	bq := &common.BinlogQueryDTO{}
+	if header.Attributes != nil && header.Attributes["clientState"] != "" {
+		if err := json.UnmarshalFromString(header.Attributes["clientState"], bq); err != nil {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    "invalid header(2)",
+			}, nil, 0, nil
+		}
+	}
+	if bq.Instance != "" {
+		return syncBinlogHandler(header, func(bq *common.BinlogQueryDTO) (binlog.XBinlogManager, error) {
+			return journalBinlogManager.Journal(bq.Instance)
+		})
+	}
+	journals, err := journalBinlogManager.Instances()
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	jr, _ := json.MarshalToString(&common.BinlogQueryResultDTO{
+		Journals: journals,
+	})
+	return &common.Header{
+		Result: common.SUCCESS,
+		Attributes: map[string]string{
+			"result": jr,
+		},
+	}, nil, 0, nil
+}
 
+// locateFileHandler returns instanceIds of the registered storage servers which hold the file.
+func locateFileHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	if header.Attributes == nil || header.Attributes["fileId"] == "" {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "invalid header",
+		}, nil, 0, nil
+	}
+	locations, err := common.GetConfigMap().GetFileLocations(header.Attributes["fileId"])
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	// locations of instances which are not registered are kept in the index,
+	// so they are located again once the instances register again.
+	instances := reg.InstanceSetSnapshot()
+	alive := []string{}
+	for _, instanceId := range locations {
+		if instances[instanceId] != nil {
+			alive = append(alive, instanceId)
+		}
+	}
+	ret, _ := json.MarshalToString(alive)
 	return &common.Header{
 		Result: common.SUCCESS,
+		Attributes: map[string]string{
+			"instances": ret,
+		},
 	}, nil, 0, nil
 }
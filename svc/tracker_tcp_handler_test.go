@@ -0,0 +1,113 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/reg"
+	json "github.com/json-iterator/go"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// initTestConfigMap opens a config map of the boot role in a temporary dir.
+func initTestConfigMap(t *testing.T, bootAs common.BootMode) {
+	dir, err := ioutil.TempDir("", "godfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	common.BootAs = bootAs
+	configMap, err := common.NewConfigMap(dir + "/config.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	common.SetConfigMap(configMap)
+}
+
+func locate(t *testing.T, fileId string) []string {
+	header, _, _, _ := locateFileHandler(&common.Header{
+		Attributes: map[string]string{"fileId": fileId},
+	})
+	if header.Result != common.SUCCESS {
+		t.Fatal("locate failed: ", header.Msg)
+	}
+	var ret []string
+	if err := json.UnmarshalFromString(header.Attributes["instances"], &ret); err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestLocateAcrossReRegister(t *testing.T) {
+	initTestConfigMap(t, common.BOOT_TRACKER)
+	ins := &common.Instance{
+		Server: common.Server{
+			Host:       "127.0.0.1",
+			Port:       3000,
+			InstanceId: "storage1",
+		},
+		Role: common.ROLE_STORAGE,
+	}
+	if err := reg.Put(ins); err != nil {
+		t.Fatal(err)
+	}
+	if err := common.GetConfigMap().AddFileLocations(map[string][]string{
+		"file1": {"storage1", "storage11"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ret := locate(t, "file1"); len(ret) != 1 || ret[0] != "storage1" {
+		t.Fatal("expect storage1, got ", ret)
+	}
+
+	// the instance expires.
+	reg.Free("storage1")
+	reg.Remove(ins)
+	if ret := locate(t, "file1"); len(ret) != 0 {
+		t.Fatal("expect no instance, got ", ret)
+	}
+
+	// the instance registers again without pushing binlogs.
+	if err := reg.Put(ins); err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Remove(ins)
+	if ret := locate(t, "file1"); len(ret) != 1 || ret[0] != "storage1" {
+		t.Fatal("expect storage1, got ", ret)
+	}
+}
+
+func TestAddFileLocationsExactMatch(t *testing.T) {
+	initTestConfigMap(t, common.BOOT_TRACKER)
+	configMap := common.GetConfigMap()
+	if err := configMap.AddFileLocations(map[string][]string{"file1": {"storage12"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := configMap.AddFileLocations(map[string][]string{"file1": {"storage1", "storage12"}}); err != nil {
+		t.Fatal(err)
+	}
+	ret, err := configMap.GetFileLocations("file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret) != 2 || ret[0] != "storage12" || ret[1] != "storage1" {
+		t.Fatal("expect storage12 and storage1, got ", ret)
+	}
+}
+
+func TestAuthenticateWithoutRegister(t *testing.T) {
+	common.BootAs = common.BOOT_TRACKER
+	h, ins, _, _, err := authenticationHandler(&common.Header{
+		Operation:  common.OPERATION_CONNECT,
+		Attributes: map[string]string{"secret": "123456"},
+	}, "123456")
+	if err != nil || h.Result != common.SUCCESS {
+		t.Fatal("expect authentication success, got ", h.Msg, err)
+	}
+	// the connection frees no instance when it is closed.
+	if ins != nil {
+		t.Fatal("expect no registered instance, got ", ins.InstanceId)
+	}
+}
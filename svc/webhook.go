@@ -0,0 +1,270 @@
+package svc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	"github.com/hetianyi/gox/uuid"
+	json "github.com/json-iterator/go"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookBatchSize      = 100
+	webhookMaxAttempts    = 50 // about 2 days with the max backoff
+	webhookMaxBackoff     = time.Hour
+	webhookPendingCheck   = time.Second * 5  // interval of checking whether the file of a pending event is committed
+	webhookPendingTimeout = time.Minute * 10 // a pending event whose file is never committed is dropped
+)
+
+var webhookClient = &http.Client{Timeout: time.Second * 10}
+
+// fireFileEvent puts a file event into the webhook outbox before the file is committed,
+// the caller must fail if it returns an error, or the event is lost.
+//
+// The event is pending until the file is in the dataset and the data dir,
+// then it is delivered to every configured webhook at least once.
+// The event of a file which is never committed is dropped after webhookPendingTimeout.
+//
+// Storage servers cannot delete files, so no event is fired for deletion.
+func fireFileEvent(event string, fileId string, size int64, source string) error {
+	hooks := common.InitializedStorageConfiguration.Webhooks
+	if len(hooks) == 0 {
+		return nil
+	}
+	now := time.Now()
+	payload := &common.WebhookEvent{
+		Id:         uuid.UUID(),
+		Event:      event,
+		FileId:     fileId,
+		Group:      common.InitializedStorageConfiguration.Group,
+		Instance:   common.InitializedStorageConfiguration.InstanceId,
+		Source:     source,
+		Size:       size,
+		CreateTime: gox.GetTimestamp(now),
+	}
+	if info, _, err := util.ParseAlias(fileId, common.InitializedStorageConfiguration.Secret); err == nil {
+		payload.Group = info.Group
+		payload.Md5 = info.Path[strings.LastIndex(info.Path, "/")+1:]
+	}
+	if meta, err := common.GetConfigMap().GetFileMeta(fileId); err == nil {
+		payload.Meta = meta
+	}
+	bs, err := json.MarshalToString(payload)
+	if err != nil {
+		return err
+	}
+	deliveries := make([]*common.WebhookDelivery, len(hooks))
+	for i, url := range hooks {
+		deliveries[i] = &common.WebhookDelivery{
+			Url:        url,
+			Event:      event,
+			EventId:    payload.Id,
+			FileId:     fileId,
+			Payload:    bs,
+			Pending:    true,
+			CreateTime: now.UnixNano(),
+			NextTime:   now.UnixNano(),
+		}
+	}
+	if err := common.GetConfigMap().PutWebhookDeliveries(deliveries...); err != nil {
+		return errors.New("error save webhook event: " + err.Error())
+	}
+	return nil
+}
+
+// initWebhookDelivery starts a timer job which delivers the webhook requests in the outbox.
+func initWebhookDelivery() {
+	if len(common.InitializedStorageConfiguration.Webhooks) == 0 {
+		return
+	}
+	timer.Start(time.Second*5, time.Second*2, 0, func(t *timer.Timer) {
+		gox.Try(func() {
+			deliverWebhooks()
+		}, func(e interface{}) {
+			logger.Error("webhook delivery err: ", e)
+		})
+	})
+}
+
+// deliverWebhooks delivers the webhook requests which are due,
+// failed requests are retried with exponential backoff.
+//
+// Webhooks are delivered in parallel, requests of a webhook are delivered in order,
+// and the requests after a failed one are put off with it,
+// so a webhook which is down never holds up the others.
+func deliverWebhooks() {
+	configMap := common.GetConfigMap()
+	// next time of the webhooks failed in this round.
+	failed := make(map[string]int64)
+	for {
+		now := time.Now()
+		deliveries, err := configMap.GetDueWebhookDeliveries(now.UnixNano(), webhookBatchSize)
+		if err != nil {
+			logger.Error("error load webhook outbox: ", err)
+			return
+		}
+		if len(deliveries) == 0 {
+			return
+		}
+		var urls []string
+		queues := make(map[string][]*common.WebhookDelivery)
+		putOff := make(map[int64][]*common.WebhookDelivery)
+		for _, d := range deliveries {
+			if d.Pending {
+				committed, err := resolvePendingWebhook(d, now)
+				if err != nil {
+					logger.Error("error update webhook delivery: ", err)
+					return
+				}
+				if !committed {
+					continue
+				}
+			}
+			if next, ok := failed[d.Url]; ok {
+				putOff[next] = append(putOff[next], d)
+				continue
+			}
+			if queues[d.Url] == nil {
+				urls = append(urls, d.Url)
+			}
+			queues[d.Url] = append(queues[d.Url], d)
+		}
+		for next, ds := range putOff {
+			if err := configMap.RescheduleWebhookDeliveries(next, ds...); err != nil {
+				logger.Error("error update webhook delivery: ", err)
+				return
+			}
+		}
+
+		results := make([]int64, len(urls))
+		wg := sync.WaitGroup{}
+		for i := range urls {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = deliverWebhookQueue(queues[urls[i]], now)
+			}(i)
+		}
+		wg.Wait()
+		for i, next := range results {
+			if next < 0 {
+				// the outbox is not updated, don't load the same requests again.
+				return
+			}
+			if next > 0 {
+				failed[urls[i]] = next
+			}
+		}
+	}
+}
+
+// deliverWebhookQueue delivers requests of a webhook in order until one fails,
+// it returns the next time of the failed request, 0 if all are delivered,
+// or -1 if the outbox cannot be updated.
+func deliverWebhookQueue(deliveries []*common.WebhookDelivery, now time.Time) int64 {
+	configMap := common.GetConfigMap()
+	for i, d := range deliveries {
+		err := postWebhook(d)
+		if err == nil {
+			if err := configMap.RemoveWebhookDelivery(d); err != nil {
+				logger.Error("error remove webhook delivery: ", err)
+				return -1
+			}
+			continue
+		}
+		logger.Debug("error deliver webhook event ", d.EventId, " to ", d.Url, ": ", err)
+		d.Attempts++
+		if d.Attempts >= webhookMaxAttempts {
+			logger.Error("give up webhook event ", d.EventId, " to ", d.Url, " after ", d.Attempts, " attempts")
+			if err := configMap.RemoveWebhookDelivery(d); err != nil {
+				logger.Error("error remove webhook delivery: ", err)
+				return -1
+			}
+			continue
+		}
+		next := now.Add(webhookBackoff(d.Attempts)).UnixNano()
+		if err := configMap.RescheduleWebhookDeliveries(next, deliveries[i:]...); err != nil {
+			logger.Error("error update webhook delivery: ", err)
+			return -1
+		}
+		return next
+	}
+	return 0
+}
+
+// resolvePendingWebhook checks if the file of the pending event is committed,
+// otherwise the request is checked again later or dropped if it is pending for too long.
+func resolvePendingWebhook(d *common.WebhookDelivery, now time.Time) (bool, error) {
+	info, _, err := util.ParseAlias(d.FileId, common.InitializedStorageConfiguration.Secret)
+	if err == nil && util.ExistsFile(info) {
+		c, err := Contains(d.FileId)
+		if err != nil {
+			return false, err
+		}
+		if c {
+			// the request is saved as committed when it is rescheduled or removed.
+			d.Pending = false
+			return true, nil
+		}
+	}
+	if now.Sub(time.Unix(0, d.CreateTime)) >= webhookPendingTimeout {
+		logger.Debug("drop webhook event ", d.EventId, ": file ", d.FileId, " is not committed")
+		return false, common.GetConfigMap().RemoveWebhookDelivery(d)
+	}
+	return false, common.GetConfigMap().RescheduleWebhookDeliveries(now.Add(webhookPendingCheck).UnixNano(), d)
+}
+
+// webhookBackoff returns the delay before the next attempt of a failed request.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := time.Second << uint(gox.TValue(attempts > 12, 12, attempts).(int))
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	return backoff
+}
+
+// postWebhook posts the event to the webhook.
+//
+// The request body is signed by HMAC-SHA256 with the webhook secret,
+// the signature is sent in the "X-Godfs-Signature" header.
+func postWebhook(d *common.WebhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.Url, bytes.NewBufferString(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Godfs-Event", d.Event)
+	req.Header.Set("X-Godfs-Delivery", d.EventId)
+	req.Header.Set("X-Godfs-Attempt", convert.IntToStr(d.Attempts+1))
+	if secret := common.InitializedStorageConfiguration.WebhookSecret; secret != "" {
+		req.Header.Set("X-Godfs-Signature", "sha256="+signWebhook(secret, d.Payload))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("unexpected status code " + convert.IntToStr(resp.StatusCode))
+	}
+	return nil
+}
+
+// signWebhook calculates HMAC-SHA256 signature of the payload.
+func signWebhook(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
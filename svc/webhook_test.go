@@ -0,0 +1,284 @@
+package svc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/uuid"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer is a webhook which fails the first requests.
+type webhookServer struct {
+	lock       sync.Mutex
+	fails      int
+	delay      time.Duration
+	events     []string
+	signatures []string
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.delay)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.fails > 0 {
+		s.fails--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.events = append(s.events, r.Header.Get("X-Godfs-Delivery"))
+	s.signatures = append(s.signatures, r.Header.Get("X-Godfs-Signature"))
+}
+
+func (s *webhookServer) delivered() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.events...)
+}
+
+func initWebhookTest(t *testing.T, hooks ...string) {
+	dir, err := ioutil.TempDir("", "godfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	initTestConfigMap(t, common.BOOT_STORAGE)
+	common.InitializedStorageConfiguration = &common.StorageConfig{
+		DataDir:       dir,
+		Group:         "G01",
+		InstanceId:    "storage1",
+		Secret:        "123456",
+		Webhooks:      hooks,
+		WebhookSecret: "hook-secret",
+	}
+	util.GenerateDecKey("123456")
+}
+
+// outbox returns all deliveries in the outbox.
+func outbox(t *testing.T) []*common.WebhookDelivery {
+	ret, err := common.GetConfigMap().GetDueWebhookDeliveries(1<<62, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+// putPendingEvent puts the deliveries of an event into the outbox as fireFileEvent does,
+// the payload is not marshalled since it has no effect on the outbox.
+func putPendingEvent(t *testing.T, fileId string) {
+	now := time.Now()
+	eventId := uuid.UUID()
+	var deliveries []*common.WebhookDelivery
+	for _, url := range common.InitializedStorageConfiguration.Webhooks {
+		deliveries = append(deliveries, &common.WebhookDelivery{
+			Url:        url,
+			Event:      common.WEBHOOK_FILE_UPLOADED,
+			EventId:    eventId,
+			FileId:     fileId,
+			Payload:    `{"id":"` + eventId + `"}`,
+			Pending:    true,
+			CreateTime: now.UnixNano(),
+			NextTime:   now.UnixNano(),
+		})
+	}
+	if err := common.GetConfigMap().PutWebhookDeliveries(deliveries...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	mac := hmac.New(sha256.New, []byte("hook-secret"))
+	mac.Write([]byte(`{"id":"1"}`))
+	if s := signWebhook("hook-secret", `{"id":"1"}`); s != hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatal("unexpected signature ", s)
+	}
+	if signWebhook("other", `{"id":"1"}`) == signWebhook("hook-secret", `{"id":"1"}`) {
+		t.Fatal("expect different signatures of different secrets")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	if b := webhookBackoff(1); b != time.Second*2 {
+		t.Fatal("unexpected backoff ", b)
+	}
+	if b := webhookBackoff(3); b != time.Second*8 {
+		t.Fatal("unexpected backoff ", b)
+	}
+	if b := webhookBackoff(webhookMaxAttempts); b != webhookMaxBackoff {
+		t.Fatal("unexpected backoff ", b)
+	}
+}
+
+func TestWebhookOutboxOrder(t *testing.T) {
+	initWebhookTest(t)
+	configMap := common.GetConfigMap()
+	now := time.Now().UnixNano()
+	a := &common.WebhookDelivery{Url: "a", EventId: "a", NextTime: now + 2}
+	b := &common.WebhookDelivery{Url: "b", EventId: "b", NextTime: now + 1}
+	c := &common.WebhookDelivery{Url: "c", EventId: "c", NextTime: now + int64(time.Hour)}
+	if err := configMap.PutWebhookDeliveries(a, b, c); err != nil {
+		t.Fatal(err)
+	}
+	due, err := configMap.GetDueWebhookDeliveries(now+2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 2 || due[0].EventId != "b" || due[1].EventId != "a" {
+		t.Fatal("expect b, a due, got ", len(due))
+	}
+
+	// a failed delivery is moved behind the others with its attempts.
+	due[0].Attempts++
+	if err := configMap.RescheduleWebhookDeliveries(now+int64(time.Hour)+1, due[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := configMap.RemoveWebhookDelivery(due[1]); err != nil {
+		t.Fatal(err)
+	}
+	all := outbox(t)
+	if len(all) != 2 || all[0].EventId != "c" || all[1].EventId != "b" || all[1].Attempts != 1 {
+		t.Fatal("unexpected outbox after reschedule")
+	}
+	if due, _ := configMap.GetDueWebhookDeliveries(now+2, 10); len(due) != 0 {
+		t.Fatal("expect nothing due, got ", len(due))
+	}
+}
+
+func TestWebhookRetryWithBackoff(t *testing.T) {
+	hook := &webhookServer{fails: 1}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+	initWebhookTest(t, server.URL)
+
+	fileId := writeTestFile(t, 1)
+	putPendingEvent(t, fileId)
+	// the event is persisted before the file is committed.
+	pending := outbox(t)
+	if len(pending) != 1 || !pending[0].Pending {
+		t.Fatal("expect a pending delivery")
+	}
+	initTestDataSet(t)
+	if err := Add(fileId); err != nil {
+		t.Fatal(err)
+	}
+
+	deliverWebhooks()
+	if len(hook.delivered()) != 0 {
+		t.Fatal("expect the first request to fail")
+	}
+	failed := outbox(t)
+	if len(failed) != 1 || failed[0].Attempts != 1 || failed[0].Pending {
+		t.Fatal("expect a committed delivery with 1 attempt")
+	}
+	if d := time.Duration(failed[0].NextTime - time.Now().UnixNano()); d <= 0 || d > webhookBackoff(1) {
+		t.Fatal("unexpected retry delay ", d)
+	}
+	deliverWebhooks()
+	if len(hook.delivered()) != 0 {
+		t.Fatal("expect no retry before the backoff")
+	}
+
+	if err := common.GetConfigMap().RescheduleWebhookDeliveries(time.Now().UnixNano(), failed[0]); err != nil {
+		t.Fatal(err)
+	}
+	deliverWebhooks()
+	if events := hook.delivered(); len(events) != 1 || events[0] != failed[0].EventId {
+		t.Fatal("expect the event delivered on retry")
+	}
+	if hook.signatures[0] != "sha256="+signWebhook("hook-secret", failed[0].Payload) {
+		t.Fatal("unexpected signature ", hook.signatures[0])
+	}
+	if len(outbox(t)) != 0 {
+		t.Fatal("expect the outbox empty")
+	}
+}
+
+func TestWebhookPendingEvent(t *testing.T) {
+	hook := &webhookServer{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+	initWebhookTest(t, server.URL)
+	initTestDataSet(t)
+
+	// the upload fails after the event is written, the file is never committed.
+	fileId := util.CreateAlias("G01/00/01/0123456789abcdef0123456789abcdef", "storage1", false, time.Now())
+	putPendingEvent(t, fileId)
+	deliverWebhooks()
+	pending := outbox(t)
+	if len(hook.delivered()) != 0 || len(pending) != 1 || !pending[0].Pending {
+		t.Fatal("expect the event pending")
+	}
+	if d := time.Duration(pending[0].NextTime - time.Now().UnixNano()); d <= 0 || d > webhookPendingCheck {
+		t.Fatal("unexpected check delay ", d)
+	}
+
+	// it is dropped when it is pending for too long.
+	pending[0].CreateTime -= int64(webhookPendingTimeout)
+	if err := common.GetConfigMap().RescheduleWebhookDeliveries(time.Now().UnixNano(), pending[0]); err != nil {
+		t.Fatal(err)
+	}
+	deliverWebhooks()
+	if len(hook.delivered()) != 0 || len(outbox(t)) != 0 {
+		t.Fatal("expect the event dropped")
+	}
+}
+
+func TestWebhookDeadUrlNotBlocking(t *testing.T) {
+	dead := &webhookServer{fails: 1 << 20, delay: time.Millisecond * 200}
+	deadServer := httptest.NewServer(dead)
+	defer deadServer.Close()
+	hook := &webhookServer{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+	initWebhookTest(t, deadServer.URL, server.URL)
+	initTestDataSet(t)
+
+	var fileIds []string
+	for i := 1; i <= 5; i++ {
+		fileId := writeTestFile(t, i)
+		putPendingEvent(t, fileId)
+		if err := Add(fileId); err != nil {
+			t.Fatal(err)
+		}
+		fileIds = append(fileIds, fileId)
+	}
+
+	start := time.Now()
+	deliverWebhooks()
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("expect the dead webhook tried once, took ", d)
+	}
+	if len(hook.delivered()) != len(fileIds) {
+		t.Fatal("expect all events delivered to the healthy webhook, got ", len(hook.delivered()))
+	}
+	// events to the dead webhook are put off together in order.
+	left := outbox(t)
+	if len(left) != len(fileIds) {
+		t.Fatal("expect ", len(fileIds), " deliveries left, got ", len(left))
+	}
+	for i, d := range left {
+		if d.Url != deadServer.URL || d.NextTime != left[0].NextTime {
+			t.Fatal("unexpected delivery left ", d.Url)
+		}
+		if (i == 0 && d.Attempts != 1) || (i > 0 && d.Attempts != 0) {
+			t.Fatal("expect only the first delivery counted, got ", d.Attempts)
+		}
+	}
+}
+
+func initTestDataSet(t *testing.T) {
+	initd = false
+	if err := initDataSet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -94,6 +94,12 @@ func ParseAlias(alias, currentSecret string) (fileInfo *common.FileInfo, secret
 	return
 }
 
+// ParseAliasWithSecret parses file info from file alias name created with the secret,
+// the secret can be unknown to this server, for example the secret of another cluster.
+func ParseAliasWithSecret(alias, secret string) (*common.FileInfo, error) {
+	return parseAliasForSecret(alias, []byte(gox.Md5Sum(secret)))
+}
+
 // parseAliasForSecret parses fileId from history secrets.
 func parseAliasForSecret(alias string, aesKey []byte) (fileInfo *common.FileInfo, err error) {
 	gox.Try(func() {
@@ -85,3 +85,20 @@ func TestBufIO(t *testing.T) {
 	resultBuffer.Write([]byte{})
 	resultBuffer.Flush()
 }
+
+func TestParseAliasWithSecret(t *testing.T) {
+	util.GenerateDecKey("source-secret")
+	alias := util.CreateAlias("G01/64/22/e92c1c72e7fff2801c7d4af5b154f88d", "43f01e05", false, time.Now())
+	util.GenerateDecKey("target-secret")
+
+	info, err := util.ParseAliasWithSecret(alias, "source-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Group != "G01" || info.Path != "64/22/e92c1c72e7fff2801c7d4af5b154f88d" || info.InstanceId != "43f01e05" {
+		t.Fatal("unexpected file info: ", info)
+	}
+	if _, err := util.ParseAliasWithSecret(alias, "target-secret"); err == nil {
+		t.Fatal("alias parsed with a wrong secret")
+	}
+}
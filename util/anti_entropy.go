@@ -0,0 +1,41 @@
+package util
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"github.com/hetianyi/godfs/common"
+)
+
+// antiEntropyBucketSize is the encoded size of a bucket: count(8) + hash(8).
+const antiEntropyBucketSize = 16
+
+// AntiEntropyBucket returns the bucket and the hash of the fileId,
+// the bucket is taken from the head of md5 of the fileId and the hash from the tail.
+func AntiEntropyBucket(fileId string) (int, uint64) {
+	sum := md5.Sum([]byte(fileId))
+	return int(binary.BigEndian.Uint16(sum[:2])) % common.ANTI_ENTROPY_BUCKETS, binary.BigEndian.Uint64(sum[8:])
+}
+
+// EncodeAntiEntropySummary encodes bucket summaries in binary.
+func EncodeAntiEntropySummary(buckets []common.AntiEntropyBucketDTO) []byte {
+	ret := make([]byte, len(buckets)*antiEntropyBucketSize)
+	for i, b := range buckets {
+		binary.BigEndian.PutUint64(ret[i*antiEntropyBucketSize:], b.Count)
+		binary.BigEndian.PutUint64(ret[i*antiEntropyBucketSize+8:], b.Hash)
+	}
+	return ret
+}
+
+// DecodeAntiEntropySummary decodes bucket summaries encoded by EncodeAntiEntropySummary.
+func DecodeAntiEntropySummary(bs []byte) ([]common.AntiEntropyBucketDTO, error) {
+	if len(bs) != common.ANTI_ENTROPY_BUCKETS*antiEntropyBucketSize {
+		return nil, errors.New("invalid anti-entropy summary size")
+	}
+	ret := make([]common.AntiEntropyBucketDTO, common.ANTI_ENTROPY_BUCKETS)
+	for i := range ret {
+		ret[i].Count = binary.BigEndian.Uint64(bs[i*antiEntropyBucketSize:])
+		ret[i].Hash = binary.BigEndian.Uint64(bs[i*antiEntropyBucketSize+8:])
+	}
+	return ret, nil
+}
@@ -0,0 +1,24 @@
+package util_test
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"testing"
+)
+
+func TestAntiEntropySummary(t *testing.T) {
+	buckets := make([]common.AntiEntropyBucketDTO, common.ANTI_ENTROPY_BUCKETS)
+	b, h := util.AntiEntropyBucket("fileId")
+	buckets[b].Count++
+	buckets[b].Hash += h
+	ret, err := util.DecodeAntiEntropySummary(util.EncodeAntiEntropySummary(buckets))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret[b] != buckets[b] || ret[b].Count != 1 {
+		t.Fatal("unexpected bucket: ", ret[b])
+	}
+	if _, err := util.DecodeAntiEntropySummary(make([]byte, 16)); err == nil {
+		t.Fatal("invalid summary is accepted")
+	}
+}
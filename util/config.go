@@ -41,7 +41,13 @@ func PrepareDirs() error {
 	file.DeleteAll(common.InitializedStorageConfiguration.TmpDir)
 	// tmp dir
 	if !file.Exists(common.InitializedStorageConfiguration.TmpDir) {
-		return file.CreateDirs(common.InitializedStorageConfiguration.TmpDir)
+		if err := file.CreateDirs(common.InitializedStorageConfiguration.TmpDir); err != nil {
+			return err
+		}
+	}
+	// partial replicas are resumed after restart.
+	if !file.Exists(common.InitializedStorageConfiguration.PartialDir) {
+		return file.CreateDirs(common.InitializedStorageConfiguration.PartialDir)
 	}
 	return nil
 }
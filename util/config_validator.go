@@ -10,6 +10,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 )
 
 var storeSecretLock *sync.Mutex
@@ -171,6 +172,122 @@ func ValidateStorageConfig(c *common.StorageConfig) error {
 
 	logger.Init(logConfig)
 
+	ExchangeEnvValue("mimeTypesFile", func(envValue string) {
+		c.MimeTypesFile = envValue
+	})
+
+	// extend mime types
+	if c.EnableMimeTypes && c.MimeTypesFile != "" {
+		if err := common.LoadMimeTypes(c.MimeTypesFile); err != nil {
+			return errors.New("cannot load mime types file \"" + c.MimeTypesFile + "\": " + err.Error())
+		}
+	}
+
+	ExchangeEnvValue("webhooks", func(envValue string) {
+		c.Webhooks = strings.Split(envValue, ",")
+	})
+	ExchangeEnvValue("webhookSecret", func(envValue string) {
+		c.WebhookSecret = envValue
+	})
+	for _, hook := range c.Webhooks {
+		if !strings.HasPrefix(hook, "http://") && !strings.HasPrefix(hook, "https://") {
+			return errors.New("invalid webhook url \"" + hook + "\"")
+		}
+	}
+
+	ExchangeEnvValue("feedKey", func(envValue string) {
+		c.FeedKey = envValue
+	})
+
+	ExchangeEnvValue("bootstrap", func(envValue string) {
+		b, err := convert.StrToBool(envValue)
+		if err != nil {
+			logger.Fatal("invalid bool value \"", envValue, "\": ", err)
+		}
+		c.Bootstrap = b
+	})
+	ExchangeEnvValue("bootstrapWorkers", func(envValue string) {
+		n, err := convert.StrToInt(envValue)
+		if err != nil {
+			logger.Fatal("invalid bootstrap workers \"", envValue, "\": ", err)
+		}
+		c.BootstrapWorkers = n
+	})
+	// check bootstrap workers
+	if c.BootstrapWorkers <= 0 {
+		c.BootstrapWorkers = common.DEFAULT_BOOTSTRAP_WORKERS
+	}
+	if c.BootstrapWorkers > common.MAX_BOOTSTRAP_WORKERS {
+		return errors.New("invalid bootstrap workers " + convert.IntToStr(c.BootstrapWorkers) +
+			", bootstrap workers must not exceed " + convert.IntToStr(common.MAX_BOOTSTRAP_WORKERS))
+	}
+
+	ExchangeEnvValue("syncWorkers", func(envValue string) {
+		n, err := convert.StrToInt(envValue)
+		if err != nil {
+			logger.Fatal("invalid sync workers \"", envValue, "\": ", err)
+		}
+		c.SyncWorkers = n
+	})
+	// check sync workers
+	if c.SyncWorkers <= 0 {
+		c.SyncWorkers = common.DEFAULT_SYNC_WORKERS
+	}
+	if c.SyncWorkers > common.MAX_SYNC_WORKERS {
+		return errors.New("invalid sync workers " + convert.IntToStr(c.SyncWorkers) +
+			", sync workers must not exceed " + convert.IntToStr(common.MAX_SYNC_WORKERS))
+	}
+
+	ExchangeEnvValue("antiEntropyInterval", func(envValue string) {
+		c.AntiEntropyInterval = envValue
+	})
+	ExchangeEnvValue("antiEntropyDryRun", func(envValue string) {
+		b, err := convert.StrToBool(envValue)
+		if err != nil {
+			logger.Fatal("invalid bool value \"", envValue, "\": ", err)
+		}
+		c.AntiEntropyDryRun = b
+	})
+	// check anti-entropy interval, 0 disables anti-entropy.
+	if c.AntiEntropyInterval == "" {
+		c.AntiEntropyInterval = common.DEFAULT_ANTI_ENTROPY
+	}
+	antiEntropy, err := time.ParseDuration(c.AntiEntropyInterval)
+	if err != nil || antiEntropy < 0 || antiEntropy > 0 && antiEntropy < time.Minute {
+		return errors.New("invalid anti-entropy interval \"" + c.AntiEntropyInterval +
+			"\", it must be 0 or at least 1m")
+	}
+	c.ParsedAntiEntropy = antiEntropy
+
+	ExchangeEnvValue("syncRate", func(envValue string) {
+		c.SyncRate = envValue
+	})
+	ExchangeEnvValue("syncPeerRates", func(envValue string) {
+		c.SyncPeerRates = strings.Split(envValue, ",")
+	})
+	ExchangeEnvValue("syncRateSchedule", func(envValue string) {
+		c.SyncRateSchedule = strings.Split(envValue, ",")
+	})
+	// check sync rate limits
+	syncRate, err := ParseSyncRate(c.SyncRate, c.SyncPeerRates, c.SyncRateSchedule)
+	if err != nil {
+		return err
+	}
+	c.ParsedSyncRate = *syncRate
+
+	ExchangeEnvValue("binlogFsync", func(envValue string) {
+		c.BinlogFsync = envValue
+	})
+	// check binlog fsync policy
+	c.BinlogFsync = strings.ToLower(c.BinlogFsync)
+	if c.BinlogFsync == "" {
+		c.BinlogFsync = common.BINLOG_FSYNC_INTERVAL
+	}
+	if c.BinlogFsync != common.BINLOG_FSYNC_ALWAYS && c.BinlogFsync != common.BINLOG_FSYNC_INTERVAL &&
+		c.BinlogFsync != common.BINLOG_FSYNC_NONE {
+		return errors.New("invalid binlog fsync policy \"" + c.BinlogFsync + "\"")
+	}
+
 	InitialConfigMap(c.DataDir + "/cfg.dat")
 
 	c.InstanceId = LoadInstanceData()
@@ -195,6 +312,33 @@ func ValidateStorageConfig(c *common.StorageConfig) error {
 			c.ParsedTrackers[i] = *server
 		}
 	}
+
+	ExchangeEnvValue("drStorages", func(envValue string) {
+		c.DrStorages = strings.Split(envValue, ",")
+	})
+	// parse storage servers of the disaster recovery cluster,
+	// they are authenticated with the secret of that cluster.
+	c.ParsedDrStorages = nil
+	for _, s := range c.DrStorages {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		server, err := ParseServer(s)
+		if err != nil {
+			return err
+		}
+		if server.Secret == "" {
+			return errors.New("secret of disaster recovery storage server \"" + s + "\" is required")
+		}
+		c.ParsedDrStorages = append(c.ParsedDrStorages, *server)
+	}
+	ExchangeEnvValue("drSources", func(envValue string) {
+		c.DrSources = strings.Split(envValue, ",")
+	})
+	for i := range c.DrSources {
+		c.DrSources[i] = strings.TrimSpace(c.DrSources[i])
+	}
 	// done!
 	return nil
 }
@@ -251,6 +395,10 @@ func ValidateTrackerConfig(c *common.TrackerConfig) error {
 		c.Secret = envValue
 	})
 
+	ExchangeEnvValue("feedKey", func(envValue string) {
+		c.FeedKey = envValue
+	})
+
 	// check secret
 	if c.Secret != "" {
 		if m, err := regexp.MatchString(common.SECRET_PATTERN, c.Secret); err != nil || !m {
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package util
+
+import "syscall"
+
+// DiskUsage returns free and total bytes of the filesystem where the path locates.
+func DiskUsage(path string) (free int64, total int64, err error) {
+	fs := syscall.Statfs_t{}
+	if err = syscall.Statfs(path, &fs); err != nil {
+		return 0, 0, err
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize), int64(fs.Blocks) * int64(fs.Bsize), nil
+}
@@ -0,0 +1,169 @@
+package util
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/convert"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	byteRateRegexp         = regexp.MustCompile("^([0-9]+)([kmg]?)b?(/s)?$")
+	syncRateWindowRegexp   = regexp.MustCompile("^([0-9]{1,2}):([0-9]{2})-([0-9]{1,2}):([0-9]{2})=(.+)$")
+	instanceIdRegexp       = regexp.MustCompile(common.INSTANCE_ID_PATTERN)
+	byteRateUnits          = map[string]int64{"": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30}
+	byteRateUnitsDescOrder = []string{"g", "m", "k"}
+)
+
+// ParseByteRate parses a byte rate like "512K", "10M/s" or "1G",
+// units are powers of 1024, "0" and "unlimited" are unlimited.
+func ParseByteRate(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" || s == "unlimited" {
+		return 0, nil
+	}
+	m := byteRateRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return 0, errors.New("invalid byte rate \"" + s + "\"")
+	}
+	n, err := convert.StrToInt64(m[1])
+	if err != nil {
+		return 0, errors.New("invalid byte rate \"" + s + "\"")
+	}
+	return n * byteRateUnits[m[2]], nil
+}
+
+// FormatByteRate formats a byte rate in the format parsed by ParseByteRate.
+func FormatByteRate(rate int64) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+	for _, u := range byteRateUnitsDescOrder {
+		if rate%byteRateUnits[u] == 0 {
+			return convert.Int64ToStr(rate/byteRateUnits[u]) + strings.ToUpper(u) + "/s"
+		}
+	}
+	return convert.Int64ToStr(rate) + "/s"
+}
+
+// ParseSyncPeerRates parses rates of group members like "instanceId=rate".
+func ParseSyncPeerRates(peers []string) (map[string]int64, error) {
+	ret := make(map[string]int64)
+	for _, p := range peers {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		i := strings.Index(p, "=")
+		if i < 0 || !instanceIdRegexp.MatchString(p[:i]) {
+			return nil, errors.New("invalid peer sync rate \"" + p + "\"")
+		}
+		rate, err := ParseByteRate(p[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		ret[p[:i]] = rate
+	}
+	return ret, nil
+}
+
+// ParseSyncRateSchedule parses time of day windows like "22:00-06:00=unlimited".
+func ParseSyncRateSchedule(schedule []string) ([]common.SyncRateWindow, error) {
+	var ret []common.SyncRateWindow
+	for _, w := range schedule {
+		w = strings.TrimSpace(w)
+		if w == "" {
+			continue
+		}
+		m := syncRateWindowRegexp.FindStringSubmatch(w)
+		if m == nil {
+			return nil, errors.New("invalid sync rate schedule \"" + w + "\"")
+		}
+		from, ok1 := minuteOfDay(m[1], m[2])
+		to, ok2 := minuteOfDay(m[3], m[4])
+		if !ok1 || !ok2 || from == to {
+			return nil, errors.New("invalid sync rate schedule \"" + w + "\"")
+		}
+		rate, err := ParseByteRate(m[5])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, common.SyncRateWindow{From: from, To: to, Rate: rate})
+	}
+	return ret, nil
+}
+
+// FormatSyncRateWindow formats a window in the format parsed by ParseSyncRateSchedule.
+func FormatSyncRateWindow(w common.SyncRateWindow) string {
+	return formatMinuteOfDay(w.From) + "-" + formatMinuteOfDay(w.To) + "=" + FormatByteRate(w.Rate)
+}
+
+// ParseSyncRate parses the sync rate limits of a storage server.
+func ParseSyncRate(rate string, peers []string, schedule []string) (*common.SyncRateDTO, error) {
+	var err error
+	ret := &common.SyncRateDTO{}
+	if ret.Rate, err = ParseByteRate(rate); err != nil {
+		return nil, err
+	}
+	if ret.Peers, err = ParseSyncPeerRates(peers); err != nil {
+		return nil, err
+	}
+	if ret.Schedule, err = ParseSyncRateSchedule(schedule); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// ValidateSyncRate validates sync rate limits which are not parsed from strings.
+func ValidateSyncRate(r *common.SyncRateDTO) error {
+	if r.Rate < 0 {
+		return errors.New("invalid sync rate " + convert.Int64ToStr(r.Rate))
+	}
+	for peer, rate := range r.Peers {
+		if !instanceIdRegexp.MatchString(peer) || rate < 0 {
+			return errors.New("invalid peer sync rate \"" + peer + "=" + convert.Int64ToStr(rate) + "\"")
+		}
+	}
+	for _, w := range r.Schedule {
+		if w.From < 0 || w.From >= 24*60 || w.To < 0 || w.To >= 24*60 || w.From == w.To || w.Rate < 0 {
+			return errors.New("invalid sync rate schedule")
+		}
+	}
+	return nil
+}
+
+// NodeSyncRate returns the rate of all synchronization at the time,
+// the first window of the schedule covering the time replaces the default rate.
+func NodeSyncRate(r *common.SyncRateDTO, t time.Time) int64 {
+	m := t.Hour()*60 + t.Minute()
+	for _, w := range r.Schedule {
+		if w.From < w.To && m >= w.From && m < w.To ||
+			w.From > w.To && (m >= w.From || m < w.To) {
+			return w.Rate
+		}
+	}
+	return r.Rate
+}
+
+func minuteOfDay(h, m string) (int, bool) {
+	hour, err1 := convert.StrToInt(h)
+	minute, err2 := convert.StrToInt(m)
+	if err1 != nil || err2 != nil || hour > 23 || minute > 59 {
+		return 0, false
+	}
+	return hour*60 + minute, true
+}
+
+func formatMinuteOfDay(m int) string {
+	h := convert.IntToStr(m / 60)
+	mm := convert.IntToStr(m % 60)
+	if len(h) < 2 {
+		h = "0" + h
+	}
+	if len(mm) < 2 {
+		mm = "0" + mm
+	}
+	return h + ":" + mm
+}
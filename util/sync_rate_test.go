@@ -0,0 +1,32 @@
+package util_test
+
+import (
+	"github.com/hetianyi/godfs/util"
+	"testing"
+	"time"
+)
+
+func TestParseSyncRate(t *testing.T) {
+	r, err := util.ParseSyncRate("10M/s", []string{"43f01e05=512k"}, []string{"22:00-06:00=unlimited", "12:00-13:30=1G"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rate != 10<<20 || r.Peers["43f01e05"] != 512<<10 || len(r.Schedule) != 2 {
+		t.Fatal("unexpected sync rate: ", r)
+	}
+	if util.FormatByteRate(r.Rate) != "10M/s" || util.FormatSyncRateWindow(r.Schedule[0]) != "22:00-06:00=unlimited" {
+		t.Fatal("unexpected format: ", util.FormatByteRate(r.Rate), " ", util.FormatSyncRateWindow(r.Schedule[0]))
+	}
+	at := func(h, m int) time.Time {
+		return time.Date(2020, 1, 1, h, m, 0, 0, time.Local)
+	}
+	if util.NodeSyncRate(r, at(23, 0)) != 0 || util.NodeSyncRate(r, at(5, 59)) != 0 ||
+		util.NodeSyncRate(r, at(12, 30)) != 1<<30 || util.NodeSyncRate(r, at(13, 30)) != 10<<20 {
+		t.Fatal("unexpected node sync rate")
+	}
+	for _, s := range [][]string{{"10X", "", ""}, {"", "bad=1M", ""}, {"", "", "25:00-06:00=1M"}, {"", "", "06:00-06:00=1M"}} {
+		if _, err := util.ParseSyncRate(s[0], []string{s[1]}, []string{s[2]}); err == nil {
+			t.Fatal("invalid sync rate is accepted: ", s)
+		}
+	}
+}